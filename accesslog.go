@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+const redacted = "[REDACTED]"
+
+// alwaysRedactedHeaders are never logged, whatever the configuration.
+var alwaysRedactedHeaders = []string{
+	fiber.HeaderAuthorization,
+	fiber.HeaderProxyAuthorization,
+	fiber.HeaderCookie,
+	fiber.HeaderSetCookie,
+}
+
+// defaultRedactedFields are the JSON, form and query fields masked unless
+// ACCESS_LOG_REDACT_FIELDS replaces the list.
+var defaultRedactedFields = []string{
+	"password", "secret", "client_secret", "token", "access_token", "refresh_token", "id_token", "ssn", "creditCard",
+}
+
+// redactor masks sensitive values. Field and header names match
+// case-insensitively.
+type redactor struct {
+	fields  map[string]bool
+	headers map[string]bool
+}
+
+func newRedactor(fields, headers []string) *redactor {
+	r := &redactor{fields: map[string]bool{}, headers: map[string]bool{}}
+	for _, f := range fields {
+		r.fields[strings.ToLower(f)] = true
+	}
+	for _, h := range append(headers, alwaysRedactedHeaders...) {
+		r.headers[strings.ToLower(h)] = true
+	}
+	return r
+}
+
+// value masks the redacted fields of a decoded JSON value, at any depth.
+func (r *redactor) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, inner := range v {
+			if r.fields[strings.ToLower(k)] {
+				v[k] = redacted
+			} else {
+				v[k] = r.value(inner)
+			}
+		}
+	case []interface{}:
+		for i, inner := range v {
+			v[i] = r.value(inner)
+		}
+	}
+	return v
+}
+
+// query masks the redacted parameters of a query or form string.
+func (r *redactor) query(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return redacted
+	}
+	for k := range values {
+		if r.fields[strings.ToLower(k)] {
+			values[k] = []string{redacted}
+		}
+	}
+	return values.Encode()
+}
+
+// body returns a loggable form of a request body: redacted JSON, a
+// redacted form, or just its size for anything else.
+func (r *redactor) body(contentType string, body []byte, max int) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	if len(body) > max {
+		return fmt.Sprintf("[%d bytes, over ACCESS_LOG_BODY_MAX]", len(body))
+	}
+	switch {
+	case strings.HasPrefix(contentType, fiber.MIMEApplicationJSON), strings.HasSuffix(strings.SplitN(contentType, ";", 2)[0], "+json"):
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return fmt.Sprintf("[%d bytes, invalid JSON]", len(body))
+		}
+		return r.value(v)
+	case strings.HasPrefix(contentType, fiber.MIMEApplicationForm):
+		return r.query(string(body))
+	}
+	return fmt.Sprintf("[%d bytes]", len(body))
+}
+
+// accessLogSink opens the writer named by ACCESS_LOG_SINK.
+func accessLogSink(sink string) (io.Writer, error) {
+	switch {
+	case sink == "stdout":
+		return os.Stdout, nil
+	case sink == "stderr":
+		return os.Stderr, nil
+	case strings.HasPrefix(sink, "file:"):
+		return os.OpenFile(strings.TrimPrefix(sink, "file:"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	case sink == "syslog" || strings.HasPrefix(sink, "syslog:"):
+		return syslogWriter(strings.TrimPrefix(strings.TrimPrefix(sink, "syslog"), ":"))
+	}
+	return nil, fmt.Errorf("unknown ACCESS_LOG_SINK %q (want stdout, stderr, file:<path> or syslog[:<network>://<addr>])", sink)
+}
+
+// responseSize doesn't read streamed bodies, which are sized only when
+// they set Content-Length.
+func responseSize(resp *fasthttp.Response) int {
+	if resp.IsBodyStream() {
+		return max(resp.Header.ContentLength(), 0)
+	}
+	return len(resp.Body())
+}
+
+// accessLog returns middleware that writes one JSON line per request. It
+// returns a no-op when ACCESS_LOG_SINK is empty or "off".
+//
+//	ACCESS_LOG_SINK           stdout (default), stderr, file:<path>, syslog or syslog:udp://host:514
+//	ACCESS_LOG_SAMPLE_RATE    fraction of successful requests logged (default 1)
+//	ACCESS_LOG_BODIES         log redacted request bodies (default false)
+//	ACCESS_LOG_BODY_MAX       larger bodies are only counted (default 4096)
+//	ACCESS_LOG_HEADERS        log request headers, redacted (default false)
+//	ACCESS_LOG_REDACT_FIELDS  JSON, form and query fields to mask (default defaultRedactedFields)
+//	ACCESS_LOG_REDACT_HEADERS headers to mask besides Authorization and cookies
+//	ACCESS_LOG_SKIP           path prefixes not logged
+//
+// Responses with status 400 or above are logged regardless of sampling.
+func accessLog() fiber.Handler {
+	next := func(c *fiber.Ctx) error { return c.Next() }
+	sink := getEnv("ACCESS_LOG_SINK", "stdout")
+	if sink == "" || sink == "off" {
+		return next
+	}
+	w, err := accessLogSink(sink)
+	if err != nil {
+		slog.Error("Access log disabled", "error", err)
+		return next
+	}
+	logger := slog.New(slog.NewJSONHandler(w, nil))
+
+	rate := 1.0
+	if v := getEnv("ACCESS_LOG_SAMPLE_RATE", ""); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
+			rate = f
+		} else {
+			slog.Warn("Ignoring ACCESS_LOG_SAMPLE_RATE, want a number from 0 to 1", "value", v)
+		}
+	}
+	bodies := getEnvBool("ACCESS_LOG_BODIES", false)
+	bodyMax := getEnvInt("ACCESS_LOG_BODY_MAX", 4096)
+	headers := getEnvBool("ACCESS_LOG_HEADERS", false)
+	skip := getEnvList("ACCESS_LOG_SKIP", nil)
+	r := newRedactor(getEnvList("ACCESS_LOG_REDACT_FIELDS", defaultRedactedFields), getEnvList("ACCESS_LOG_REDACT_HEADERS", nil))
+
+	return func(c *fiber.Ctx) error {
+		for _, prefix := range skip {
+			if strings.HasPrefix(c.Path(), prefix) {
+				return c.Next()
+			}
+		}
+		start := time.Now()
+		// Render errors here so the logged status is the one sent.
+		if err := c.Next(); err != nil {
+			if err := c.App().Config().ErrorHandler(c, err); err != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+		status := c.Response().StatusCode()
+		if status < fiber.StatusBadRequest && rate < 1 && rand.Float64() >= rate {
+			return nil
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", c.Method()),
+			slog.String("path", c.Path()),
+			slog.Int("status", status),
+			slog.Float64("latencyMs", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", responseSize(c.Response())),
+			slog.String("ip", c.IP()),
+			slog.String("requestId", c.GetRespHeader(fiber.HeaderXRequestID)),
+		}
+		if t, ok := c.Locals("trace").(traceContext); ok {
+			attrs = append(attrs, slog.String("traceparent", t.traceparent()))
+		}
+		if q := r.query(string(c.Request().URI().QueryString())); q != "" {
+			attrs = append(attrs, slog.String("query", q))
+		}
+		if route := c.Route(); route != nil && route.Path != "/" {
+			attrs = append(attrs, slog.String("route", route.Path))
+		}
+		if t, ok := keycloakauth.Cached(c); ok && t.Err == nil {
+			if sub, _ := t.Claims["sub"].(string); sub != "" {
+				attrs = append(attrs, slog.String("subject", sub))
+			}
+			if imp := impersonatorOf(t.Claims); imp != nil {
+				attrs = append(attrs, slog.String("impersonator", imp.name()))
+			}
+		}
+		if headers {
+			h := map[string]string{}
+			c.Request().Header.VisitAll(func(k, v []byte) {
+				if r.headers[strings.ToLower(string(k))] {
+					h[string(k)] = redacted
+				} else {
+					h[string(k)] = string(v)
+				}
+			})
+			attrs = append(attrs, slog.Any("headers", h))
+		}
+		if bodies {
+			if b := r.body(c.Get(fiber.HeaderContentType), c.Body(), bodyMax); b != nil {
+				attrs = append(attrs, slog.Any("body", b))
+			}
+		}
+		logger.LogAttrs(c.UserContext(), slog.LevelInfo, "access", attrs...)
+		return nil
+	}
+}
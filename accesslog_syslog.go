@@ -0,0 +1,22 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"net/url"
+)
+
+// syslogWriter connects to the local syslog daemon, or to a remote one
+// given as udp://host:514 or tcp://host:514.
+func syslogWriter(addr string) (io.Writer, error) {
+	if addr == "" {
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_LOCAL0, "fiber-demo")
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	return syslog.Dial(u.Scheme, u.Host, syslog.LOG_INFO|syslog.LOG_LOCAL0, "fiber-demo")
+}
@@ -0,0 +1,25 @@
+package main
+
+import "github.com/gofiber/fiber/v2"
+
+// mountAdmin adds the unversioned operator endpoints under /admin, all of
+// which require the admin role. The versioned /api/vN/admin route is
+// separate and unaffected. Jobs, reports, retention and webhooks need MongoDB.
+func mountAdmin(app *fiber.App) {
+	admin := app.Group("/admin", requireRole("admin"))
+	registerDenylistRoutes(admin)
+	registerIPBanRoutes(admin)
+	registerExportRoutes(admin)
+	registerImportRoutes(admin)
+	registerQuotaRoutes(admin)
+	registerFlagRoutes(admin)
+	registerRealmRoutes(admin)
+	registerStatsRoutes(admin)
+	registerSessionRoutes(admin)
+	if usesMongo() {
+		registerJobRoutes(admin)
+		registerReportRoutes(admin)
+		registerRetentionRoutes(admin)
+		registerWebhookRoutes(admin)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/example/fiber-demo/internal/oidctest"
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/valyala/fasthttp"
+)
+
+var benchClaims = jwt.MapClaims{
+	"sub":                "0b6a3f1e-alice",
+	"preferred_username": "alice",
+	"realm_access":       map[string]interface{}{"roles": []interface{}{"offline_access", "uma_authorization", "user"}},
+}
+
+// gatewayToken is signed with a throwaway HMAC key; gateway mode never
+// checks the signature.
+func gatewayToken(b *testing.B) string {
+	b.Helper()
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, benchClaims).SignedString([]byte("bench"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return s
+}
+
+// jwksToken switches to AUTH_MODE=jwks against a mock issuer and returns
+// a token it signed.
+func jwksToken(b *testing.B) string {
+	b.Helper()
+	iss := oidctest.New(b)
+	iss.Setenv(b)
+	if err := initAuthMode(); err != nil {
+		b.Fatal(err)
+	}
+	prev := auth
+	b.Cleanup(func() { authMode, auth = authModeGateway, prev })
+	return iss.Token(b, benchClaims)
+}
+
+// benchApp mirrors the production chain for an item route: rate limiting,
+// policy enforcement and the route's own role check all look at the token.
+func benchApp(b *testing.B) fasthttp.RequestHandler {
+	b.Helper()
+	currentPolicy.Store(&policy.Policy{Rules: []policy.Rule{{
+		Pattern: policy.Pattern{Path: "/api/*/items/**"},
+		Roles:   []string{"user", "admin"},
+	}}})
+	limits := compileRateLimits([]rateLimitRule{{
+		Pattern: policy.Pattern{Path: "/**"},
+		Max:     1 << 30,
+		Window:  duration(time.Minute),
+	}})
+	currentRateLimits.Store(&limits)
+	b.Cleanup(func() {
+		currentPolicy.Store(nil)
+		currentRateLimits.Store(nil)
+	})
+
+	app := fiber.New()
+	app.Use(rateLimit, enforcePolicy)
+	app.Get("/api/v1/items", requireAnyRole("user", "admin"), func(c *fiber.Ctx) error {
+		return c.SendString(subject(c))
+	})
+	return app.Handler()
+}
+
+func benchRequests(b *testing.B, h fasthttp.RequestHandler, token string) {
+	b.Helper()
+	var ctx fasthttp.RequestCtx
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx.Request.Reset()
+		ctx.Response.Reset()
+		ctx.ResetUserValues()
+		ctx.Request.SetRequestURI("/api/v1/items")
+		ctx.Request.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+		h(&ctx)
+		if ctx.Response.StatusCode() != fiber.StatusOK {
+			b.Fatalf("status %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+	}
+}
+
+func BenchmarkAuthChainGateway(b *testing.B) {
+	benchRequests(b, benchApp(b), gatewayToken(b))
+}
+
+func BenchmarkAuthChainJWKS(b *testing.B) {
+	token := jwksToken(b)
+	benchRequests(b, benchApp(b), token)
+}
+
+func BenchmarkExtractRoles(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := extractRoles(benchClaims); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/gofiber/fiber/v2"
+)
+
+// With AUTH_ANOMALY_ENABLED, 401 and 403 responses are counted per client
+// IP and per subject in fixed windows. A key that reaches its threshold
+// raises one alert per window: a log line, an auth.anomaly event for the
+// broker and webhooks, and a metric. With AUTH_ANOMALY_BAN the IP is also
+// added to the deny list of Kong's ip-restriction plugin on the app's
+// service, and removed again after AUTH_ANOMALY_BAN_TTL.
+
+// authAnomaly is the data of auth.anomaly events.
+type authAnomaly struct {
+	// Kind is "ip" or "subject".
+	Kind     string `json:"kind"`
+	Key      string `json:"key"`
+	Failures int64  `json:"failures"`
+	Window   string `json:"window"`
+	Banned   bool   `json:"banned"`
+}
+
+type authWindow struct {
+	start time.Time
+	count int64
+}
+
+var (
+	anomalyEnabled          bool
+	anomalyWindow           time.Duration
+	anomalyIPThreshold      int64
+	anomalySubjectThreshold int64
+	anomalyAllowed          []*net.IPNet
+	anomalyBan              bool
+	anomalyBanTTL           time.Duration
+
+	anomalyMu     sync.Mutex
+	anomalyCounts = map[string]*authWindow{}
+
+	// kongBans are the IPs this instance banned, with when to lift them.
+	kongBansMu sync.Mutex
+	kongBans   = map[string]time.Time{}
+
+	authAnomalies = newMetricVec("counter", "auth_anomalies_total",
+		"Keys whose authentication failures reached the threshold, by kind.",
+		"kind")
+)
+
+// initAuthAnomalies reads the detection settings:
+//
+//	AUTH_ANOMALY_WINDOW             counting window (default 1m)
+//	AUTH_ANOMALY_IP_THRESHOLD       failures per IP and window (default 30)
+//	AUTH_ANOMALY_SUBJECT_THRESHOLD  failures per subject and window (default 20)
+//	AUTH_ANOMALY_ALLOW_IPS          IPs and CIDRs never counted, such as monitoring
+//	AUTH_ANOMALY_BAN                ban IPs in Kong, needs KONG_ADMIN_URL (default false)
+//	AUTH_ANOMALY_BAN_TTL            how long a ban lasts (default 1h)
+//
+// Counts are kept in Redis when the cache is configured, so every replica
+// adds to the same windows, and in memory otherwise.
+func initAuthAnomalies() error {
+	if !getEnvBool("AUTH_ANOMALY_ENABLED", false) {
+		return nil
+	}
+	for _, s := range getEnvList("AUTH_ANOMALY_ALLOW_IPS", nil) {
+		n, err := parseIPNet(s)
+		if err != nil {
+			return fmt.Errorf("AUTH_ANOMALY_ALLOW_IPS: %w", err)
+		}
+		anomalyAllowed = append(anomalyAllowed, n)
+	}
+	anomalyWindow = getEnvDuration("AUTH_ANOMALY_WINDOW", time.Minute)
+	anomalyIPThreshold = int64(getEnvInt("AUTH_ANOMALY_IP_THRESHOLD", 30))
+	anomalySubjectThreshold = int64(getEnvInt("AUTH_ANOMALY_SUBJECT_THRESHOLD", 20))
+	anomalyBan = getEnvBool("AUTH_ANOMALY_BAN", false)
+	anomalyBanTTL = getEnvDuration("AUTH_ANOMALY_BAN_TTL", time.Hour)
+	if anomalyBan && getEnv("KONG_ADMIN_URL", "") == "" {
+		return fmt.Errorf("AUTH_ANOMALY_BAN needs KONG_ADMIN_URL")
+	}
+	anomalyEnabled = true
+	go func() {
+		for range time.Tick(anomalyWindow) {
+			pruneAuthWindows(time.Now())
+			if anomalyBan {
+				liftExpiredBans(time.Now())
+			}
+		}
+	}()
+	log.Printf("Watching authentication failures (per %s: %d per IP, %d per subject)",
+		anomalyWindow, anomalyIPThreshold, anomalySubjectThreshold)
+	return nil
+}
+
+// parseIPNet accepts a CIDR or a single IP.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP or CIDR", s)
+	}
+	bits := 8 * len(ip.To4())
+	if bits == 0 {
+		bits = 128
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func anomalyAllowedIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed == nil || slices.ContainsFunc(anomalyAllowed, func(n *net.IPNet) bool { return n.Contains(parsed) })
+}
+
+// noteAuthFailure counts a 401 or 403 against the client IP and, when the
+// token was valid, the subject. Only refused valid tokens name a subject.
+func noteAuthFailure(c *fiber.Ctx) {
+	if !anomalyEnabled {
+		return
+	}
+	// c.IP() may point into the request buffer, which is reused.
+	ip := strings.Clone(c.IP())
+	var sub string
+	if t, ok := keycloakauth.Cached(c); ok && t.Err == nil {
+		sub, _ = t.Claims["sub"].(string)
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if !anomalyAllowedIP(ip) {
+			countAuthFailure(ctx, "ip", ip, anomalyIPThreshold)
+		}
+		if sub != "" {
+			countAuthFailure(ctx, "subject", sub, anomalySubjectThreshold)
+		}
+	}()
+}
+
+// countAuthFailure alerts when key's count in the current window reaches
+// threshold, so each key alerts at most once per window.
+func countAuthFailure(ctx context.Context, kind, key string, threshold int64) {
+	if threshold <= 0 {
+		return
+	}
+	n, err := incrAuthWindow(ctx, kind+":"+key, time.Now())
+	if err != nil {
+		log.Println("Authentication failure not counted:", err)
+		return
+	}
+	if n != threshold {
+		return
+	}
+	a := authAnomaly{Kind: kind, Key: key, Failures: n, Window: anomalyWindow.String()}
+	if kind == "ip" && anomalyBan {
+		if err := banIP(ctx, key); err != nil {
+			log.Printf("Banning %s in Kong failed: %v", key, err)
+		} else {
+			a.Banned = true
+		}
+	}
+	slog.Warn("Authentication failures over threshold",
+		"kind", a.Kind, "key", a.Key, "failures", a.Failures, "window", a.Window, "banned", a.Banned)
+	if metricsEnabled {
+		authAnomalies.inc(kind)
+	}
+	emitEvent(eventAuthAnomaly, key, a)
+}
+
+// incrAuthWindow returns the count of key in the window holding now, after
+// adding one.
+func incrAuthWindow(ctx context.Context, key string, now time.Time) (int64, error) {
+	start := now.Truncate(anomalyWindow)
+	if client := cacheClient.Load(); client != nil {
+		k := cachePrefix + "authfail:" + key + ":" + strconv.FormatInt(start.Unix(), 10)
+		n, err := client.Incr(ctx, k).Result()
+		if err == nil && n == 1 {
+			err = client.ExpireAt(ctx, k, start.Add(2*anomalyWindow)).Err()
+		}
+		return n, err
+	}
+	anomalyMu.Lock()
+	defer anomalyMu.Unlock()
+	w, ok := anomalyCounts[key]
+	if !ok || !w.start.Equal(start) {
+		w = &authWindow{start: start}
+		anomalyCounts[key] = w
+	}
+	w.count++
+	return w.count, nil
+}
+
+func pruneAuthWindows(now time.Time) {
+	start := now.Truncate(anomalyWindow)
+	anomalyMu.Lock()
+	defer anomalyMu.Unlock()
+	for k, w := range anomalyCounts {
+		if w.start.Before(start) {
+			delete(anomalyCounts, k)
+		}
+	}
+}
+
+// kongIPRestriction is the ip-restriction plugin of the app's service.
+type kongIPRestriction struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Config struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	} `json:"config"`
+}
+
+var kongPluginMu sync.Mutex
+
+// kongService is the Kong service in front of the app.
+func kongService() string {
+	return url.PathEscape(getEnv("KONG_SERVICE", "go-app-service"))
+}
+
+func findIPRestriction(ctx context.Context) (*kongIPRestriction, error) {
+	var list struct {
+		Data []kongIPRestriction `json:"data"`
+	}
+	if err := kongAdmin(ctx, http.MethodGet, "/services/"+kongService()+"/plugins", nil, &list); err != nil {
+		return nil, err
+	}
+	for _, p := range list.Data {
+		if p.Name == "ip-restriction" {
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+// editKongDenyList applies edit to the ip-restriction deny list,
+// creating the plugin for the first ban and deleting it with the last.
+func editKongDenyList(ctx context.Context, edit func(deny []string) []string) error {
+	kongPluginMu.Lock()
+	defer kongPluginMu.Unlock()
+	p, err := findIPRestriction(ctx)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		deny := edit(nil)
+		if len(deny) == 0 {
+			return nil
+		}
+		return kongAdmin(ctx, http.MethodPost, "/services/"+kongService()+"/plugins",
+			map[string]interface{}{"name": "ip-restriction", "config": map[string]interface{}{"deny": deny}}, nil)
+	}
+	deny := edit(p.Config.Deny)
+	if slices.Equal(deny, p.Config.Deny) {
+		return nil
+	}
+	if len(deny) == 0 && len(p.Config.Allow) == 0 {
+		// The plugin needs an allow or a deny list.
+		return kongAdmin(ctx, http.MethodDelete, "/plugins/"+p.ID, nil, nil)
+	}
+	if deny == nil {
+		deny = []string{}
+	}
+	return kongAdmin(ctx, http.MethodPatch, "/plugins/"+p.ID,
+		map[string]interface{}{"config": map[string]interface{}{"deny": deny}}, nil)
+}
+
+func banIP(ctx context.Context, ip string) error {
+	err := editKongDenyList(ctx, func(deny []string) []string {
+		if slices.Contains(deny, ip) {
+			return deny
+		}
+		return append(slices.Clone(deny), ip)
+	})
+	if err == nil {
+		kongBansMu.Lock()
+		kongBans[ip] = time.Now().Add(anomalyBanTTL)
+		kongBansMu.Unlock()
+	}
+	return err
+}
+
+func unbanIP(ctx context.Context, ip string) error {
+	err := editKongDenyList(ctx, func(deny []string) []string {
+		return slices.DeleteFunc(slices.Clone(deny), func(d string) bool { return d == ip })
+	})
+	if err == nil {
+		kongBansMu.Lock()
+		delete(kongBans, ip)
+		kongBansMu.Unlock()
+	}
+	return err
+}
+
+// liftExpiredBans removes the bans this instance made once they expire.
+// Bans outlive a restart of the instance that made them until they are
+// removed through DELETE /admin/ip-bans/:ip.
+func liftExpiredBans(now time.Time) {
+	kongBansMu.Lock()
+	var due []string
+	for ip, until := range kongBans {
+		if now.After(until) {
+			due = append(due, ip)
+		}
+	}
+	kongBansMu.Unlock()
+	for _, ip := range due {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := unbanIP(ctx, ip); err != nil {
+			log.Printf("Lifting the Kong ban of %s failed: %v", ip, err)
+		} else {
+			log.Printf("Lifted the Kong ban of %s", ip)
+		}
+		cancel()
+	}
+}
+
+func registerIPBanRoutes(r fiber.Router) {
+	r.Get("/ip-bans", listIPBans)
+	r.Delete("/ip-bans/:ip", deleteIPBan)
+}
+
+// listIPBans returns Kong's deny list, with the expiry of the bans this
+// instance made.
+func listIPBans(c *fiber.Ctx) error {
+	if getEnv("KONG_ADMIN_URL", "") == "" {
+		return newProblem(fiber.StatusNotFound, problemAboutBlank, "KONG_ADMIN_URL is not set")
+	}
+	p, err := findIPRestriction(c.UserContext())
+	if err != nil {
+		return newProblem(fiber.StatusBadGateway, problemAboutBlank, err.Error())
+	}
+	type ban struct {
+		IP        string     `json:"ip"`
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	}
+	bans := []ban{}
+	if p != nil {
+		kongBansMu.Lock()
+		for _, ip := range p.Config.Deny {
+			b := ban{IP: ip}
+			if until, ok := kongBans[ip]; ok {
+				b.ExpiresAt = &until
+			}
+			bans = append(bans, b)
+		}
+		kongBansMu.Unlock()
+	}
+	return c.JSON(fiber.Map{"bans": bans})
+}
+
+func deleteIPBan(c *fiber.Ctx) error {
+	if getEnv("KONG_ADMIN_URL", "") == "" {
+		return newProblem(fiber.StatusNotFound, problemAboutBlank, "KONG_ADMIN_URL is not set")
+	}
+	ip := c.Params("ip")
+	if err := unbanIP(c.UserContext(), ip); err != nil {
+		return newProblem(fiber.StatusBadGateway, problemAboutBlank, err.Error())
+	}
+	recordAudit(c, "ipban.remove", ip, nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// canCheck is one question of POST /auth/can: may the caller send the
+// request, or do they hold the permission?
+type canCheck struct {
+	Method     string `json:"method" validate:"required_without=Permission,excluded_with=Permission,omitempty,oneof=GET HEAD POST PUT PATCH DELETE"`
+	Path       string `json:"path" validate:"required_with=Method,omitempty,startswith=/,max=2048"`
+	Permission string `json:"permission" validate:"max=255"`
+}
+
+type canRequest struct {
+	Checks []canCheck `json:"checks" validate:"required,min=1,max=50,dive"`
+}
+
+// canResult answers a canCheck, in the same position.
+type canResult struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// mountAuthCan adds POST /auth/can, for frontends to hide or disable what
+// the caller can't do without repeating the checks client-side.
+func mountAuthCan(app *fiber.App) {
+	app.Post("/auth/can", authCan).
+		Name(documented("authCan", routeDoc{Summary: "Check what the calling user may do", Tags: []string{"auth"}, Auth: true}))
+}
+
+// authCan answers each check as the app would decide the request: by the
+// POLICY_FILE rule matching it, then IMPERSONATION_BLOCK_DESTRUCTIVE, then
+// the roles and caller kind its route requires, then, for a single item,
+// the item's shares. It only sees the routes in the
+// OpenAPI document; others are reported as unknown.
+func authCan(c *fiber.Ctx) error {
+	claims, err := parseToken(c)
+	if err != nil {
+		return errUnauthorized(err.Error())
+	}
+	roles, _ := requestRoles(c)
+	var req canRequest
+	if err := bindBody(c, &req); err != nil {
+		return err
+	}
+	results := make([]canResult, len(req.Checks))
+	for i, chk := range req.Checks {
+		var reason string
+		if chk.Permission != "" {
+			if !slices.Contains(keycloakauth.Permissions(claims), chk.Permission) {
+				reason = "Missing permission: " + chk.Permission
+			}
+		} else if reason, err = canRequestRoute(c, claims, roles, chk.Method, canPath(c, chk.Path)); err != nil {
+			return err
+		}
+		results[i] = canResult{Allowed: reason == "", Reason: reason}
+	}
+	return c.JSON(fiber.Map{"results": results})
+}
+
+// canPath resolves an unversioned /api path to the version the caller's
+// Accept header would get, like negotiateVersion.
+func canPath(c *fiber.Ctx, path string) string {
+	path = strings.TrimSuffix(path, "/")
+	if !strings.HasPrefix(path, "/api/") || versionedPath.MatchString(path) {
+		return path
+	}
+	name := versionFromAccept(c.Get(fiber.HeaderAccept))
+	if name == "" {
+		name = defaultAPIVersion
+	}
+	return "/api/" + name + strings.TrimPrefix(path, "/api")
+}
+
+// canItemAccess is the access to the item itself that item routes need,
+// besides their roles.
+var canItemAccess = map[string]string{
+	"getItem":     accessRead,
+	"replaceItem": accessWrite,
+	"shareItem":   accessWrite,
+}
+
+// canRequestRoute returns why the caller may not send method path, or ""
+// when they may. Only database failures are errors.
+func canRequestRoute(c *fiber.Ctx, claims jwt.MapClaims, roles []string, method, path string) (string, error) {
+	if reason := requestRefusal(claims, roles, method, path); reason != "" {
+		return reason, nil
+	}
+	route, params, ok := matchDocumentedRoute(c.App(), method, path)
+	if !ok {
+		return "Unknown route", nil
+	}
+	if reason := routeDocs[route.Name].refusal(claims, roles); reason != "" {
+		return reason, nil
+	}
+	access, ok := canItemAccess[route.Name]
+	if !ok {
+		return "", nil
+	}
+	id, err := primitive.ObjectIDFromHex(params["id"])
+	if err != nil {
+		return "Item not found", nil
+	}
+	u := newItemCaller(claims, roles)
+	if u.Admin {
+		return "", nil
+	}
+	doc, err := itemDB.Get(c.UserContext(), id)
+	if err != nil {
+		if p := itemProblem(err); p.Status == fiber.StatusNotFound {
+			return p.Detail, nil
+		}
+		return "", errDatabase(err)
+	}
+	if route.Name == "shareItem" && !u.owns(doc) {
+		return "Only the item's creator can share it", nil
+	}
+	if p := checkItemAccess(u, doc, access); p != nil {
+		return p.Detail, nil
+	}
+	return "", nil
+}
+
+// requestRefusal returns why the POLICY_FILE rule matching method path,
+// or IMPERSONATION_BLOCK_DESTRUCTIVE, refuses the caller, or "".
+func requestRefusal(claims jwt.MapClaims, roles []string, method, path string) string {
+	if rule, ok := currentPolicy.Load().Match(method, path); ok && !rule.Open() {
+		if reason := rule.Check(claims, roles); reason != "" {
+			return reason
+		}
+	}
+	if closedToImpersonation(method, path) && impersonatorOf(claims) != nil {
+		return impersonationRefused
+	}
+	return ""
+}
+
+// refusal returns why the caller lacks the roles or caller kind the route
+// requires, or "".
+func (d routeDoc) refusal(claims jwt.MapClaims, roles []string) string {
+	if len(d.Roles) > 0 && !keycloakauth.HasAny(roles, d.Roles...) {
+		return "Missing role: " + strings.Join(d.Roles, " or ")
+	}
+	return policy.CheckCaller(claims, d.Caller)
+}
+
+// matchDocumentedRoute finds the documented route serving method path and
+// its path parameters.
+func matchDocumentedRoute(app *fiber.App, method, path string) (fiber.Route, map[string]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, r := range app.GetRoutes(true) {
+		if _, ok := routeDocs[r.Name]; !ok || r.Method != method {
+			continue
+		}
+		if params, ok := matchRoutePath(r.Path, segments); ok {
+			return r, params, true
+		}
+	}
+	return fiber.Route{}, nil, false
+}
+
+// matchRoutePath matches path segments against a Fiber route path, where
+// ":name" is a parameter, "*" matches the rest and `\:` is a literal colon.
+func matchRoutePath(route string, segments []string) (map[string]string, bool) {
+	pattern := strings.Split(strings.Trim(route, "/"), "/")
+	params := map[string]string{}
+	for i, p := range pattern {
+		if p == "*" {
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		if name, ok := strings.CutPrefix(p, ":"); ok {
+			params[strings.TrimSuffix(name, "?")] = segments[i]
+			continue
+		}
+		if !strings.EqualFold(strings.ReplaceAll(p, `\:`, ":"), segments[i]) {
+			return nil, false
+		}
+	}
+	return params, len(pattern) == len(segments)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Auth modes selected by AUTH_MODE.
+const (
+	// authModeGateway trusts Kong to have validated the bearer token.
+	authModeGateway = "gateway"
+	// authModeJWKS verifies the signature against the realm's JWKS, for
+	// deployments where nothing in front of the app does.
+	authModeJWKS = "jwks"
+	// authModeDev needs no Keycloak: requests without a token get the
+	// synthetic claims from DEV_AUTH_*, and tokens are never verified.
+	authModeDev = "dev"
+)
+
+var (
+	authMode  = authModeGateway
+	devClaims jwt.MapClaims
+)
+
+// auth decodes and checks tokens for HTTP, WebSocket and gRPC alike. It
+// starts out in gateway mode; initAuthMode configures it from AUTH_MODE.
+var auth *keycloakauth.Auth
+
+func init() {
+	auth = keycloakauth.MustNew(authOptions(keycloakauth.ModeGateway))
+}
+
+// authOptions are the settings shared by every mode: roles from
+// ROLES_CLAIM_PATHS, the claims transformers of the runtime config, the
+// denylist, and problem responses for refusals.
+func authOptions(mode keycloakauth.Mode) keycloakauth.Options {
+	return keycloakauth.Options{
+		Mode:        mode,
+		RolesClaims: getEnvList("ROLES_CLAIM_PATHS", nil),
+		Claims:      currentClaimsConfig,
+		Transform:   acceptClaims,
+		Deny: func(c *fiber.Ctx, status int, message string) error {
+			if status == fiber.StatusUnauthorized {
+				return errUnauthorized(message)
+			}
+			// requireCaller has already labelled its refusals.
+			if c.Locals("authzDenied") == nil {
+				markDenied(c, "role")
+			}
+			return errForbidden(message)
+		},
+	}
+}
+
+// acceptClaims turns away denylisted subjects, after the claims
+// transformers have run.
+func acceptClaims(claims jwt.MapClaims) error {
+	if isDenylisted(claims) {
+		return errors.New("subject is denylisted")
+	}
+	return nil
+}
+
+// jwksURL is KEYCLOAK_JWKS_URL, defaulting to the realm's certs endpoint.
+func jwksURL() string {
+	return getEnv("KEYCLOAK_JWKS_URL", keycloakIssuer()+"/protocol/openid-connect/certs")
+}
+
+// fetchJWKS returns the realm's signing keys published at url.
+func fetchJWKS(url string) (map[string]*rsa.PublicKey, error) {
+	return keycloakauth.FetchJWKS(keycloakHTTP, url)
+}
+
+func initAuthMode() error {
+	opts := authOptions(keycloakauth.ModeGateway)
+	switch mode := getEnv("AUTH_MODE", authModeGateway); mode {
+	case authModeGateway:
+		authMode = mode
+	case authModeJWKS:
+		authMode = mode
+		minRefetch, err := time.ParseDuration(getEnv("KEYCLOAK_JWKS_MIN_REFRESH", "30s"))
+		if err != nil {
+			return fmt.Errorf("KEYCLOAK_JWKS_MIN_REFRESH: %w", err)
+		}
+		if minRefetch <= 0 {
+			minRefetch = -1
+		}
+		opts.Mode = keycloakauth.ModeJWKS
+		opts.Issuer = keycloakIssuer()
+		opts.JWKSURL = jwksURL()
+		opts.JWKSMinRefresh = minRefetch
+		opts.HTTPClient = keycloakHTTP
+	case authModeDev:
+		if !devAuthAllowed {
+			return errors.New("AUTH_MODE=dev is not available in production builds")
+		}
+		if appEnv() == "production" {
+			return errors.New("AUTH_MODE=dev cannot be used with APP_ENV=production")
+		}
+		claims, err := buildDevClaims()
+		if err != nil {
+			return err
+		}
+		authMode, devClaims = mode, claims
+		opts.Anonymous = devTokenClaims
+		warnDevAuth()
+	default:
+		return fmt.Errorf("unknown AUTH_MODE %q", mode)
+	}
+	if policyAtGateway {
+		if authMode != authModeGateway {
+			return errors.New("POLICY_ENFORCED_BY_GATEWAY requires AUTH_MODE=gateway")
+		}
+		log.Println("POLICY_FILE is enforced by the keycloak-authz Kong plugin; skipping it in the app")
+	}
+	if err := configureKeyPinning(&opts); err != nil {
+		return err
+	}
+	a, err := keycloakauth.New(opts)
+	if err != nil {
+		return err
+	}
+	auth = a
+	return nil
+}
+
+// buildDevClaims assembles the synthetic token from DEV_AUTH_SUB,
+// DEV_AUTH_USERNAME, DEV_AUTH_ROLES and any extra claims in the
+// DEV_AUTH_CLAIMS JSON object, which win over the rest.
+func buildDevClaims() (jwt.MapClaims, error) {
+	roles := []interface{}{}
+	for _, r := range getEnvList("DEV_AUTH_ROLES", []string{"user", "admin"}) {
+		roles = append(roles, r)
+	}
+	claims := jwt.MapClaims{
+		"iss":                keycloakIssuer(),
+		"sub":                getEnv("DEV_AUTH_SUB", "dev-user"),
+		"preferred_username": getEnv("DEV_AUTH_USERNAME", "developer"),
+		"roles":              roles,
+		"realm_access":       map[string]interface{}{"roles": roles},
+		"iat":                float64(time.Now().Unix()),
+	}
+	if extra := os.Getenv("DEV_AUTH_CLAIMS"); extra != "" {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(extra), &m); err != nil {
+			return nil, fmt.Errorf("DEV_AUTH_CLAIMS: %w", err)
+		}
+		for k, v := range m {
+			claims[k] = v
+		}
+	}
+	return claims, nil
+}
+
+func warnDevAuth() {
+	banner := strings.Repeat("!", 72)
+	log.Println(banner)
+	log.Println("!!! AUTH_MODE=dev: TOKEN VALIDATION IS DISABLED")
+	log.Printf("!!! Every request is treated as sub=%v with roles %v", devClaims["sub"], devClaims["roles"])
+	log.Println("!!! Never expose this instance; it is for local frontend development only")
+	log.Println(banner)
+}
+
+// devTokenClaims hands out a copy of the synthetic claims to requests
+// without a token. Tokens that are sent are decoded but never verified.
+func devTokenClaims() jwt.MapClaims {
+	claims := make(jwt.MapClaims, len(devClaims))
+	for k, v := range devClaims {
+		claims[k] = v
+	}
+	return claims
+}
@@ -0,0 +1,6 @@
+//go:build production
+
+package main
+
+// devAuthAllowed gates AUTH_MODE=dev; production builds turn it off.
+const devAuthAllowed = false
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Hot reads are cached in Redis when the REDIS_URL secret is set. Values
+// are stored as BSON, so encrypted item fields stay sealed in the cache as
+// they are in the database. Redis errors never fail a request; the read
+// falls through to the store.
+var cacheClient atomic.Pointer[redis.Client]
+
+// cacheOpTimeout bounds each Redis call so a slow cache can't slow the
+// request more than a miss would.
+const cacheOpTimeout = 100 * time.Millisecond
+
+// cacheRoute is one kind of cached read with its own TTL. A TTL of 0
+// turns caching off for that route.
+type cacheRoute struct {
+	Name    string
+	Env     string
+	Default time.Duration
+	ttl     time.Duration
+
+	// hits and misses count the reads of the route, for /admin/stats.
+	hits, misses atomic.Int64
+}
+
+var (
+	itemCache   = &cacheRoute{Name: "item", Env: "CACHE_ITEM_TTL", Default: 5 * time.Minute}
+	reportCache = &cacheRoute{Name: "report", Env: "CACHE_REPORT_TTL", Default: time.Minute}
+	// meCache holds the userinfo and profile behind /me, per subject.
+	meCache = &cacheRoute{Name: "me", Env: "CACHE_ME_TTL", Default: time.Minute}
+)
+
+var cacheRoutes = []*cacheRoute{itemCache, reportCache, meCache}
+
+var cachePrefix string
+
+func connectRedis(url string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// initCache connects to Redis. Without REDIS_URL caching is off. A cache
+// that can't be reached at startup is logged and skipped rather than
+// keeping the app down.
+func initCache() {
+	cachePrefix = getEnv("CACHE_PREFIX", "fiber-demo:")
+	for _, r := range cacheRoutes {
+		r.ttl = r.Default
+		if d, err := time.ParseDuration(getEnv(r.Env, "")); err == nil && d >= 0 {
+			r.ttl = d
+		}
+	}
+	url := secrets.Get("REDIS_URL", "")
+	if url == "" {
+		return
+	}
+	client, err := connectRedis(url)
+	if err != nil {
+		log.Println("Redis cache disabled:", err)
+		return
+	}
+	cacheClient.Store(client)
+	log.Println("Redis cache enabled:", redactURI(url))
+
+	secrets.Watch("REDIS_URL", func(url string) {
+		client, err := connectRedis(url)
+		if err != nil {
+			log.Println("Keeping current Redis connection, rotated URL failed:", err)
+			return
+		}
+		if old := cacheClient.Swap(client); old != nil {
+			time.AfterFunc(30*time.Second, func() { _ = old.Close() })
+		}
+		log.Println("Reconnected to Redis with rotated URL:", redactURI(url))
+	})
+}
+
+func cacheEnabled() bool {
+	return cacheClient.Load() != nil
+}
+
+func (r *cacheRoute) key(id string) string {
+	return cachePrefix + r.Name + ":" + id
+}
+
+// get decodes the cached value of id into dst and reports a hit.
+func (r *cacheRoute) get(ctx context.Context, id string, dst interface{}) bool {
+	client := cacheClient.Load()
+	if client == nil || r.ttl == 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, cacheOpTimeout)
+	defer cancel()
+	raw, err := client.Get(ctx, r.key(id)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Println("Cache read failed:", err)
+		}
+		r.misses.Add(1)
+		return false
+	}
+	if err := bson.Unmarshal(raw, dst); err != nil {
+		log.Printf("Cache entry %s unreadable: %v", r.key(id), err)
+		r.misses.Add(1)
+		return false
+	}
+	r.hits.Add(1)
+	return true
+}
+
+func (r *cacheRoute) set(ctx context.Context, id string, v interface{}) {
+	client := cacheClient.Load()
+	if client == nil || r.ttl == 0 {
+		return
+	}
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		log.Println("Cache write failed:", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, cacheOpTimeout)
+	defer cancel()
+	if err := client.Set(ctx, r.key(id), raw, r.ttl).Err(); err != nil {
+		log.Println("Cache write failed:", err)
+	}
+}
+
+// invalidate drops the cached values of ids. A failure leaves stale
+// entries for at most the route's TTL.
+func (r *cacheRoute) invalidate(ctx context.Context, ids ...string) {
+	client := cacheClient.Load()
+	if client == nil || len(ids) == 0 {
+		return
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = r.key(id)
+	}
+	ctx, cancel := context.WithTimeout(ctx, cacheOpTimeout)
+	defer cancel()
+	if err := client.Del(ctx, keys...).Err(); err != nil {
+		log.Println("Cache invalidation failed:", err)
+	}
+}
+
+// flush drops every cached value of the route and returns how many there
+// were. Unlike the per-request calls it may take a while on a large cache.
+func (r *cacheRoute) flush(ctx context.Context) (int, error) {
+	client := cacheClient.Load()
+	if client == nil {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	n := 0
+	iter := client.Scan(ctx, 0, r.key("*"), 500).Iterator()
+	var batch []string
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == 500 {
+			if err := client.Del(ctx, batch...).Err(); err != nil {
+				return n, err
+			}
+			n, batch = n+len(batch), batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return n, err
+	}
+	if len(batch) > 0 {
+		if err := client.Del(ctx, batch...).Err(); err != nil {
+			return n, err
+		}
+		n += len(batch)
+	}
+	return n, nil
+}
+
+// cachedItemStore reads items through the cache and invalidates them on
+// every write, so the item routes, gRPC and the batch endpoint all share
+// one consistent view.
+type cachedItemStore struct {
+	itemStore
+}
+
+func (s cachedItemStore) Get(ctx context.Context, id primitive.ObjectID) (item, error) {
+	var doc item
+	if itemCache.get(ctx, id.Hex(), &doc) {
+		return doc, nil
+	}
+	doc, err := s.itemStore.Get(ctx, id)
+	if err != nil {
+		return item{}, err
+	}
+	itemCache.set(ctx, id.Hex(), doc)
+	return doc, nil
+}
+
+func (s cachedItemStore) Update(ctx context.Context, id primitive.ObjectID, ch itemChanges) (item, error) {
+	doc, err := s.itemStore.Update(ctx, id, ch)
+	itemCache.invalidate(ctx, id.Hex())
+	return doc, err
+}
+
+func (s cachedItemStore) SetACL(ctx context.Context, id primitive.ObjectID, acl itemACL) (item, error) {
+	doc, err := s.itemStore.SetACL(ctx, id, acl)
+	itemCache.invalidate(ctx, id.Hex())
+	return doc, err
+}
+
+func (s cachedItemStore) Delete(ctx context.Context, id primitive.ObjectID) (item, error) {
+	doc, err := s.itemStore.Delete(ctx, id)
+	itemCache.invalidate(ctx, id.Hex())
+	return doc, err
+}
+
+func (s cachedItemStore) Bulk(ctx context.Context, writes []itemWrite) ([]error, error) {
+	errs, err := s.itemStore.Bulk(ctx, writes)
+	var ids []string
+	for _, w := range writes {
+		if w.Op != batchCreate {
+			ids = append(ids, w.ID.Hex())
+		}
+	}
+	itemCache.invalidate(ctx, ids...)
+	return errs, err
+}
+
+func (s cachedItemStore) Import(ctx context.Context, docs []item, batchSize int, inTx importHook) (int, error) {
+	applied, err := s.itemStore.Import(ctx, docs, batchSize, inTx)
+	ids := make([]string, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.ID.Hex()
+	}
+	itemCache.invalidate(ctx, ids...)
+	return applied, err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Responses to requests with credentials are never stored by shared caches
+// such as Kong's proxy-cache plugin or a CDN: whatever a rule says, they
+// are marked "private, no-store". Every response also varies on
+// Authorization, so a cache that ignores Cache-Control still can't serve
+// one caller's response to another.
+const cacheControlPrivate = "private, no-store"
+
+// cacheControlRule sets the caching headers of the anonymous GET and HEAD
+// responses of the routes its pattern matches. SurrogateControl, for CDNs
+// and Kong, can cache longer than CacheControl lets browsers, and is
+// stripped by the CDN before the response reaches them.
+type cacheControlRule struct {
+	policy.Pattern
+	CacheControl     string   `json:"cacheControl"`
+	SurrogateControl string   `json:"surrogateControl,omitempty"`
+	Vary             []string `json:"vary,omitempty"`
+}
+
+func (r cacheControlRule) validate() error {
+	if err := r.Pattern.Validate(); err != nil {
+		return err
+	}
+	if strings.TrimSpace(r.CacheControl) == "" {
+		return errors.New("cacheControl is required")
+	}
+	return nil
+}
+
+var (
+	// cacheControlDefault is the Cache-Control of anonymous responses no
+	// rule matches.
+	cacheControlDefault string
+	// currentCacheControl is replaced on every runtime config reload.
+	currentCacheControl atomic.Pointer[[]cacheControlRule]
+)
+
+// initCacheControl reads CACHE_CONTROL_DEFAULT (default no-cache), which
+// keeps shared caches from serving a response without revalidating it.
+func initCacheControl() {
+	cacheControlDefault = getEnv("CACHE_CONTROL_DEFAULT", "no-cache")
+}
+
+// cacheHeaders sets Cache-Control, Surrogate-Control and Vary once the
+// response is known:
+//
+//   - requests with an Authorization header get "private, no-store";
+//   - other methods than GET and HEAD, and responses other than 2xx and
+//     304, get "no-store";
+//   - the other anonymous GET and HEAD responses get the first matching
+//     cacheControl rule, or CACHE_CONTROL_DEFAULT.
+//
+// A Cache-Control set by the handler is kept, except on responses to
+// requests with credentials.
+func cacheHeaders(c *fiber.Ctx) error {
+	err := c.Next()
+	c.Vary(fiber.HeaderAuthorization)
+	h := &c.Response().Header
+	if c.Get(fiber.HeaderAuthorization) != "" {
+		h.Del("Surrogate-Control")
+		c.Set(fiber.HeaderCacheControl, cacheControlPrivate)
+		return err
+	}
+	if len(h.Peek(fiber.HeaderCacheControl)) > 0 {
+		return err
+	}
+	// The error handler hasn't written the response yet. A 4xx written by
+	// the handler itself must not be cached either.
+	status := h.StatusCode()
+	if err != nil || (status/100 != 2 && status != fiber.StatusNotModified) ||
+		(c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead) {
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return err
+	}
+	rule, ok := cacheControlFor(c.Method(), c.Path())
+	if !ok {
+		c.Set(fiber.HeaderCacheControl, cacheControlDefault)
+		return nil
+	}
+	c.Set(fiber.HeaderCacheControl, rule.CacheControl)
+	if rule.SurrogateControl != "" {
+		c.Set("Surrogate-Control", rule.SurrogateControl)
+	}
+	c.Vary(rule.Vary...)
+	return nil
+}
+
+func cacheControlFor(method, path string) (cacheControlRule, bool) {
+	if rules := currentCacheControl.Load(); rules != nil {
+		for _, r := range *rules {
+			if r.Matches(method, path) {
+				return r, true
+			}
+		}
+	}
+	return cacheControlRule{}, false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Only successful anonymous responses get the shared-cache rule.
+func TestCacheHeadersByStatus(t *testing.T) {
+	rules := []cacheControlRule{{Pattern: policy.Pattern{Path: "/public/**"}, CacheControl: "public, max-age=60"}}
+	currentCacheControl.Store(&rules)
+	defer currentCacheControl.Store(nil)
+
+	app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
+	app.Use(cacheHeaders)
+	app.Get("/public/ok", func(c *fiber.Ctx) error { return c.SendString("ok") })
+	app.Get("/public/missing", func(c *fiber.Ctx) error {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "not found"})
+	})
+	app.Get("/public/failed", func(c *fiber.Ctx) error { return fiber.ErrBadRequest })
+	app.Get("/public/unchanged", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusNotModified) })
+
+	cases := []struct{ path, want string }{
+		{"/public/ok", "public, max-age=60"},
+		{"/public/unchanged", "public, max-age=60"},
+		{"/public/missing", "no-store"},
+		{"/public/failed", "no-store"},
+	}
+	for _, c := range cases {
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, c.path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get(fiber.HeaderCacheControl); got != c.want {
+			t.Errorf("%s: Cache-Control %q, want %q", c.path, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// consistencyHeader carries the causal consistency token between requests.
+const consistencyHeader = "X-Consistency-Token"
+
+// consistencyToken is the cluster and operation time of a client's last
+// request, which the next request's session waits for.
+type consistencyToken struct {
+	ClusterTime   bson.Raw             `bson:"ct"`
+	OperationTime *primitive.Timestamp `bson:"ot"`
+}
+
+func (t consistencyToken) encode() (string, error) {
+	b, err := bson.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeConsistencyToken(s string) (consistencyToken, bool) {
+	var t consistencyToken
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || bson.Unmarshal(b, &t) != nil || t.OperationTime == nil {
+		return consistencyToken{}, false
+	}
+	return t, true
+}
+
+// causalConsistency runs each API request in a causally consistent MongoDB
+// session (MONGO_CAUSAL_CONSISTENCY), so reads see the caller's earlier
+// writes even when Kong sends the requests to different instances and the
+// reads go to secondaries. The session's times are returned in the
+// X-Consistency-Token header, and in the MONGO_CAUSAL_COOKIE cookie when
+// set, and the client sends the header back with its next request. An
+// invalid token is ignored.
+//
+// The guarantee needs majority read and write concerns; with weaker ones
+// the session only orders operations on a best-effort basis.
+func causalConsistency() fiber.Handler {
+	cookie := getEnv("MONGO_CAUSAL_COOKIE", "")
+	return func(c *fiber.Ctx) error {
+		sess, err := mongoClient.Load().StartSession(options.Session().SetCausalConsistency(true))
+		if err != nil {
+			log.Println("Causal session not started:", err)
+			return c.Next()
+		}
+		defer sess.EndSession(c.UserContext())
+
+		raw := c.Get(consistencyHeader)
+		if raw == "" && cookie != "" {
+			raw = c.Cookies(cookie)
+		}
+		if t, ok := decodeConsistencyToken(raw); ok {
+			if len(t.ClusterTime) > 0 {
+				_ = sess.AdvanceClusterTime(t.ClusterTime)
+			}
+			_ = sess.AdvanceOperationTime(t.OperationTime)
+		}
+
+		c.SetUserContext(mongo.NewSessionContext(c.UserContext(), sess))
+		err = c.Next()
+
+		if ot := sess.OperationTime(); ot != nil {
+			if token, encErr := (consistencyToken{ClusterTime: sess.ClusterTime(), OperationTime: ot}).encode(); encErr == nil {
+				c.Set(consistencyHeader, token)
+				if cookie != "" {
+					c.Cookie(&fiber.Cookie{
+						Name:     cookie,
+						Value:    token,
+						Path:     "/api",
+						HTTPOnly: true,
+						Secure:   appEnv() == "production",
+						SameSite: fiber.CookieSameSiteLaxMode,
+					})
+				}
+			}
+		}
+		return err
+	}
+}
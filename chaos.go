@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Fault injection tests the timeouts, load shedding, retries and circuit
+// breakers before an incident does. It is only compiled into non-production
+// builds and needs CHAOS_ENABLED; faults are then set at runtime with
+// PUT /ops/chaos and switch themselves off after a while.
+
+// chaosConfig is the faults injected into the requests under Paths.
+type chaosConfig struct {
+	// Paths are the path prefixes faults apply to (default /api).
+	Paths []string `json:"paths" validate:"max=20,dive,startswith=/"`
+	// LatencyPercent of the requests are delayed by Latency before they
+	// are handled.
+	LatencyPercent float64  `json:"latencyPercent" validate:"min=0,max=100"`
+	Latency        duration `json:"latency"`
+	// DatabaseErrorPercent of the requests see every item store call fail.
+	DatabaseErrorPercent float64 `json:"databaseErrorPercent" validate:"min=0,max=100"`
+	// JWKSErrorPercent of the JWKS fetches fail, whichever request causes
+	// them.
+	JWKSErrorPercent float64 `json:"jwksErrorPercent" validate:"min=0,max=100"`
+	// Duration is how long the faults last (default 10m, at most 1h).
+	Duration  duration  `json:"duration"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+const chaosMaxDuration = time.Hour
+
+var (
+	chaosEnabled bool
+	currentChaos atomic.Pointer[chaosConfig]
+
+	chaosFaults = newMetricVec("counter", "chaos_faults_total",
+		"Faults injected by the chaos mode, by kind.",
+		"fault")
+)
+
+// errChaos is the error injected into item store calls.
+var errChaos = errors.New("chaos: injected database error")
+
+// initChaos reads CHAOS_ENABLED, which makes /ops/chaos available. It is
+// refused in production builds and with APP_ENV=production.
+func initChaos() error {
+	if !getEnvBool("CHAOS_ENABLED", false) {
+		return nil
+	}
+	if !chaosAllowed {
+		return errors.New("CHAOS_ENABLED is not available in production builds")
+	}
+	if appEnv() == "production" {
+		return errors.New("CHAOS_ENABLED cannot be used with APP_ENV=production")
+	}
+	chaosEnabled = true
+	log.Println("WARNING: fault injection is available at /ops/chaos; never enable CHAOS_ENABLED in production")
+	return nil
+}
+
+// activeChaos returns the faults in force, or nil.
+func activeChaos() *chaosConfig {
+	cfg := currentChaos.Load()
+	if cfg == nil || time.Now().After(cfg.ExpiresAt) {
+		return nil
+	}
+	return cfg
+}
+
+func chaosRoll(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+func (cfg *chaosConfig) covers(path string) bool {
+	for _, p := range cfg.Paths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+type chaosKey struct{}
+
+// injectChaos delays the request or marks it for database errors. It runs
+// inside the request deadline, so a delay past it ends in a 504, and
+// inside load shedding, which sees the added latency.
+func injectChaos(c *fiber.Ctx) error {
+	if !chaosEnabled {
+		return c.Next()
+	}
+	cfg := activeChaos()
+	if cfg == nil || !cfg.covers(c.Path()) {
+		return c.Next()
+	}
+	if chaosRoll(cfg.LatencyPercent) {
+		chaosFaults.inc("latency")
+		timer := time.NewTimer(time.Duration(cfg.Latency))
+		select {
+		case <-timer.C:
+		case <-c.UserContext().Done():
+			timer.Stop()
+			return c.UserContext().Err()
+		}
+	}
+	if chaosRoll(cfg.DatabaseErrorPercent) {
+		chaosFaults.inc("database")
+		c.SetUserContext(context.WithValue(c.UserContext(), chaosKey{}, true))
+	}
+	return c.Next()
+}
+
+// chaosItemStore fails the calls made for requests marked by injectChaos.
+type chaosItemStore struct {
+	itemStore
+}
+
+func chaosFailing(ctx context.Context) bool {
+	failing, _ := ctx.Value(chaosKey{}).(bool)
+	return failing
+}
+
+func (s chaosItemStore) List(ctx context.Context, f itemFilter, offset, limit int) ([]item, error) {
+	if chaosFailing(ctx) {
+		return nil, errChaos
+	}
+	return s.itemStore.List(ctx, f, offset, limit)
+}
+
+func (s chaosItemStore) Count(ctx context.Context) (int64, error) {
+	if chaosFailing(ctx) {
+		return 0, errChaos
+	}
+	return s.itemStore.Count(ctx)
+}
+
+func (s chaosItemStore) Insert(ctx context.Context, doc item) error {
+	if chaosFailing(ctx) {
+		return errChaos
+	}
+	return s.itemStore.Insert(ctx, doc)
+}
+
+func (s chaosItemStore) Get(ctx context.Context, id primitive.ObjectID) (item, error) {
+	if chaosFailing(ctx) {
+		return item{}, errChaos
+	}
+	return s.itemStore.Get(ctx, id)
+}
+
+func (s chaosItemStore) Update(ctx context.Context, id primitive.ObjectID, ch itemChanges) (item, error) {
+	if chaosFailing(ctx) {
+		return item{}, errChaos
+	}
+	return s.itemStore.Update(ctx, id, ch)
+}
+
+func (s chaosItemStore) Delete(ctx context.Context, id primitive.ObjectID) (item, error) {
+	if chaosFailing(ctx) {
+		return item{}, errChaos
+	}
+	return s.itemStore.Delete(ctx, id)
+}
+
+func (s chaosItemStore) GetMany(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]item, error) {
+	if chaosFailing(ctx) {
+		return nil, errChaos
+	}
+	return s.itemStore.GetMany(ctx, ids)
+}
+
+func (s chaosItemStore) SetACL(ctx context.Context, id primitive.ObjectID, acl itemACL) (item, error) {
+	if chaosFailing(ctx) {
+		return item{}, errChaos
+	}
+	return s.itemStore.SetACL(ctx, id, acl)
+}
+
+func (s chaosItemStore) Bulk(ctx context.Context, writes []itemWrite) ([]error, error) {
+	if chaosFailing(ctx) {
+		return nil, errChaos
+	}
+	return s.itemStore.Bulk(ctx, writes)
+}
+
+func (s chaosItemStore) Each(ctx context.Context, f itemFilter, fn func(item) error) error {
+	if chaosFailing(ctx) {
+		return errChaos
+	}
+	return s.itemStore.Each(ctx, f, fn)
+}
+
+func (s chaosItemStore) Import(ctx context.Context, docs []item, batchSize int, inTx importHook) (int, error) {
+	if chaosFailing(ctx) {
+		return 0, errChaos
+	}
+	return s.itemStore.Import(ctx, docs, batchSize, inTx)
+}
+
+func (s chaosItemStore) TagCounts(ctx context.Context) (map[string]int, error) {
+	if chaosFailing(ctx) {
+		return nil, errChaos
+	}
+	return s.itemStore.TagCounts(ctx)
+}
+
+// chaosTransport fails a share of the JWKS fetches made through the
+// Keycloak client.
+type chaosTransport struct {
+	base http.RoundTripper
+}
+
+func (tr chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if cfg := activeChaos(); cfg != nil && req.URL.String() == jwksURL() && chaosRoll(cfg.JWKSErrorPercent) {
+		chaosFaults.inc("jwks")
+		return nil, errors.New("chaos: injected JWKS failure")
+	}
+	return tr.base.RoundTrip(req)
+}
+
+func registerChaosRoutes(r fiber.Router) {
+	if !chaosEnabled {
+		return
+	}
+	r.Get("/chaos", getChaos)
+	r.Put("/chaos", putChaos)
+	r.Delete("/chaos", deleteChaos)
+}
+
+func getChaos(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"active": activeChaos()})
+}
+
+func putChaos(c *fiber.Ctx) error {
+	var cfg chaosConfig
+	if err := bindBody(c, &cfg); err != nil {
+		return err
+	}
+	if cfg.Latency < 0 || (cfg.LatencyPercent > 0 && cfg.Latency == 0) {
+		return errValidation([]fieldError{{Field: "latency", Rule: "min", Message: "must be positive with latencyPercent"}})
+	}
+	if cfg.Duration < 0 || time.Duration(cfg.Duration) > chaosMaxDuration {
+		return errValidation([]fieldError{{Field: "duration", Rule: "max", Message: fmt.Sprintf("must be between 0 and %s", chaosMaxDuration)}})
+	}
+	if cfg.Duration == 0 {
+		cfg.Duration = duration(10 * time.Minute)
+	}
+	if len(cfg.Paths) == 0 {
+		cfg.Paths = []string{"/api"}
+	}
+	cfg.ExpiresAt = time.Now().UTC().Add(time.Duration(cfg.Duration))
+	currentChaos.Store(&cfg)
+	log.Printf("Fault injection set by %s until %s: latency %g%% (%s), database errors %g%%, JWKS errors %g%% on %v",
+		subject(c), cfg.ExpiresAt.Format(time.RFC3339), cfg.LatencyPercent, time.Duration(cfg.Latency),
+		cfg.DatabaseErrorPercent, cfg.JWKSErrorPercent, cfg.Paths)
+	recordAudit(c, "ops.chaos.set", "chaos", bson.M{
+		"paths": cfg.Paths, "latencyPercent": cfg.LatencyPercent, "latency": time.Duration(cfg.Latency).String(),
+		"databaseErrorPercent": cfg.DatabaseErrorPercent, "jwksErrorPercent": cfg.JWKSErrorPercent, "expiresAt": cfg.ExpiresAt,
+	})
+	return c.JSON(fiber.Map{"active": &cfg})
+}
+
+func deleteChaos(c *fiber.Ctx) error {
+	currentChaos.Store(nil)
+	log.Printf("Fault injection stopped by %s", subject(c))
+	recordAudit(c, "ops.chaos.clear", "chaos", nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
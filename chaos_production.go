@@ -0,0 +1,6 @@
+//go:build production
+
+package main
+
+// chaosAllowed gates CHAOS_ENABLED; production builds turn it off.
+const chaosAllowed = false
@@ -0,0 +1,19 @@
+package main
+
+import "github.com/example/fiber-demo/pkg/keycloakauth"
+
+// The claims transformers (role aliases, then permissions derived from the
+// aliased roles, then the tenant) live in pkg/keycloakauth, so the
+// keycloak-authz Kong plugin applies them exactly as the app does. They
+// run on every accepted token, before the denylist, roles, policy and
+// handlers see it, and are configured by the "claims" section of the
+// runtime config.
+
+// currentClaimsConfig returns the claims section of the runtime config in
+// force, or nil.
+func currentClaimsConfig() *keycloakauth.ClaimsConfig {
+	if cfg := currentRuntime.Load(); cfg != nil && cfg.Claims != nil {
+		return cfg.Claims
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// command is a subcommand of the binary. Running it without one serves
+// the API, as before subcommands existed.
+type command struct {
+	name, usage string
+	run         func(fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"serve", "run the HTTP and gRPC servers (the default)", runServe},
+	{"migrate", "apply the pending MongoDB migrations", runMigrate},
+	{"seed", "create the demo realm and load demo items", runSeed},
+	{"realm", "export the Keycloak realm, or import a definition (realm export|import)", runRealm},
+	{"healthcheck", "exit nonzero unless /readyz reports ready", runHealthcheck},
+	{"thumbprints", "print the thumbprints of the realm's signing keys, for KEYCLOAK_PINNED_KEYS", runThumbprints},
+}
+
+// runCommand dispatches args to a subcommand and returns the exit code.
+func runCommand(args []string, stderr io.Writer) int {
+	name := "serve"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		name, args = args[0], args[1:]
+	}
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		err := cmd.run(fs, args)
+		switch {
+		case err == nil:
+			return 0
+		case errors.Is(err, flag.ErrHelp):
+			return 2
+		default:
+			fmt.Fprintf(stderr, "%s: %v\n", cmd.name, err)
+			return 1
+		}
+	}
+	if name != "help" {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", name)
+	}
+	fmt.Fprintf(stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(stderr, "  %-12s %s\n", cmd.name, cmd.usage)
+	}
+	if name == "help" {
+		return 0
+	}
+	return 2
+}
+
+// initCommand prepares what every command but serve needs: logging,
+// secrets and the Keycloak client. It then waits for the dependencies
+// named in wait, if any.
+func initCommand(wait ...string) error {
+	initLogging()
+	if err := initSecrets(); err != nil {
+		return fmt.Errorf("secrets: %w", err)
+	}
+	if err := initKeycloakClient(); err != nil {
+		return fmt.Errorf("keycloak client: %w", err)
+	}
+	if len(wait) == 0 {
+		return nil
+	}
+	return waitForDependencies(wait...)
+}
+
+// initStore connects the storage backend for the commands that work on
+// the data: field encryption, the cache and storage.
+func initStore() error {
+	if err := initFieldEncryption(); err != nil {
+		return fmt.Errorf("field encryption: %w", err)
+	}
+	initCache()
+	if err := initStorage(); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	if usesMongo() && !ready("mongodb") {
+		return errors.New("MongoDB is unreachable")
+	}
+	return nil
+}
+
+// runMigrate applies the MongoDB migrations. PostgreSQL creates its tables
+// at startup and has none.
+func runMigrate(fs *flag.FlagSet, args []string) error {
+	dryRun := fs.Bool("dry-run", false, "list the migrations and their state without applying any")
+	timeout := fs.Duration("timeout", 10*time.Minute, "give up after this long")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if getEnv("STORAGE_BACKEND", storageMongo) != storageMongo {
+		return errors.New("migrations apply to MongoDB only; the PostgreSQL tables are created at startup")
+	}
+	if err := initCommand("mongodb"); err != nil {
+		return err
+	}
+	if err := initStore(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	return runMigrations(ctx, os.Stdout, *dryRun)
+}
+
+// runSeed creates the demo realm in Keycloak and loads demo items, so a
+// fresh environment is usable straight away.
+func runSeed(fs *flag.FlagSet, args []string) error {
+	withKeycloak := fs.Bool("keycloak", true, "create the realm, client, roles and users through the Keycloak Admin API")
+	withItems := fs.Bool("data", true, "insert the demo items")
+	file := fs.String("items", getEnv("SEED_ITEMS_FILE", ""), "JSON array of items to load instead of the built-in demo items")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	reqs, err := loadSeedItems(*file)
+	if err != nil {
+		return err
+	}
+	var wait []string
+	if *withKeycloak {
+		wait = append(wait, "keycloak-server")
+	}
+	if *withItems && getEnv("STORAGE_BACKEND", storageMongo) == storageMongo {
+		wait = append(wait, "mongodb")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if err := initCommand(wait...); err != nil {
+		return err
+	}
+	if *withKeycloak {
+		if err := seedKeycloak(ctx, os.Stdout); err != nil {
+			return fmt.Errorf("keycloak: %w", err)
+		}
+	}
+	if !*withItems {
+		return nil
+	}
+	if err := initStore(); err != nil {
+		return err
+	}
+	return seedItems(ctx, os.Stdout, reqs)
+}
+
+// runRealm exports the realm to a file or imports one. It logs in as the
+// master realm administrator when KEYCLOAK_ADMIN_PASSWORD is set, which
+// can also create a missing realm, and as the app's service account
+// otherwise.
+func runRealm(fs *flag.FlagSet, args []string) error {
+	file := fs.String("file", "-", "file to write the export to or read the import from")
+	ifExists := fs.String("if-exists", "skip", "import: what to do with users, clients, groups and roles that exist (fail, skip or overwrite)")
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		return errors.New("usage: realm export|import [-file realm.json] [-if-exists skip]")
+	}
+	action := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	switch *ifExists {
+	case "fail", "skip", "overwrite":
+	default:
+		return fmt.Errorf("-if-exists: want fail, skip or overwrite, not %q", *ifExists)
+	}
+	if err := initCommand("keycloak-server"); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	call, create := adminCall(keycloakAdmin), adminCall(serviceAccountCreate)
+	if secrets.Get("KEYCLOAK_ADMIN_PASSWORD", "") != "" {
+		var err error
+		if call, create, err = masterAdmin(ctx); err != nil {
+			return err
+		}
+	}
+
+	if action == "export" {
+		rep, err := exportRealm(ctx, call)
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(rep, "", "  ")
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if *file == "-" {
+			_, err = os.Stdout.Write(b)
+			return err
+		}
+		return os.WriteFile(*file, b, 0o600)
+	}
+
+	var b []byte
+	var err error
+	if *file == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+	var rep map[string]interface{}
+	if err := json.Unmarshal(b, &rep); err != nil {
+		return fmt.Errorf("%s: %w", *file, err)
+	}
+	result, err := importRealm(ctx, call, create, rep, *ifExists)
+	if err != nil {
+		return err
+	}
+	if result.Created {
+		fmt.Println("realm created")
+		return nil
+	}
+	for _, r := range result.Results {
+		fmt.Printf("%-11s %-16s %s\n", r.Action, r.ResourceType, r.ResourceName)
+	}
+	fmt.Printf("%d added, %d overwritten, %d skipped\n", result.Added, result.Overwritten, result.Skipped)
+	return nil
+}
+
+// runHealthcheck asks a running instance whether it is ready, for a Docker
+// HEALTHCHECK. It reads nothing but PORT and the TLS settings, so it works
+// in the container without the app's secrets.
+func runHealthcheck(fs *flag.FlagSet, args []string) error {
+	scheme := "http"
+	if os.Getenv("TLS_CERT_FILE") != "" || os.Getenv("TLS_AUTOCERT_DOMAINS") != "" {
+		scheme = "https"
+	}
+	defaultURL := fmt.Sprintf("%s://127.0.0.1:%s/readyz", scheme, getEnv("PORT", "3000"))
+	url := fs.String("url", defaultURL, "readiness endpoint to probe")
+	timeout := fs.Duration("timeout", 3*time.Second, "give up after this long")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// The certificate names the public host, not 127.0.0.1, and the probe
+	// only needs the status code. It has no client certificate, so it
+	// fails against TLS_CLIENT_AUTH=require.
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	resp, err := client.Get(*url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", *url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"strings"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/compress"
+)
+
+// compression returns middleware that compresses responses with brotli,
+// gzip or deflate, whichever the client accepts first in that order.
+// Bodies under 200 bytes are sent as is. Streamed responses such as the
+// export are compressed as they stream.
+//
+//	COMPRESSION_LEVEL off, speed, default or best (default "default")
+func compression() fiber.Handler {
+	levels := map[string]compress.Level{
+		"off":     compress.LevelDisabled,
+		"speed":   compress.LevelBestSpeed,
+		"default": compress.LevelDefault,
+		"best":    compress.LevelBestCompression,
+	}
+	name := getEnv("COMPRESSION_LEVEL", "default")
+	level, ok := levels[name]
+	if !ok {
+		log.Printf("Unknown COMPRESSION_LEVEL %q, using default", name)
+	}
+	return compress.New(compress.Config{
+		Level: level,
+		Next:  websocket.IsWebSocketUpgrade,
+	})
+}
+
+// conditionalGet returns middleware that tags successful GET and HEAD
+// responses with a weak ETag, a hash of the uncompressed body, and
+// answers a matching If-None-Match with 304 Not Modified. The tag is weak
+// because the compressed bytes differ from what it was computed on.
+// Fiber's etag middleware isn't used because it reads streamed bodies
+// into memory; those are skipped here.
+//
+//	ETAG_ENABLED default true
+func conditionalGet() fiber.Handler {
+	if !getEnvBool("ETAG_ENABLED", true) {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+	return func(c *fiber.Ctx) error {
+		if c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead {
+			return c.Next()
+		}
+		if err := c.Next(); err != nil {
+			return err
+		}
+		resp := c.Response()
+		if resp.StatusCode() != fiber.StatusOK || resp.IsBodyStream() || len(resp.Header.Peek(fiber.HeaderETag)) > 0 {
+			return nil
+		}
+		body := resp.Body()
+		if len(body) == 0 {
+			return nil
+		}
+		sum := sha256.Sum256(body)
+		tag := `W/"` + base64.RawURLEncoding.EncodeToString(sum[:12]) + `"`
+		c.Set(fiber.HeaderETag, tag)
+		if etagMatches(c.Get(fiber.HeaderIfNoneMatch), tag) {
+			c.Context().ResetBody()
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+		return nil
+	}
+}
+
+// etagMatches applies the weak comparison of If-None-Match (RFC 9110
+// section 13.1.2) to a list of tags or "*".
+func etagMatches(header, tag string) bool {
+	if header == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	opaque := strings.TrimPrefix(tag, "W/")
+	for _, t := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == opaque {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getEnv returns the value of key, or fallback when it is unset or empty.
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// getEnvBool parses key as a boolean, returning fallback when unset or invalid.
+func getEnvBool(key string, fallback bool) bool {
+	if b, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return b
+	}
+	return fallback
+}
+
+// getEnvInt parses key as an integer, returning fallback when unset or invalid.
+func getEnvInt(key string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return n
+	}
+	return fallback
+}
+
+// getEnvDuration parses key as a positive duration, returning fallback when
+// unset or invalid.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// getEnvList splits a comma-separated value, dropping empty entries.
+func getEnvList(key string, fallback []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	return splitList(v)
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// appEnv names the deployment environment, e.g. "development" or "production".
+func appEnv() string {
+	return strings.ToLower(getEnv("APP_ENV", "development"))
+}
+
+// keycloakIssuer is the realm issuer URL tokens are minted by.
+func keycloakIssuer() string {
+	return getEnv("KEYCLOAK_ISSUER", "http://localhost:8080/realms/demo-realm")
+}
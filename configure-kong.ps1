@@ -9,7 +9,8 @@ param(
   [string]$KongAdminUrl     = "http://localhost:8001",  # Kong Admin API
   [string]$GatewayUrl       = "http://localhost:8081",  # Kong proxy for clients
   [string]$KeycloakIssuer   = "http://keycloak:8080/realms/demo-realm",
-  [string]$AppName          = "go-app-service"
+  [string]$AppName          = "go-app-service",
+  [switch]$EnforcePolicy                                # Attach keycloak-authz too
 )
 
 function Decode-Base64Url {
@@ -157,6 +158,16 @@ Invoke-RestMethod -Method Post -Uri "$KongAdminUrl/services/$AppName/routes" `
   -Body (@{ name = "public-route"; paths = @("/public"); strip_path = $false } | ConvertTo-Json) `
   -ContentType "application/json"
 
+# 6b'') Embedded frontend (SPA_ENABLED); public, it sends its token to the API routes
+Invoke-RestMethod -Method Post -Uri "$KongAdminUrl/services/$AppName/routes" `
+  -Body (@{ name = "app-route"; paths = @("/app"); strip_path = $false } | ConvertTo-Json) `
+  -ContentType "application/json"
+
+# 6b') SCIM provisioning (its own bearer token, SCIM_TOKEN, instead of JWT)
+Invoke-RestMethod -Method Post -Uri "$KongAdminUrl/services/$AppName/routes" `
+  -Body (@{ name = "scim-route"; paths = @("/scim"); strip_path = $false } | ConvertTo-Json) `
+  -ContentType "application/json"
+
 # 6c) Protected endpoints
 @("profile","user","admin") | ForEach-Object {
   Invoke-RestMethod -Method Post -Uri "$KongAdminUrl/services/$AppName/routes" `
@@ -187,6 +198,23 @@ Write-Host "`n🔌 Securing protected routes with JWT…" -ForegroundColor Cyan
     -ContentType "application/json"
 }
 
+# 8a) TAG EVERY REQUEST WITH AN X-Request-ID THE APP REUSES, SO GATEWAY AND APP LOGS LINE UP
+$correlation = @{ name = "correlation-id"; config = @{ header_name = "X-Request-ID"; generator = "uuid"; echo_downstream = $true } }
+Invoke-RestMethod -Method Post -Uri "$KongAdminUrl/services/$AppName/plugins" `
+  -Body ($correlation | ConvertTo-Json -Depth 5) `
+  -ContentType "application/json"
+
+# 8b) OPTIONALLY ENFORCE THE POLICY FILE AT THE GATEWAY
+if ($EnforcePolicy) {
+  Write-Host "`n🛡️  Attaching keycloak-authz plugin to protected routes…" -ForegroundColor Cyan
+  $authz = @{ name = "keycloak-authz"; config = @{ policy_file = "/etc/kong/policy.json"; runtime_config_file = "/etc/kong/runtime.json" } }
+  @("profile-route","user-route","admin-route") | ForEach-Object {
+    Invoke-RestMethod -Method Post -Uri "$KongAdminUrl/routes/$_/plugins" `
+      -Body ($authz | ConvertTo-Json -Depth 5) `
+      -ContentType "application/json"
+  }
+}
+
 # 9) FINAL SUMMARY
 Write-Host "`n🎉 All done! Kong gateway is live on $GatewayUrl" -ForegroundColor Green
 Write-Host "  • Login:         $GatewayUrl/login"
@@ -8,6 +8,8 @@ KONG_ADMIN_URL="http://localhost:8001"
 KEYCLOAK_CERTS_URL="http://localhost:8080/realms/demo-realm/protocol/openid-connect/certs"
 APP_NAME="go-app-service"
 KEYCLOAK_ISSUER="http://localhost:8080/realms/demo-realm"
+# Set KONG_AUTHZ=true to also enforce the policy file at the gateway
+KONG_AUTHZ="${KONG_AUTHZ:-false}"
 
 # --- Script Body ---
 
@@ -76,6 +78,16 @@ curl -s -X POST "$KONG_ADMIN_URL/services/$APP_NAME/routes" \
   --header 'Content-Type: application/json' \
   --data '{"name":"admin-route","paths":["/admin"],"strip_path":false}'
 
+# The embedded frontend (SPA_ENABLED) is public; it sends its token to the API routes
+curl -s -X POST "$KONG_ADMIN_URL/services/$APP_NAME/routes" \
+  --header 'Content-Type: application/json' \
+  --data '{"name":"app-route","paths":["/app"],"strip_path":false}'
+
+# SCIM provisioning authenticates with its own bearer token (SCIM_TOKEN), not a Keycloak JWT
+curl -s -X POST "$KONG_ADMIN_URL/services/$APP_NAME/routes" \
+  --header 'Content-Type: application/json' \
+  --data '{"name":"scim-route","paths":["/scim"],"strip_path":false}'
+
 # 6) Create Consumer
 echo "\n👤 Creating Consumer 'keycloak-users'…"
 curl -s -X POST "$KONG_ADMIN_URL/consumers" \
@@ -101,8 +113,22 @@ curl -s -X POST "$KONG_ADMIN_URL/routes/profile-route/plugins" --header 'Content
 curl -s -X POST "$KONG_ADMIN_URL/routes/user-route/plugins" --header 'Content-Type: application/json' --data '{"name":"jwt"}'
 curl -s -X POST "$KONG_ADMIN_URL/routes/admin-route/plugins" --header 'Content-Type: application/json' --data '{"name":"jwt"}'
 
+# 8b) Tag every request with an X-Request-ID the app reuses, so gateway and app logs line up
+curl -s -X POST "$KONG_ADMIN_URL/services/$APP_NAME/plugins" --header 'Content-Type: application/json' \
+  --data '{"name":"correlation-id","config":{"header_name":"X-Request-ID","generator":"uuid","echo_downstream":true}}'
+
+# 9) Optionally enforce the policy file at the gateway
+if [ "$KONG_AUTHZ" = "true" ]; then
+  echo "\n🛡️  Attaching keycloak-authz plugin to protected routes…"
+  for route in profile-route user-route admin-route; do
+    curl -s -X POST "$KONG_ADMIN_URL/routes/$route/plugins" --header 'Content-Type: application/json' \
+      --data '{"name":"keycloak-authz","config":{"policy_file":"/etc/kong/policy.json","runtime_config_file":"/etc/kong/runtime.json"}}'
+  done
+fi
+
 echo "\n🎉 Done! Kong is configured:"
 echo "   • http://localhost:8081/public  → no auth"
+echo "   • http://localhost:8081/app     → frontend, no auth (SPA_ENABLED)"
 echo "   • http://localhost:8081/profile → JWT required"
 echo "   • http://localhost:8081/user    → JWT required"
 echo "   • http://localhost:8081/admin   → JWT required"
\ No newline at end of file
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+)
+
+// devOrigins are allowed by default outside production so a locally
+// served SPA can call the API and Kong without extra setup.
+var devOrigins = []string{
+	"http://localhost:3000",
+	"http://localhost:5173",
+	"http://localhost:8081",
+}
+
+// corsKey returns CORS_<GROUP>_<NAME> when that variable is set and the
+// global CORS_<NAME> otherwise.
+func corsKey(group, name string) string {
+	if k := "CORS_" + group + "_" + name; group != "" && os.Getenv(k) != "" {
+		return k
+	}
+	return "CORS_" + name
+}
+
+// validateCORSOrigins rejects a wildcard for groups that allow
+// credentials, which would let any site make authenticated calls.
+func validateCORSOrigins(group string, origins []string) error {
+	if !getEnvBool(corsKey(strings.ToUpper(group), "ALLOW_CREDENTIALS"), false) {
+		return nil
+	}
+	for _, o := range origins {
+		if o == "*" {
+			return fmt.Errorf("CORS %s: credentials cannot be combined with a wildcard origin", strings.ToLower(group))
+		}
+	}
+	return nil
+}
+
+// newCORS builds the CORS middleware for a route group such as "API" or
+// "DOCS". Each setting can be overridden per group, e.g.
+// CORS_API_ALLOWED_ORIGINS, and otherwise comes from the global CORS_*
+// variables. The allowed origins can also be replaced at runtime through
+// corsOrigins in the runtime config; with no allowed origins the
+// middleware adds no CORS headers.
+func newCORS(group string) fiber.Handler {
+	return cors.New(cors.Config{
+		AllowOriginsFunc: originChecker(group),
+		AllowMethods:     "GET,POST,PUT,PATCH,DELETE,OPTIONS",
+		AllowHeaders:     "Authorization,Content-Type,Accept,X-Request-ID,Idempotency-Key,If-None-Match,X-Consistency-Token,traceparent,tracestate",
+		ExposeHeaders:    "API-Version,Deprecation,Sunset,Link,Location,X-Request-ID,Idempotent-Replayed,ETag,X-Quota-Limit,X-Quota-Remaining,X-Quota-Reset,X-Consistency-Token",
+		AllowCredentials: getEnvBool(corsKey(group, "ALLOW_CREDENTIALS"), false),
+		MaxAge:           getEnvInt(corsKey(group, "MAX_AGE"), 600),
+	})
+}
+
+// originChecker reports whether an origin is allowed for the group, from
+// the runtime config if it sets the group's origins and from the
+// environment otherwise.
+func originChecker(group string) func(origin string) bool {
+	defaults := devOrigins
+	if appEnv() == "production" {
+		defaults = nil
+	}
+	envOrigins := getEnvList(corsKey(group, "ALLOWED_ORIGINS"), defaults)
+	if err := validateCORSOrigins(group, envOrigins); err != nil {
+		log.Fatal(err)
+	}
+
+	origins := func() []string {
+		if cfg := currentRuntime.Load(); cfg != nil {
+			if o, ok := cfg.CORSOrigins[strings.ToLower(group)]; ok {
+				return o
+			}
+		}
+		return envOrigins
+	}
+	return func(origin string) bool {
+		for _, o := range origins() {
+			if o == "*" || strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// useCORS mounts the group's CORS middleware on prefix.
+func useCORS(r fiber.Router, prefix, group string) {
+	r.Use(prefix, newCORS(group))
+}
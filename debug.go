@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/pprof"
+)
+
+// buildVersion is stamped at build time with
+// -ldflags "-X main.buildVersion=1.2.3".
+var buildVersion = "dev"
+
+var startedAt = time.Now()
+
+// mountDebug exposes the diagnostics endpoints under /debug for the admin
+// role when DEBUG_ENABLED is set. DEBUG_ADDR (for example
+// "127.0.0.1:6060") serves them without authentication on a separate
+// listener, which must only be reachable from inside the deployment.
+func mountDebug(app *fiber.App) {
+	if getEnvBool("DEBUG_ENABLED", false) {
+		registerDebugRoutes(app.Group("/debug", requireRole("admin")))
+		log.Println("Diagnostics enabled under /debug for the admin role")
+	}
+	if addr := os.Getenv("DEBUG_ADDR"); addr != "" {
+		internal := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler, DisableStartupMessage: true})
+		registerDebugRoutes(internal.Group("/debug"))
+		go func() {
+			log.Println("Starting diagnostics server on", addr)
+			if err := internal.Listen(addr); err != nil {
+				log.Println("Diagnostics server stopped:", err)
+			}
+		}()
+	}
+}
+
+// registerDebugRoutes adds the pprof profiles, a full goroutine dump and
+// build/runtime info to r, which must be mounted at /debug.
+func registerDebugRoutes(r fiber.Router) {
+	r.Use(pprof.New())
+	r.Get("/goroutines", goroutinesHandler)
+	r.Get("/info", debugInfoHandler)
+}
+
+// goroutinesHandler dumps every goroutine's stack as text, growing the
+// buffer until the dump fits.
+func goroutinesHandler(c *fiber.Ctx) error {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+			return c.Send(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+func debugInfoHandler(c *fiber.Ctx) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	build := fiber.Map{"version": buildVersion}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		build["goVersion"] = bi.GoVersion
+		build["module"] = bi.Main.Path
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				build[s.Key] = s.Value
+			}
+		}
+	}
+	return c.JSON(fiber.Map{
+		"build":     build,
+		"startedAt": startedAt.UTC(),
+		"uptime":    time.Since(startedAt).Round(time.Second).String(),
+		"runtime": fiber.Map{
+			"goroutines": runtime.NumGoroutine(),
+			"gomaxprocs": runtime.GOMAXPROCS(0),
+			"numCPU":     runtime.NumCPU(),
+			"heapAlloc":  mem.HeapAlloc,
+			"heapSys":    mem.HeapSys,
+			"numGC":      mem.NumGC,
+			"pauseTotal": time.Duration(mem.PauseTotalNs).String(),
+		},
+		"authMode": authMode,
+		"appEnv":   appEnv(),
+	})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const denylistCollection = "denylist"
+
+// denylistEntry blocks every token of a subject, whatever its expiry,
+// until the entry is removed or ExpiresAt passes. With IssuedBefore it
+// only blocks the tokens issued up to then, as after a logout. An entry
+// whose Subject is "jti:" and a token ID only blocks that token.
+type denylistEntry struct {
+	Subject      string     `bson:"_id" json:"subject"`
+	Reason       string     `bson:"reason" json:"reason"`
+	CreatedBy    string     `bson:"createdBy" json:"createdBy"`
+	CreatedAt    time.Time  `bson:"createdAt" json:"createdAt"`
+	ExpiresAt    *time.Time `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	IssuedBefore *time.Time `bson:"issuedBefore,omitempty" json:"issuedBefore,omitempty"`
+}
+
+// denial is how the entry applies to tokens.
+func (e denylistEntry) denial() keycloakauth.Denial {
+	return keycloakauth.Denial{ExpiresAt: e.ExpiresAt, IssuedBefore: e.IssuedBefore}
+}
+
+func (e denylistEntry) active(now time.Time) bool {
+	return e.denial().Active(now)
+}
+
+// denylistRequest is the body of PUT /admin/denylist/:subject. A zero TTL
+// denies the subject until the entry is deleted.
+type denylistRequest struct {
+	Reason string   `json:"reason" validate:"max=200"`
+	TTL    duration `json:"ttl"`
+}
+
+// denied is the in-memory copy of the denylist consulted on every
+// request. It is refreshed from the database every DENYLIST_REFRESH_INTERVAL so
+// entries added on other replicas apply there too.
+var denied atomic.Pointer[map[string]denylistEntry]
+
+var (
+	denylistMu       sync.Mutex // guards denylistWatchers and serializes updates of denied
+	denylistWatchers []func(subject string)
+)
+
+// denylistTokenPrefix starts the keys of the entries blocking a single
+// token by its jti.
+const denylistTokenPrefix = keycloakauth.DenylistTokenPrefix
+
+// isDenylisted reports whether an active denylist entry rejects the
+// token of claims. The decision is keycloakauth.Denied, which the
+// keycloak-authz Kong plugin applies to the same entries.
+func isDenylisted(claims jwt.MapClaims) bool {
+	m := denied.Load()
+	if m == nil {
+		return false
+	}
+	return keycloakauth.Denied(claims, time.Now(), func(key string) (keycloakauth.Denial, bool) {
+		e, ok := (*m)[key]
+		return e.denial(), ok
+	})
+}
+
+// issuedAt returns the iat claim, or the zero time without one.
+func issuedAt(claims jwt.MapClaims) time.Time {
+	return claimTime(claims, "iat")
+}
+
+// claimTime reads a NumericDate claim, or the zero time without one.
+func claimTime(claims jwt.MapClaims, name string) time.Time {
+	return keycloakauth.ClaimTime(claims, name)
+}
+
+// onDenylisted registers fn to run when a subject becomes denylisted, or
+// its entry is replaced, so long-lived connections can be closed right
+// away.
+func onDenylisted(fn func(subject string)) {
+	denylistMu.Lock()
+	defer denylistMu.Unlock()
+	denylistWatchers = append(denylistWatchers, fn)
+}
+
+// updateDenylist applies edit to a copy of the denylist, swaps the copy
+// in and notifies watchers of newly denied subjects.
+func updateDenylist(edit func(m map[string]denylistEntry)) {
+	denylistMu.Lock()
+	old := denied.Load()
+	m := map[string]denylistEntry{}
+	if old != nil {
+		for k, v := range *old {
+			m[k] = v
+		}
+	}
+	edit(m)
+	denied.Store(&m)
+	watchers := append([]func(string){}, denylistWatchers...)
+	denylistMu.Unlock()
+
+	for sub, e := range m {
+		if old != nil {
+			if prev, seen := (*old)[sub]; seen && prev.CreatedAt.Equal(e.CreatedAt) {
+				continue
+			}
+		}
+		for _, fn := range watchers {
+			fn(sub)
+		}
+	}
+}
+
+// denylistChange is what an instance publishes on the Redis channel
+// <CACHE_PREFIX>denylist after changing the denylist, so the other
+// instances apply it within moments instead of on their next refresh.
+type denylistChange struct {
+	Entry   *denylistEntry `json:"entry,omitempty"`
+	Deleted string         `json:"deleted,omitempty"`
+}
+
+func denylistChannel() string {
+	return cachePrefix + "denylist"
+}
+
+func (ch denylistChange) apply() {
+	updateDenylist(func(m map[string]denylistEntry) {
+		if ch.Entry != nil {
+			m[ch.Entry.Subject] = *ch.Entry
+		} else {
+			delete(m, ch.Deleted)
+		}
+	})
+}
+
+// changeDenylist applies ch locally and broadcasts it. The entry must
+// already be stored.
+func changeDenylist(ctx context.Context, ch denylistChange) {
+	ch.apply()
+	client := cacheClient.Load()
+	if client == nil {
+		return
+	}
+	body, err := json.Marshal(ch)
+	if err == nil {
+		err = client.Publish(ctx, denylistChannel(), body).Err()
+	}
+	if err != nil {
+		log.Println("Denylist change not broadcast, other instances apply it on refresh:", err)
+	}
+}
+
+// watchDenylistChanges applies the changes other instances broadcast. It
+// subscribes again when the Redis client is replaced after a rotation.
+func watchDenylistChanges() {
+	check := time.NewTicker(30 * time.Second)
+	defer check.Stop()
+	for {
+		client := cacheClient.Load()
+		ps := client.Subscribe(context.Background(), denylistChannel())
+		msgs := ps.Channel()
+		for current := true; current; {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					current = false
+					break
+				}
+				var ch denylistChange
+				if err := json.Unmarshal([]byte(msg.Payload), &ch); err != nil {
+					log.Println("Ignoring malformed denylist change:", err)
+					continue
+				}
+				ch.apply()
+			case <-check.C:
+				current = cacheClient.Load() == client
+			}
+		}
+		_ = ps.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+func refreshDenylist(ctx context.Context) error {
+	entries, err := denylistDB.List(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	updateDenylist(func(m map[string]denylistEntry) {
+		for k := range m {
+			delete(m, k)
+		}
+		for _, e := range entries {
+			if e.active(now) {
+				m[e.Subject] = e
+			}
+		}
+	})
+	return nil
+}
+
+// initDenylist loads the denylist and keeps it fresh. A failed refresh
+// keeps the previous copy. With Redis, changes also arrive as they are
+// made.
+func initDenylist() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := refreshDenylist(ctx); err != nil {
+		log.Println("Denylist load failed:", err)
+	}
+
+	interval := 30 * time.Second
+	if d, err := time.ParseDuration(getEnv("DENYLIST_REFRESH_INTERVAL", "30s")); err == nil && d > 0 {
+		interval = d
+	}
+	if cacheClient.Load() != nil {
+		go watchDenylistChanges()
+	}
+	go func() {
+		for range time.Tick(interval) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := refreshDenylist(ctx); err != nil {
+				log.Println("Denylist refresh failed:", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// purgeDenylist deletes expired entries. They no longer match anything,
+// so this only keeps the collection small.
+func purgeDenylist(ctx context.Context) error {
+	n, err := denylistDB.DeleteExpired(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Purged %d expired denylist entries", n)
+	}
+	return refreshDenylist(ctx)
+}
+
+func registerDenylistRoutes(r fiber.Router) {
+	r.Get("/denylist", listDenylist)
+	r.Put("/denylist/:subject", putDenylist)
+	r.Delete("/denylist/:subject", deleteDenylist)
+}
+
+// mountDenylistFeed adds GET /hooks/denylist when DENYLIST_FEED_TOKEN is
+// set. The keycloak-authz Kong plugin polls it (config.denylist_url) to
+// turn denylisted tokens away at the gateway as the app does.
+func mountDenylistFeed(app *fiber.App) {
+	if secrets.Get("DENYLIST_FEED_TOKEN", "") == "" {
+		return
+	}
+	app.Get("/hooks/denylist", denylistFeedAuth, denylistFeed)
+}
+
+// denylistFeedAuth checks the bearer token the plugin is configured with
+// against DENYLIST_FEED_TOKEN.
+func denylistFeedAuth(c *fiber.Ctx) error {
+	want := secrets.Get("DENYLIST_FEED_TOKEN", "")
+	got, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if want == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return errUnauthorized("Invalid feed token")
+	}
+	return c.Next()
+}
+
+// denylistFeed lists the entries in force on this instance.
+func denylistFeed(c *fiber.Ctx) error {
+	now := time.Now()
+	entries := []denylistEntry{}
+	if m := denied.Load(); m != nil {
+		for _, e := range *m {
+			if e.active(now) {
+				entries = append(entries, e)
+			}
+		}
+	}
+	return c.JSON(fiber.Map{"entries": entries})
+}
+
+func listDenylist(c *fiber.Ctx) error {
+	entries, err := denylistDB.List(c.UserContext())
+	if err != nil {
+		return errDatabase(err)
+	}
+	return c.JSON(fiber.Map{"entries": entries})
+}
+
+func putDenylist(c *fiber.Ctx) error {
+	var req denylistRequest
+	if err := bindBody(c, &req); err != nil {
+		return err
+	}
+	if req.TTL < 0 {
+		return errValidation([]fieldError{{Field: "ttl", Rule: "min", Message: "must not be negative"}})
+	}
+	e := denylistEntry{
+		Subject:   c.Params("subject"),
+		Reason:    req.Reason,
+		CreatedBy: subject(c),
+		CreatedAt: time.Now().UTC(),
+	}
+	if req.TTL > 0 {
+		exp := e.CreatedAt.Add(time.Duration(req.TTL))
+		e.ExpiresAt = &exp
+	}
+	if err := denylistDB.Put(c.UserContext(), e); err != nil {
+		return errDatabase(err)
+	}
+
+	// Apply everywhere right away rather than on the next refresh.
+	changeDenylist(c.UserContext(), denylistChange{Entry: &e})
+	log.Printf("Subject %s denylisted by %s: %s", e.Subject, e.CreatedBy, e.Reason)
+	recordAudit(c, "denylist.add", e.Subject, bson.M{"reason": e.Reason, "expiresAt": e.ExpiresAt})
+	return c.JSON(e)
+}
+
+func deleteDenylist(c *fiber.Ctx) error {
+	sub := c.Params("subject")
+	found, err := denylistDB.Delete(c.UserContext(), sub)
+	if err != nil {
+		return errDatabase(err)
+	}
+	if !found {
+		return newProblem(fiber.StatusNotFound, problemAboutBlank, "Subject is not denylisted")
+	}
+	changeDenylist(c.UserContext(), denylistChange{Deleted: sub})
+	recordAudit(c, "denylist.remove", sub, nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
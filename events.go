@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// Event types, suffixed to EVENTS_TYPE_PREFIX.
+const (
+	eventItemCreated     = "item.created"
+	eventItemUpdated     = "item.updated"
+	eventItemDeleted     = "item.deleted"
+	eventAuthDenied      = "auth.denied"
+	eventAuthAnomaly     = "auth.anomaly"
+	eventAuthUnpinnedKey = "auth.unpinned_key"
+)
+
+// cloudEvent is a CloudEvents 1.0 envelope in structured JSON mode.
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+	// name is the unprefixed type, used for NATS subjects.
+	name string
+}
+
+// eventPublisher delivers envelopes to a broker.
+type eventPublisher interface {
+	Publish(ctx context.Context, e cloudEvent) error
+}
+
+// natsPublisher publishes each event on <prefix>.<type>, e.g.
+// "fiberdemo.item.created".
+type natsPublisher struct {
+	conn   *nats.Conn
+	prefix string
+}
+
+func (p *natsPublisher) Publish(_ context.Context, e cloudEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(p.prefix + "." + e.name)
+	msg.Header.Set("Content-Type", "application/cloudevents+json")
+	// JetStream drops a message it has seen within its duplicate window,
+	// which makes a republished outbox entry harmless.
+	msg.Header.Set("Nats-Msg-Id", e.ID)
+	msg.Data = b
+	return p.conn.PublishMsg(msg)
+}
+
+// kafkaPublisher writes every event to one topic keyed by the CloudEvents
+// subject, so events about the same item stay ordered.
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, e cloudEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return p.writer.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(e.Subject),
+		Value:   b,
+		Headers: []kafka.Header{{Key: "content-type", Value: []byte("application/cloudevents+json")}},
+	})
+}
+
+var (
+	events       chan cloudEvent
+	eventsPub    eventPublisher
+	eventsSource string
+	eventsPrefix string
+)
+
+// initEvents connects the broker chosen by EVENTS_BACKEND ("nats" or
+// "kafka"; unset disables events). Publishing is asynchronous through a
+// buffer of EVENTS_BUFFER events (default 1024) so a slow broker never
+// holds up requests; events are dropped and logged when it is full.
+func initEvents() error {
+	eventsSource = getEnv("EVENTS_SOURCE", "/fiber-demo")
+	eventsPrefix = getEnv("EVENTS_TYPE_PREFIX", "com.example.fiberdemo.")
+	var pub eventPublisher
+	switch backend := getEnv("EVENTS_BACKEND", ""); backend {
+	case "":
+		return nil
+	case "nats":
+		opts := []nats.Option{nats.Name("fiber-demo")}
+		tlsCfg, err := upstreamTLSConfig("NATS")
+		if err != nil {
+			return err
+		}
+		if tlsCfg != nil {
+			opts = append(opts, nats.Secure(tlsCfg))
+		}
+		conn, err := nats.Connect(secrets.Get("EVENTS_NATS_URL", nats.DefaultURL), opts...)
+		if err != nil {
+			return fmt.Errorf("NATS connect: %w", err)
+		}
+		pub = &natsPublisher{conn: conn, prefix: getEnv("EVENTS_NATS_SUBJECT_PREFIX", "fiberdemo")}
+	case "kafka":
+		tlsCfg, err := upstreamTLSConfig("KAFKA")
+		if err != nil {
+			return err
+		}
+		pub = &kafkaPublisher{writer: &kafka.Writer{
+			Addr:         kafka.TCP(getEnvList("EVENTS_KAFKA_BROKERS", []string{"localhost:9092"})...),
+			Topic:        getEnv("EVENTS_KAFKA_TOPIC", "fiber-demo.events"),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			Transport:    &kafka.Transport{TLS: tlsCfg},
+		}}
+	default:
+		return fmt.Errorf("unknown EVENTS_BACKEND %q", backend)
+	}
+
+	eventsPub = pub
+	events = make(chan cloudEvent, getEnvInt("EVENTS_BUFFER", 1024))
+	go func() {
+		for e := range events {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := pub.Publish(ctx, e); err != nil {
+				log.Printf("Event %s (%s) not published: %v", e.ID, e.Type, err)
+			}
+			cancel()
+		}
+	}()
+	log.Println("Publishing events to", getEnv("EVENTS_BACKEND", ""))
+	return nil
+}
+
+// emitEvent queues an event for the broker and the matching webhooks
+// without blocking. It is a no-op when both are disabled.
+func emitEvent(name, subject string, data interface{}) {
+	if eventsWanted() {
+		publishEvent(newEvent(name, subject, data))
+	}
+}
+
+// eventsWanted reports whether anything receives events.
+func eventsWanted() bool {
+	return events != nil || webhooksEnabled
+}
+
+func newEvent(name, subject string, data interface{}) cloudEvent {
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              uuid.NewString(),
+		Source:          eventsSource,
+		Type:            eventsPrefix + name,
+		Subject:         subject,
+		Time:            time.Now().UTC(),
+		DataContentType: fiber.MIMEApplicationJSON,
+		Data:            data,
+		name:            name,
+	}
+}
+
+// publishEvent hands e to the webhooks and the broker buffer.
+func publishEvent(e cloudEvent) {
+	queueWebhooks(e)
+	if events == nil {
+		return
+	}
+	select {
+	case events <- e:
+	default:
+		log.Printf("Event buffer full, dropping %s for %s", e.Type, e.Subject)
+	}
+}
+
+// authDenial is the data of auth.denied events, for SIEM pipelines.
+type authDenial struct {
+	Status   int    `json:"status"`
+	Reason   string `json:"reason"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	ClientIP string `json:"clientIp"`
+	Subject  string `json:"subject,omitempty"`
+}
+
+// emitAuthDenied records a 401 or 403 answered over HTTP.
+func emitAuthDenied(c *fiber.Ctx, status int, reason string) {
+	if events == nil {
+		return
+	}
+	// The event outlives the request, whose buffers are reused.
+	d := authDenial{Status: status, Reason: reason, Method: c.Method(), Path: strings.Clone(c.Path()), ClientIP: strings.Clone(c.IP())}
+	if t, ok := keycloakauth.Cached(c); ok && t.Err == nil {
+		d.Subject, _ = t.Claims["sub"].(string)
+	}
+	emitEvent(eventAuthDenied, d.Subject, d)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// itemColumns are the item fields available to export and import, in
+// their default order. In CSV, tags are joined with ";".
+var itemColumns = []string{"id", "name", "description", "tags", "createdBy", "createdAt", "updatedAt"}
+
+// itemColumn returns the value of one column for NDJSON output.
+func itemColumn(it item, col string) interface{} {
+	switch col {
+	case "id":
+		return it.ID.Hex()
+	case "name":
+		return it.Name
+	case "description":
+		return string(it.Description)
+	case "tags":
+		return nonNilTags(it.Tags)
+	case "createdBy":
+		return string(it.CreatedBy)
+	case "createdAt":
+		return it.CreatedAt.Format(time.RFC3339)
+	case "updatedAt":
+		return it.UpdatedAt.Format(time.RFC3339)
+	}
+	return nil
+}
+
+// itemCSVColumn renders a column as a CSV field.
+func itemCSVColumn(it item, col string) string {
+	if col == "tags" {
+		return strings.Join(it.Tags, ";")
+	}
+	return fmt.Sprint(itemColumn(it, col))
+}
+
+// exportQuery holds the query parameters of the item export.
+type exportQuery struct {
+	Format    string `query:"format" validate:"omitempty,oneof=csv ndjson"`
+	Fields    string `query:"fields"`
+	Tag       string `query:"tag" validate:"max=30"`
+	CreatedBy string `query:"createdBy"`
+	Since     string `query:"since" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	Until     string `query:"until" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+}
+
+func registerExportRoutes(r fiber.Router) {
+	r.Get("/export/items", exportItems)
+}
+
+// parseColumns turns "name,tags" into a column list, defaulting to all
+// columns.
+func parseColumns(fields string) ([]string, error) {
+	if fields == "" {
+		return itemColumns, nil
+	}
+	var cols []string
+	for _, f := range strings.Split(fields, ",") {
+		f = strings.TrimSpace(f)
+		if itemColumn(item{}, f) == nil {
+			return nil, errValidation([]fieldError{{
+				Field:   "fields",
+				Rule:    "oneof",
+				Message: "unknown column " + f + "; must be one of: " + strings.Join(itemColumns, " "),
+			}})
+		}
+		cols = append(cols, f)
+	}
+	return cols, nil
+}
+
+var errClientGone = errors.New("client went away")
+
+// exportItems streams matching items as CSV (the default) or NDJSON. The
+// response is written as the store reads the items, so the export never
+// holds the collection in memory. Errors after the first byte can only be
+// logged.
+func exportItems(c *fiber.Ctx) error {
+	var q exportQuery
+	if err := bindQuery(c, &q); err != nil {
+		return err
+	}
+	cols, err := parseColumns(q.Fields)
+	if err != nil {
+		return err
+	}
+	if q.Format == "" {
+		q.Format = "csv"
+		if strings.Contains(c.Get(fiber.HeaderAccept), "ndjson") {
+			q.Format = "ndjson"
+		}
+	}
+
+	f := itemFilter{Tag: q.Tag, CreatedBy: q.CreatedBy}
+	f.CreatedSince, _ = time.Parse(time.RFC3339, q.Since)
+	f.CreatedUntil, _ = time.Parse(time.RFC3339, q.Until)
+
+	recordAudit(c, "items.export", q.Format, bson.M{"filter": c.Context().QueryArgs().String()})
+
+	name := "items-" + time.Now().UTC().Format("20060102T150405Z")
+	if q.Format == "ndjson" {
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+		name += ".ndjson"
+	} else {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		name += ".csv"
+	}
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+name+`"`)
+
+	// The export counts against its concurrency limit until it is sent.
+	release := holdConcurrencySlot(c)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer release()
+		// The stream outlives the handler, so it can't use a request context.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		defer cancel()
+		var write func(item) error
+		if q.Format == "ndjson" {
+			// Written field by field to keep the requested column order.
+			write = func(it item) error {
+				w.WriteByte('{')
+				for i, col := range cols {
+					if i > 0 {
+						w.WriteByte(',')
+					}
+					v, err := json.Marshal(itemColumn(it, col))
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(w, "%q:%s", col, v)
+				}
+				_, err := w.WriteString("}\n")
+				return err
+			}
+		} else {
+			cw := csv.NewWriter(w)
+			if err := cw.Write(cols); err != nil {
+				return
+			}
+			record := make([]string, len(cols))
+			write = func(it item) error {
+				for i, col := range cols {
+					record[i] = itemCSVColumn(it, col)
+				}
+				if err := cw.Write(record); err != nil {
+					return err
+				}
+				cw.Flush()
+				return cw.Error()
+			}
+		}
+
+		rows := 0
+		err := itemDB.Each(ctx, f, func(it item) error {
+			if err := write(it); err != nil {
+				return errClientGone
+			}
+			if rows++; rows%1000 == 0 {
+				if err := w.Flush(); err != nil {
+					return errClientGone
+				}
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errClientGone) {
+			log.Println("Export stopped:", err)
+		}
+		_ = w.Flush()
+	})
+	return nil
+}
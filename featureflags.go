@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/example/fiber-demo/internal/flags"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const flagsCollection = "flags"
+
+// initFlags loads the feature flags and refreshes them every
+// FLAGS_REFRESH_INTERVAL (default 30s). A failed load starts with every
+// flag off.
+func initFlags() {
+	var store flags.Store = mongoFlagStore{}
+	if !usesMongo() {
+		store = pgFlagStore{}
+	}
+	set := flags.NewSet(store)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := set.Refresh(ctx); err != nil {
+		log.Println("Feature flag load failed:", err)
+	}
+	flags.SetDefault(set)
+
+	interval := 30 * time.Second
+	if d, err := time.ParseDuration(getEnv("FLAGS_REFRESH_INTERVAL", "30s")); err == nil && d > 0 {
+		interval = d
+	}
+	go set.Watch(context.Background(), interval)
+}
+
+// flagCaller puts the token's subject, roles and groups in the user
+// context so handlers can call flags.IsEnabled(c.UserContext(), ...).
+func flagCaller(c *fiber.Ctx) error {
+	claims, err := parseToken(c)
+	if err != nil {
+		return c.Next()
+	}
+	caller := flags.Caller{}
+	caller.Subject, _ = claims["sub"].(string)
+	caller.Roles, _ = requestRoles(c)
+	if groups, ok := claims["groups"].([]interface{}); ok {
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				caller.Groups = append(caller.Groups, s)
+			}
+		}
+	}
+	c.SetUserContext(flags.WithCaller(c.UserContext(), caller))
+	return c.Next()
+}
+
+// myFlags returns every flag evaluated for the caller, for clients that
+// switch features themselves.
+func myFlags(c *fiber.Ctx) error {
+	if _, err := parseToken(c); err != nil {
+		return errUnauthorized(err.Error())
+	}
+	out := map[string]bool{}
+	if set := flags.Default(); set != nil {
+		caller, _ := flags.CallerFrom(c.UserContext())
+		for _, f := range set.All() {
+			out[f.Key] = f.For(caller)
+		}
+	}
+	return c.JSON(fiber.Map{"flags": out})
+}
+
+// flagRequest is the body of PUT /admin/flags/:key.
+type flagRequest struct {
+	Description string   `json:"description" validate:"max=200"`
+	Enabled     bool     `json:"enabled"`
+	Subjects    []string `json:"subjects" validate:"max=1000,dive,min=1"`
+	Roles       []string `json:"roles" validate:"max=50,dive,min=1"`
+	Groups      []string `json:"groups" validate:"max=50,dive,min=1"`
+	Percentage  int      `json:"percentage" validate:"min=0,max=100"`
+}
+
+var flagKey = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+func registerFlagRoutes(r fiber.Router) {
+	r.Get("/flags", listFlags)
+	r.Get("/flags/:key", getFlag)
+	r.Put("/flags/:key", putFlag)
+	r.Delete("/flags/:key", deleteFlag)
+}
+
+// refreshFlags applies an admin change locally right away rather than on
+// the next refresh.
+func refreshFlags(ctx context.Context) {
+	if err := flags.Default().Refresh(ctx); err != nil {
+		log.Println("Feature flag refresh failed:", err)
+	}
+}
+
+func listFlags(c *fiber.Ctx) error {
+	list, err := flags.Default().Store().List(c.UserContext())
+	if err != nil {
+		return errDatabase(err)
+	}
+	return c.JSON(fiber.Map{"flags": list})
+}
+
+func getFlag(c *fiber.Ctx) error {
+	list, err := flags.Default().Store().List(c.UserContext())
+	if err != nil {
+		return errDatabase(err)
+	}
+	for _, f := range list {
+		if f.Key == c.Params("key") {
+			return c.JSON(f)
+		}
+	}
+	return newProblem(fiber.StatusNotFound, problemAboutBlank, "No such flag")
+}
+
+func putFlag(c *fiber.Ctx) error {
+	key := c.Params("key")
+	if !flagKey.MatchString(key) {
+		return errValidation([]fieldError{{Field: "key", Rule: "pattern", Message: "must be 1-64 lowercase letters, digits, '.', '_' or '-'"}})
+	}
+	var req flagRequest
+	if err := bindBody(c, &req); err != nil {
+		return err
+	}
+	f := flags.Flag{
+		Key:         key,
+		Description: req.Description,
+		Enabled:     req.Enabled,
+		Subjects:    nonNilTags(req.Subjects),
+		Roles:       nonNilTags(req.Roles),
+		Groups:      nonNilTags(req.Groups),
+		Percentage:  req.Percentage,
+		UpdatedBy:   subject(c),
+		UpdatedAt:   time.Now().UTC(),
+	}
+	ctx := c.UserContext()
+	if err := flags.Default().Store().Put(ctx, f); err != nil {
+		return errDatabase(err)
+	}
+	refreshFlags(ctx)
+	recordAudit(c, "flag.put", key, bson.M{"enabled": f.Enabled, "percentage": f.Percentage})
+	return c.JSON(f)
+}
+
+func deleteFlag(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	found, err := flags.Default().Store().Delete(ctx, c.Params("key"))
+	if err != nil {
+		return errDatabase(err)
+	}
+	if !found {
+		return newProblem(fiber.StatusNotFound, problemAboutBlank, "No such flag")
+	}
+	refreshFlags(ctx)
+	recordAudit(c, "flag.delete", c.Params("key"), nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// mongoFlagStore keeps flags in the flags collection keyed by flag key.
+type mongoFlagStore struct{}
+
+func (mongoFlagStore) List(ctx context.Context) ([]flags.Flag, error) {
+	cur, err := db().Collection(flagsCollection).Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	out := []flags.Flag{}
+	if err := cur.All(ctx, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (mongoFlagStore) Put(ctx context.Context, f flags.Flag) error {
+	_, err := db().Collection(flagsCollection).ReplaceOne(ctx, bson.M{"_id": f.Key}, f, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (mongoFlagStore) Delete(ctx context.Context, key string) (bool, error) {
+	res, err := db().Collection(flagsCollection).DeleteOne(ctx, bson.M{"_id": key})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// pgFlagStore keeps flags in the flags table.
+type pgFlagStore struct{}
+
+func (pgFlagStore) List(ctx context.Context) ([]flags.Flag, error) {
+	rows, err := pg().Query(ctx, "SELECT key, description, enabled, subjects, roles, groups, percentage, updated_by, updated_at FROM flags ORDER BY key")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (flags.Flag, error) {
+		var f flags.Flag
+		err := row.Scan(&f.Key, &f.Description, &f.Enabled, &f.Subjects, &f.Roles, &f.Groups, &f.Percentage, &f.UpdatedBy, &f.UpdatedAt)
+		return f, err
+	})
+}
+
+func (pgFlagStore) Put(ctx context.Context, f flags.Flag) error {
+	_, err := pg().Exec(ctx, "INSERT INTO flags (key, description, enabled, subjects, roles, groups, percentage, updated_by, updated_at) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (key) DO UPDATE SET description = EXCLUDED.description, "+
+		"enabled = EXCLUDED.enabled, subjects = EXCLUDED.subjects, roles = EXCLUDED.roles, groups = EXCLUDED.groups, "+
+		"percentage = EXCLUDED.percentage, updated_by = EXCLUDED.updated_by, updated_at = EXCLUDED.updated_at",
+		f.Key, f.Description, f.Enabled, f.Subjects, f.Roles, f.Groups, f.Percentage, f.UpdatedBy, f.UpdatedAt)
+	return err
+}
+
+func (pgFlagStore) Delete(ctx context.Context, key string) (bool, error) {
+	tag, err := pg().Exec(ctx, "DELETE FROM flags WHERE key = $1", key)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
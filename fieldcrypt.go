@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Sensitive item fields are sealed with AES-256-GCM before they are
+// stored, so the database and its backups only hold ciphertext. The key
+// comes from the FIELD_ENCRYPTION_KEY secret; without it the fields are
+// stored in the clear. Values are stored as "enc1:<key id>:<base64>" and
+// anything without that prefix is read as plaintext, so existing data
+// stays readable and is encrypted on its next write.
+const sealedPrefix = "enc1:"
+
+type fieldKey struct {
+	id   string
+	aead cipher.AEAD
+	// nonceKey derives the nonce of deterministic encryption.
+	nonceKey []byte
+}
+
+// fieldKeyring holds the key new values are sealed with and every key
+// that can still open old ones (FIELD_ENCRYPTION_PREVIOUS_KEYS).
+type fieldKeyring struct {
+	current *fieldKey
+	byID    map[string]*fieldKey
+}
+
+var fieldKeys atomic.Pointer[fieldKeyring]
+
+func newFieldKey(encoded string) (*fieldKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("field encryption key: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("field encryption key must be 32 bytes, got %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	mac := hmac.New(sha256.New, raw)
+	mac.Write([]byte("fiber-demo deterministic nonce"))
+	return &fieldKey{id: hex.EncodeToString(sum[:4]), aead: aead, nonceKey: mac.Sum(nil)}, nil
+}
+
+func loadFieldKeys(current, previous string) (*fieldKeyring, error) {
+	if current == "" {
+		return nil, nil
+	}
+	ring := &fieldKeyring{byID: map[string]*fieldKey{}}
+	for i, encoded := range append([]string{current}, splitList(previous)...) {
+		k, err := newFieldKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			ring.current = k
+		}
+		ring.byID[k.id] = k
+	}
+	return ring, nil
+}
+
+// initFieldEncryption loads the keys and follows their rotation. A
+// rotated key only stays readable if it is added to
+// FIELD_ENCRYPTION_PREVIOUS_KEYS.
+func initFieldEncryption() error {
+	load := func() error {
+		ring, err := loadFieldKeys(secrets.Get("FIELD_ENCRYPTION_KEY", ""), secrets.Get("FIELD_ENCRYPTION_PREVIOUS_KEYS", ""))
+		if err != nil {
+			return err
+		}
+		fieldKeys.Store(ring)
+		return nil
+	}
+	if err := load(); err != nil {
+		return err
+	}
+	for _, name := range []string{"FIELD_ENCRYPTION_KEY", "FIELD_ENCRYPTION_PREVIOUS_KEYS"} {
+		secrets.Watch(name, func(string) {
+			if err := load(); err != nil {
+				log.Println("Keeping current field encryption keys:", err)
+			}
+		})
+	}
+	if fieldKeys.Load() != nil {
+		log.Println("Field-level encryption enabled for item descriptions and creators")
+	}
+	return nil
+}
+
+// seal encrypts plaintext with the current key. Deterministic sealing
+// derives the nonce from the plaintext, so equal values give equal
+// ciphertexts and can still be matched in queries.
+func (r *fieldKeyring) seal(plaintext string, deterministic bool) (string, error) {
+	return r.current.seal(plaintext, deterministic)
+}
+
+func (k *fieldKey) seal(plaintext string, deterministic bool) (string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if deterministic {
+		mac := hmac.New(sha256.New, k.nonceKey)
+		mac.Write([]byte(plaintext))
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedPrefix + k.id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+var errFieldKey = errors.New("encrypted field: no key to decrypt it; is FIELD_ENCRYPTION_PREVIOUS_KEYS complete?")
+
+// open decrypts a stored value; plaintext values are returned unchanged.
+func (r *fieldKeyring) open(stored string) (string, error) {
+	rest, ok := strings.CutPrefix(stored, sealedPrefix)
+	if !ok {
+		return stored, nil
+	}
+	id, data, _ := strings.Cut(rest, ":")
+	var k *fieldKey
+	if r != nil {
+		k = r.byID[id]
+	}
+	if k == nil {
+		return "", errFieldKey
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(data)
+	if err != nil || len(raw) < k.aead.NonceSize() {
+		return "", errors.New("encrypted field: malformed value")
+	}
+	plain, err := k.aead.Open(nil, raw[:k.aead.NonceSize()], raw[k.aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("encrypted field: %w", err)
+	}
+	return string(plain), nil
+}
+
+// sealValue seals s when encryption is enabled.
+func sealValue(s string, deterministic bool) (string, error) {
+	if ring := fieldKeys.Load(); ring != nil && s != "" {
+		return ring.seal(s, deterministic)
+	}
+	return s, nil
+}
+
+func marshalSealed(s string, deterministic bool) (bsontype.Type, []byte, error) {
+	sealed, err := sealValue(s, deterministic)
+	if err != nil {
+		return 0, nil, err
+	}
+	return bson.MarshalValue(sealed)
+}
+
+func unmarshalSealed(t bsontype.Type, data []byte) (string, error) {
+	if t == bsontype.Null {
+		return "", nil
+	}
+	stored, ok := bson.RawValue{Type: t, Value: data}.StringValueOK()
+	if !ok {
+		return "", fmt.Errorf("encrypted field: cannot decode %s as a string", t)
+	}
+	return fieldKeys.Load().open(stored)
+}
+
+// scanSealed reads a sealed column value for PostgreSQL.
+func scanSealed(src interface{}) (string, error) {
+	switch v := src.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return fieldKeys.Load().open(v)
+	case []byte:
+		return fieldKeys.Load().open(string(v))
+	}
+	return "", fmt.Errorf("encrypted field: cannot scan %T as a string", src)
+}
+
+// encryptedString is a string field sealed with a random nonce. It can't
+// be used in query filters.
+type encryptedString string
+
+func (s encryptedString) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return marshalSealed(string(s), false)
+}
+
+func (s *encryptedString) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	v, err := unmarshalSealed(t, data)
+	*s = encryptedString(v)
+	return err
+}
+
+func (s encryptedString) Value() (driver.Value, error) {
+	return sealValue(string(s), false)
+}
+
+func (s *encryptedString) Scan(src interface{}) error {
+	v, err := scanSealed(src)
+	*s = encryptedString(v)
+	return err
+}
+
+// searchableString is a string field sealed deterministically, so an
+// equality filter on a searchableString value matches it. Filters that
+// must also match values stored in the clear or under a previous key use
+// searchableForms instead.
+type searchableString string
+
+func (s searchableString) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return marshalSealed(string(s), true)
+}
+
+func (s *searchableString) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	v, err := unmarshalSealed(t, data)
+	*s = searchableString(v)
+	return err
+}
+
+func (s searchableString) Value() (driver.Value, error) {
+	return sealValue(string(s), true)
+}
+
+func (s *searchableString) Scan(src interface{}) error {
+	v, err := scanSealed(src)
+	*s = searchableString(v)
+	return err
+}
+
+// searchableForms are the values a searchableString holding s may be
+// stored as: s itself, written before encryption was enabled, and its
+// seal under each key of the ring.
+func searchableForms(s string) []string {
+	forms := []string{s}
+	ring := fieldKeys.Load()
+	if ring == nil || s == "" {
+		return forms
+	}
+	for _, k := range ring.byID {
+		if sealed, err := k.seal(s, true); err == nil {
+			forms = append(forms, sealed)
+		}
+	}
+	return forms
+}
+
+// openField returns a possibly sealed string taken from an untyped
+// document such as a job payload.
+func openField(v interface{}) string {
+	s, _ := v.(string)
+	plain, err := fieldKeys.Load().open(s)
+	if err != nil {
+		log.Println(err)
+	}
+	return plain
+}
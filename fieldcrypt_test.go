@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"slices"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func newTestFieldKey(t *testing.T) string {
+	t.Helper()
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// Items written in the clear or under a rotated key stay in their owner's
+// listing.
+func TestVisibleToMatchesEveryStoredForm(t *testing.T) {
+	old, current := newTestFieldKey(t), newTestFieldKey(t)
+	oldRing, err := loadFieldKeys(old, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	underOld, err := oldRing.seal("alice", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := loadFieldKeys(current, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fieldKeys.Store(ring)
+	defer fieldKeys.Store(nil)
+	underCurrent, err := ring.seal("alice", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter := mongoItemStore{}.filter(itemFilter{VisibleTo: &itemCaller{Subject: "alice"}})
+	or, _ := filter["$or"].(bson.A)
+	if len(or) < 2 {
+		t.Fatalf("filter %v", filter)
+	}
+	for _, cond := range or[:2] {
+		for field, v := range cond.(bson.M) {
+			forms, _ := v.(bson.M)["$in"].([]string)
+			for _, want := range []string{"alice", underOld, underCurrent} {
+				if !slices.Contains(forms, want) {
+					t.Errorf("%s: %v lacks %q", field, forms, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/example/fiber-demo/pkg/itemsrpc"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcRoute is the HTTP item route a method mirrors. Calls are authorized
+// as that request would be.
+type grpcRoute struct {
+	name   string // of the route's routeDoc
+	method string
+	item   bool // the path ends in the request's item ID
+}
+
+// grpcRoutes maps each method to its route. Methods missing here are
+// refused.
+var grpcRoutes = map[string]grpcRoute{
+	"ListItems":   {"listItems", fiber.MethodGet, false},
+	"StreamItems": {"listItems", fiber.MethodGet, false},
+	"GetItem":     {"getItem", fiber.MethodGet, true},
+	"CreateItem":  {"createItem", fiber.MethodPost, false},
+	"ReplaceItem": {"replaceItem", fiber.MethodPut, true},
+	"DeleteItem":  {"deleteItem", fiber.MethodDelete, true},
+}
+
+// path is the route's path under the default API version.
+func (r grpcRoute) path(req interface{}) string {
+	path := "/api/" + defaultAPIVersion + "/items"
+	if !r.item {
+		return path
+	}
+	var id string
+	switch in := req.(type) {
+	case *itemsrpc.GetRequest:
+		id = in.ID
+	case *itemsrpc.ReplaceRequest:
+		id = in.ID
+	case *itemsrpc.DeleteRequest:
+		id = in.ID
+	}
+	return path + "/" + id
+}
+
+type grpcClaimsKey struct{}
+
+// grpcAuthorize decodes the token from the "authorization" metadata the
+// same way the HTTP middleware does, then checks the call like a request
+// to the method's route: against the policy (even when the gateway
+// enforces it, as Kong only sees the gRPC method), the impersonation guard
+// and the route's roles and caller kind. req is nil for streams.
+func grpcAuthorize(ctx context.Context, fullMethod string, req interface{}) (context.Context, error) {
+	var header string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			header = v[0]
+		}
+	}
+	t := decodeToken(header)
+	if t.Err != nil {
+		grpcAuthDenied(ctx, fullMethod, fiber.StatusUnauthorized, t.Err.Error(), "")
+		return nil, status.Error(codes.Unauthenticated, t.Err.Error())
+	}
+	sub, _ := t.Claims["sub"].(string)
+	if t.RolesErr != nil {
+		grpcAuthDenied(ctx, fullMethod, fiber.StatusForbidden, "Cannot extract roles", sub)
+		return nil, status.Error(codes.PermissionDenied, "Cannot extract roles")
+	}
+	route, ok := grpcRoutes[fullMethod[strings.LastIndexByte(fullMethod, '/')+1:]]
+	doc, documented := routeDocs[route.name]
+	if !ok || !documented {
+		grpcAuthDenied(ctx, fullMethod, fiber.StatusForbidden, "Unknown method", sub)
+		return nil, status.Error(codes.PermissionDenied, "Unknown method")
+	}
+	reason := requestRefusal(t.Claims, t.Roles, route.method, route.path(req))
+	if reason == "" {
+		reason = doc.refusal(t.Claims, t.Roles)
+	}
+	if reason != "" {
+		grpcAuthDenied(ctx, fullMethod, fiber.StatusForbidden, reason, sub)
+		return nil, status.Error(codes.PermissionDenied, reason)
+	}
+	return context.WithValue(ctx, grpcClaimsKey{}, t.Claims), nil
+}
+
+// grpcAuthDenied emits the auth.denied event for a refused call, with the
+// full method as the path.
+func grpcAuthDenied(ctx context.Context, fullMethod string, code int, reason, sub string) {
+	d := authDenial{Status: code, Reason: reason, Method: "gRPC", Path: fullMethod, Subject: sub}
+	if p, ok := peer.FromContext(ctx); ok {
+		d.ClientIP, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+	emitEvent(eventAuthDenied, sub, d)
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcAuthorize(ctx, info.FullMethod, req)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcAuthorize(ss.Context(), info.FullMethod, nil)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authedStream{ServerStream: ss, ctx: ctx})
+}
+
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authedStream) Context() context.Context { return s.ctx }
+
+func grpcSubject(ctx context.Context) string {
+	claims, _ := ctx.Value(grpcClaimsKey{}).(jwt.MapClaims)
+	sub, _ := claims["sub"].(string)
+	return sub
+}
+
+// grpcItemCaller returns the caller for the item ownership checks.
+func grpcItemCaller(ctx context.Context) itemCaller {
+	claims, _ := ctx.Value(grpcClaimsKey{}).(jwt.MapClaims)
+	roles, _ := extractRoles(claims)
+	return newItemCaller(claims, roles)
+}
+
+// grpcError converts the *problem errors of the item store to statuses.
+func grpcError(err error) error {
+	var p *problem
+	if !errors.As(err, &p) {
+		return status.Error(codes.Internal, "Internal error")
+	}
+	code := codes.Internal
+	switch p.Status {
+	case fiber.StatusBadRequest, fiber.StatusUnprocessableEntity:
+		code = codes.InvalidArgument
+	case fiber.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case fiber.StatusForbidden:
+		code = codes.PermissionDenied
+	case fiber.StatusNotFound:
+		code = codes.NotFound
+	case fiber.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	}
+	msg := p.Detail
+	for _, fe := range p.Errors {
+		msg += "; " + fe.Field + ": " + fe.Message
+	}
+	return status.Error(code, msg)
+}
+
+// itemsService serves the items API over gRPC on top of the same store
+// functions as the HTTP handlers.
+type itemsService struct{}
+
+func toRPCItem(it item) *itemsrpc.Item {
+	return &itemsrpc.Item{
+		ID:          it.ID.Hex(),
+		Name:        it.Name,
+		Description: string(it.Description),
+		Tags:        it.Tags,
+		CreatedBy:   string(it.CreatedBy),
+		CreatedAt:   it.CreatedAt,
+		UpdatedAt:   it.UpdatedAt,
+	}
+}
+
+func rpcItemID(id string) (primitive.ObjectID, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return oid, grpcError(errItemNotFound())
+	}
+	return oid, nil
+}
+
+func rpcItemRequest(in itemsrpc.ItemInput) (itemRequest, error) {
+	req := itemRequest{Name: in.Name, Description: in.Description, Tags: in.Tags}
+	if err := validateStruct(req); err != nil {
+		return req, grpcError(err)
+	}
+	return req, nil
+}
+
+func rpcListQuery(in *itemsrpc.ListRequest) (listItemsQuery, error) {
+	q := listItemsQuery{Limit: in.Limit, Offset: in.Offset, Tag: in.Tag}
+	if err := validateStruct(q); err != nil {
+		return q, grpcError(err)
+	}
+	if q.Limit == 0 {
+		q.Limit = 20
+	}
+	return q, nil
+}
+
+func (itemsService) ListItems(ctx context.Context, in *itemsrpc.ListRequest) (*itemsrpc.ListResponse, error) {
+	q, err := rpcListQuery(in)
+	if err != nil {
+		return nil, err
+	}
+	items, err := findItems(ctx, grpcItemCaller(ctx), q)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &itemsrpc.ListResponse{Items: make([]itemsrpc.Item, 0, len(items)), Limit: q.Limit, Offset: q.Offset}
+	for _, it := range items {
+		resp.Items = append(resp.Items, *toRPCItem(it))
+	}
+	return resp, nil
+}
+
+func (itemsService) GetItem(ctx context.Context, in *itemsrpc.GetRequest) (*itemsrpc.Item, error) {
+	id, err := rpcItemID(in.ID)
+	if err != nil {
+		return nil, err
+	}
+	it, err := findItem(ctx, grpcItemCaller(ctx), id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toRPCItem(it), nil
+}
+
+func (itemsService) CreateItem(ctx context.Context, in *itemsrpc.ItemInput) (*itemsrpc.Item, error) {
+	req, err := rpcItemRequest(*in)
+	if err != nil {
+		return nil, err
+	}
+	it, err := insertItem(ctx, req, grpcSubject(ctx))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toRPCItem(it), nil
+}
+
+func (itemsService) ReplaceItem(ctx context.Context, in *itemsrpc.ReplaceRequest) (*itemsrpc.Item, error) {
+	id, err := rpcItemID(in.ID)
+	if err != nil {
+		return nil, err
+	}
+	req, err := rpcItemRequest(in.Item)
+	if err != nil {
+		return nil, err
+	}
+	it, err := updateItem(ctx, grpcItemCaller(ctx), id, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toRPCItem(it), nil
+}
+
+func (itemsService) DeleteItem(ctx context.Context, in *itemsrpc.DeleteRequest) (*itemsrpc.Empty, error) {
+	id, err := rpcItemID(in.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeItem(ctx, grpcItemCaller(ctx), id); err != nil {
+		return nil, grpcError(err)
+	}
+	return &itemsrpc.Empty{}, nil
+}
+
+func (itemsService) StreamItems(in *itemsrpc.ListRequest, stream itemsrpc.ItemStream) error {
+	q, err := rpcListQuery(&itemsrpc.ListRequest{Tag: in.Tag, Limit: 100})
+	if err != nil {
+		return err
+	}
+	caller := grpcItemCaller(stream.Context())
+	for {
+		items, err := findItems(stream.Context(), caller, q)
+		if err != nil {
+			return grpcError(err)
+		}
+		for _, it := range items {
+			if err := stream.Send(toRPCItem(it)); err != nil {
+				return err
+			}
+		}
+		if len(items) < q.Limit {
+			return nil
+		}
+		q.Offset += len(items)
+	}
+}
+
+// startGRPC serves the items service on GRPC_PORT when it is set, over TLS
+// (including client certificate checks) whenever the HTTP listener uses it.
+// Calls are authorized by the HTTP routes, so newApp must have run.
+func startGRPC() error {
+	port := os.Getenv("GRPC_PORT")
+	if port == "" {
+		return nil
+	}
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcUnaryAuth),
+		grpc.ChainStreamInterceptor(grpcStreamAuth),
+	}
+	tlsCfg, _, err := serverTLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsCfg != nil {
+		// gRPC needs HTTP/2 negotiated on every per-client config.
+		getConfig := tlsCfg.GetConfigForClient
+		tlsCfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg, err := getConfig(hello)
+			if err != nil {
+				return nil, err
+			}
+			cfg.NextProtos = []string{"h2"}
+			return cfg, nil
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer(opts...)
+	itemsrpc.RegisterItemsServer(s, itemsService{})
+	go func() {
+		log.Println("Starting gRPC server on port", port)
+		if err := s.Serve(ln); err != nil {
+			log.Println("gRPC server stopped:", err)
+		}
+	}()
+	return nil
+}
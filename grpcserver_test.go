@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/example/fiber-demo/pkg/itemsrpc"
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC calls are refused to the callers the mirrored HTTP routes refuse:
+// by their roles and caller kind, the policy and the impersonation guard.
+func TestGRPCAuthorizesLikeHTTPRoutes(t *testing.T) {
+	registerItemRoutes(fiber.New().Group("/api/v1"))
+	t.Cleanup(func() { currentPolicy.Store(nil); impersonationBlockDestructive = false })
+
+	robot := bearer(t, jwt.MapClaims{"sub": "u-robot", "client_id": "reporting-batch", "roles": []interface{}{"admin"}})
+	bob := bearer(t, jwt.MapClaims{"sub": "u-bob", "roles": []interface{}{"user"}})
+	alice := bearer(t, jwt.MapClaims{"sub": "u-alice", "roles": []interface{}{"admin"}})
+	impersonated := bearer(t, jwt.MapClaims{"sub": "u-bob", "roles": []interface{}{"admin"}, "impersonator": map[string]interface{}{"id": "u-alice"}})
+	stricter := &policy.Policy{Rules: []policy.Rule{
+		{Pattern: policy.Pattern{Methods: []string{"GET"}, Path: "/api/*/items/*"}, Roles: []string{"auditor"}},
+	}}
+	const id = "64b7f0c2a1b2c3d4e5f60718"
+	cases := []struct {
+		name         string
+		policy       *policy.Policy
+		guard        bool
+		method, auth string
+		req          interface{}
+		code         codes.Code
+		reason       string
+	}{
+		{"admin deletes", nil, false, "DeleteItem", alice, &itemsrpc.DeleteRequest{ID: id}, codes.OK, ""},
+		{"service account admin deletes", nil, false, "DeleteItem", robot, &itemsrpc.DeleteRequest{ID: id}, codes.PermissionDenied, "Service account tokens are not accepted here; sign in as a user"},
+		{"user deletes", nil, false, "DeleteItem", bob, &itemsrpc.DeleteRequest{ID: id}, codes.PermissionDenied, "Missing role: admin"},
+		{"impersonated delete", nil, true, "DeleteItem", impersonated, &itemsrpc.DeleteRequest{ID: id}, codes.PermissionDenied, impersonationRefused},
+		{"user lists", nil, false, "StreamItems", bob, nil, codes.OK, ""},
+		{"get under a stricter policy", stricter, false, "GetItem", bob, &itemsrpc.GetRequest{ID: id}, codes.PermissionDenied, "Missing role: auditor"},
+		{"list under a stricter policy", stricter, false, "ListItems", bob, &itemsrpc.ListRequest{}, codes.OK, ""},
+		{"unknown method", nil, false, "PurgeItems", alice, nil, codes.PermissionDenied, "Unknown method"},
+		{"anonymous", nil, false, "ListItems", "", &itemsrpc.ListRequest{}, codes.Unauthenticated, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			currentPolicy.Store(c.policy)
+			impersonationBlockDestructive = c.guard
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", c.auth))
+			_, err := grpcAuthorize(ctx, "/"+itemsrpc.ServiceName+"/"+c.method, c.req)
+			st := status.Convert(err)
+			if st.Code() != c.code || (c.reason != "" && st.Message() != c.reason) {
+				t.Errorf("got %v %q, want %v %q", st.Code(), st.Message(), c.code, c.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// readiness records the dependencies that are currently down. /readyz
+// fails while any is, so a load balancer stops routing here; /healthz only
+// reports that the process is serving. The reasons are logged by whoever
+// reports the failure, not served to the unauthenticated probes.
+var readiness struct {
+	sync.Mutex
+	known map[string]bool
+	down  map[string]bool
+}
+
+// setReady records the state of dependency name and reports whether it
+// changed.
+func setReady(name string, err error) bool {
+	readiness.Lock()
+	defer readiness.Unlock()
+	if readiness.known == nil {
+		readiness.known, readiness.down = map[string]bool{}, map[string]bool{}
+	}
+	wasDown, first := readiness.down[name], !readiness.known[name]
+	readiness.known[name], readiness.down[name] = true, err != nil
+	return !first && wasDown != (err != nil)
+}
+
+// ready reports whether dependency name was last seen up.
+func ready(name string) bool {
+	readiness.Lock()
+	defer readiness.Unlock()
+	return readiness.known[name] && !readiness.down[name]
+}
+
+// mountHealth adds the unauthenticated probe endpoints.
+func mountHealth(app *fiber.App) {
+	app.Get("/healthz", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "ok"})
+	})
+	app.Get("/readyz", readyzHandler)
+}
+
+func readyzHandler(c *fiber.Ctx) error {
+	readiness.Lock()
+	names := make([]string, 0, len(readiness.known))
+	for name := range readiness.known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make(fiber.Map, len(names))
+	status, code := "ok", fiber.StatusOK
+	for _, name := range names {
+		if readiness.down[name] {
+			checks[name] = "down"
+			status, code = "unavailable", fiber.StatusServiceUnavailable
+		} else {
+			checks[name] = "ok"
+		}
+	}
+	readiness.Unlock()
+	return c.Status(code).JSON(fiber.Map{"status": status, "checks": checks})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const idempotencyCollection = "idempotency"
+
+// idempotencyRecord is the stored outcome of the first request made with
+// an Idempotency-Key. Completed is false while that request is running.
+type idempotencyRecord struct {
+	ID          string            `bson:"_id"`
+	Fingerprint string            `bson:"fingerprint"`
+	Completed   bool              `bson:"completed"`
+	Status      int               `bson:"status,omitempty"`
+	Headers     map[string]string `bson:"headers,omitempty"`
+	Body        []byte            `bson:"body,omitempty"`
+	CreatedAt   time.Time         `bson:"createdAt"`
+}
+
+// replayedHeaders are copied from the stored response onto a replay.
+var replayedHeaders = []string{fiber.HeaderContentType, fiber.HeaderLocation, fiber.HeaderETag}
+
+// idempotency replays the stored response when a POST or PUT is retried
+// with the same Idempotency-Key, so a retry by Kong or a flaky client
+// doesn't create a second item. Keys are scoped to the caller and route
+// and kept for the idempotency retention (IDEMPOTENCY_TTL, default 24h,
+// adjustable under /admin/retention). Reusing a key with a
+// different body is rejected, as is a retry while the first request is
+// still running.
+func idempotency(c *fiber.Ctx) error {
+	key := c.Get("Idempotency-Key")
+	if key == "" || (c.Method() != fiber.MethodPost && c.Method() != fiber.MethodPut) {
+		return c.Next()
+	}
+	if len(key) > 255 {
+		return newProblem(fiber.StatusBadRequest, problemAboutBlank, "Idempotency-Key must be at most 255 characters")
+	}
+	claims, _ := parseToken(c)
+	sub, _ := claims["sub"].(string)
+	scope := sha256.Sum256([]byte(sub + "\x00" + c.Method() + " " + c.Path() + "\x00" + key))
+	body := sha256.Sum256(c.Body())
+	rec := idempotencyRecord{
+		ID:          hex.EncodeToString(scope[:]),
+		Fingerprint: hex.EncodeToString(body[:]),
+		CreatedAt:   time.Now(),
+	}
+
+	coll := db().Collection(idempotencyCollection)
+	_, err := coll.InsertOne(c.UserContext(), rec)
+	if mongo.IsDuplicateKeyError(err) {
+		return replayIdempotent(c, rec)
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+
+	// Render errors here so that their response is what gets stored. A
+	// request past its deadline is a 504, which is not.
+	if err := timedOut(c, c.Next()); err != nil {
+		if herr := c.App().Config().ErrorHandler(c, err); herr != nil {
+			return herr
+		}
+	}
+
+	// The record is settled even when the request ran out of time.
+	ctx := context.WithoutCancel(c.UserContext())
+	status := c.Response().StatusCode()
+	if status >= fiber.StatusInternalServerError || status == fiber.StatusUnauthorized ||
+		status == fiber.StatusForbidden || status == fiber.StatusTooManyRequests {
+		// Transient or caller-specific: let a retry run the request again.
+		if _, err := coll.DeleteOne(ctx, bson.M{"_id": rec.ID}); err != nil {
+			log.Println("Idempotency record not released:", err)
+		}
+		return nil
+	}
+	headers := map[string]string{}
+	for _, h := range replayedHeaders {
+		if v := c.GetRespHeader(h); v != "" {
+			headers[h] = v
+		}
+	}
+	update := bson.M{"$set": bson.M{
+		"completed": true,
+		"status":    status,
+		"headers":   headers,
+		"body":      append([]byte(nil), c.Response().Body()...),
+	}}
+	if _, err := coll.UpdateByID(ctx, rec.ID, update); err != nil {
+		log.Println("Idempotency response not stored:", err)
+	}
+	return nil
+}
+
+func replayIdempotent(c *fiber.Ctx, rec idempotencyRecord) error {
+	var stored idempotencyRecord
+	err := db().Collection(idempotencyCollection).FindOne(c.UserContext(), bson.M{"_id": rec.ID}).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Released or expired in the meantime.
+		return newProblem(fiber.StatusConflict, problemAboutBlank, "Request with this Idempotency-Key is being retried; try again")
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+	if stored.Fingerprint != rec.Fingerprint {
+		return newProblem(fiber.StatusUnprocessableEntity, problemAboutBlank, "Idempotency-Key was already used with a different request body")
+	}
+	if !stored.Completed {
+		c.Set(fiber.HeaderRetryAfter, "1")
+		return newProblem(fiber.StatusConflict, problemAboutBlank, "A request with this Idempotency-Key is still in progress")
+	}
+	for h, v := range stored.Headers {
+		c.Set(h, v)
+	}
+	c.Set("Idempotent-Replayed", "true")
+	return c.Status(stored.Status).Send(stored.Body)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// impersonator is who started a Keycloak impersonation session. Keycloak
+// adds it to tokens as the "impersonator" claim.
+type impersonator struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+func impersonatorOf(claims jwt.MapClaims) *impersonator {
+	m, ok := claims["impersonator"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	var imp impersonator
+	imp.ID, _ = m["id"].(string)
+	imp.Username, _ = m["username"].(string)
+	if imp.ID == "" && imp.Username == "" {
+		return nil
+	}
+	return &imp
+}
+
+// requestImpersonator returns the impersonator of the caller's token, or
+// nil for an ordinary session.
+func requestImpersonator(c *fiber.Ctx) *impersonator {
+	claims, err := parseToken(c)
+	if err != nil {
+		return nil
+	}
+	return impersonatorOf(claims)
+}
+
+// name is the impersonator as recorded in audit and access logs.
+func (imp *impersonator) name() string {
+	if imp == nil {
+		return ""
+	}
+	if imp.ID == "" {
+		return imp.Username
+	}
+	return imp.ID
+}
+
+// destructiveRoutes are closed to impersonated sessions when
+// IMPERSONATION_BLOCK_DESTRUCTIVE is set: every delete, including those of
+// a batch, and every change through the operator endpoints.
+var destructiveRoutes = []policy.Pattern{
+	{Methods: []string{fiber.MethodDelete}, Path: "/**"},
+	{Methods: []string{fiber.MethodPost}, Path: "/api/*/items:batch"},
+	{Methods: []string{fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete}, Path: "/admin/**"},
+	{Methods: []string{fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete}, Path: "/ops/**"},
+}
+
+// impersonationBlockDestructive is IMPERSONATION_BLOCK_DESTRUCTIVE.
+var impersonationBlockDestructive bool
+
+const impersonationRefused = "Not allowed in an impersonated session"
+
+// closedToImpersonation reports whether impersonated sessions may not
+// send method path.
+func closedToImpersonation(method, path string) bool {
+	if !impersonationBlockDestructive {
+		return false
+	}
+	for _, r := range destructiveRoutes {
+		if r.Matches(method, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// guardImpersonation returns middleware that rejects impersonated
+// sessions on destructive routes, or a no-op unless
+// IMPERSONATION_BLOCK_DESTRUCTIVE is true.
+func guardImpersonation() fiber.Handler {
+	impersonationBlockDestructive = getEnvBool("IMPERSONATION_BLOCK_DESTRUCTIVE", false)
+	if !impersonationBlockDestructive {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+	return func(c *fiber.Ctx) error {
+		if closedToImpersonation(c.Method(), c.Path()) && requestImpersonator(c) != nil {
+			return errForbidden(impersonationRefused)
+		}
+		return c.Next()
+	}
+}
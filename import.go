@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// importRow is one decoded row of an item import. Columns are those of
+// the export; id, createdBy and the timestamps are optional.
+type importRow struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	CreatedBy   string   `json:"createdBy"`
+	CreatedAt   string   `json:"createdAt"`
+	UpdatedAt   string   `json:"updatedAt"`
+}
+
+// importRowError reports why a row (1-based, not counting a CSV header)
+// was rejected.
+type importRowError struct {
+	Row    int          `json:"row"`
+	Detail string       `json:"detail"`
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+type importQuery struct {
+	Format string `query:"format" validate:"omitempty,oneof=csv ndjson"`
+	DryRun bool   `query:"dryRun"`
+}
+
+func registerImportRoutes(r fiber.Router) {
+	r.Post("/import/items", importItems)
+}
+
+// importItems loads items from a CSV or NDJSON upload, sent as the raw
+// body or as the "file" field of a multipart form. Every row is validated
+// against the item schema first; accepted rows are then written in
+// transactions of IMPORT_BATCH_SIZE rows (default 500). Rows with an id
+// replace that item, others are inserted. With dryRun=true nothing is
+// written.
+func importItems(c *fiber.Ctx) error {
+	var q importQuery
+	if err := bindQuery(c, &q); err != nil {
+		return err
+	}
+	body, format, err := importBody(c)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if q.Format != "" {
+		format = q.Format
+	}
+
+	var docs []item
+	var rowErrs []importRowError
+	accept := func(n int, r importRow) {
+		doc, err := importDoc(r, subject(c))
+		if err != nil {
+			p := asProblem(err)
+			rowErrs = append(rowErrs, importRowError{Row: n, Detail: p.Detail, Errors: p.Errors})
+			return
+		}
+		docs = append(docs, doc)
+	}
+	if format == "ndjson" {
+		err = readNDJSONRows(body, accept, func(n int, err error) {
+			rowErrs = append(rowErrs, importRowError{Row: n, Detail: err.Error()})
+		})
+	} else {
+		err = readCSVRows(body, accept, func(n int, err error) {
+			rowErrs = append(rowErrs, importRowError{Row: n, Detail: err.Error()})
+		})
+	}
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, problemValidation, "Malformed upload: "+err.Error())
+	}
+
+	result := fiber.Map{
+		"dryRun":   q.DryRun,
+		"accepted": len(docs),
+		"rejected": len(rowErrs),
+		"errors":   rowErrs,
+	}
+	if rowErrs == nil {
+		result["errors"] = []importRowError{}
+	}
+	if q.DryRun || len(docs) == 0 {
+		result["applied"] = 0
+		return c.JSON(result)
+	}
+
+	applied, err := applyImport(c.UserContext(), docs)
+	result["applied"] = applied
+	recordAudit(c, "items.import", format, bson.M{"applied": applied, "rejected": len(rowErrs)})
+	if err != nil {
+		p := errDatabase(err)
+		p.Detail = fmt.Sprintf("Import stopped after %d rows: database error", applied)
+		result["error"] = p
+		return c.Status(p.Status).JSON(result)
+	}
+	return c.JSON(result)
+}
+
+// importBody returns the upload and its format guessed from the content
+// type.
+func importBody(c *fiber.Ctx) (io.ReadCloser, string, error) {
+	format := "csv"
+	if strings.Contains(c.Get(fiber.HeaderContentType), "ndjson") {
+		format = "ndjson"
+	}
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		return io.NopCloser(bytes.NewReader(c.Body())), format, nil
+	}
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return nil, "", newProblem(fiber.StatusBadRequest, problemValidation, "Multipart upload needs a \"file\" field")
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	if strings.HasSuffix(fh.Filename, ".ndjson") || strings.HasSuffix(fh.Filename, ".jsonl") {
+		format = "ndjson"
+	}
+	return f, format, nil
+}
+
+func readNDJSONRows(r io.Reader, accept func(int, importRow), reject func(int, error)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var row importRow
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&row); err != nil {
+			reject(n, err)
+			continue
+		}
+		accept(n, row)
+	}
+	return sc.Err()
+}
+
+func readCSVRows(r io.Reader, accept func(int, importRow), reject func(int, error)) error {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+	for _, col := range header {
+		if itemColumn(item{}, col) == nil {
+			return fmt.Errorf("unknown column %q; columns are %s", col, strings.Join(itemColumns, ", "))
+		}
+	}
+	for n := 1; ; n++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, csv.ErrFieldCount) {
+			reject(n, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var row importRow
+		for i, col := range header {
+			v := record[i]
+			switch col {
+			case "id":
+				row.ID = v
+			case "name":
+				row.Name = v
+			case "description":
+				row.Description = v
+			case "tags":
+				if v != "" {
+					row.Tags = strings.Split(v, ";")
+				}
+			case "createdBy":
+				row.CreatedBy = v
+			case "createdAt":
+				row.CreatedAt = v
+			case "updatedAt":
+				row.UpdatedAt = v
+			}
+		}
+		accept(n, row)
+	}
+}
+
+// importDoc validates a row and builds the item to store.
+func importDoc(r importRow, importer string) (item, error) {
+	if err := validateStruct(itemRequest{Name: r.Name, Description: r.Description, Tags: r.Tags}); err != nil {
+		return item{}, err
+	}
+	now := time.Now().UTC()
+	doc := item{
+		Name:        r.Name,
+		Description: encryptedString(r.Description),
+		Tags:        nonNilTags(r.Tags),
+		CreatedBy:   searchableString(r.CreatedBy),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if doc.CreatedBy == "" {
+		doc.CreatedBy = searchableString(importer)
+	}
+	var fields []fieldError
+	if r.ID != "" {
+		id, err := primitive.ObjectIDFromHex(r.ID)
+		if err != nil {
+			fields = append(fields, fieldError{Field: "id", Rule: "objectid", Message: "must be a 24-character hex object ID"})
+		}
+		doc.ID = id
+	}
+	for _, ts := range []struct {
+		field, value string
+		dst          *time.Time
+	}{{"createdAt", r.CreatedAt, &doc.CreatedAt}, {"updatedAt", r.UpdatedAt, &doc.UpdatedAt}} {
+		if ts.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, ts.value)
+		if err != nil {
+			fields = append(fields, fieldError{Field: ts.field, Rule: "datetime", Message: "must be an RFC 3339 time"})
+			continue
+		}
+		*ts.dst = t.UTC()
+	}
+	if fields != nil {
+		return item{}, errValidation(fields)
+	}
+	return doc, nil
+}
+
+// applyImport writes docs in batches, each in its own transaction, and
+// returns how many were committed before any failure. Each batch's item
+// events go to the outbox in its transaction; without the outbox they are
+// published once it commits.
+func applyImport(ctx context.Context, docs []item) (int, error) {
+	size := getEnvInt("IMPORT_BATCH_SIZE", 500)
+	if size < 1 {
+		size = 500
+	}
+	for i := range docs {
+		if docs[i].ID.IsZero() {
+			docs[i].ID = primitive.NewObjectID()
+		}
+	}
+	// Keyed by item, since a retried transaction stages its batch again.
+	held := map[primitive.ObjectID]cloudEvent{}
+	applied, err := itemDB.Import(ctx, docs, size, func(ctx context.Context, batch []item, created []bool) error {
+		evs := make([]cloudEvent, len(batch))
+		for i, doc := range batch {
+			name := eventItemUpdated
+			if created[i] {
+				name = eventItemCreated
+			}
+			evs[i] = newEvent(name, itemSubject(doc.ID), doc)
+		}
+		if outboxEnabled {
+			return insertOutbox(ctx, evs)
+		}
+		for i, e := range evs {
+			held[batch[i].ID] = e
+		}
+		return nil
+	})
+	if outboxEnabled {
+		if applied > 0 {
+			wakeOutboxRelay()
+		}
+	} else {
+		for _, doc := range docs[:applied] {
+			if e, ok := held[doc.ID]; ok {
+				publishEvent(e)
+				delete(held, doc.ID)
+			}
+		}
+	}
+	if err != nil {
+		return applied, err
+	}
+	enqueueOrLog(ctx, "reports.compute", itemReportID, nil)
+	return applied, nil
+}
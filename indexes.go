@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// collectionIndexes lists the indexes each collection needs. They are
+// created at startup; creating an existing index is a no-op. TTL indexes
+// are managed by the retention policies instead.
+func collectionIndexes() map[string][]mongo.IndexModel {
+	return map[string][]mongo.IndexModel{
+		itemsCollection:             itemIndexes,
+		jobsCollection:              jobIndexes,
+		usersCollection:             userIndexes,
+		webhooksCollection:          webhookIndexes,
+		webhookDeliveriesCollection: webhookDeliveryIndexes,
+	}
+}
+
+func ensureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for coll, models := range collectionIndexes() {
+		if _, err := db().Collection(coll).Indexes().CreateMany(ctx, models); err != nil {
+			return fmt.Errorf("indexes on %s: %w", coll, err)
+		}
+	}
+	return ensureRetention(ctx)
+}
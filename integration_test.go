@@ -0,0 +1,304 @@
+//go:build integration
+
+// End-to-end tests against real Keycloak and MongoDB containers, with Kong
+// in front when E2E_KONG=1. Docker is required:
+//
+//	go test -tags=integration ./...
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/mongodb"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// e2eTargets maps a name ("app", "kong") to the base URL the cases run
+// against.
+var e2eTargets = map[string]string{}
+
+func TestMain(m *testing.M) {
+	ctx := context.Background()
+	cleanup, err := startE2E(ctx)
+	if err != nil {
+		cleanup()
+		log.Fatal("e2e setup: ", err)
+	}
+	code := m.Run()
+	cleanup()
+	os.Exit(code)
+}
+
+func startE2E(ctx context.Context) (func(), error) {
+	var containers []testcontainers.Container
+	cleanup := func() {
+		for _, c := range containers {
+			_ = c.Terminate(context.Background())
+		}
+	}
+
+	mongo, err := mongodb.Run(ctx, "mongo:6.0")
+	if err != nil {
+		return cleanup, err
+	}
+	containers = append(containers, mongo)
+	mongoURI, err := mongo.ConnectionString(ctx)
+	if err != nil {
+		return cleanup, err
+	}
+
+	keycloak, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "quay.io/keycloak/keycloak:21.1.1",
+			Cmd:          []string{"start-dev", "--import-realm"},
+			ExposedPorts: []string{"8080/tcp"},
+			Env: map[string]string{
+				"KEYCLOAK_ADMIN":          "admin",
+				"KEYCLOAK_ADMIN_PASSWORD": "admin",
+			},
+			Files: []testcontainers.ContainerFile{{
+				HostFilePath:      "keycloak/import-realm.json",
+				ContainerFilePath: "/opt/keycloak/data/import/realm.json",
+				FileMode:          0o644,
+			}},
+			WaitingFor: wait.ForHTTP("/realms/demo-realm").WithPort("8080/tcp").WithStartupTimeout(3 * time.Minute),
+		},
+		Started: true,
+	})
+	if err != nil {
+		return cleanup, err
+	}
+	containers = append(containers, keycloak)
+	issuer, err := containerURL(ctx, keycloak, "8080/tcp")
+	if err != nil {
+		return cleanup, err
+	}
+	issuer += "/realms/demo-realm"
+
+	for k, v := range map[string]string{
+		"SECRETS_PROVIDERS": "env",
+		"MONGO_URI":         mongoURI,
+		"MONGO_DB":          "e2e",
+		"AUTH_MODE":         authModeJWKS,
+		"KEYCLOAK_ISSUER":   issuer,
+	} {
+		os.Setenv(k, v)
+	}
+	if err := initSecrets(); err != nil {
+		return cleanup, err
+	}
+	if err := initAuthMode(); err != nil {
+		return cleanup, err
+	}
+	if err := initStorage(); err != nil {
+		return cleanup, err
+	}
+	initRuntimeConfig()
+	if err := initKeycloakClient(); err != nil {
+		return cleanup, err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return cleanup, err
+	}
+	go func() { _ = newApp().Listener(ln) }()
+	appPort := ln.Addr().(*net.TCPAddr).Port
+	e2eTargets["app"] = fmt.Sprintf("http://127.0.0.1:%d", appPort)
+
+	if os.Getenv("E2E_KONG") == "1" {
+		kong, err := startKong(ctx, issuer, appPort)
+		if err != nil {
+			return cleanup, err
+		}
+		containers = append(containers, kong)
+		if e2eTargets["kong"], err = containerURL(ctx, kong, "8000/tcp"); err != nil {
+			return cleanup, err
+		}
+	}
+	return cleanup, nil
+}
+
+// startKong runs DB-less Kong proxying to the in-process app, with the JWT
+// plugin holding the realm's signing key as configure-kong.sh sets it up.
+func startKong(ctx context.Context, issuer string, appPort int) (testcontainers.Container, error) {
+	keys, err := fetchJWKS(issuer + "/protocol/openid-connect/certs")
+	if err != nil {
+		return nil, err
+	}
+	var publicPEM string
+	for _, k := range keys {
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return nil, err
+		}
+		publicPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		break
+	}
+	declarative, err := json.Marshal(map[string]interface{}{
+		"_format_version": "3.0",
+		"services": []map[string]interface{}{{
+			"name": "go-app-service",
+			"url":  fmt.Sprintf("http://%s:%d", testcontainers.HostInternal, appPort),
+			"routes": []map[string]interface{}{
+				{"name": "public-route", "paths": []string{"/public", "/api/v1/public", "/api/v2/public"}, "strip_path": false},
+				{"name": "protected-route", "paths": []string{"/api", "/profile", "/user", "/admin"}, "strip_path": false,
+					"plugins": []map[string]interface{}{{"name": "jwt"}}},
+			},
+		}},
+		"consumers": []map[string]interface{}{{
+			"username": "keycloak-users",
+			"jwt_secrets": []map[string]interface{}{{
+				"key": issuer, "algorithm": "RS256", "rsa_public_key": publicPEM,
+			}},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:           "kong:3.7-ubuntu",
+			ExposedPorts:    []string{"8000/tcp"},
+			HostAccessPorts: []int{appPort},
+			Env: map[string]string{
+				"KONG_DATABASE":                  "off",
+				"KONG_DECLARATIVE_CONFIG_STRING": string(declarative),
+				"KONG_PROXY_LISTEN":              "0.0.0.0:8000",
+			},
+			WaitingFor: wait.ForHTTP("/public").WithPort("8000/tcp").WithStartupTimeout(2 * time.Minute),
+		},
+		Started: true,
+	})
+}
+
+func containerURL(ctx context.Context, c testcontainers.Container, port string) (string, error) {
+	host, err := c.Host(ctx)
+	if err != nil {
+		return "", err
+	}
+	mapped, err := c.MappedPort(ctx, nat.Port(port))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("http://%s:%s", host, mapped.Port()), nil
+}
+
+// e2eToken logs in as a realm user with the password grant.
+func e2eToken(t *testing.T, username string) string {
+	t.Helper()
+	resp, err := http.PostForm(keycloakIssuer()+"/protocol/openid-connect/token", url.Values{
+		"grant_type": {"password"},
+		"client_id":  {"fiber-app"},
+		"username":   {username},
+		"password":   {"password123"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.AccessToken == "" {
+		t.Fatalf("token for %s: %s %v", username, resp.Status, err)
+	}
+	return body.AccessToken
+}
+
+func e2eDo(t *testing.T, method, url, token, body string) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]interface{}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	return resp, out
+}
+
+func TestE2ERoutes(t *testing.T) {
+	alice, bob := e2eToken(t, "alice"), e2eToken(t, "bob")
+	cases := []struct {
+		name, path, token string
+		want              int
+		message           string
+	}{
+		{"public", "/api/v1/public", "", 200, "This is a public endpoint."},
+		{"legacy public", "/public", "", 200, "This is a public endpoint."},
+		{"profile without token", "/api/v1/profile", "", 401, ""},
+		{"profile", "/api/v1/profile", alice, 200, "Hello, alice"},
+		{"user as user", "/api/v1/user", alice, 200, "Hello, user-level endpoint!"},
+		{"user as admin", "/api/v1/user", bob, 403, ""},
+		{"admin as admin", "/api/v1/admin", bob, 200, "Hello, admin-level endpoint!"},
+		{"admin as user", "/api/v1/admin", alice, 403, ""},
+		{"tampered token", "/api/v1/user", alice[:len(alice)-4] + "AAAA", 401, ""},
+	}
+	for target, base := range e2eTargets {
+		for _, tc := range cases {
+			t.Run(target+"/"+tc.name, func(t *testing.T) {
+				resp, body := e2eDo(t, http.MethodGet, base+tc.path, tc.token, "")
+				if resp.StatusCode != tc.want {
+					t.Fatalf("status %d, want %d (%v)", resp.StatusCode, tc.want, body)
+				}
+				if tc.message != "" && body["message"] != tc.message {
+					t.Fatalf("message %q, want %q", body["message"], tc.message)
+				}
+			})
+		}
+	}
+}
+
+func TestE2EItems(t *testing.T) {
+	alice, bob := e2eToken(t, "alice"), e2eToken(t, "bob")
+	for target, base := range e2eTargets {
+		t.Run(target, func(t *testing.T) {
+			resp, created := e2eDo(t, http.MethodPost, base+"/api/v1/items", alice, `{"name":"e2e","tags":["a"]}`)
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("create: %d %v", resp.StatusCode, created)
+			}
+			path := "/api/v1/items/" + created["id"].(string)
+
+			if resp, got := e2eDo(t, http.MethodGet, base+path, alice, ""); resp.StatusCode != 200 || got["name"] != "e2e" {
+				t.Fatalf("get: %d %v", resp.StatusCode, got)
+			}
+			if resp, _ := e2eDo(t, http.MethodPost, base+"/api/v1/items", alice, `{"name":""}`); resp.StatusCode != http.StatusUnprocessableEntity {
+				t.Fatalf("invalid create: %d", resp.StatusCode)
+			}
+			if resp, _ := e2eDo(t, http.MethodDelete, base+path, alice, ""); resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("delete as user: %d", resp.StatusCode)
+			}
+			if resp, _ := e2eDo(t, http.MethodDelete, base+path, bob, ""); resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("delete as admin: %d", resp.StatusCode)
+			}
+			if resp, _ := e2eDo(t, http.MethodGet, base+path, alice, ""); resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("get deleted: %d", resp.StatusCode)
+			}
+		})
+	}
+}
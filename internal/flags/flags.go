@@ -0,0 +1,198 @@
+// Package flags evaluates feature flags for the caller of a request.
+//
+// A flag is off until enabled. An enabled flag without targeting is on for
+// everyone; with targeting it is on for callers that match any of its
+// subjects, roles or groups, or that fall inside its percentage rollout.
+// The rollout bucket is derived from the flag key and the subject, so a
+// caller keeps the same answer as the percentage grows.
+//
+//	ctx = flags.WithCaller(ctx, flags.Caller{Subject: sub, Roles: roles})
+//	if flags.IsEnabled(ctx, "new-items-api") { ... }
+package flags
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Flag is a feature flag and its targeting rules.
+type Flag struct {
+	Key         string   `bson:"_id" json:"key"`
+	Description string   `bson:"description" json:"description"`
+	Enabled     bool     `bson:"enabled" json:"enabled"`
+	Subjects    []string `bson:"subjects" json:"subjects"`
+	Roles       []string `bson:"roles" json:"roles"`
+	Groups      []string `bson:"groups" json:"groups"`
+	// Percentage rolls the flag out to that share of subjects, 0 to 100.
+	Percentage int       `bson:"percentage" json:"percentage"`
+	UpdatedBy  string    `bson:"updatedBy" json:"updatedBy"`
+	UpdatedAt  time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+func (f Flag) targeted() bool {
+	return len(f.Subjects) > 0 || len(f.Roles) > 0 || len(f.Groups) > 0 || f.Percentage > 0
+}
+
+// For reports whether f is on for c.
+func (f Flag) For(c Caller) bool {
+	if !f.Enabled {
+		return false
+	}
+	if !f.targeted() {
+		return true
+	}
+	if c.Subject == "" {
+		return false
+	}
+	if slices.Contains(f.Subjects, c.Subject) {
+		return true
+	}
+	for _, r := range c.Roles {
+		if slices.Contains(f.Roles, r) {
+			return true
+		}
+	}
+	for _, g := range c.Groups {
+		if slices.Contains(f.Groups, g) {
+			return true
+		}
+	}
+	return f.Percentage > 0 && bucket(f.Key, c.Subject) < f.Percentage
+}
+
+// bucket places subject in one of 100 buckets for key.
+func bucket(key, subject string) int {
+	sum := sha256.Sum256([]byte(key + "\x00" + subject))
+	return int(binary.BigEndian.Uint32(sum[:4]) % 100)
+}
+
+// Caller is who a flag is evaluated for, taken from the token claims.
+type Caller struct {
+	Subject string
+	Roles   []string
+	Groups  []string
+}
+
+type callerKey struct{}
+
+// WithCaller returns a context carrying c.
+func WithCaller(ctx context.Context, c Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// CallerFrom returns the caller stored by WithCaller.
+func CallerFrom(ctx context.Context) (Caller, bool) {
+	c, ok := ctx.Value(callerKey{}).(Caller)
+	return c, ok
+}
+
+// Store persists flags.
+type Store interface {
+	List(ctx context.Context) ([]Flag, error)
+	Put(ctx context.Context, f Flag) error
+	// Delete reports whether the flag existed.
+	Delete(ctx context.Context, key string) (bool, error)
+}
+
+// Set is an in-memory copy of the stored flags, refreshed periodically.
+// Unknown flags are off.
+type Set struct {
+	store Store
+	flags atomic.Pointer[map[string]Flag]
+}
+
+// NewSet returns a set reading from store. Call Refresh to load it.
+func NewSet(store Store) *Set {
+	s := &Set{store: store}
+	s.flags.Store(&map[string]Flag{})
+	return s
+}
+
+// Refresh reloads the flags. On error the previous copy is kept.
+func (s *Set) Refresh(ctx context.Context) error {
+	list, err := s.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	m := make(map[string]Flag, len(list))
+	for _, f := range list {
+		m[f.Key] = f
+	}
+	s.flags.Store(&m)
+	return nil
+}
+
+// Watch refreshes the set every interval until ctx is done.
+func (s *Set) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			rctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			if err := s.Refresh(rctx); err != nil {
+				log.Println("Feature flag refresh failed:", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// Store returns the store the set reads from.
+func (s *Set) Store() Store {
+	return s.store
+}
+
+// Get returns the cached flag.
+func (s *Set) Get(key string) (Flag, bool) {
+	f, ok := (*s.flags.Load())[key]
+	return f, ok
+}
+
+// All returns the cached flags sorted by key.
+func (s *Set) All() []Flag {
+	m := *s.flags.Load()
+	out := make([]Flag, 0, len(m))
+	for _, f := range m {
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// IsEnabled reports whether key is on for the caller in ctx.
+func (s *Set) IsEnabled(ctx context.Context, key string) bool {
+	f, ok := s.Get(key)
+	if !ok {
+		return false
+	}
+	c, _ := CallerFrom(ctx)
+	return f.For(c)
+}
+
+var defaultSet atomic.Pointer[Set]
+
+// SetDefault makes s the set used by IsEnabled.
+func SetDefault(s *Set) {
+	defaultSet.Store(s)
+}
+
+// Default returns the set given to SetDefault, or nil.
+func Default() *Set {
+	return defaultSet.Load()
+}
+
+// IsEnabled reports whether key is on for the caller in ctx, using the
+// default set. Every flag is off before SetDefault.
+func IsEnabled(ctx context.Context, key string) bool {
+	s := defaultSet.Load()
+	return s != nil && s.IsEnabled(ctx, key)
+}
@@ -0,0 +1,89 @@
+package httpclient
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker is the circuit of one target. It opens after threshold failures
+// in a row; once cooldown has passed it lets a single probe through, which
+// closes it on success and reopens it on failure.
+type breaker struct {
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+type breakers struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu sync.Mutex
+	m  map[string]*breaker
+}
+
+func newBreakers(threshold int, cooldown time.Duration) *breakers {
+	return &breakers{threshold: threshold, cooldown: cooldown, m: map[string]*breaker{}}
+}
+
+func (bs *breakers) allow(key string) bool {
+	if bs.threshold < 0 {
+		return true
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b := bs.m[key]
+	if b == nil || b.failures < bs.threshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < bs.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (bs *breakers) record(key string, ok bool) {
+	if bs.threshold < 0 {
+		return
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b := bs.m[key]
+	if ok {
+		if b != nil {
+			delete(bs.m, key)
+		}
+		return
+	}
+	if b == nil {
+		b = &breaker{}
+		bs.m[key] = b
+	}
+	b.failures++
+	b.probing = false
+	if b.failures >= bs.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// State reports the circuit of each target that has failed recently:
+// "closed" while below the threshold, "open" while rejecting calls and
+// "half-open" while ready for, or running, a probe.
+func (t *Transport) State() map[string]string {
+	bs := t.breakers
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	out := make(map[string]string, len(bs.m))
+	for key, b := range bs.m {
+		switch {
+		case b.failures < bs.threshold:
+			out[key] = "closed"
+		case b.probing || time.Since(b.openedAt) >= bs.cooldown:
+			out[key] = "half-open"
+		default:
+			out[key] = "open"
+		}
+	}
+	return out
+}
@@ -0,0 +1,311 @@
+// Package httpclient is an HTTP client for calling sibling services,
+// usually through Kong. Its transport attaches a bearer token chosen per
+// target: the caller's own token (optionally exchanged for the target's
+// audience) or the app's client-credentials token. It also bounds each
+// attempt with a timeout, retries transient failures and stops calling a
+// target that keeps failing.
+//
+//	client := httpclient.New(httpclient.Config{
+//		Targets: []httpclient.Target{
+//			{Prefix: "http://kong:8000/billing", Auth: httpclient.AuthUser, Audience: "billing-api"},
+//			{Prefix: "http://kong:8000/reports", Auth: httpclient.AuthService},
+//		},
+//		ServiceToken: serviceToken,
+//		Exchange:     exchange,
+//	})
+//	ctx = httpclient.WithUser(ctx, httpclient.User{Token: raw, Subject: sub})
+//	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://kong:8000/billing/invoices", nil)
+//	resp, err := client.Do(req)
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Auth is how requests to a target are authenticated.
+type Auth int
+
+const (
+	// AuthNone sends no token.
+	AuthNone Auth = iota
+	// AuthUser sends the token of the user the request is made for.
+	AuthUser
+	// AuthService sends the app's client-credentials token.
+	AuthService
+)
+
+// ParseAuth parses "none", "user" or "service".
+func ParseAuth(s string) (Auth, error) {
+	switch s {
+	case "none", "":
+		return AuthNone, nil
+	case "user":
+		return AuthUser, nil
+	case "service":
+		return AuthService, nil
+	}
+	return AuthNone, fmt.Errorf("httpclient: unknown auth %q (want none, user or service)", s)
+}
+
+// Target is the token policy for URLs starting with Prefix.
+type Target struct {
+	Prefix string
+	Auth   Auth
+	// Audience, with AuthUser, exchanges the user's token for one issued
+	// to this client. Empty forwards the user's token unchanged.
+	Audience string
+}
+
+// User is the caller whose token AuthUser targets receive.
+type User struct {
+	Token   string
+	Subject string
+	// Expires is when Token expires; exchanged tokens are not kept longer.
+	Expires time.Time
+}
+
+type userKey struct{}
+
+// WithUser returns a context carrying u for requests made with it.
+func WithUser(ctx context.Context, u User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// UserFrom returns the user stored by WithUser.
+func UserFrom(ctx context.Context) (User, bool) {
+	u, ok := ctx.Value(userKey{}).(User)
+	return u, ok && u.Token != ""
+}
+
+var (
+	// ErrNoUser is returned for an AuthUser target when the request's
+	// context has no user.
+	ErrNoUser = errors.New("httpclient: no user token in context")
+	// ErrCircuitOpen is returned without calling a target that has failed
+	// too often recently.
+	ErrCircuitOpen = errors.New("httpclient: circuit open")
+)
+
+// Config configures the client. Zero durations and counts take the
+// defaults noted on each field.
+type Config struct {
+	Targets []Target
+	// Default applies to URLs that match no target. Its zero value sends
+	// no token, so user tokens never leak to unlisted hosts.
+	Default Target
+
+	// ServiceToken returns the app's client-credentials token.
+	ServiceToken func(ctx context.Context) (string, error)
+	// Exchange trades a user's token for one for audience.
+	Exchange func(ctx context.Context, u User, audience string) (string, error)
+
+	// Timeout bounds each attempt, including reading the body (10s).
+	Timeout time.Duration
+	// Retries is how many times a failed attempt is repeated (2). Use a
+	// negative value to disable retries.
+	Retries int
+	// Backoff is the delay before the first retry, doubled for each
+	// following one, with jitter (100ms).
+	Backoff time.Duration
+	// BreakerThreshold is how many failures in a row open a target's
+	// circuit (5). Use a negative value to disable the breaker.
+	BreakerThreshold int
+	// BreakerCooldown is how long an open circuit rejects calls before
+	// letting one through to probe the target (30s).
+	BreakerCooldown time.Duration
+
+	// Base performs the requests (http.DefaultTransport).
+	Base http.RoundTripper
+}
+
+// New returns a client using NewTransport(cfg).
+func New(cfg Config) *http.Client {
+	return &http.Client{Transport: NewTransport(cfg)}
+}
+
+// Transport is the client's RoundTripper.
+type Transport struct {
+	cfg      Config
+	targets  []Target // longest prefix first
+	breakers *breakers
+}
+
+// NewTransport returns a transport for cfg.
+func NewTransport(cfg Config) *Transport {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = 2
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = 100 * time.Millisecond
+	}
+	if cfg.BreakerThreshold == 0 {
+		cfg.BreakerThreshold = 5
+	}
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = 30 * time.Second
+	}
+	if cfg.Base == nil {
+		cfg.Base = http.DefaultTransport
+	}
+	targets := append([]Target(nil), cfg.Targets...)
+	sort.SliceStable(targets, func(i, j int) bool { return len(targets[i].Prefix) > len(targets[j].Prefix) })
+	return &Transport{cfg: cfg, targets: targets, breakers: newBreakers(cfg.BreakerThreshold, cfg.BreakerCooldown)}
+}
+
+// target returns the policy for u and the key its circuit is kept under.
+func (t *Transport) target(u string) (Target, string) {
+	for _, tg := range t.targets {
+		if strings.HasPrefix(u, tg.Prefix) {
+			return tg, tg.Prefix
+		}
+	}
+	return t.cfg.Default, ""
+}
+
+func (t *Transport) token(ctx context.Context, tg Target) (string, error) {
+	switch tg.Auth {
+	case AuthUser:
+		u, ok := UserFrom(ctx)
+		if !ok {
+			return "", ErrNoUser
+		}
+		if tg.Audience == "" || t.cfg.Exchange == nil {
+			return u.Token, nil
+		}
+		return t.cfg.Exchange(ctx, u, tg.Audience)
+	case AuthService:
+		if t.cfg.ServiceToken == nil {
+			return "", errors.New("httpclient: no service token source configured")
+		}
+		return t.cfg.ServiceToken(ctx)
+	}
+	return "", nil
+}
+
+// RoundTrip implements http.RoundTripper. An Authorization header already
+// on the request is left as it is.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tg, key := t.target(req.URL.String())
+	if key == "" {
+		key = req.URL.Scheme + "://" + req.URL.Host
+	}
+	ctx := req.Context()
+
+	req = req.Clone(ctx)
+	if req.Header.Get("Authorization") == "" {
+		token, err := t.token(ctx, tg)
+		if err != nil {
+			closeBody(req)
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	retries := t.cfg.Retries
+	if retries < 0 || !retryable(req) {
+		retries = 0
+	}
+	for attempt := 0; ; attempt++ {
+		if !t.breakers.allow(key) {
+			closeBody(req)
+			return nil, fmt.Errorf("%w: %s", ErrCircuitOpen, key)
+		}
+		resp, err := t.attempt(req)
+		failed := err != nil || transient(resp.StatusCode)
+		t.breakers.record(key, !failed)
+		if !failed || attempt >= retries || ctx.Err() != nil {
+			return resp, err
+		}
+		delay := t.backoff(attempt, resp)
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// attempt sends req once under the per-attempt timeout. The timeout keeps
+// running while the caller reads the body and is released by Close.
+func (t *Transport) attempt(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.cfg.Timeout)
+	resp, err := t.cfg.Base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (t *Transport) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 && s <= 30 {
+			return time.Duration(s) * time.Second
+		}
+	}
+	d := t.cfg.Backoff << attempt
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryable reports whether req can be sent again safely: an idempotent
+// method, or a POST or PATCH carrying an Idempotency-Key, with a body that
+// can be replayed.
+func retryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// transient reports whether a status is worth retrying: Kong or the
+// target is briefly unavailable.
+func transient(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
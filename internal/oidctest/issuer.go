@@ -0,0 +1,194 @@
+// Package oidctest runs an in-process Keycloak-style OpenID Connect issuer
+// so tests can mint RS256 tokens the app accepts in AUTH_MODE=jwks, without
+// Docker or a real Keycloak.
+//
+//	iss := oidctest.New(t)
+//	iss.Setenv(t)
+//	token := iss.TokenFor(t, "alice", "user")
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Realm is the realm name in the issuer URL.
+const Realm = "test-realm"
+
+// Issuer is a running mock issuer. Its discovery document and JWKS follow
+// Keycloak's URL layout under URL.
+type Issuer struct {
+	// URL is the issuer ("iss") of minted tokens.
+	URL string
+	// JWKSURL serves the public signing keys.
+	JWKSURL string
+
+	server *httptest.Server
+
+	mu   sync.Mutex
+	keys []signingKey // current key first
+	seq  int
+}
+
+type signingKey struct {
+	kid string
+	key *rsa.PrivateKey
+	// cert is the self-signed certificate published as x5c, as Keycloak
+	// does.
+	cert []byte
+}
+
+// CertValidity is how long the certificates of the keys are valid.
+const CertValidity = 365 * 24 * time.Hour
+
+// New starts an issuer that is shut down when the test ends.
+func New(tb testing.TB) *Issuer {
+	tb.Helper()
+	i := &Issuer{}
+	i.server = httptest.NewServer(http.HandlerFunc(i.serveHTTP))
+	tb.Cleanup(i.server.Close)
+	i.URL = i.server.URL + "/realms/" + Realm
+	i.JWKSURL = i.URL + "/protocol/openid-connect/certs"
+	i.RotateKey(tb)
+	return i
+}
+
+// Setenv points the app at this issuer for the duration of the test, with
+// JWKS refetching unthrottled so RotateKey takes effect immediately.
+func (i *Issuer) Setenv(tb testing.TB) {
+	tb.Setenv("AUTH_MODE", "jwks")
+	tb.Setenv("KEYCLOAK_ISSUER", i.URL)
+	tb.Setenv("KEYCLOAK_JWKS_URL", i.JWKSURL)
+	tb.Setenv("KEYCLOAK_JWKS_MIN_REFRESH", "0s")
+}
+
+// RotateKey makes a new key current. Earlier keys stay in the JWKS so
+// tokens they signed remain valid, as with Keycloak's rotation.
+func (i *Issuer) RotateKey(tb testing.TB) {
+	tb.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		tb.Fatalf("oidctest: generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: Realm},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(CertValidity),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatalf("oidctest: create certificate: %v", err)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.seq++
+	i.keys = append([]signingKey{{kid: fmt.Sprintf("key-%d", i.seq), key: key, cert: cert}}, i.keys...)
+}
+
+// Token signs claims with the current key. iss, iat and exp (five minutes
+// ahead) are filled in unless claims sets them; set exp in the past to get
+// an expired token.
+func (i *Issuer) Token(tb testing.TB, claims jwt.MapClaims) string {
+	tb.Helper()
+	i.mu.Lock()
+	k := i.keys[0]
+	i.mu.Unlock()
+	return i.sign(tb, k.kid, k.key, claims)
+}
+
+// TokenFor mints a token for sub holding the given realm roles.
+func (i *Issuer) TokenFor(tb testing.TB, sub string, roles ...string) string {
+	tb.Helper()
+	rs := make([]interface{}, len(roles))
+	for n, r := range roles {
+		rs[n] = r
+	}
+	return i.Token(tb, jwt.MapClaims{
+		"sub":                sub,
+		"preferred_username": sub,
+		"realm_access":       map[string]interface{}{"roles": rs},
+	})
+}
+
+// ForgedToken signs claims with a key the issuer doesn't publish, for
+// testing that bad signatures are rejected.
+func (i *Issuer) ForgedToken(tb testing.TB, claims jwt.MapClaims) string {
+	tb.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		tb.Fatalf("oidctest: generate key: %v", err)
+	}
+	i.mu.Lock()
+	kid := i.keys[0].kid
+	i.mu.Unlock()
+	return i.sign(tb, kid, key, claims)
+}
+
+func (i *Issuer) sign(tb testing.TB, kid string, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	tb.Helper()
+	full := jwt.MapClaims{
+		"iss": i.URL,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range claims {
+		full[k] = v
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, full)
+	t.Header["kid"] = kid
+	s, err := t.SignedString(key)
+	if err != nil {
+		tb.Fatalf("oidctest: sign token: %v", err)
+	}
+	return s
+}
+
+func (i *Issuer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/realms/" + Realm + "/.well-known/openid-configuration":
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                i.URL,
+			"jwks_uri":                              i.JWKSURL,
+			"token_endpoint":                        i.URL + "/protocol/openid-connect/token",
+			"authorization_endpoint":                i.URL + "/protocol/openid-connect/auth",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	case "/realms/" + Realm + "/protocol/openid-connect/certs":
+		i.mu.Lock()
+		keys := make([]map[string]interface{}, 0, len(i.keys))
+		for _, k := range i.keys {
+			keys = append(keys, map[string]interface{}{
+				"kid": k.kid,
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(k.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.E)).Bytes()),
+				"x5c": []string{base64.StdEncoding.EncodeToString(k.cert)},
+			})
+		}
+		i.mu.Unlock()
+		writeJSON(w, map[string]interface{}{"keys": keys})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Item access levels. The creator of an item and admins have both; shares
+// grant one of them to other subjects or groups.
+const (
+	accessRead  = "read"
+	accessWrite = "write"
+)
+
+// itemShare grants a subject, or every member of a group, access to an
+// item. Subjects are sealed like createdBy.
+type itemShare struct {
+	Subject searchableString `bson:"subject,omitempty" json:"subject,omitempty"`
+	Group   string           `bson:"group,omitempty" json:"group,omitempty"`
+	Access  string           `bson:"access" json:"access"`
+}
+
+// itemACL is the list of shares of an item, besides its creator.
+type itemACL []itemShare
+
+// itemIndexes serve the visibility filter of non-admin listings.
+var itemIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "createdBy", Value: 1}}},
+	{Keys: bson.D{{Key: "acl.subject", Value: 1}}},
+	{Keys: bson.D{{Key: "acl.group", Value: 1}}},
+}
+
+// itemCaller is who an item function works for. Non-admins only see and
+// change the items they created or that are shared with them.
+type itemCaller struct {
+	Subject string
+	Groups  []string
+	Admin   bool
+}
+
+func newItemCaller(claims jwt.MapClaims, roles []string) itemCaller {
+	sub, _ := claims["sub"].(string)
+	return itemCaller{Subject: sub, Groups: auth.GroupsOf(claims), Admin: keycloakauth.HasAny(roles, "admin")}
+}
+
+// itemCallerOf returns the caller of an HTTP request.
+func itemCallerOf(c *fiber.Ctx) itemCaller {
+	t := tokenFor(c)
+	return newItemCaller(t.Claims, t.Roles)
+}
+
+// owns reports whether the caller created the item, or is an admin.
+func (u itemCaller) owns(it item) bool {
+	return u.Admin || (u.Subject != "" && string(it.CreatedBy) == u.Subject)
+}
+
+// can reports whether the caller has access, accessRead or accessWrite,
+// to the item.
+func (u itemCaller) can(it item, access string) bool {
+	if u.owns(it) {
+		return true
+	}
+	for _, s := range it.ACL {
+		if access == accessWrite && s.Access != accessWrite {
+			continue
+		}
+		if (s.Subject != "" && string(s.Subject) == u.Subject) || (s.Group != "" && slices.Contains(u.Groups, s.Group)) {
+			return true
+		}
+	}
+	return false
+}
+
+// visibility is the listing filter of the caller: nil for admins, who see
+// every item.
+func (u itemCaller) visibility() *itemCaller {
+	if u.Admin {
+		return nil
+	}
+	return &u
+}
+
+// checkItemAccess refuses an item the caller has no access to. Items the
+// caller can't read are reported as not found, so their IDs don't leak.
+func checkItemAccess(u itemCaller, it item, access string) *problem {
+	if u.can(it, access) {
+		return nil
+	}
+	if access == accessWrite && u.can(it, accessRead) {
+		return errForbidden("Item is shared with you read-only")
+	}
+	return errItemNotFound()
+}
+
+// shareRequest is one entry of the body of PUT /items/:id/acl.
+type shareRequest struct {
+	Subject string `json:"subject" validate:"required_without=Group,excluded_with=Group,max=255"`
+	Group   string `json:"group" validate:"max=255"`
+	Access  string `json:"access" validate:"required,oneof=read write"`
+}
+
+// aclRequest is the body of PUT /items/:id/acl, replacing the item's
+// shares.
+type aclRequest struct {
+	ACL []shareRequest `json:"acl" validate:"max=100,dive"`
+}
+
+func registerItemACLRoutes(items fiber.Router) {
+	items.Put("/:id/acl", shareItem).
+		Name(documented("shareItem", routeDoc{Summary: "Share an item with subjects or groups", Tags: []string{"items"}, Roles: []string{"user", "admin"}}))
+}
+
+// shareItem replaces the shares of an item. Only its creator and admins
+// can change them.
+func shareItem(c *fiber.Ctx) error {
+	id, err := itemID(c)
+	if err != nil {
+		return err
+	}
+	var req aclRequest
+	if err := bindBody(c, &req); err != nil {
+		return err
+	}
+	acl := make(itemACL, len(req.ACL))
+	for i, s := range req.ACL {
+		acl[i] = itemShare{Subject: searchableString(s.Subject), Group: s.Group, Access: s.Access}
+	}
+	doc, err := setItemACL(c.UserContext(), itemCallerOf(c), id, acl)
+	if err != nil {
+		return err
+	}
+	recordAudit(c, "items.share", id.Hex(), bson.M{"shares": len(acl)})
+	return c.JSON(doc)
+}
+
+func setItemACL(ctx context.Context, u itemCaller, id primitive.ObjectID, acl itemACL) (item, error) {
+	doc, err := findItem(ctx, u, id)
+	if err != nil {
+		return item{}, err
+	}
+	if !u.owns(doc) {
+		return item{}, errForbidden("Only the item's creator can share it")
+	}
+	err = withOutbox(ctx, func(ctx context.Context) (evs []cloudEvent, err error) {
+		if doc, err = itemDB.SetACL(ctx, id, acl); err != nil {
+			return nil, err
+		}
+		return []cloudEvent{newEvent(eventItemUpdated, itemSubject(id), doc)}, nil
+	})
+	if err != nil {
+		return item{}, itemProblem(err)
+	}
+	return doc, nil
+}
+
+// pgShare is an itemShare as stored in the acl column, with the subject
+// sealed.
+type pgShare struct {
+	Subject string `json:"subject,omitempty"`
+	Group   string `json:"group,omitempty"`
+	Access  string `json:"access"`
+}
+
+// pgValue renders the ACL for the acl jsonb column.
+func (acl itemACL) pgValue() ([]byte, error) {
+	rows := make([]pgShare, len(acl))
+	for i, s := range acl {
+		sub, err := sealValue(string(s.Subject), true)
+		if err != nil {
+			return nil, err
+		}
+		rows[i] = pgShare{Subject: sub, Group: s.Group, Access: s.Access}
+	}
+	return json.Marshal(rows)
+}
+
+// pgSharedWith is the acl containment pattern matching the shares with
+// the stored subject value, one of searchableForms.
+func pgSharedWith(stored string) []byte {
+	raw, _ := json.Marshal([]map[string]string{{"subject": stored}})
+	return raw
+}
+
+// scanPGACL reads the acl jsonb column.
+func scanPGACL(raw []byte) (itemACL, error) {
+	var rows []pgShare
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &rows); err != nil {
+			return nil, err
+		}
+	}
+	acl := make(itemACL, 0, len(rows))
+	for _, r := range rows {
+		sub, err := scanSealed(r.Subject)
+		if err != nil {
+			return nil, err
+		}
+		acl = append(acl, itemShare{Subject: searchableString(sub), Group: r.Group, Access: r.Access})
+	}
+	return acl, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const itemsCollection = "items"
+
+// deletedItemsCollection keeps deleted items until their retention runs
+// out, so an accidental delete can still be recovered from the database.
+const deletedItemsCollection = "items_deleted"
+
+// item is the document stored in the items collection.
+type item struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name        string             `bson:"name" json:"name"`
+	Description encryptedString    `bson:"description" json:"description"`
+	Tags        []string           `bson:"tags" json:"tags"`
+	CreatedBy   searchableString   `bson:"createdBy" json:"createdBy"`
+	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt   time.Time          `bson:"updatedAt" json:"updatedAt"`
+	// ACL shares the item beyond its creator.
+	ACL itemACL `bson:"acl,omitempty" json:"acl,omitempty"`
+}
+
+// deletedItem is an item moved to deletedItemsCollection.
+type deletedItem struct {
+	Item      item      `bson:",inline"`
+	DeletedAt time.Time `bson:"deletedAt"`
+}
+
+// itemRequest is the body of item create and replace calls.
+type itemRequest struct {
+	Name        string   `json:"name" validate:"required,max=100"`
+	Description string   `json:"description" validate:"max=1000"`
+	Tags        []string `json:"tags" validate:"max=20,dive,required,max=30"`
+}
+
+// listItemsQuery holds the query parameters of the item listing.
+type listItemsQuery struct {
+	Limit  int    `query:"limit" validate:"omitempty,min=1,max=100"`
+	Offset int    `query:"offset" validate:"min=0"`
+	Tag    string `query:"tag" validate:"max=30"`
+}
+
+// registerItemRoutes adds the item CRUD endpoints to a version group.
+func registerItemRoutes(r fiber.Router) {
+	items := r.Group("/items", requireAnyRole("user", "admin"))
+	items.Get("", listItems).
+		Name(documented("listItems", routeDoc{Summary: "List items", Tags: []string{"items"}, Roles: []string{"user", "admin"}}))
+	items.Post("", createItem).
+		Name(documented("createItem", routeDoc{Summary: "Create an item", Tags: []string{"items"}, Roles: []string{"user", "admin"}}))
+	items.Get("/:id", getItem).
+		Name(documented("getItem", routeDoc{Summary: "Fetch an item", Tags: []string{"items"}, Roles: []string{"user", "admin"}}))
+	items.Put("/:id", replaceItem).
+		Name(documented("replaceItem", routeDoc{Summary: "Replace an item", Tags: []string{"items"}, Roles: []string{"user", "admin"}}))
+	items.Delete("/:id", requireRole("admin"), requireHuman(), deleteItem).
+		Name(documented("deleteItem", routeDoc{Summary: "Delete an item", Tags: []string{"items"}, Roles: []string{"admin"}, Caller: policy.CallerHuman}))
+	registerItemACLRoutes(items)
+
+	// Fiber needs the colon escaped to keep it literal.
+	r.Post("/items\\:batch", requireAnyRole("user", "admin"), batchItems).
+		Name(documented("batchItems", routeDoc{Summary: "Create, update and delete items in bulk", Tags: []string{"items"}, Roles: []string{"user", "admin"}}))
+}
+
+func errItemNotFound() *problem {
+	return newProblem(fiber.StatusNotFound, problemAboutBlank, "Item not found")
+}
+
+// itemID parses the :id path parameter. Malformed IDs cannot match any
+// document and are reported as not found.
+func itemID(c *fiber.Ctx) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return id, errItemNotFound()
+	}
+	return id, nil
+}
+
+// subject returns the "sub" claim stored by the role middleware.
+func subject(c *fiber.Ctx) string {
+	claims, _ := c.Locals("claims").(jwt.MapClaims)
+	sub, _ := claims["sub"].(string)
+	return sub
+}
+
+func listItems(c *fiber.Ctx) error {
+	var q listItemsQuery
+	if err := bindQuery(c, &q); err != nil {
+		return err
+	}
+	if q.Limit == 0 {
+		q.Limit = 20
+	}
+	items, err := findItems(c.UserContext(), itemCallerOf(c), q)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"items": items, "limit": q.Limit, "offset": q.Offset})
+}
+
+func createItem(c *fiber.Ctx) error {
+	var req itemRequest
+	if err := bindBody(c, &req); err != nil {
+		return err
+	}
+	doc, err := insertItem(c.UserContext(), req, subject(c))
+	if err != nil {
+		return err
+	}
+	c.Location(c.Path() + "/" + doc.ID.Hex())
+	return c.Status(fiber.StatusCreated).JSON(doc)
+}
+
+func getItem(c *fiber.Ctx) error {
+	id, err := itemID(c)
+	if err != nil {
+		return err
+	}
+	doc, err := findItem(c.UserContext(), itemCallerOf(c), id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(doc)
+}
+
+func replaceItem(c *fiber.Ctx) error {
+	id, err := itemID(c)
+	if err != nil {
+		return err
+	}
+	var req itemRequest
+	if err := bindBody(c, &req); err != nil {
+		return err
+	}
+	doc, err := updateItem(c.UserContext(), itemCallerOf(c), id, req)
+	if err != nil {
+		return err
+	}
+	return c.JSON(doc)
+}
+
+func deleteItem(c *fiber.Ctx) error {
+	id, err := itemID(c)
+	if err != nil {
+		return err
+	}
+	if err := removeItem(c.UserContext(), itemCallerOf(c), id); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// The item functions below are shared by the HTTP handlers and the gRPC
+// service. They persist through itemDB, emit the item events and check
+// the caller's access to the items; their errors are *problem values
+// ready to be rendered.
+
+// itemProblem maps a store error onto the problem returned to callers.
+func itemProblem(err error) *problem {
+	if errors.Is(err, errNoDocument) {
+		return errItemNotFound()
+	}
+	return errDatabase(err)
+}
+
+// findItems returns a page of the items visible to u, newest first. q
+// must be validated.
+func findItems(ctx context.Context, u itemCaller, q listItemsQuery) ([]item, error) {
+	items, err := itemDB.List(ctx, itemFilter{Tag: q.Tag, VisibleTo: u.visibility()}, q.Offset, q.Limit)
+	if err != nil {
+		return nil, errDatabase(err)
+	}
+	return items, nil
+}
+
+func insertItem(ctx context.Context, req itemRequest, createdBy string) (item, error) {
+	now := time.Now().UTC()
+	doc := item{
+		ID:          primitive.NewObjectID(),
+		Name:        req.Name,
+		Description: encryptedString(req.Description),
+		Tags:        nonNilTags(req.Tags),
+		CreatedBy:   searchableString(createdBy),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	err := withOutbox(ctx, func(ctx context.Context) ([]cloudEvent, error) {
+		if err := itemDB.Insert(ctx, doc); err != nil {
+			return nil, err
+		}
+		return []cloudEvent{newEvent(eventItemCreated, itemSubject(doc.ID), doc)}, nil
+	})
+	if err != nil {
+		return item{}, errDatabase(err)
+	}
+	enqueueOrLog(ctx, "item.notify", "", bson.M{"id": doc.ID.Hex(), "name": doc.Name, "createdBy": doc.CreatedBy})
+	enqueueOrLog(ctx, "reports.compute", itemReportID, nil)
+	return doc, nil
+}
+
+func findItem(ctx context.Context, u itemCaller, id primitive.ObjectID) (item, error) {
+	doc, err := itemDB.Get(ctx, id)
+	if err != nil {
+		return item{}, itemProblem(err)
+	}
+	if p := checkItemAccess(u, doc, accessRead); p != nil {
+		return item{}, p
+	}
+	return doc, nil
+}
+
+// writableItem checks that u may change the item. Admins skip the lookup.
+func writableItem(ctx context.Context, u itemCaller, id primitive.ObjectID) error {
+	if u.Admin {
+		return nil
+	}
+	doc, err := itemDB.Get(ctx, id)
+	if err != nil {
+		return itemProblem(err)
+	}
+	if p := checkItemAccess(u, doc, accessWrite); p != nil {
+		return p
+	}
+	return nil
+}
+
+func updateItem(ctx context.Context, u itemCaller, id primitive.ObjectID, req itemRequest) (item, error) {
+	if err := writableItem(ctx, u, id); err != nil {
+		return item{}, err
+	}
+	var doc item
+	err := withOutbox(ctx, func(ctx context.Context) (evs []cloudEvent, err error) {
+		if doc, err = itemDB.Update(ctx, id, changesFrom(req)); err != nil {
+			return nil, err
+		}
+		return []cloudEvent{newEvent(eventItemUpdated, itemSubject(id), doc)}, nil
+	})
+	if err != nil {
+		return item{}, itemProblem(err)
+	}
+	enqueueOrLog(ctx, "reports.compute", itemReportID, nil)
+	return doc, nil
+}
+
+func removeItem(ctx context.Context, u itemCaller, id primitive.ObjectID) error {
+	if err := writableItem(ctx, u, id); err != nil {
+		return err
+	}
+	err := withOutbox(ctx, func(ctx context.Context) ([]cloudEvent, error) {
+		if _, err := itemDB.Delete(ctx, id); err != nil {
+			return nil, err
+		}
+		return []cloudEvent{newEvent(eventItemDeleted, itemSubject(id), fiber.Map{"id": id.Hex()})}, nil
+	})
+	if err != nil {
+		return itemProblem(err)
+	}
+	enqueueOrLog(ctx, "reports.compute", itemReportID, nil)
+	return nil
+}
+
+func changesFrom(req itemRequest) itemChanges {
+	return itemChanges{
+		Name:        req.Name,
+		Description: encryptedString(req.Description),
+		Tags:        nonNilTags(req.Tags),
+		UpdatedAt:   time.Now().UTC(),
+	}
+}
+
+// keepDeleted hands deleted items to keep for the deleted-items retention
+// period. The delete has already happened, so a failure is only logged.
+func keepDeleted(ctx context.Context, keep func(context.Context, []deletedItem) error, docs ...item) {
+	now := time.Now().UTC()
+	kept := make([]deletedItem, len(docs))
+	for i, doc := range docs {
+		kept[i] = deletedItem{Item: doc, DeletedAt: now}
+	}
+	if err := keep(ctx, kept); err != nil {
+		log.Printf("Deleted items not kept for recovery: %v", err)
+	}
+}
+
+// itemSubject is the CloudEvents subject of events about an item.
+func itemSubject(id primitive.ObjectID) string {
+	return "items/" + id.Hex()
+}
+
+func nonNilTags(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
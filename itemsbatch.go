@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Batch operation kinds.
+const (
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+)
+
+// batchRequest is the body of POST /items:batch. Operations are validated
+// one by one so that a bad entry fails alone.
+type batchRequest struct {
+	Operations []batchOperation `json:"operations" validate:"required,min=1"`
+}
+
+type batchOperation struct {
+	Op   string       `json:"op" validate:"required,oneof=create update delete"`
+	ID   string       `json:"id" validate:"required_unless=Op create"`
+	Item *itemRequest `json:"item" validate:"required_unless=Op delete"`
+}
+
+// batchResult reports the outcome of one operation, in request order.
+type batchResult struct {
+	Index  int      `json:"index"`
+	Op     string   `json:"op"`
+	ID     string   `json:"id,omitempty"`
+	Status int      `json:"status"`
+	Item   *item    `json:"item,omitempty"`
+	Error  *problem `json:"error,omitempty"`
+}
+
+func batchItems(c *fiber.Ctx) error {
+	var req batchRequest
+	if err := bindBody(c, &req); err != nil {
+		return err
+	}
+	if max := getEnvInt("ITEMS_BATCH_MAX", 500); len(req.Operations) > max {
+		return errValidation([]fieldError{{
+			Field:   "operations",
+			Rule:    "max",
+			Message: fmt.Sprintf("must contain at most %d operations", max),
+		}})
+	}
+	results := writeItemBatch(c.UserContext(), req.Operations, itemCallerOf(c), batchDeleteCheck(c))
+
+	failed := 0
+	for _, r := range results {
+		if r.Error != nil {
+			failed++
+		}
+	}
+	return c.JSON(fiber.Map{
+		"results":   results,
+		"succeeded": len(results) - failed,
+		"failed":    failed,
+	})
+}
+
+// batchDeleteCheck returns why the caller may not delete an item by ID,
+// or nil. Each delete of a batch is decided as DELETE /items/:id would be:
+// by the policy rule for that path, caller kind included, then by the
+// route's own admin role and person checks. The policy is applied even
+// when Kong enforces it, as Kong only sees the batch request.
+func batchDeleteCheck(c *fiber.Ctx) func(id string) *problem {
+	t := tokenFor(c)
+	base := strings.TrimSuffix(c.Path(), ":batch")
+	return func(id string) *problem {
+		if rule, ok := currentPolicy.Load().Match(fiber.MethodDelete, base+"/"+id); ok && !rule.Open() {
+			if reason := rule.Check(t.Claims, t.Roles); reason != "" {
+				return errForbidden(reason)
+			}
+		}
+		if !keycloakauth.HasAny(t.Roles, "admin") {
+			return errForbidden("Missing role: admin")
+		}
+		if reason := policy.CheckCaller(t.Claims, policy.CallerHuman); reason != "" {
+			return errForbidden(reason)
+		}
+		return nil
+	}
+}
+
+// writeItemBatch validates ops and runs the valid ones as one unordered
+// bulk write. Updates and deletes of missing items fail with 404, and so
+// do those of items not visible to u; mayDelete refuses the deletes the
+// caller could not make on DELETE /items/:id.
+func writeItemBatch(ctx context.Context, ops []batchOperation, u itemCaller, mayDelete func(id string) *problem) []batchResult {
+	results := make([]batchResult, len(ops))
+	ids := make([]primitive.ObjectID, len(ops))
+	seen := map[primitive.ObjectID]bool{}
+	var lookup []primitive.ObjectID
+	for i, op := range ops {
+		results[i] = batchResult{Index: i, Op: op.Op, ID: op.ID}
+		if err := validateStruct(op); err != nil {
+			results[i].Error = asProblem(err)
+			continue
+		}
+		if op.Op == batchCreate {
+			ids[i] = primitive.NewObjectID()
+			results[i].ID = ids[i].Hex()
+			continue
+		}
+		if op.Op == batchDelete {
+			if p := mayDelete(op.ID); p != nil {
+				results[i].Error = p
+				continue
+			}
+		}
+		id, err := primitive.ObjectIDFromHex(op.ID)
+		if err != nil {
+			results[i].Error = errItemNotFound()
+			continue
+		}
+		// Unordered writes may run in any order, so one item per batch.
+		if seen[id] {
+			results[i].Error = newProblem(fiber.StatusConflict, problemAboutBlank, "Item appears more than once in the batch")
+			continue
+		}
+		seen[id] = true
+		ids[i] = id
+		lookup = append(lookup, id)
+	}
+
+	// Report missing items up front: bulk writes only return totals.
+	existing := map[primitive.ObjectID]item{}
+	if len(lookup) > 0 {
+		var err error
+		if existing, err = itemDB.GetMany(ctx, lookup); err != nil {
+			return failBatch(results, errDatabase(err))
+		}
+	}
+
+	now := time.Now().UTC()
+	var writes []itemWrite
+	var writeOp []int
+	for i, op := range ops {
+		if results[i].Error != nil {
+			continue
+		}
+		if op.Op != batchCreate {
+			doc, ok := existing[ids[i]]
+			if !ok {
+				results[i].Error = errItemNotFound()
+				continue
+			}
+			if p := checkItemAccess(u, doc, accessWrite); p != nil {
+				results[i].Error = p
+				continue
+			}
+		}
+		w := itemWrite{Op: op.Op, ID: ids[i]}
+		switch op.Op {
+		case batchCreate:
+			w.Doc = item{
+				ID:          ids[i],
+				Name:        op.Item.Name,
+				Description: encryptedString(op.Item.Description),
+				Tags:        nonNilTags(op.Item.Tags),
+				CreatedBy:   searchableString(u.Subject),
+				CreatedAt:   now,
+				UpdatedAt:   now,
+			}
+		case batchUpdate:
+			w.Set = changesFrom(*op.Item)
+		}
+		writes = append(writes, w)
+		writeOp = append(writeOp, i)
+	}
+	if len(writes) > 0 {
+		errs, err := bulkWithEvents(ctx, writes, func(ok []bool) []cloudEvent {
+			var evs []cloudEvent
+			for k, w := range writes {
+				if !ok[k] {
+					continue
+				}
+				switch w.Op {
+				case batchCreate:
+					evs = append(evs, newEvent(eventItemCreated, itemSubject(w.ID), w.Doc))
+				case batchUpdate:
+					updated := existing[w.ID]
+					updated.Name, updated.Description, updated.Tags, updated.UpdatedAt = w.Set.Name, w.Set.Description, w.Set.Tags, w.Set.UpdatedAt
+					evs = append(evs, newEvent(eventItemUpdated, itemSubject(w.ID), updated))
+				case batchDelete:
+					evs = append(evs, newEvent(eventItemDeleted, itemSubject(w.ID), fiber.Map{"id": w.ID.Hex()}))
+				}
+			}
+			return evs
+		})
+		if err != nil {
+			for _, i := range writeOp {
+				results[i].Error = errDatabase(err)
+			}
+		}
+		for k, err := range errs {
+			if err != nil {
+				results[writeOp[k]].Error = errDatabase(err)
+			}
+		}
+	}
+
+	changed := false
+	for k, i := range writeOp {
+		r, w := &results[i], writes[k]
+		if r.Error != nil {
+			continue
+		}
+		changed = true
+		switch r.Op {
+		case batchCreate:
+			r.Status, r.Item = fiber.StatusCreated, &w.Doc
+			enqueueOrLog(ctx, "item.notify", "", bson.M{"id": r.ID, "name": w.Doc.Name, "createdBy": w.Doc.CreatedBy})
+		case batchUpdate:
+			r.Status = fiber.StatusOK
+		case batchDelete:
+			r.Status = fiber.StatusNoContent
+		}
+	}
+	if changed {
+		enqueueOrLog(ctx, "reports.compute", itemReportID, nil)
+	}
+	for i := range results {
+		if results[i].Error != nil {
+			results[i].Status = results[i].Error.Status
+		}
+	}
+	return results
+}
+
+// errBulkAborted rolls back a bulk write that had failed writes.
+var errBulkAborted = errors.New("bulk write aborted")
+
+// bulkWithEvents runs writes as one unordered bulk write, with the events
+// that events returns for the writes that succeeded, and returns one error
+// slot per write. With the outbox the writes and their events commit in
+// one transaction, which a failed write aborts; it is then retried without
+// the failed writes, so the batch keeps its partial success.
+func bulkWithEvents(ctx context.Context, writes []itemWrite, events func(ok []bool) []cloudEvent) ([]error, error) {
+	errs := make([]error, len(writes))
+	pending := make([]int, len(writes))
+	for i := range pending {
+		pending[i] = i
+	}
+	for len(pending) > 0 {
+		sub := make([]itemWrite, len(pending))
+		for k, i := range pending {
+			sub[k] = writes[i]
+		}
+		var subErrs []error
+		err := withOutbox(ctx, func(ctx context.Context) ([]cloudEvent, error) {
+			var err error
+			if subErrs, err = itemDB.Bulk(ctx, sub); err != nil {
+				return nil, err
+			}
+			ok := make([]bool, len(writes))
+			for k, i := range pending {
+				if subErrs[k] != nil {
+					if outboxEnabled {
+						return nil, errBulkAborted
+					}
+					continue
+				}
+				ok[i] = true
+			}
+			return events(ok), nil
+		})
+		aborted := errors.Is(err, errBulkAborted)
+		if err != nil && !aborted {
+			return errs, err
+		}
+		var retry []int
+		for k, i := range pending {
+			if subErrs[k] != nil {
+				errs[i] = subErrs[k]
+			} else if aborted {
+				retry = append(retry, i)
+			}
+		}
+		pending = retry
+	}
+	return errs, nil
+}
+
+// failBatch marks every operation not already rejected with p.
+func failBatch(results []batchResult, p *problem) []batchResult {
+	for i := range results {
+		if results[i].Error == nil {
+			results[i].Error = p
+		}
+		results[i].Status = results[i].Error.Status
+	}
+	return results
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Batch deletes are refused to the callers DELETE /items/:id refuses,
+// with and without a policy file.
+func TestBatchDeleteChecksLikeDeleteItem(t *testing.T) {
+	p, err := policy.Load("config/policy.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { currentPolicy.Store(nil) })
+	app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
+	registerItemRoutes(app.Group("/api/v1"))
+
+	robot := bearer(t, jwt.MapClaims{"sub": "u-robot", "client_id": "reporting-batch", "roles": []interface{}{"admin"}})
+	bob := bearer(t, jwt.MapClaims{"sub": "u-bob", "roles": []interface{}{"user"}})
+	alice := bearer(t, jwt.MapClaims{"sub": "u-alice", "roles": []interface{}{"admin"}})
+	stricter := &policy.Policy{Rules: []policy.Rule{
+		{Pattern: policy.Pattern{Methods: []string{"DELETE"}, Path: "/api/*/items/*"}, Roles: []string{"owner"}},
+	}}
+	cases := []struct {
+		name   string
+		policy *policy.Policy
+		auth   string
+		reason string
+	}{
+		{"service account admin, policy", p, robot, "Service account tokens are not accepted here; sign in as a user"},
+		{"service account admin, no policy", nil, robot, "Service account tokens are not accepted here; sign in as a user"},
+		{"user, policy", p, bob, "Missing role: admin"},
+		{"user, no policy", nil, bob, "Missing role: admin"},
+		{"admin, stricter policy", stricter, alice, "Missing role: owner"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			currentPolicy.Store(c.policy)
+			body := `{"operations":[{"op":"delete","id":"64b7f0c2a1b2c3d4e5f60718"}]}`
+			req := httptest.NewRequest(fiber.MethodPost, "/api/v1/items:batch", strings.NewReader(body))
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			req.Header.Set(fiber.HeaderAuthorization, c.auth)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out struct {
+				Results []batchResult `json:"results"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+				t.Fatalf("status %d: %v", resp.StatusCode, err)
+			}
+			if len(out.Results) != 1 {
+				t.Fatalf("results: %+v", out.Results)
+			}
+			r := out.Results[0]
+			if r.Status != fiber.StatusForbidden || r.Error == nil || r.Error.Detail != c.reason {
+				t.Errorf("got %d %+v, want 403 %q", r.Status, r.Error, c.reason)
+			}
+		})
+	}
+}
+
+// failingBulkStore fails the bulk writes of the items in fail.
+type failingBulkStore struct {
+	itemStore
+	fail map[primitive.ObjectID]bool
+}
+
+func (s failingBulkStore) Bulk(ctx context.Context, writes []itemWrite) ([]error, error) {
+	errs := make([]error, len(writes))
+	for i, w := range writes {
+		if s.fail[w.ID] {
+			errs[i] = errors.New("duplicate key")
+		}
+	}
+	return errs, nil
+}
+
+// Only the writes of a batch that succeed have their events published.
+func TestBulkWithEventsSkipsFailedWrites(t *testing.T) {
+	ok, failed := primitive.NewObjectID(), primitive.NewObjectID()
+	prevDB, prevEvents := itemDB, events
+	itemDB = failingBulkStore{fail: map[primitive.ObjectID]bool{failed: true}}
+	events = make(chan cloudEvent, 4)
+	t.Cleanup(func() { itemDB, events = prevDB, prevEvents })
+
+	writes := []itemWrite{{Op: batchCreate, ID: ok}, {Op: batchCreate, ID: failed}}
+	errs, err := bulkWithEvents(context.Background(), writes, func(done []bool) []cloudEvent {
+		var evs []cloudEvent
+		for k, w := range writes {
+			if done[k] {
+				evs = append(evs, newEvent(eventItemCreated, itemSubject(w.ID), nil))
+			}
+		}
+		return evs
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != nil || errs[1] == nil {
+		t.Fatalf("errs %v, want only the second write failed", errs)
+	}
+	if len(events) != 1 {
+		t.Fatalf("%d events published, want 1", len(events))
+	}
+	if e := <-events; e.Subject != itemSubject(ok) {
+		t.Errorf("event for %s, want %s", e.Subject, itemSubject(ok))
+	}
+}
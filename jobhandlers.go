@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const reportsCollection = "reports"
+
+// itemReportID names the report of item counts per tag.
+const itemReportID = "items-by-tag"
+
+// notifyItemCreated mails NOTIFY_ITEM_CREATED_TO about a new item through
+// SMTP_ADDR. Without SMTP configured the message is only logged.
+func notifyItemCreated(_ context.Context, payload bson.M) error {
+	to := getEnvList("NOTIFY_ITEM_CREATED_TO", nil)
+	if len(to) == 0 {
+		return nil
+	}
+	subject := fmt.Sprintf("New item: %v", payload["name"])
+	body := fmt.Sprintf("Item %v (%v) was created by %v.\r\n", payload["name"], payload["id"], openField(payload["createdBy"]))
+
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		log.Printf("SMTP_ADDR not set, not sending %q to %s", subject, strings.Join(to, ", "))
+		return nil
+	}
+	from := getEnv("SMTP_FROM", "fiber-demo@localhost")
+	msg := "From: " + from + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" + body
+
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", user, secrets.Get("SMTP_PASSWORD", ""), host)
+	}
+	return smtp.SendMail(addr, auth, from, to, []byte(msg))
+}
+
+// itemReport counts items per tag.
+type itemReport struct {
+	ID         string         `bson:"_id" json:"id"`
+	Total      int64          `bson:"total" json:"total"`
+	Tags       map[string]int `bson:"tags" json:"tags"`
+	ComputedAt time.Time      `bson:"computedAt" json:"computedAt"`
+}
+
+// computeItemReport rebuilds the items-by-tag report.
+func computeItemReport(ctx context.Context, _ bson.M) error {
+	total, err := itemDB.Count(ctx)
+	if err != nil {
+		return err
+	}
+	tags, err := itemDB.TagCounts(ctx)
+	if err != nil {
+		return err
+	}
+	report := itemReport{ID: itemReportID, Total: total, Tags: tags, ComputedAt: time.Now().UTC()}
+	_, err = db().Collection(reportsCollection).ReplaceOne(ctx, bson.M{"_id": itemReportID}, report, options.Replace().SetUpsert(true))
+	reportCache.invalidate(ctx, itemReportID)
+	return err
+}
+
+func registerReportRoutes(r fiber.Router) {
+	r.Get("/reports/:name", getReport)
+}
+
+func getReport(c *fiber.Ctx) error {
+	var report itemReport
+	name := c.Params("name")
+	if reportCache.get(c.UserContext(), name, &report) {
+		return c.JSON(report)
+	}
+	err := db().Collection(reportsCollection).FindOne(c.UserContext(), bson.M{"_id": name}).Decode(&report)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return newProblem(fiber.StatusNotFound, problemAboutBlank, "Report not computed yet")
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+	reportCache.set(c.UserContext(), name, report)
+	return c.JSON(report)
+}
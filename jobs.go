@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const jobsCollection = "jobs"
+
+// Job states. A running job whose visibility timeout (runAt) has passed
+// is treated as abandoned by a crashed worker and claimed again.
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobDead    = "dead"
+)
+
+// job is a unit of asynchronous work in the jobs collection.
+type job struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Type        string             `bson:"type" json:"type"`
+	Payload     bson.M             `bson:"payload" json:"payload"`
+	Key         string             `bson:"key,omitempty" json:"key,omitempty"`
+	Status      string             `bson:"status" json:"status"`
+	Attempts    int                `bson:"attempts" json:"attempts"`
+	MaxAttempts int                `bson:"maxAttempts" json:"maxAttempts"`
+	RunAt       time.Time          `bson:"runAt" json:"runAt"`
+	LockedBy    string             `bson:"lockedBy,omitempty" json:"lockedBy,omitempty"`
+	LastError   string             `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt   time.Time          `bson:"updatedAt" json:"updatedAt"`
+}
+
+var jobIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "status", Value: 1}, {Key: "runAt", Value: 1}}},
+	// At most one pending job per key, which makes enqueueing with a key
+	// idempotent.
+	{
+		Keys: bson.D{{Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+			"status": jobPending, "key": bson.M{"$exists": true},
+		}),
+	},
+}
+
+// jobHandler performs one job. A returned error schedules a retry.
+type jobHandler func(ctx context.Context, payload bson.M) error
+
+// jobHandlers maps job types to their handlers.
+var jobHandlers = map[string]jobHandler{
+	"item.notify":     notifyItemCreated,
+	"reports.compute": computeItemReport,
+	"webhook.deliver": deliverWebhook,
+}
+
+var jobsEnabled bool
+
+// enqueueJob adds a job, or does nothing when jobs are disabled. With a key
+// it is dropped if a pending job with the same key exists, so bursts of
+// triggers (e.g. many item writes) collapse into one run.
+func enqueueJob(ctx context.Context, typ, key string, payload bson.M) error {
+	if !jobsEnabled {
+		return nil
+	}
+	now := time.Now().UTC()
+	j := job{
+		Type:        typ,
+		Payload:     payload,
+		Key:         key,
+		Status:      jobPending,
+		MaxAttempts: getEnvInt("JOBS_MAX_ATTEMPTS", 5),
+		RunAt:       now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if key == "" {
+		_, err := db().Collection(jobsCollection).InsertOne(ctx, j)
+		return err
+	}
+	_, err := db().Collection(jobsCollection).UpdateOne(ctx,
+		bson.M{"key": key, "status": jobPending},
+		bson.M{"$setOnInsert": j},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// enqueueOrLog is for callers where the job is a side effect that must
+// not fail the request.
+func enqueueOrLog(ctx context.Context, typ, key string, payload bson.M) {
+	if err := enqueueJob(ctx, typ, key, payload); err != nil {
+		log.Printf("Enqueue %s failed: %v", typ, err)
+	}
+}
+
+// claimJob takes the next due job and hides it from other workers for the
+// visibility timeout.
+func claimJob(ctx context.Context, worker string, visibility time.Duration) (*job, error) {
+	now := time.Now().UTC()
+	var j job
+	err := db().Collection(jobsCollection).FindOneAndUpdate(ctx,
+		bson.M{"status": bson.M{"$in": []string{jobPending, jobRunning}}, "runAt": bson.M{"$lte": now}},
+		bson.M{
+			"$set": bson.M{"status": jobRunning, "runAt": now.Add(visibility), "lockedBy": worker, "updatedAt": now},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "runAt", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&j)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// retryDelay backs off exponentially from 10s, capped at an hour.
+func retryDelay(attempts int) time.Duration {
+	d := 10 * time.Second << (attempts - 1)
+	if d <= 0 || d > time.Hour {
+		return time.Hour
+	}
+	return d
+}
+
+// finishJob records the outcome. Only the worker holding the claim may
+// finish the job, so a worker that overran its visibility timeout cannot
+// overwrite the result of the one that took over.
+func finishJob(ctx context.Context, j *job, worker string, runErr error) error {
+	now := time.Now().UTC()
+	set := bson.M{"updatedAt": now}
+	switch {
+	case runErr == nil:
+		set["status"] = jobDone
+	case j.Attempts >= j.MaxAttempts:
+		set["status"] = jobDead
+		set["lastError"] = runErr.Error()
+	default:
+		set["status"] = jobPending
+		set["runAt"] = now.Add(retryDelay(j.Attempts))
+		set["lastError"] = runErr.Error()
+	}
+	_, err := db().Collection(jobsCollection).UpdateOne(ctx,
+		bson.M{"_id": j.ID, "lockedBy": worker, "status": jobRunning},
+		bson.M{"$set": set, "$unset": bson.M{"lockedBy": ""}})
+	return err
+}
+
+func runJob(j *job, visibility time.Duration) error {
+	h, ok := jobHandlers[j.Type]
+	if !ok {
+		return fmt.Errorf("no handler for job type %q", j.Type)
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), jobAttemptKey{}, j.Attempts), visibility)
+	defer cancel()
+	return h(ctx, j.Payload)
+}
+
+type jobAttemptKey struct{}
+
+// jobAttempt returns which attempt at its job a handler is running,
+// counting from 1.
+func jobAttempt(ctx context.Context) int {
+	n, _ := ctx.Value(jobAttemptKey{}).(int)
+	return n
+}
+
+func jobWorker(name string, poll, visibility time.Duration) {
+	for {
+		j, err := claimJob(context.Background(), name, visibility)
+		if err != nil {
+			log.Println("Job claim failed:", err)
+		}
+		if j == nil {
+			time.Sleep(poll)
+			continue
+		}
+		runErr := runJob(j, visibility)
+		if runErr != nil {
+			log.Printf("Job %s (%s) attempt %d/%d failed: %v", j.ID.Hex(), j.Type, j.Attempts, j.MaxAttempts, runErr)
+		}
+		if err := finishJob(context.Background(), j, name, runErr); err != nil {
+			log.Printf("Job %s: recording result failed: %v", j.ID.Hex(), err)
+		}
+	}
+}
+
+// initJobs enables the queue when JOBS_ENABLED is set and starts
+// JOBS_WORKERS workers (default 2; 0 only enqueues, leaving processing
+// to other replicas). Workers poll every JOBS_POLL_INTERVAL (default 1s)
+// and hold a job for JOBS_VISIBILITY_TIMEOUT (default 5m) before another
+// worker may take it over.
+func initJobs() {
+	if jobsEnabled = getEnvBool("JOBS_ENABLED", false); !jobsEnabled {
+		return
+	}
+	poll, err := time.ParseDuration(getEnv("JOBS_POLL_INTERVAL", "1s"))
+	if err != nil {
+		log.Fatal("JOBS_POLL_INTERVAL: ", err)
+	}
+	visibility, err := time.ParseDuration(getEnv("JOBS_VISIBILITY_TIMEOUT", "5m"))
+	if err != nil {
+		log.Fatal("JOBS_VISIBILITY_TIMEOUT: ", err)
+	}
+	host, _ := os.Hostname()
+	workers := getEnvInt("JOBS_WORKERS", 2)
+	for i := 0; i < workers; i++ {
+		go jobWorker(host+"/"+strconv.Itoa(i), poll, visibility)
+	}
+	log.Printf("Job queue enabled with %d workers", workers)
+}
+
+func registerJobRoutes(r fiber.Router) {
+	r.Get("/jobs", listJobs)
+	r.Get("/jobs/:id", getJob)
+	r.Post("/jobs/:id/retry", retryJob)
+}
+
+type listJobsQuery struct {
+	Status string `query:"status" validate:"omitempty,oneof=pending running done dead"`
+	Type   string `query:"type" validate:"max=100"`
+	Limit  int    `query:"limit" validate:"omitempty,min=1,max=100"`
+}
+
+func listJobs(c *fiber.Ctx) error {
+	var q listJobsQuery
+	if err := bindQuery(c, &q); err != nil {
+		return err
+	}
+	if q.Limit == 0 {
+		q.Limit = 50
+	}
+	filter := bson.M{}
+	if q.Status != "" {
+		filter["status"] = q.Status
+	}
+	if q.Type != "" {
+		filter["type"] = q.Type
+	}
+	cur, err := db().Collection(jobsCollection).Find(c.UserContext(), filter,
+		options.Find().SetSort(bson.D{{Key: "updatedAt", Value: -1}}).SetLimit(int64(q.Limit)))
+	if err != nil {
+		return errDatabase(err)
+	}
+	jobs := []job{}
+	if err := cur.All(c.UserContext(), &jobs); err != nil {
+		return errDatabase(err)
+	}
+	return c.JSON(fiber.Map{"jobs": jobs})
+}
+
+func errJobNotFound() *problem {
+	return newProblem(fiber.StatusNotFound, problemAboutBlank, "Job not found")
+}
+
+func getJob(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return errJobNotFound()
+	}
+	var j job
+	err = db().Collection(jobsCollection).FindOne(c.UserContext(), bson.M{"_id": id}).Decode(&j)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errJobNotFound()
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+	return c.JSON(j)
+}
+
+// retryJob puts a dead job back in the queue with a fresh attempt budget.
+func retryJob(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return errJobNotFound()
+	}
+	now := time.Now().UTC()
+	var j job
+	err = db().Collection(jobsCollection).FindOneAndUpdate(c.UserContext(),
+		bson.M{"_id": id, "status": jobDead},
+		bson.M{"$set": bson.M{"status": jobPending, "attempts": 0, "runAt": now, "updatedAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&j)
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		n, err := db().Collection(jobsCollection).CountDocuments(c.UserContext(), bson.M{"_id": id})
+		if err != nil {
+			return errDatabase(err)
+		}
+		if n == 0 {
+			return errJobNotFound()
+		}
+		return newProblem(fiber.StatusConflict, problemAboutBlank, "Only dead jobs can be retried")
+	case mongo.IsDuplicateKeyError(err):
+		return newProblem(fiber.StatusConflict, problemAboutBlank, "A pending job with the same key already exists")
+	case err != nil:
+		return errDatabase(err)
+	}
+	recordAudit(c, "job.retry", j.ID.Hex(), bson.M{"type": j.Type})
+	return c.JSON(j)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keycloakHTTP is the client used for every call to Keycloak. It presents
+// the KEYCLOAK_TLS_* client certificate and trusts KEYCLOAK_TLS_CA_FILE
+// when those are configured.
+var keycloakHTTP = http.DefaultClient
+
+func initKeycloakClient() error {
+	tlsCfg, err := upstreamTLSConfig("KEYCLOAK")
+	if err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsCfg != nil {
+		transport.TLSClientConfig = tlsCfg
+	}
+	var rt http.RoundTripper = tracingTransport{transport}
+	if chaosEnabled {
+		rt = chaosTransport{rt}
+	}
+	keycloakHTTP = &http.Client{Transport: rt, Timeout: 10 * time.Second}
+	return nil
+}
+
+// keycloakClientSecret is the confidential client secret used for
+// client-credentials, token exchange and Admin API calls.
+func keycloakClientSecret() string {
+	return secrets.Get("KEYCLOAK_CLIENT_SECRET", "")
+}
+
+// keycloakRealmURL splits the issuer into the server base URL and realm
+// name ("http://kc:8080/realms/demo" -> "http://kc:8080", "demo").
+func keycloakRealmURL() (base, realm string) {
+	issuer := keycloakIssuer()
+	i := strings.LastIndex(issuer, "/realms/")
+	if i < 0 {
+		return issuer, ""
+	}
+	return issuer[:i], issuer[i+len("/realms/"):]
+}
+
+// keycloakClientID is the confidential client the app authenticates as.
+func keycloakClientID() string {
+	return getEnv("KEYCLOAK_CLIENT_ID", "fiber-app")
+}
+
+var serviceToken struct {
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// forgetServiceToken makes the next keycloakServiceToken call fetch a new
+// token.
+func forgetServiceToken() {
+	serviceToken.Lock()
+	defer serviceToken.Unlock()
+	serviceToken.token, serviceToken.expires = "", time.Time{}
+}
+
+// keycloakServiceToken returns an access token for the app's own service
+// account (client credentials grant), cached until shortly before expiry.
+func keycloakServiceToken(ctx context.Context) (string, error) {
+	serviceToken.Lock()
+	defer serviceToken.Unlock()
+	if serviceToken.token != "" && time.Until(serviceToken.expires) > 30*time.Second {
+		return serviceToken.token, nil
+	}
+	secret := keycloakClientSecret()
+	if secret == "" {
+		return "", errors.New("KEYCLOAK_CLIENT_SECRET is not set")
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {keycloakClientID()},
+		"client_secret": {secret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, keycloakIssuer()+"/protocol/openid-connect/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := keycloakHTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("service token: %s", resp.Status)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("service token: %w", err)
+	}
+	serviceToken.token = body.AccessToken
+	serviceToken.expires = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	return body.AccessToken, nil
+}
+
+// keycloakAdmin calls the Admin API of the app's realm at path (e.g.
+// "/roles") with the service account token and decodes the JSON reply
+// into out. The service account needs the matching realm-management roles.
+func keycloakAdmin(ctx context.Context, method, path string, body, out interface{}) error {
+	token, err := keycloakServiceToken(ctx)
+	if err != nil {
+		return err
+	}
+	_, realm := keycloakRealmURL()
+	return keycloakAdminAs(ctx, token, method, "/admin/realms/"+realm+path, body, out)
+}
+
+// keycloakAdminError is a non-2xx reply from the Admin API.
+type keycloakAdminError struct {
+	Method, Path string
+	Status       int
+	Message      string
+}
+
+func (e *keycloakAdminError) Error() string {
+	return fmt.Sprintf("keycloak %s %s: %d %s %s", e.Method, e.Path, e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// keycloakAdminStatus returns the status of an Admin API error, or 0.
+func keycloakAdminStatus(err error) int {
+	var adminErr *keycloakAdminError
+	if errors.As(err, &adminErr) {
+		return adminErr.Status
+	}
+	return 0
+}
+
+// keycloakAdminAs calls path on the Keycloak server (e.g.
+// "/admin/realms/demo/users") with token, for callers that aren't limited
+// to the app's realm.
+func keycloakAdminAs(ctx context.Context, token, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	base, _ := keycloakRealmURL()
+	req, err := http.NewRequestWithContext(ctx, method, base+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := keycloakHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &keycloakAdminError{Method: method, Path: path, Status: resp.StatusCode, Message: string(bytes.TrimSpace(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// realmRoles caches the realm's role names, refreshed by the scheduler.
+var realmRoles atomic.Pointer[[]string]
+
+// refreshRealmRoles reloads the role cache and warns about policy rules
+// naming roles the realm doesn't define, which can never match.
+func refreshRealmRoles(ctx context.Context) error {
+	var roles []struct {
+		Name string `json:"name"`
+	}
+	if err := keycloakAdmin(ctx, http.MethodGet, "/roles", nil, &roles); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(roles))
+	known := map[string]bool{}
+	for _, r := range roles {
+		names = append(names, r.Name)
+		known[r.Name] = true
+	}
+	realmRoles.Store(&names)
+
+	if p := currentPolicy.Load(); p != nil {
+		for _, rule := range p.Rules {
+			for _, role := range rule.Roles {
+				if !known[role] {
+					log.Printf("Policy rule for %s requires role %q, which the realm does not define", rule.Path, role)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// keycloakEventsActor is the creator of the denylist entries made from
+// Keycloak events, and the actor of their audit entries.
+const keycloakEventsActor = "keycloak"
+
+// The reasons of the entries made for a disabled or locked-out user, which
+// re-enabling the user lifts.
+const (
+	keycloakReasonDisabled  = "Keycloak: user disabled"
+	keycloakReasonLockedOut = "Keycloak: locked out"
+)
+
+// keycloakEvent is a Keycloak user event or admin event, as posted by an
+// event listener such as keycloak-events' webhook. Only the fields the
+// denylist needs are decoded.
+type keycloakEvent struct {
+	// Time is in milliseconds since the epoch.
+	Time int64 `json:"time"`
+
+	// User events
+	Type   string `json:"type"`
+	UserID string `json:"userId"`
+
+	// Admin events
+	OperationType  string `json:"operationType"`
+	ResourceType   string `json:"resourceType"`
+	ResourcePath   string `json:"resourcePath"`
+	Representation string `json:"representation"`
+}
+
+// denylistAction is what an event does to its user's denylist entry.
+type denylistAction struct {
+	subject string
+	reason  string
+	// logout only rejects the tokens issued before the event; otherwise
+	// all of them are rejected.
+	logout bool
+	// lift removes an entry made from an earlier event.
+	lift bool
+}
+
+// action maps the event to a denylist change:
+//
+//	LOGOUT user event                  logout
+//	USER_DISABLED_BY_PERMANENT_LOCKOUT deny
+//	admin ACTION users/<id>/logout     logout (Sign out all sessions)
+//	admin DELETE users/<id>            deny
+//	admin UPDATE users/<id>            deny if disabled, lift if enabled
+//
+// Other events return false.
+func (ev keycloakEvent) action() (denylistAction, bool) {
+	// keycloak-events prefixes the types, as in "access.LOGOUT".
+	switch strings.TrimPrefix(ev.Type, "access.") {
+	case "LOGOUT":
+		return denylistAction{subject: ev.UserID, reason: "Keycloak: logged out", logout: true}, ev.UserID != ""
+	case "USER_DISABLED_BY_PERMANENT_LOCKOUT":
+		return denylistAction{subject: ev.UserID, reason: keycloakReasonLockedOut}, ev.UserID != ""
+	}
+	if ev.ResourceType != "USER" {
+		return denylistAction{}, false
+	}
+	parts := strings.Split(strings.Trim(ev.ResourcePath, "/"), "/")
+	if len(parts) < 2 || parts[0] != "users" || parts[1] == "" {
+		return denylistAction{}, false
+	}
+	id := parts[1]
+	switch {
+	case ev.OperationType == "ACTION" && len(parts) == 3 && parts[2] == "logout":
+		return denylistAction{subject: id, reason: "Keycloak: all sessions signed out", logout: true}, true
+	case ev.OperationType == "DELETE" && len(parts) == 2:
+		return denylistAction{subject: id, reason: "Keycloak: user deleted"}, true
+	case ev.OperationType == "UPDATE" && len(parts) == 2:
+		var user struct {
+			Enabled *bool `json:"enabled"`
+		}
+		// Without the representation (admin events stored without it)
+		// the change is unknown.
+		if json.Unmarshal([]byte(ev.Representation), &user) != nil || user.Enabled == nil {
+			return denylistAction{}, false
+		}
+		if *user.Enabled {
+			return denylistAction{subject: id, lift: true}, true
+		}
+		return denylistAction{subject: id, reason: keycloakReasonDisabled}, true
+	}
+	return denylistAction{}, false
+}
+
+// keycloakEventsAuth checks the bearer token Keycloak's event listener is
+// configured with against KEYCLOAK_EVENTS_TOKEN.
+func keycloakEventsAuth(c *fiber.Ctx) error {
+	want := secrets.Get("KEYCLOAK_EVENTS_TOKEN", "")
+	got, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if want == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return errUnauthorized("Invalid event token")
+	}
+	c.Locals("claims", jwt.MapClaims{"sub": keycloakEventsActor})
+	return c.Next()
+}
+
+// mountKeycloakEvents adds POST /hooks/keycloak when KEYCLOAK_EVENTS_TOKEN
+// is set. Each event that disables, deletes or signs out a user denylists
+// them on every instance, for KEYCLOAK_EVENTS_DENY_TTL (default 1h), which
+// should be at least the realm's access token lifespan.
+func mountKeycloakEvents(app *fiber.App) {
+	if secrets.Get("KEYCLOAK_EVENTS_TOKEN", "") == "" {
+		return
+	}
+	ttl := getEnvDuration("KEYCLOAK_EVENTS_DENY_TTL", time.Hour)
+	app.Post("/hooks/keycloak", keycloakEventsAuth, func(c *fiber.Ctx) error {
+		return keycloakEventsHandler(c, ttl)
+	})
+	log.Println("Accepting Keycloak events at /hooks/keycloak")
+}
+
+// keycloakEventsHandler accepts one event or an array of them.
+func keycloakEventsHandler(c *fiber.Ctx, ttl time.Duration) error {
+	var events []keycloakEvent
+	body := bytes.TrimSpace(c.Body())
+	var err error
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &events)
+	} else {
+		var ev keycloakEvent
+		err = json.Unmarshal(body, &ev)
+		events = append(events, ev)
+	}
+	if err != nil {
+		return newProblem(fiber.StatusBadRequest, problemAboutBlank, "Malformed event: "+err.Error())
+	}
+	for _, ev := range events {
+		act, ok := ev.action()
+		if !ok {
+			continue
+		}
+		if act.lift {
+			if err := liftKeycloakDenial(c, act.subject); err != nil {
+				return err
+			}
+			continue
+		}
+		at := time.Now().UTC()
+		if ev.Time > 0 {
+			at = time.UnixMilli(ev.Time).UTC()
+		}
+		exp := time.Now().UTC().Add(ttl)
+		e := denylistEntry{
+			Subject:   act.subject,
+			Reason:    act.reason,
+			CreatedBy: keycloakEventsActor,
+			CreatedAt: time.Now().UTC(),
+			ExpiresAt: &exp,
+		}
+		if act.logout {
+			e.IssuedBefore = &at
+		}
+		// A logout must not shorten the denial of a disabled user.
+		if prev, ok := currentDenial(e.Subject); ok && prev.IssuedBefore == nil && e.IssuedBefore != nil {
+			continue
+		}
+		if err := denylistDB.Put(c.UserContext(), e); err != nil {
+			return errDatabase(err)
+		}
+		changeDenylist(c.UserContext(), denylistChange{Entry: &e})
+		log.Printf("Subject %s denylisted: %s", e.Subject, e.Reason)
+		recordAudit(c, "denylist.add", e.Subject, bson.M{"reason": e.Reason, "expiresAt": e.ExpiresAt, "issuedBefore": e.IssuedBefore})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func currentDenial(sub string) (denylistEntry, bool) {
+	m := denied.Load()
+	if m == nil {
+		return denylistEntry{}, false
+	}
+	e, ok := (*m)[sub]
+	return e, ok && e.active(time.Now())
+}
+
+// liftKeycloakDenial removes the entry a disable or lockout made for a
+// re-enabled user. Keycloak sends "enabled": true on every profile edit,
+// so entries made by admins or for logouts are left to expire.
+func liftKeycloakDenial(c *fiber.Ctx, sub string) error {
+	prev, ok := currentDenial(sub)
+	if !ok || prev.CreatedBy != keycloakEventsActor || prev.IssuedBefore != nil ||
+		(prev.Reason != keycloakReasonDisabled && prev.Reason != keycloakReasonLockedOut) {
+		return nil
+	}
+	if _, err := denylistDB.Delete(c.UserContext(), sub); err != nil {
+		return errDatabase(err)
+	}
+	changeDenylist(c.UserContext(), denylistChange{Deleted: sub})
+	log.Printf("Subject %s re-enabled in Keycloak, denylist entry removed", sub)
+	recordAudit(c, "denylist.remove", sub, nil)
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// memDenylist is a denylistStore in memory.
+type memDenylist map[string]denylistEntry
+
+func (m memDenylist) List(context.Context) ([]denylistEntry, error) {
+	out := make([]denylistEntry, 0, len(m))
+	for _, e := range m {
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (m memDenylist) Put(_ context.Context, e denylistEntry) error {
+	m[e.Subject] = e
+	return nil
+}
+
+func (m memDenylist) Delete(_ context.Context, subject string) (bool, error) {
+	_, ok := m[subject]
+	delete(m, subject)
+	return ok, nil
+}
+
+func (m memDenylist) DeleteExpired(context.Context, time.Time) (int64, error) { return 0, nil }
+
+// nopAudit drops audit entries.
+type nopAudit struct{}
+
+func (nopAudit) Insert(context.Context, auditEntry) error               { return nil }
+func (nopAudit) DeleteBefore(context.Context, time.Time) (int64, error) { return 0, nil }
+
+func postKeycloakEvents(t *testing.T, events ...string) {
+	t.Helper()
+	app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
+	app.Post("/hooks/keycloak", func(c *fiber.Ctx) error {
+		return keycloakEventsHandler(c, time.Hour)
+	})
+	for _, ev := range events {
+		req := httptest.NewRequest(fiber.MethodPost, "/hooks/keycloak", strings.NewReader(ev))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("%s: status %d", ev, resp.StatusCode)
+		}
+	}
+}
+
+func TestKeycloakEventsLiftOnlyDisables(t *testing.T) {
+	const (
+		logout  = `{"type":"LOGOUT","userId":"u1"}`
+		disable = `{"operationType":"UPDATE","resourceType":"USER","resourcePath":"users/u1","representation":"{\"enabled\":false}"}`
+		edit    = `{"operationType":"UPDATE","resourceType":"USER","resourcePath":"users/u1","representation":"{\"enabled\":true,\"firstName\":\"Al\"}"}`
+	)
+	cases := []struct {
+		name   string
+		events []string
+		denied bool
+	}{
+		{"logout then profile update", []string{logout, edit}, true},
+		{"disable then enable", []string{disable, edit}, false},
+		{"profile update only", []string{edit}, false},
+	}
+	auditDB = nopAudit{}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			denylistDB = memDenylist{}
+			denied.Store(&map[string]denylistEntry{})
+			postKeycloakEvents(t, c.events...)
+			if _, ok := currentDenial("u1"); ok != c.denied {
+				t.Errorf("denied = %v, want %v", ok, c.denied)
+			}
+		})
+	}
+}
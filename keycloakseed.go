@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// seedUser is a demo user created by the seed command.
+type seedUser struct {
+	Username string
+	Email    string
+	Roles    []string
+}
+
+// The demo realm matches keycloak/import-realm.json.
+var (
+	seedRoles = []string{"user", "admin"}
+	seedUsers = []seedUser{
+		{Username: "alice", Email: "alice@example.com", Roles: []string{"user"}},
+		{Username: "bob", Email: "bob@example.com", Roles: []string{"admin"}},
+	}
+)
+
+// keycloakMasterToken logs in to the master realm's admin-cli client as
+// KEYCLOAK_ADMIN_USERNAME (admin) with KEYCLOAK_ADMIN_PASSWORD. Unlike the
+// app's service account, that user can create realms.
+func keycloakMasterToken(ctx context.Context) (string, error) {
+	password := secrets.Get("KEYCLOAK_ADMIN_PASSWORD", "")
+	if password == "" {
+		return "", errors.New("KEYCLOAK_ADMIN_PASSWORD is not set")
+	}
+	form := url.Values{
+		"grant_type": {"password"},
+		"client_id":  {"admin-cli"},
+		"username":   {getEnv("KEYCLOAK_ADMIN_USERNAME", "admin")},
+		"password":   {password},
+	}
+	base, _ := keycloakRealmURL()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/realms/master/protocol/openid-connect/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := keycloakHTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("master realm login: %s", resp.Status)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("master realm login: %w", err)
+	}
+	return body.AccessToken, nil
+}
+
+// realmSeeder creates the demo realm through the Admin API. Every step
+// leaves existing objects alone, so seeding twice is harmless.
+type realmSeeder struct {
+	token, realm, password string
+	out                    io.Writer
+}
+
+func (s realmSeeder) call(ctx context.Context, method, path string, body, out interface{}) error {
+	return keycloakAdminAs(ctx, s.token, method, "/admin/realms/"+s.realm+path, body, out)
+}
+
+// seedKeycloak creates the realm of KEYCLOAK_ISSUER with the user and
+// admin roles, the KEYCLOAK_CLIENT_ID client and the demo users, whose
+// password is SEED_USER_PASSWORD (password123). The client is confidential,
+// with a service account, when KEYCLOAK_CLIENT_SECRET is set, and public
+// otherwise.
+func seedKeycloak(ctx context.Context, out io.Writer) error {
+	password := getEnv("SEED_USER_PASSWORD", "password123")
+	if appEnv() == "production" && password == "password123" {
+		return errors.New("refusing to create users with the default password in production; set SEED_USER_PASSWORD")
+	}
+	token, err := keycloakMasterToken(ctx)
+	if err != nil {
+		return err
+	}
+	_, realm := keycloakRealmURL()
+	if realm == "" {
+		return fmt.Errorf("KEYCLOAK_ISSUER %q names no realm", keycloakIssuer())
+	}
+	s := realmSeeder{token: token, realm: realm, password: password, out: out}
+	for _, step := range []func(context.Context) error{s.realmExists, s.roles, s.client, s.users} {
+		if err := step(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s realmSeeder) realmExists(ctx context.Context) error {
+	err := s.call(ctx, http.MethodGet, "", nil, nil)
+	if keycloakAdminStatus(err) != http.StatusNotFound {
+		if err == nil {
+			fmt.Fprintf(s.out, "realm %q exists\n", s.realm)
+		}
+		return err
+	}
+	if err := keycloakAdminAs(ctx, s.token, http.MethodPost, "/admin/realms",
+		map[string]interface{}{"realm": s.realm, "enabled": true}, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "realm %q created\n", s.realm)
+	return nil
+}
+
+func (s realmSeeder) roles(ctx context.Context) error {
+	for _, role := range seedRoles {
+		err := s.call(ctx, http.MethodPost, "/roles", map[string]string{"name": role}, nil)
+		switch {
+		case keycloakAdminStatus(err) == http.StatusConflict:
+			fmt.Fprintf(s.out, "role %q exists\n", role)
+		case err != nil:
+			return err
+		default:
+			fmt.Fprintf(s.out, "role %q created\n", role)
+		}
+	}
+	return nil
+}
+
+func (s realmSeeder) client(ctx context.Context) error {
+	clientID := keycloakClientID()
+	var existing []struct{ ID string }
+	if err := s.call(ctx, http.MethodGet, "/clients?clientId="+url.QueryEscape(clientID), nil, &existing); err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		fmt.Fprintf(s.out, "client %q exists\n", clientID)
+		return nil
+	}
+	secret := keycloakClientSecret()
+	client := map[string]interface{}{
+		"clientId":                  clientID,
+		"enabled":                   true,
+		"publicClient":              secret == "",
+		"directAccessGrantsEnabled": true,
+		"standardFlowEnabled":       true,
+		"redirectUris":              []string{"*"},
+	}
+	if secret != "" {
+		client["secret"] = secret
+		client["serviceAccountsEnabled"] = true
+	}
+	if err := s.call(ctx, http.MethodPost, "/clients", client, nil); err != nil {
+		return err
+	}
+	kind := "public"
+	if secret != "" {
+		kind = "confidential"
+	}
+	fmt.Fprintf(s.out, "client %q created (%s)\n", clientID, kind)
+	return nil
+}
+
+func (s realmSeeder) users(ctx context.Context) error {
+	for _, u := range seedUsers {
+		id, created, err := s.user(ctx, u)
+		if err != nil {
+			return err
+		}
+		// Role mappings are granted to existing users too; adding a role
+		// the user already has is a no-op.
+		var roles []interface{}
+		for _, name := range u.Roles {
+			var role map[string]interface{}
+			if err := s.call(ctx, http.MethodGet, "/roles/"+url.PathEscape(name), nil, &role); err != nil {
+				return err
+			}
+			roles = append(roles, role)
+		}
+		if err := s.call(ctx, http.MethodPost, "/users/"+id+"/role-mappings/realm", roles, nil); err != nil {
+			return err
+		}
+		state := "exists"
+		if created {
+			state = "created"
+		}
+		fmt.Fprintf(s.out, "user %q %s with roles %s\n", u.Username, state, strings.Join(u.Roles, ", "))
+	}
+	return nil
+}
+
+// user returns the ID of the user, creating it first if needed.
+func (s realmSeeder) user(ctx context.Context, u seedUser) (id string, created bool, err error) {
+	find := func() (string, error) {
+		var found []struct{ ID string }
+		err := s.call(ctx, http.MethodGet, "/users?exact=true&username="+url.QueryEscape(u.Username), nil, &found)
+		if err != nil || len(found) == 0 {
+			return "", err
+		}
+		return found[0].ID, nil
+	}
+	if id, err = find(); err != nil || id != "" {
+		return id, false, err
+	}
+	err = s.call(ctx, http.MethodPost, "/users", map[string]interface{}{
+		"username":      u.Username,
+		"email":         u.Email,
+		"enabled":       true,
+		"emailVerified": true,
+		"credentials":   []map[string]interface{}{{"type": "password", "value": s.password, "temporary": false}},
+	}, nil)
+	if err != nil {
+		return "", false, err
+	}
+	if id, err = find(); err == nil && id == "" {
+		err = fmt.Errorf("user %q not found after creating it", u.Username)
+	}
+	return id, true, err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// configureKeyPinning adds the issuer allowlist and key pins to the jwks
+// mode options:
+//
+//	KEYCLOAK_ALLOWED_ISSUERS  accepted "iss" values (default KEYCLOAK_ISSUER alone)
+//	KEYCLOAK_PINNED_KEYS      RFC 7638 thumbprints of the keys tokens may be signed with
+//	AUTH_STRICT               refuse to start unless both are set (default false)
+//
+// Pins protect against a compromised JWKS or discovery endpoint serving a
+// key of the attacker's: tokens it signs are rejected and reported. They
+// must be updated before Keycloak rotates to a new key.
+func configureKeyPinning(opts *keycloakauth.Options) error {
+	issuers := getEnvList("KEYCLOAK_ALLOWED_ISSUERS", nil)
+	pins := getEnvList("KEYCLOAK_PINNED_KEYS", nil)
+	strict := getEnvBool("AUTH_STRICT", false)
+	if opts.Mode != keycloakauth.ModeJWKS {
+		if strict || len(issuers) > 0 || len(pins) > 0 {
+			return errors.New("AUTH_STRICT, KEYCLOAK_ALLOWED_ISSUERS and KEYCLOAK_PINNED_KEYS need AUTH_MODE=jwks")
+		}
+		return nil
+	}
+	if strict && (len(issuers) == 0 || len(pins) == 0) {
+		return errors.New("AUTH_STRICT needs KEYCLOAK_ALLOWED_ISSUERS and KEYCLOAK_PINNED_KEYS")
+	}
+	opts.Issuers = issuers
+	opts.PinnedKeys = pins
+	opts.OnUnpinnedKey = reportUnpinnedKey
+	if len(pins) > 0 {
+		log.Printf("Accepting tokens signed by %d pinned keys only", len(pins))
+	}
+	return nil
+}
+
+// unpinnedReported limits reports to one per key ID a minute, since every
+// token the key signed is rejected.
+var (
+	unpinnedMu       sync.Mutex
+	unpinnedReported = map[string]time.Time{}
+)
+
+// unpinnedKey is the data of auth.unpinned_key events.
+type unpinnedKey struct {
+	Kid        string `json:"kid"`
+	Thumbprint string `json:"thumbprint"`
+	JWKSURL    string `json:"jwksUrl"`
+}
+
+// reportUnpinnedKey logs, audits and publishes a token signed by a key
+// that is not pinned. It runs inside the JWT key lookup, so the audit
+// entry is written in the background.
+func reportUnpinnedKey(kid, thumbprint string) {
+	unpinnedMu.Lock()
+	last, seen := unpinnedReported[kid]
+	if seen && time.Since(last) < time.Minute {
+		unpinnedMu.Unlock()
+		return
+	}
+	unpinnedReported[kid] = time.Now()
+	unpinnedMu.Unlock()
+
+	k := unpinnedKey{Kid: kid, Thumbprint: thumbprint, JWKSURL: jwksURL()}
+	slog.Error("Token signed by a key that is not pinned; the JWKS may be compromised, or the pins need updating after a key rotation",
+		"kid", k.Kid, "thumbprint", k.Thumbprint, "jwksUrl", k.JWKSURL)
+	go func() {
+		if auditDB != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			e := auditEntry{
+				Time:    time.Now().UTC(),
+				Actor:   "system",
+				Action:  "auth.unpinned_key",
+				Target:  kid,
+				Details: bson.M{"thumbprint": k.Thumbprint, "jwksUrl": k.JWKSURL},
+			}
+			if err := auditDB.Insert(ctx, e); err != nil {
+				log.Printf("Audit auth.unpinned_key %s not recorded: %v", kid, err)
+			}
+		}
+		emitEvent(eventAuthUnpinnedKey, kid, k)
+	}()
+}
+
+// runThumbprints prints the thumbprints of the keys the realm's JWKS
+// serves now, for KEYCLOAK_PINNED_KEYS. Check them against the keys shown
+// in Keycloak's admin console before pinning them.
+func runThumbprints(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := initCommand(); err != nil {
+		return err
+	}
+	keys, err := fetchJWKS(jwksURL())
+	if err != nil {
+		return err
+	}
+	kids := make([]string, 0, len(keys))
+	for kid := range keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	for _, kid := range kids {
+		fmt.Printf("%s  %s\n", keycloakauth.Thumbprint(keys[kid]), kid)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+)
+
+// kongHTTP talks to the Kong Admin API at KONG_ADMIN_URL, presenting the
+// KONG_TLS_* client certificate when set.
+var kongHTTP = http.DefaultClient
+
+func initKongClient() error {
+	tlsCfg, err := upstreamTLSConfig("KONG")
+	if err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsCfg != nil {
+		transport.TLSClientConfig = tlsCfg
+	}
+	kongHTTP = &http.Client{Transport: tracingTransport{transport}, Timeout: 10 * time.Second}
+	return nil
+}
+
+func kongAdmin(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(os.Getenv("KONG_ADMIN_URL"), "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := secrets.Get("KONG_ADMIN_TOKEN", ""); token != "" {
+		req.Header.Set("Kong-Admin-Token", token)
+	}
+	resp, err := kongHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("kong %s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// activeSigningKey picks the realm key Kong must trust: the one Keycloak
+// reports as active for RS256, or the only RS256 key in the JWKS.
+func activeSigningKey(ctx context.Context) (*rsa.PublicKey, error) {
+	keys, err := fetchJWKS(jwksURL())
+	if err != nil {
+		return nil, err
+	}
+	var realmKeys struct {
+		Active map[string]string `json:"active"`
+	}
+	if err := keycloakAdmin(ctx, http.MethodGet, "/keys", nil, &realmKeys); err == nil {
+		if k, ok := keys[realmKeys.Active["RS256"]]; ok {
+			return k, nil
+		}
+	}
+	if len(keys) == 1 {
+		for _, k := range keys {
+			return k, nil
+		}
+	}
+	kids := make([]string, 0, len(keys))
+	for kid := range keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	return nil, fmt.Errorf("cannot tell which of the realm keys %v is active", kids)
+}
+
+// syncKongConsumer makes sure the Kong consumer that represents Keycloak
+// users (KONG_CONSUMER, default keycloak-users) holds a JWT credential for
+// the issuer with the realm's active public key, as configure-kong.sh
+// sets it up. This repairs Kong after a Keycloak key rotation. A key
+// outside KEYCLOAK_PINNED_KEYS is never handed to Kong.
+func syncKongConsumer(ctx context.Context) error {
+	key, err := activeSigningKey(ctx)
+	if err != nil {
+		return err
+	}
+	if pins := getEnvList("KEYCLOAK_PINNED_KEYS", nil); len(pins) > 0 && !slices.Contains(pins, keycloakauth.Thumbprint(key)) {
+		return fmt.Errorf("active realm key %s is not pinned, leaving Kong's credential unchanged", keycloakauth.Thumbprint(key))
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return err
+	}
+	publicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	consumer := url.PathEscape(getEnv("KONG_CONSUMER", "keycloak-users"))
+	issuer := keycloakIssuer()
+	var creds struct {
+		Data []struct {
+			ID           string `json:"id"`
+			Key          string `json:"key"`
+			RSAPublicKey string `json:"rsa_public_key"`
+		} `json:"data"`
+	}
+	if err := kongAdmin(ctx, http.MethodGet, "/consumers/"+consumer+"/jwt", nil, &creds); err != nil {
+		return err
+	}
+	want := map[string]string{"key": issuer, "algorithm": "RS256", "rsa_public_key": publicPEM}
+	for _, c := range creds.Data {
+		if c.Key != issuer {
+			continue
+		}
+		if strings.TrimSpace(c.RSAPublicKey) == strings.TrimSpace(publicPEM) {
+			return nil
+		}
+		log.Println("Updating Kong JWT credential with the rotated realm key")
+		return kongAdmin(ctx, http.MethodPatch, "/consumers/"+consumer+"/jwt/"+c.ID, want, nil)
+	}
+	log.Println("Creating missing Kong JWT credential for", issuer)
+	return kongAdmin(ctx, http.MethodPost, "/consumers/"+consumer+"/jwt", want, nil)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+)
+
+// concurrencyRule runs at most Max requests at once on the routes its
+// pattern matches. Up to Queue more wait for a slot for QueueTimeout;
+// the rest are refused with 503 straight away.
+type concurrencyRule struct {
+	policy.Pattern
+	Max          int      `json:"max"`
+	Queue        int      `json:"queue"`
+	QueueTimeout duration `json:"queueTimeout"`
+}
+
+func (r concurrencyRule) validate() error {
+	if err := r.Pattern.Validate(); err != nil {
+		return err
+	}
+	if r.Max <= 0 {
+		return errors.New("max must be positive")
+	}
+	if r.Queue < 0 || r.QueueTimeout < 0 {
+		return errors.New("queue and queueTimeout must not be negative")
+	}
+	if r.Queue > 0 && r.QueueTimeout == 0 {
+		return errors.New("queueTimeout is required with a queue")
+	}
+	return nil
+}
+
+type compiledConcurrency struct {
+	rule    concurrencyRule
+	slots   chan struct{}
+	waiting atomic.Int64
+}
+
+// currentConcurrency is rebuilt on every runtime config reload. Requests
+// already running keep the slots of the limits they started under.
+var currentConcurrency atomic.Pointer[[]*compiledConcurrency]
+
+func compileConcurrency(rules []concurrencyRule) []*compiledConcurrency {
+	out := make([]*compiledConcurrency, 0, len(rules))
+	for _, r := range rules {
+		out = append(out, &compiledConcurrency{rule: r, slots: make(chan struct{}, r.Max)})
+	}
+	return out
+}
+
+// acquire takes a slot, waiting in the queue if there is room in it.
+func (l *compiledConcurrency) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.waiting.Add(1) > int64(l.rule.Queue) {
+		l.waiting.Add(-1)
+		return false
+	}
+	defer l.waiting.Add(-1)
+	timer := time.NewTimer(time.Duration(l.rule.QueueTimeout))
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// concurrencySlot is the slot a request took, released when the handler
+// returns unless the handler holds it.
+type concurrencySlot struct {
+	once    sync.Once
+	release func()
+	held    bool
+}
+
+func (s *concurrencySlot) done() {
+	s.once.Do(s.release)
+}
+
+// holdConcurrencySlot keeps the request's concurrency slot, if it took
+// one, after the handler returns, for handlers whose body is streamed
+// later. The returned func releases it; the stream writer calls it when
+// it finishes.
+func holdConcurrencySlot(c *fiber.Ctx) func() {
+	s, ok := c.Locals("concurrencySlot").(*concurrencySlot)
+	if !ok {
+		return func() {}
+	}
+	s.held = true
+	return s.done
+}
+
+// limitConcurrency applies the first configured concurrency limit
+// matching the request.
+func limitConcurrency(c *fiber.Ctx) error {
+	limits := currentConcurrency.Load()
+	if limits == nil {
+		return c.Next()
+	}
+	for _, l := range *limits {
+		if !l.rule.Matches(c.Method(), c.Path()) {
+			continue
+		}
+		if !l.acquire() {
+			return overloaded(c, "concurrency", fmt.Sprintf("More than %d concurrent requests to %s", l.rule.Max, l.rule.Path))
+		}
+		slot := &concurrencySlot{release: func() { <-l.slots }}
+		c.Locals("concurrencySlot", slot)
+		err := c.Next()
+		if !slot.held {
+			slot.done()
+		}
+		return err
+	}
+	return c.Next()
+}
+
+var (
+	shedEnabled     bool
+	shedMaxInflight int64
+	shedMinInflight int64
+	shedTarget      time.Duration
+	shedSkip        []string
+
+	inflight atomic.Int64
+	// latencyEWMA is the moving average of request latency in
+	// nanoseconds, weighted 1/16 per completed request.
+	latencyEWMA atomic.Int64
+
+	loadShed = newMetricVec("counter", "load_shed_total",
+		"Requests refused with 503 to shed load, by reason.",
+		"reason")
+)
+
+// initLoadShedding reads the adaptive shedding settings:
+//
+//	LOAD_SHED_ENABLED         shed load under overload (default false)
+//	LOAD_SHED_MAX_INFLIGHT    requests in progress beyond which all are refused (default 512)
+//	LOAD_SHED_TARGET_LATENCY  average latency above which some are refused (default 500ms)
+//	LOAD_SHED_MIN_INFLIGHT    requests in progress below which none are (default 16)
+//	LOAD_SHED_SKIP            path prefixes never shed (default /admin,/ops)
+func initLoadShedding() {
+	if !getEnvBool("LOAD_SHED_ENABLED", false) {
+		return
+	}
+	shedEnabled = true
+	shedMaxInflight = int64(getEnvInt("LOAD_SHED_MAX_INFLIGHT", 512))
+	shedMinInflight = int64(getEnvInt("LOAD_SHED_MIN_INFLIGHT", 16))
+	shedTarget = getEnvDuration("LOAD_SHED_TARGET_LATENCY", 500*time.Millisecond)
+	shedSkip = getEnvList("LOAD_SHED_SKIP", []string{"/admin", "/ops"})
+	log.Printf("Shedding load over %d requests in progress or %s average latency", shedMaxInflight, shedTarget)
+}
+
+// shedLoad refuses requests early while the app is overloaded: always
+// beyond LOAD_SHED_MAX_INFLIGHT, and, once the average latency exceeds
+// LOAD_SHED_TARGET_LATENCY, a share of them that grows with the excess (a
+// quarter at 1.25 times the target, nearly all at twice). Refused requests
+// never reach the database, which lets latency recover.
+func shedLoad(c *fiber.Ctx) error {
+	if !shedEnabled {
+		return c.Next()
+	}
+	for _, prefix := range shedSkip {
+		if strings.HasPrefix(c.Path(), prefix) {
+			return c.Next()
+		}
+	}
+	n := inflight.Add(1)
+	defer inflight.Add(-1)
+	if shedMaxInflight > 0 && n > shedMaxInflight {
+		return overloaded(c, "inflight", "Too many requests in progress")
+	}
+	if n > shedMinInflight && rand.Float64() < shedProbability(time.Duration(latencyEWMA.Load())) {
+		return overloaded(c, "latency", "Response times are over target")
+	}
+	start := time.Now()
+	err := c.Next()
+	recordLatency(time.Since(start))
+	return err
+}
+
+// shedProbability is the share of requests refused at average latency
+// avg, capped at 95% so the average keeps being measured.
+func shedProbability(avg time.Duration) float64 {
+	if shedTarget <= 0 || avg <= shedTarget {
+		return 0
+	}
+	return min(float64(avg-shedTarget)/float64(shedTarget), 0.95)
+}
+
+func recordLatency(d time.Duration) {
+	for {
+		old := latencyEWMA.Load()
+		next := old + (int64(d)-old)/16
+		if old == 0 {
+			next = int64(d)
+		}
+		if latencyEWMA.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// overloaded refuses the request with 503, asking the client, or Kong's
+// retries, to come back in a second.
+func overloaded(c *fiber.Ctx, reason, detail string) error {
+	if metricsEnabled {
+		loadShed.inc(reason)
+	}
+	c.Set(fiber.HeaderRetryAfter, "1")
+	return newProblem(fiber.StatusServiceUnavailable, problemOverloaded, detail)
+}
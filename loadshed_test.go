@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+)
+
+// A streamed response keeps its concurrency slot until the stream ends.
+func TestConcurrencySlotHeldByStream(t *testing.T) {
+	rules := compileConcurrency([]concurrencyRule{{Pattern: policy.Pattern{Path: "/stream"}, Max: 1}})
+	currentConcurrency.Store(&rules)
+	defer currentConcurrency.Store(nil)
+
+	finish := make(chan struct{})
+	app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
+	app.Use(limitConcurrency)
+	app.Get("/stream", func(c *fiber.Ctx) error {
+		release := holdConcurrencySlot(c)
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer release()
+			<-finish
+			w.WriteString("done")
+		})
+		return nil
+	})
+
+	first := make(chan int)
+	go func() {
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/stream", nil), -1)
+		if err != nil {
+			t.Error(err)
+			first <- 0
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		first <- resp.StatusCode
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(rules[0].slots) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/stream", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Errorf("second request while streaming: status %d, want 503", resp.StatusCode)
+	}
+	close(finish)
+	if got := <-first; got != fiber.StatusOK {
+		t.Errorf("first request: status %d", got)
+	}
+	if n := len(rules[0].slots); n != 0 {
+		t.Errorf("%d slots still taken after the stream ended", n)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// logLevel is shared by the default slog handler so the level can change
+// at runtime. Output from the standard log package is routed through the
+// same handler at info level.
+var logLevel = new(slog.LevelVar)
+
+func initLogging() {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+	if err := setLogLevel(getEnv("LOG_LEVEL", "info")); err != nil {
+		slog.Warn("Ignoring LOG_LEVEL", "error", err)
+	}
+}
+
+// setLogLevel accepts debug, info, warn or error.
+func setLogLevel(name string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return err
+	}
+	logLevel.Set(l)
+	return nil
+}
+
+// logOverride is a temporary level set through /ops/log-level.
+var logOverride struct {
+	sync.Mutex
+	timer *time.Timer
+	until time.Time
+}
+
+// overrideLogLevel sets the level by name. With a positive d the previous
+// level comes back after d; a later override replaces the pending revert.
+func overrideLogLevel(name string, d time.Duration) error {
+	logOverride.Lock()
+	defer logOverride.Unlock()
+	prev := logLevel.Level()
+	if err := setLogLevel(name); err != nil {
+		return err
+	}
+	if logOverride.timer != nil {
+		logOverride.timer.Stop()
+		logOverride.timer, logOverride.until = nil, time.Time{}
+	}
+	if d > 0 {
+		var t *time.Timer
+		t = time.AfterFunc(d, func() {
+			logOverride.Lock()
+			defer logOverride.Unlock()
+			if logOverride.timer != t {
+				return // replaced while this one was firing
+			}
+			logLevel.Set(prev)
+			logOverride.timer, logOverride.until = nil, time.Time{}
+			slog.Info("Log level override expired", "level", prev)
+		})
+		logOverride.timer, logOverride.until = t, time.Now().Add(d)
+	}
+	return nil
+}
+
+// logLevelUntil returns when the current override reverts, or the zero
+// time.
+func logLevelUntil() time.Time {
+	logOverride.Lock()
+	defer logOverride.Unlock()
+	return logOverride.until
+}
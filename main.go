@@ -1,173 +1,245 @@
 package main
 
 import (
-	"context"
-	"fmt"
+	"flag"
 	"log"
+	"net/url"
 	"os"
-	"strings"
-	"time"
 
+	"github.com/example/fiber-demo/pkg/keycloakauth"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/golang-jwt/jwt/v4"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-)
-
-var (
-	mongoClient *mongo.Client
-	mongoDB     *mongo.Database
 )
 
 // --- NEW HELPER FUNCTION ---
-// Manually parse the JWT from the Authorization header without validation
+// Read the caller's JWT from the Authorization header, once per request
 func parseToken(c *fiber.Ctx) (jwt.MapClaims, error) {
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		return nil, fmt.Errorf("missing Authorization header")
-	}
+	t := tokenFor(c)
+	return t.Claims, t.Err
+}
 
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return nil, fmt.Errorf("invalid Authorization header format")
+// requestRoles returns the caller's realm roles, extracted once per request.
+func requestRoles(c *fiber.Ctx) ([]string, error) {
+	t := tokenFor(c)
+	if t.Err != nil {
+		return nil, t.Err
 	}
-	tokenString := parts[1]
+	return t.Roles, t.RolesErr
+}
 
-	// Parse the token without verifying the signature. We trust KrakenD for that.
-	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse token: %v", err)
+func tokenFor(c *fiber.Ctx) *keycloakauth.Token {
+	if authMode == authModeDev {
+		c.Set("X-Auth-Mode", authModeDev)
 	}
+	return auth.Token(c)
+}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, fmt.Errorf("invalid token claims")
-	}
-	return claims, nil
+// decodeToken reads an Authorization header value according to AUTH_MODE.
+// It is shared by the HTTP middleware and the gRPC interceptors.
+func decodeToken(authHeader string) *keycloakauth.Token {
+	return auth.Decode(authHeader)
 }
 
 // --- MODIFIED HELPER ---
-// extract roles from parsed claims
+// extract roles from parsed claims, trying each ROLES_CLAIM_PATHS entry
+// in turn (default: top-level "roles", then Keycloak's "realm_access.roles")
 func extractRoles(claims jwt.MapClaims) ([]string, error) {
-	// 1) Look for custom top-level "roles"
-	if tl, ok := claims["roles"].([]interface{}); ok {
-		return coerceStrings(tl), nil
-	}
-	// 2) Fallback to Keycloak's default "realm_access.roles"
-	if ra, ok := claims["realm_access"].(map[string]interface{}); ok {
-		if rl, ok2 := ra["roles"].([]interface{}); ok2 {
-			return coerceStrings(rl), nil
-		}
-	}
-	return nil, fmt.Errorf("no roles in token")
-}
-
-func coerceStrings(ifaces []interface{}) []string {
-	out := make([]string, 0, len(ifaces))
-	for _, v := range ifaces {
-		if s, ok := v.(string); ok {
-			out = append(out, s)
-		}
-	}
-	return out
+	return auth.RolesOf(claims)
 }
 
 // --- MODIFIED MIDDLEWARE ---
 // Middleware to allow only users with a specific role
 func requireRole(role string) fiber.Handler {
+	return requireAnyRole(role)
+}
+
+// Middleware to allow users holding at least one of the given roles
+func requireAnyRole(allowed ...string) fiber.Handler {
+	check := auth.RequireRole(allowed...)
 	return func(c *fiber.Ctx) error {
-		claims, err := parseToken(c)
-		if err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
-		}
-
-		roles, err := extractRoles(claims)
-		if err != nil {
-			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Cannot extract roles"})
-		}
-		for _, r := range roles {
-			if r == role {
-				// Store claims in context for the next handler to use
-				c.Locals("claims", claims)
-				return c.Next()
-			}
-		}
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": fmt.Sprintf("Missing role: %s", role)})
+		tokenFor(c)
+		return check(c)
 	}
 }
 
-// Connect to MongoDB
-func initMongo() {
-	// ... (this function is fine, no changes needed)
-	mongoURI := os.Getenv("MONGO_URI")
-	if mongoURI == "" {
-		mongoURI = "mongodb://localhost:27017"
+// redactURI hides the password of a connection string for logging.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.User == nil {
+		return uri
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
 
-	clientOptions := options.Client().ApplyURI(mongoURI)
-	client, err := mongo.Connect(ctx, clientOptions)
-	if err != nil {
-		log.Fatal("Mongo Connect error:", err)
+func main() {
+	os.Exit(runCommand(os.Args[1:], os.Stderr))
+}
+
+// runServe initialises everything and serves until the server fails.
+func runServe(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	initLogging()
+	if err := initSecrets(); err != nil {
+		log.Fatal("Secrets error:", err)
+	}
+	if err := initChaos(); err != nil {
+		log.Fatal("Chaos mode error: ", err)
+	}
+	// The JWKS is fetched through the Keycloak client
+	if err := initKeycloakClient(); err != nil {
+		log.Fatal("Keycloak client error:", err)
+	}
+	if err := waitForDependencies(); err != nil {
+		log.Fatal("Startup wait error: ", err)
+	}
+	if err := initAuthMode(); err != nil {
+		log.Fatal("Auth mode error: ", err)
+	}
+	if err := initEvents(); err != nil {
+		log.Fatal("Events error: ", err)
+	}
+	if err := initFieldEncryption(); err != nil {
+		log.Fatal("Field encryption error: ", err)
+	}
+	initCache()
+	if err := initStorage(); err != nil {
+		log.Fatal("Storage error: ", err)
+	}
+	initQuotas()
+	initFlags()
+	initDenylist()
+	initSessions()
+	if err := initAuthAnomalies(); err != nil {
+		log.Fatal("Auth anomaly detection error: ", err)
 	}
-	if err = client.Ping(ctx, nil); err != nil {
-		log.Fatal("Mongo Ping error:", err)
+	initJobs()
+	initWebhooks()
+	initOutbox()
+	initRuntimeConfig()
+	initLoadShedding()
+	initRequestTimeouts()
+	initCacheControl()
+	if err := initUpstream(); err != nil {
+		log.Fatal("Upstream client error: ", err)
 	}
-	mongoClient = client
-	dbName := os.Getenv("MONGO_DB")
-	if dbName == "" {
-		dbName = "demo_db"
+	initScheduler()
+
+	app := newApp()
+	if err := startGRPC(); err != nil {
+		log.Fatal("gRPC server error: ", err)
 	}
-	mongoDB = client.Database(dbName)
-	log.Println("Connected to MongoDB:", mongoURI)
+	return serve(app)
 }
 
-func main() {
-	initMongo()
+// newApp assembles the middleware chain and routes. The init functions
+// must have run first.
+func newApp() *fiber.App {
+	// Behind Kong, PROXY_HEADER=X-Real-IP makes c.IP() the client's address
+	// for rate limits, logs and failure counting; set TRUSTED_PROXIES too, or
+	// any caller can choose the IP it is counted under
+	trusted := getEnvList("TRUSTED_PROXIES", nil)
+	app := fiber.New(fiber.Config{
+		ErrorHandler:            problemErrorHandler,
+		ProxyHeader:             os.Getenv("PROXY_HEADER"),
+		EnableTrustedProxyCheck: len(trusted) > 0,
+		TrustedProxies:          trusted,
+	})
 
-	app := fiber.New()
+	// Hardening headers on every response, including errors
+	app.Use(securityHeaders())
 
-	// Public route (no auth)
-	app.Get("/public", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"message": "This is a public endpoint."})
-	})
+	// Legacy aliases and Accept-based version negotiation rewrite the path
+	// before anything that must run only once per request
+	useVersionRouting(app)
 
-	// --- THE JWTWARE MIDDLEWARE HAS BEEN REMOVED ---
-
-	// Protected route: any authenticated user
-	app.Get("/profile", func(c *fiber.Ctx) error {
-		claims, err := parseToken(c)
-		if err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
-		}
-		username, _ := claims["preferred_username"].(string)
-
-		return c.JSON(fiber.Map{
-			"message":  fmt.Sprintf("Hello, %v", username),
-			"roles":    claims["roles"],
-			"subject":  claims["sub"],
-			"issuedAt": claims["iat"],
-		})
-	})
+	// Request IDs double as the traceId of problem responses; both they and
+	// the W3C trace context follow the request into Mongo and Keycloak
+	app.Use(requestid.New())
+	app.Use(tracing)
 
-	// Protected route: only users with realm role "user"
-	app.Get("/user", requireRole("user"), func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"message": "Hello, user-level endpoint!"})
-	})
+	// Liveness and readiness probes, ahead of the access log they would flood
+	mountHealth(app)
 
-	// Protected route: only users with realm role "admin"
-	app.Get("/admin", requireRole("admin"), func(c *fiber.Ctx) error {
-		count, err := mongoDB.Collection("items").CountDocuments(context.Background(), struct{}{})
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
-		}
-		return c.JSON(fiber.Map{
-			"message":     "Hello, admin-level endpoint!",
-			"itemCountDB": count,
-		})
-	})
+	// Request counts and latency by route, tenant and role (METRICS_ENABLED)
+	useMetrics(app)
+
+	// Per-route request rates for /admin/stats
+	app.Use(countRouteRate)
+
+	// One JSON access log line per request, with secrets redacted
+	app.Use(accessLog())
+
+	// Compression wraps the ETag check, which hashes the uncompressed body
+	app.Use(compression())
+	app.Use(conditionalGet())
+
+	// Cache-Control and Vary for Kong's proxy-cache and CDNs (reloadable
+	// per-route rules); responses to authenticated requests are never shared
+	app.Use(cacheHeaders)
+
+	// CORS ahead of auth so browsers can read error responses too
+	useCORS(app, "/api", "API")
+
+	// Overload protection ahead of any auth or database work (LOAD_SHED_*,
+	// and reloadable per-route concurrency limits)
+	app.Use(shedLoad)
+	app.Use(limitConcurrency)
+
+	// A deadline for the database and Keycloak calls made for the request
+	// (REQUEST_TIMEOUT, and reloadable per-route timeouts)
+	app.Use(requestTimeout)
+
+	// Injected faults, within that deadline (CHAOS_ENABLED, non-production builds)
+	app.Use(injectChaos)
+
+	// The caller, for the token of upstreamHTTP requests (UPSTREAM_TARGETS)
+	app.Use(carryUpstreamUser)
+
+	// Reloadable rate limits, authorization policy and quotas (RUNTIME_CONFIG_FILE, POLICY_FILE)
+	app.Use(rateLimit)
+	app.Use(enforcePolicy)
+	app.Use(guardImpersonation())
+	app.Use(enforceQuota)
+
+	// Tokens seen, for listing and terminating sessions (SESSIONS_ENABLED)
+	app.Use(recordSession)
+
+	// Versioned API under /api/v1, /api/v2
+	mountAPI(app)
+
+	// Batch authorization checks for frontends at /auth/can
+	mountAuthCan(app)
+
+	// Operator endpoints under /admin (denylist, jobs) and /ops (scheduler)
+	mountAdmin(app)
+	mountOps(app)
+
+	// SCIM 2.0 provisioning under /scim/v2 (SCIM_TOKEN)
+	mountSCIM(app)
+
+	// Keycloak user and admin events feeding the denylist (KEYCLOAK_EVENTS_TOKEN)
+	mountKeycloakEvents(app)
+
+	// The denylist for the keycloak-authz Kong plugin (DENYLIST_FEED_TOKEN)
+	mountDenylistFeed(app)
+
+	// Authenticated WebSocket endpoint
+	mountWebSocket(app)
+
+	// Embedded frontend under /app (SPA_ENABLED)
+	mountSPA(app)
+
+	// OpenAPI document and Swagger UI (API_DOCS_ENABLED)
+	mountDocs(app)
+
+	// pprof and runtime diagnostics (DEBUG_ENABLED, DEBUG_ADDR)
+	mountDebug(app)
 
-	log.Println("Starting server on port 3000")
-	log.Fatal(app.Listen(":3000"))
+	return app
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const profilesCollection = "profiles"
+
+// profileDoc is the app's own data about a user, kept next to what
+// Keycloak knows. It is keyed by subject.
+type profileDoc struct {
+	Subject     string                 `bson:"_id" json:"-"`
+	DisplayName string                 `bson:"displayName" json:"displayName"`
+	Locale      string                 `bson:"locale" json:"locale"`
+	Preferences map[string]interface{} `bson:"preferences" json:"preferences"`
+	UpdatedAt   time.Time              `bson:"updatedAt" json:"updatedAt"`
+}
+
+// profileStore persists profile documents. Get returns nil for a user
+// without one.
+type profileStore interface {
+	Get(ctx context.Context, subject string) (*profileDoc, error)
+	Put(ctx context.Context, p profileDoc) error
+}
+
+func profiles() profileStore {
+	if usesMongo() {
+		return mongoProfileStore{}
+	}
+	return pgProfileStore{}
+}
+
+// enrichment is the part of /me that isn't in the token.
+type enrichment struct {
+	Userinfo map[string]interface{} `bson:"userinfo"`
+	Profile  *profileDoc            `bson:"profile"`
+}
+
+// fetchUserinfo calls Keycloak's userinfo endpoint with the caller's
+// token. It returns the attributes the client's mappers expose there,
+// including ones not mapped into the access token.
+func fetchUserinfo(ctx context.Context, token string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, keycloakIssuer()+"/protocol/openid-connect/userinfo", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := keycloakHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo: %s", resp.Status)
+	}
+	var info map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("userinfo: %w", err)
+	}
+	return info, nil
+}
+
+// enrich returns the userinfo and profile of subject, from the cache when
+// fresh. Either half is left empty when its source fails, so /me degrades
+// to the token claims rather than failing.
+func enrich(ctx context.Context, subject, token string) enrichment {
+	var e enrichment
+	if meCache.get(ctx, subject, &e) {
+		return e
+	}
+	complete := true
+	info, err := fetchUserinfo(ctx, token)
+	if err != nil {
+		log.Println("Userinfo lookup failed:", err)
+		complete = false
+	}
+	e.Userinfo = info
+	if e.Profile, err = profiles().Get(ctx, subject); err != nil {
+		log.Println("Profile lookup failed:", err)
+		complete = false
+	}
+	if complete {
+		meCache.set(ctx, subject, e)
+	}
+	return e
+}
+
+// meHandler returns everything known about the caller in one response:
+// the token claims overlaid with the live userinfo attributes, and the
+// app's profile document. "sources" tells which parts could be loaded.
+func meHandler(c *fiber.Ctx) error {
+	u, err := inboundUser(c)
+	if err != nil {
+		return errUnauthorized(err.Error())
+	}
+	if u.Subject == "" {
+		return errUnauthorized("Token has no subject")
+	}
+	claims, _ := parseToken(c)
+	e := enrich(c.UserContext(), u.Subject, u.Token)
+
+	user := make(map[string]interface{}, len(claims)+len(e.Userinfo))
+	for k, v := range claims {
+		user[k] = v
+	}
+	// Userinfo is fresher than the token, e.g. after a profile change in
+	// the account console.
+	for k, v := range e.Userinfo {
+		user[k] = v
+	}
+	roles, _ := requestRoles(c)
+	if roles == nil {
+		roles = []string{}
+	}
+	out := fiber.Map{
+		"subject":     u.Subject,
+		"caller":      policy.CallerKind(claims),
+		"roles":       roles,
+		"permissions": keycloakauth.Permissions(claims),
+		"user":        user,
+		"profile":     e.Profile,
+		"sources": fiber.Map{
+			"token":    true,
+			"userinfo": e.Userinfo != nil,
+			"profile":  e.Profile != nil,
+		},
+	}
+	if imp := impersonatorOf(claims); imp != nil {
+		out["impersonator"] = imp
+	}
+	return c.JSON(out)
+}
+
+// profileRequest is the body of PUT /me/profile.
+type profileRequest struct {
+	DisplayName string                 `json:"displayName" validate:"max=100"`
+	Locale      string                 `json:"locale" validate:"omitempty,bcp47_language_tag"`
+	Preferences map[string]interface{} `json:"preferences" validate:"max=50"`
+}
+
+// putMyProfile replaces the caller's profile document.
+func putMyProfile(c *fiber.Ctx) error {
+	claims, err := parseToken(c)
+	if err != nil {
+		return errUnauthorized(err.Error())
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return errUnauthorized("Token has no subject")
+	}
+	var req profileRequest
+	if err := bindBody(c, &req); err != nil {
+		return err
+	}
+	p := profileDoc{
+		Subject:     sub,
+		DisplayName: req.DisplayName,
+		Locale:      req.Locale,
+		Preferences: req.Preferences,
+		UpdatedAt:   time.Now().UTC(),
+	}
+	if p.Preferences == nil {
+		p.Preferences = map[string]interface{}{}
+	}
+	ctx := c.UserContext()
+	if err := profiles().Put(ctx, p); err != nil {
+		return errDatabase(err)
+	}
+	meCache.invalidate(ctx, sub)
+	return c.JSON(p)
+}
+
+// mongoProfileStore keeps profiles in the profiles collection.
+type mongoProfileStore struct{}
+
+func (mongoProfileStore) Get(ctx context.Context, subject string) (*profileDoc, error) {
+	var p profileDoc
+	err := coll(profilesCollection, mongoReads).FindOne(ctx, bson.M{"_id": subject}, options.FindOne().SetComment(mongoComment(ctx))).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (mongoProfileStore) Put(ctx context.Context, p profileDoc) error {
+	_, err := coll(profilesCollection, mongoWrites).ReplaceOne(ctx, bson.M{"_id": p.Subject}, p, options.Replace().SetUpsert(true).SetComment(mongoComment(ctx)))
+	return err
+}
+
+// pgProfileStore keeps profiles in the profiles table.
+type pgProfileStore struct{}
+
+func (pgProfileStore) Get(ctx context.Context, subject string) (*profileDoc, error) {
+	p := profileDoc{Subject: subject}
+	err := pg().QueryRow(ctx, "SELECT display_name, locale, preferences, updated_at FROM profiles WHERE subject = $1", subject).
+		Scan(&p.DisplayName, &p.Locale, &p.Preferences, &p.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (pgProfileStore) Put(ctx context.Context, p profileDoc) error {
+	_, err := pg().Exec(ctx, "INSERT INTO profiles (subject, display_name, locale, preferences, updated_at) VALUES ($1, $2, $3, $4, $5) "+
+		"ON CONFLICT (subject) DO UPDATE SET display_name = EXCLUDED.display_name, locale = EXCLUDED.locale, "+
+		"preferences = EXCLUDED.preferences, updated_at = EXCLUDED.updated_at",
+		p.Subject, p.DisplayName, p.Locale, p.Preferences, p.UpdatedAt)
+	return err
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Request metrics are kept in memory and exposed in the Prometheus text
+// format. Besides the method, route and status they are labelled by the
+// caller's tenant and primary role, which are bounded by allowlists so a
+// scrape cannot grow with the number of customers.
+const (
+	metricsNone  = "none"
+	metricsOther = "other"
+)
+
+// metricsBuckets are the latency histogram's upper bounds in seconds.
+var metricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricVec is a family of series sharing a name and label names.
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	values []string
+	count  uint64
+	sum    float64
+	// buckets counts the observations up to each of metricsBuckets.
+	buckets []uint64
+}
+
+func newMetricVec(kind, name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, series: map[string]*metricSeries{}}
+}
+
+func (v *metricVec) get(values []string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &metricSeries{values: values}
+		if v.kind == "histogram" {
+			s.buckets = make([]uint64, len(metricsBuckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// inc adds one to a counter.
+func (v *metricVec) inc(values ...string) {
+	v.mu.Lock()
+	v.get(values).count++
+	v.mu.Unlock()
+}
+
+// observe records a histogram observation.
+func (v *metricVec) observe(x float64, values ...string) {
+	v.mu.Lock()
+	s := v.get(values)
+	s.count++
+	s.sum += x
+	for i, le := range metricsBuckets {
+		if x <= le {
+			s.buckets[i]++
+		}
+	}
+	v.mu.Unlock()
+}
+
+// write renders the family in the text exposition format, series sorted
+// by their labels.
+func (v *metricVec) write(b *strings.Builder) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		labels := metricLabels(v.labels, s.values)
+		if v.kind == "counter" {
+			fmt.Fprintf(b, "%s{%s} %d\n", v.name, labels, s.count)
+			continue
+		}
+		for i, le := range metricsBuckets {
+			fmt.Fprintf(b, "%s_bucket{%s,le=%q} %d\n", v.name, labels, strconv.FormatFloat(le, 'g', -1, 64), s.buckets[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", v.name, labels, s.count)
+		fmt.Fprintf(b, "%s_sum{%s} %s\n", v.name, labels, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "%s_count{%s} %d\n", v.name, labels, s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = n + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+var (
+	metricsEnabled bool
+	// metricsTenants and metricsRoles are the label values kept as they
+	// are; other tenants and roles are counted as "other".
+	metricsTenants map[string]bool
+	metricsRoles   []string
+
+	httpRequests = newMetricVec("counter", "http_requests_total",
+		"Requests by route, status, tenant and primary role.",
+		"method", "route", "status", "tenant", "role")
+	httpDuration = newMetricVec("histogram", "http_request_duration_seconds",
+		"Request latency by route, tenant and primary role.",
+		"method", "route", "tenant", "role")
+	authzDenials = newMetricVec("counter", "authz_denials_total",
+		"Requests refused by a role, scope, permission or policy check.",
+		"route", "check", "tenant", "role")
+)
+
+// useMetrics counts every request after it when METRICS_ENABLED is set,
+// and serves the counts at /metrics: without authentication on
+// METRICS_ADDR (for example ":9090"), a listener only the scraper must
+// reach, or otherwise on the app for the admin role.
+//
+//	METRICS_TENANTS  tenants labelled by name (default none)
+//	METRICS_ROLES    roles labelled by name, in order of precedence (default admin,user)
+func useMetrics(app *fiber.App) {
+	if !getEnvBool("METRICS_ENABLED", false) {
+		return
+	}
+	metricsEnabled = true
+	metricsTenants = map[string]bool{}
+	for _, t := range getEnvList("METRICS_TENANTS", nil) {
+		metricsTenants[t] = true
+	}
+	metricsRoles = getEnvList("METRICS_ROLES", []string{"admin", "user"})
+
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		internal := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler, DisableStartupMessage: true})
+		internal.Get("/metrics", metricsHandler)
+		go func() {
+			log.Println("Starting metrics server on", addr)
+			if err := internal.Listen(addr); err != nil {
+				log.Println("Metrics server stopped:", err)
+			}
+		}()
+	} else {
+		app.Get("/metrics", requireRole("admin"), metricsHandler)
+	}
+	app.Use(countRequest)
+	log.Println("Request metrics enabled")
+}
+
+// countRequest records the request once its response is final.
+func countRequest(c *fiber.Ctx) error {
+	start := time.Now()
+	if err := c.Next(); err != nil {
+		if err := c.App().Config().ErrorHandler(c, err); err != nil {
+			_ = c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+	route := "unmatched"
+	if r := c.Route(); r != nil && r.Path != "/" {
+		route = r.Path
+	}
+	tenant, role := metricsCaller(c)
+	status := strconv.Itoa(c.Response().StatusCode())
+	httpRequests.inc(c.Method(), route, status, tenant, role)
+	httpDuration.observe(time.Since(start).Seconds(), c.Method(), route, tenant, role)
+	if check, ok := c.Locals("authzDenied").(string); ok {
+		authzDenials.inc(route, check, tenant, role)
+	}
+	return nil
+}
+
+// metricsCaller returns the tenant and primary role labels of the caller:
+// "none" for both without a valid token, and "other" for values outside
+// METRICS_TENANTS and METRICS_ROLES. The primary role is the first of
+// METRICS_ROLES the caller holds.
+func metricsCaller(c *fiber.Ctx) (tenant, role string) {
+	t, ok := keycloakauth.Cached(c)
+	if !ok || t.Err != nil {
+		return metricsNone, metricsNone
+	}
+	tenant = metricsNone
+	if s, _ := t.Claims["tenant"].(string); s != "" {
+		tenant = metricsOther
+		if metricsTenants[s] {
+			tenant = s
+		}
+	}
+	role = metricsOther
+	for _, r := range metricsRoles {
+		if slices.Contains(t.Roles, r) {
+			role = r
+			break
+		}
+	}
+	return tenant, role
+}
+
+// markDenied records that the current request was refused by check, one
+// of "role" (also scopes and groups), "caller" or "policy",
+// for authz_denials_total.
+func markDenied(c *fiber.Ctx, check string) {
+	if metricsEnabled {
+		c.Locals("authzDenied", check)
+	}
+}
+
+func metricsHandler(c *fiber.Ctx) error {
+	var b strings.Builder
+	for _, v := range []*metricVec{httpRequests, httpDuration, authzDenials, authAnomalies, loadShed, chaosFaults} {
+		v.write(&b)
+	}
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	return c.SendString(b.String())
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// migrationsCollection records the migrations applied to the database.
+const migrationsCollection = "migrations"
+
+// migration is one change to the MongoDB schema or data. Migrations run
+// in order, each once; the ones that are safe to repeat, such as creating
+// indexes, also run at every start.
+type migration struct {
+	ID          string
+	Description string
+	Up          func(ctx context.Context) error
+}
+
+// migrations lists every migration. Append new ones at the end and never
+// renumber or remove an existing one.
+var migrations = []migration{
+	{
+		ID:          "0001_indexes",
+		Description: "Create the collection, TTL and retention indexes",
+		Up:          func(context.Context) error { return ensureIndexes() },
+	},
+	{
+		ID:          "0002_item_tags",
+		Description: "Store missing or null item tags as an empty list",
+		Up: func(ctx context.Context) error {
+			_, err := db().Collection(itemsCollection).UpdateMany(ctx,
+				bson.M{"$or": bson.A{bson.M{"tags": nil}, bson.M{"tags": bson.M{"$exists": false}}}},
+				bson.M{"$set": bson.M{"tags": bson.A{}}})
+			return err
+		},
+	},
+}
+
+type migrationRecord struct {
+	ID        string    `bson:"_id"`
+	AppliedAt time.Time `bson:"appliedAt"`
+	Version   string    `bson:"version"`
+}
+
+// appliedMigrations returns when each recorded migration was applied.
+func appliedMigrations(ctx context.Context) (map[string]time.Time, error) {
+	cur, err := db().Collection(migrationsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []migrationRecord
+	if err := cur.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	applied := make(map[string]time.Time, len(records))
+	for _, r := range records {
+		applied[r.ID] = r.AppliedAt
+	}
+	return applied, nil
+}
+
+// runMigrations applies the pending migrations in order and reports each
+// to out. With dryRun it only lists their state. It stops at the first
+// failure, leaving that migration pending.
+func runMigrations(ctx context.Context, out io.Writer, dryRun bool) error {
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", migrationsCollection, err)
+	}
+	for _, m := range migrations {
+		if at, ok := applied[m.ID]; ok {
+			fmt.Fprintf(out, "%s  applied %s  %s\n", m.ID, at.Format(time.RFC3339), m.Description)
+			continue
+		}
+		if dryRun {
+			fmt.Fprintf(out, "%s  pending  %s\n", m.ID, m.Description)
+			continue
+		}
+		start := time.Now()
+		if err := m.Up(ctx); err != nil {
+			return fmt.Errorf("migration %s: %w", m.ID, err)
+		}
+		record := migrationRecord{ID: m.ID, AppliedAt: time.Now().UTC(), Version: buildVersion}
+		_, err := db().Collection(migrationsCollection).InsertOne(ctx, record)
+		var dup mongo.WriteException
+		if errors.As(err, &dup) && dup.HasErrorCode(11000) {
+			// Another instance applied it concurrently; the migrations are
+			// written to tolerate that.
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("recording migration %s: %w", m.ID, err)
+		}
+		fmt.Fprintf(out, "%s  applied now (%s)  %s\n", m.ID, time.Since(start).Round(time.Millisecond), m.Description)
+	}
+	return nil
+}
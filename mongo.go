@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// The live client and database are swapped when MONGO_URI rotates or the
+// health monitor reconnects, so handlers go through db() rather than
+// holding on to them.
+var (
+	mongoClient atomic.Pointer[mongo.Client]
+	mongoDB     atomic.Pointer[mongo.Database]
+)
+
+func db() *mongo.Database {
+	return mongoDB.Load()
+}
+
+// mongoClientOptions applies uri and then the MONGO_* pool, timeout and
+// concern settings, which win over the same options in the URI.
+func mongoClientOptions(uri string) (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(uri).SetPoolMonitor(mongoPoolMonitor)
+	tlsCfg, err := upstreamTLSConfig("MONGO")
+	if err != nil {
+		return nil, fmt.Errorf("Mongo TLS error: %w", err)
+	}
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
+
+	for key, set := range map[string]func(uint64) *options.ClientOptions{
+		"MONGO_MAX_POOL_SIZE":  opts.SetMaxPoolSize,
+		"MONGO_MIN_POOL_SIZE":  opts.SetMinPoolSize,
+		"MONGO_MAX_CONNECTING": opts.SetMaxConnecting,
+	} {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			set(n)
+		}
+	}
+	for key, set := range map[string]func(time.Duration) *options.ClientOptions{
+		"MONGO_CONNECT_TIMEOUT":          opts.SetConnectTimeout,
+		"MONGO_SERVER_SELECTION_TIMEOUT": opts.SetServerSelectionTimeout,
+		"MONGO_MAX_CONN_IDLE_TIME":       opts.SetMaxConnIdleTime,
+		"MONGO_TIMEOUT":                  opts.SetTimeout,
+	} {
+		if v := os.Getenv(key); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			set(d)
+		}
+	}
+
+	rp, err := readPrefFrom("MONGO_")
+	if err != nil {
+		return nil, err
+	}
+	if rp != nil {
+		opts.SetReadPreference(rp)
+	}
+	rc, err := readConcernFrom("MONGO_")
+	if err != nil {
+		return nil, err
+	}
+	if rc != nil {
+		opts.SetReadConcern(rc)
+	}
+	wc, err := writeConcernFrom("MONGO_")
+	if err != nil {
+		return nil, err
+	}
+	if wc != nil {
+		opts.SetWriteConcern(wc)
+	}
+	return opts, nil
+}
+
+// readPrefFrom reads <prefix>READ_PREFERENCE (primary, primaryPreferred,
+// secondary, secondaryPreferred or nearest) and <prefix>MAX_STALENESS. It
+// returns nil when the mode is unset.
+func readPrefFrom(prefix string) (*readpref.ReadPref, error) {
+	name := os.Getenv(prefix + "READ_PREFERENCE")
+	if name == "" {
+		return nil, nil
+	}
+	mode, err := readpref.ModeFromString(name)
+	if err != nil {
+		return nil, fmt.Errorf("%sREAD_PREFERENCE: %w", prefix, err)
+	}
+	var rpOpts []readpref.Option
+	if d := getEnvDuration(prefix+"MAX_STALENESS", 0); d > 0 {
+		rpOpts = append(rpOpts, readpref.WithMaxStaleness(d))
+	}
+	rp, err := readpref.New(mode, rpOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("%sREAD_PREFERENCE: %w", prefix, err)
+	}
+	return rp, nil
+}
+
+// readConcernFrom reads <prefix>READ_CONCERN, returning nil when unset.
+func readConcernFrom(prefix string) (*readconcern.ReadConcern, error) {
+	switch level := os.Getenv(prefix + "READ_CONCERN"); level {
+	case "":
+		return nil, nil
+	case "local", "available", "majority", "linearizable", "snapshot":
+		return &readconcern.ReadConcern{Level: level}, nil
+	default:
+		return nil, fmt.Errorf("%sREAD_CONCERN: unknown level %q", prefix, level)
+	}
+}
+
+// writeConcernFrom reads <prefix>WRITE_CONCERN ("majority", a tag set
+// name or a node count) with <prefix>WRITE_JOURNAL and
+// <prefix>WRITE_TIMEOUT, returning nil when the concern is unset.
+func writeConcernFrom(prefix string) (*writeconcern.WriteConcern, error) {
+	w := os.Getenv(prefix + "WRITE_CONCERN")
+	if w == "" {
+		return nil, nil
+	}
+	wc := &writeconcern.WriteConcern{W: w}
+	if n, err := strconv.Atoi(w); err == nil {
+		if n < 0 {
+			return nil, fmt.Errorf("%sWRITE_CONCERN: %d is negative", prefix, n)
+		}
+		wc.W = n
+	}
+	if os.Getenv(prefix+"WRITE_JOURNAL") != "" {
+		j := getEnvBool(prefix+"WRITE_JOURNAL", false)
+		wc.Journal = &j
+	}
+	wc.WTimeout = getEnvDuration(prefix+"WRITE_TIMEOUT", 0)
+	return wc, nil
+}
+
+// mongoOp classifies the operations of the item and profile stores so
+// each kind can get its own MONGO_<KIND>_* read preference and concerns on
+// top of the client's.
+type mongoOp int
+
+const (
+	// mongoReads are interactive reads: item lookups and lists, profiles.
+	mongoReads mongoOp = iota
+	// mongoReports are scans and aggregations behind reports and exports,
+	// which can usually run on a secondary.
+	mongoReports
+	// mongoWrites are inserts, updates and deletes.
+	mongoWrites
+)
+
+var mongoOpPrefixes = [...]string{
+	mongoReads:   "MONGO_READS_",
+	mongoReports: "MONGO_REPORTS_",
+	mongoWrites:  "MONGO_WRITES_",
+}
+
+var mongoOpOptions [len(mongoOpPrefixes)]*options.CollectionOptions
+
+func initMongoOps() error {
+	for op, prefix := range mongoOpPrefixes {
+		opts := options.Collection()
+		rp, err := readPrefFrom(prefix)
+		if err != nil {
+			return err
+		}
+		rc, err := readConcernFrom(prefix)
+		if err != nil {
+			return err
+		}
+		wc, err := writeConcernFrom(prefix)
+		if err != nil {
+			return err
+		}
+		mongoOpOptions[op] = opts.SetReadPreference(rp).SetReadConcern(rc).SetWriteConcern(wc)
+	}
+	return nil
+}
+
+// coll returns collection name of the live database, configured for op.
+func coll(name string, op mongoOp) *mongo.Collection {
+	return db().Collection(name, mongoOpOptions[op])
+}
+
+// connectMongo creates a client for uri and pings the primary. Only an
+// invalid configuration returns a nil client: after a failed ping the
+// client is returned along with the error, since the driver keeps dialling
+// in the background.
+func connectMongo(uri string) (*mongo.Client, error) {
+	opts, err := mongoClientOptions(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("Mongo Connect error: %w", err)
+	}
+	return client, pingMongo(client)
+}
+
+func pingMongo(client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		return fmt.Errorf("Mongo Ping error: %w", err)
+	}
+	return nil
+}
+
+// swapMongo makes client the live one.
+func swapMongo(client *mongo.Client, dbName string) {
+	old := mongoClient.Swap(client)
+	mongoDB.Store(client.Database(dbName))
+	if old != nil {
+		// Let in-flight operations on the old client finish.
+		time.AfterFunc(30*time.Second, func() { _ = old.Disconnect(context.Background()) })
+	}
+}
+
+// mongoPending holds work that needs a reachable server, such as creating
+// indexes, deferred when MongoDB was down at startup.
+var mongoPending struct {
+	sync.Mutex
+	fns []func()
+}
+
+// whenMongoUp runs fn once the primary is reachable: now if it is, or
+// after the health monitor's first successful ping.
+func whenMongoUp(fn func()) {
+	if ready("mongodb") {
+		fn()
+		return
+	}
+	mongoPending.Lock()
+	defer mongoPending.Unlock()
+	mongoPending.fns = append(mongoPending.fns, fn)
+}
+
+func runMongoPending() {
+	mongoPending.Lock()
+	fns := mongoPending.fns
+	mongoPending.fns = nil
+	mongoPending.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// initMongo connects to MongoDB. A server that cannot be reached does not
+// stop the app: it starts unready and the health monitor takes over. The
+// URI is a secret and may rotate, in which case a new client replaces the
+// current one.
+func initMongo() error {
+	if err := initMongoOps(); err != nil {
+		return err
+	}
+	mongoURI := secrets.Get("MONGO_URI", "mongodb://localhost:27017")
+	dbName := getEnv("MONGO_DB", "demo_db")
+	client, err := connectMongo(mongoURI)
+	if client == nil {
+		return err
+	}
+	swapMongo(client, dbName)
+	setReady("mongodb", err)
+	if err != nil {
+		log.Println("MongoDB unreachable, starting unready:", err)
+	} else {
+		log.Println("Connected to MongoDB:", redactURI(mongoURI))
+	}
+
+	secrets.Watch("MONGO_URI", func(uri string) {
+		client, err := connectMongo(uri)
+		if err != nil {
+			if client != nil {
+				_ = client.Disconnect(context.Background())
+			}
+			log.Println("Keeping current MongoDB connection, rotated URI failed:", err)
+			return
+		}
+		swapMongo(client, dbName)
+		log.Println("Reconnected to MongoDB with rotated URI:", redactURI(uri))
+	})
+
+	go monitorMongo(dbName)
+	return nil
+}
+
+// monitorMongo pings the primary every MONGO_HEALTH_INTERVAL (10s) and
+// keeps the app unready while it fails. The driver reconnects by itself,
+// but after MONGO_RECONNECT_AFTER consecutive failures (6) the monitor
+// also tries a fresh client, which re-resolves DNS and SRV records. Those
+// attempts back off, doubling the number of failed pings between them up
+// to 64.
+func monitorMongo(dbName string) {
+	interval := getEnvDuration("MONGO_HEALTH_INTERVAL", 10*time.Second)
+	reconnectAfter := getEnvInt("MONGO_RECONNECT_AFTER", 6)
+	failures, step := 0, reconnectAfter
+	nextAttempt := reconnectAfter
+	for range time.Tick(interval) {
+		err := pingMongo(mongoClient.Load())
+		if setReady("mongodb", err) {
+			if err != nil {
+				log.Println("MongoDB primary unreachable, marking unready:", err)
+			} else {
+				log.Println("MongoDB primary reachable again")
+			}
+		}
+		if err == nil {
+			failures, step, nextAttempt = 0, reconnectAfter, reconnectAfter
+			runMongoPending()
+			continue
+		}
+		failures++
+		if reconnectAfter <= 0 || failures < nextAttempt {
+			continue
+		}
+		step = min(2*step, 64)
+		nextAttempt = failures + step
+		uri := secrets.Get("MONGO_URI", "mongodb://localhost:27017")
+		client, err := connectMongo(uri)
+		if err != nil {
+			if client != nil {
+				_ = client.Disconnect(context.Background())
+			}
+			log.Printf("MongoDB reconnect failed, next attempt after %d more failed pings: %v", step, err)
+			continue
+		}
+		swapMongo(client, dbName)
+		setReady("mongodb", nil)
+		log.Println("Reconnected to MongoDB with a new client")
+		failures, step, nextAttempt = 0, reconnectAfter, reconnectAfter
+		runMongoPending()
+	}
+}
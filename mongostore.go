@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoItemStore keeps items in the items collection and deleted ones in
+// items_deleted. Its operations carry the request's mongoComment.
+type mongoItemStore struct{}
+
+func (mongoItemStore) filter(f itemFilter) bson.M {
+	filter := bson.M{}
+	if f.Tag != "" {
+		filter["tags"] = f.Tag
+	}
+	if f.CreatedBy != "" {
+		filter["createdBy"] = bson.M{"$in": searchableForms(f.CreatedBy)}
+	}
+	created := bson.M{}
+	if !f.CreatedSince.IsZero() {
+		created["$gte"] = f.CreatedSince
+	}
+	if !f.CreatedUntil.IsZero() {
+		created["$lt"] = f.CreatedUntil
+	}
+	if len(created) > 0 {
+		filter["createdAt"] = created
+	}
+	if v := f.VisibleTo; v != nil {
+		var visible bson.A
+		if v.Subject != "" {
+			forms := searchableForms(v.Subject)
+			visible = append(visible, bson.M{"createdBy": bson.M{"$in": forms}}, bson.M{"acl.subject": bson.M{"$in": forms}})
+		}
+		if len(v.Groups) > 0 {
+			visible = append(visible, bson.M{"acl.group": bson.M{"$in": v.Groups}})
+		}
+		if visible == nil {
+			// Nothing identifies the caller, so nothing is visible.
+			visible = bson.A{bson.M{"_id": bson.M{"$in": bson.A{}}}}
+		}
+		filter["$or"] = visible
+	}
+	return filter
+}
+
+func (s mongoItemStore) List(ctx context.Context, f itemFilter, offset, limit int) ([]item, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit)).
+		SetComment(mongoComment(ctx))
+	cur, err := coll(itemsCollection, mongoReads).Find(ctx, s.filter(f), opts)
+	if err != nil {
+		return nil, err
+	}
+	out := []item{}
+	if err := cur.All(ctx, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (mongoItemStore) Count(ctx context.Context) (int64, error) {
+	return coll(itemsCollection, mongoReports).CountDocuments(ctx, bson.M{}, options.Count().SetComment(mongoComment(ctx)))
+}
+
+func (mongoItemStore) Insert(ctx context.Context, doc item) error {
+	_, err := coll(itemsCollection, mongoWrites).InsertOne(ctx, doc, options.InsertOne().SetComment(mongoComment(ctx)))
+	return err
+}
+
+func (mongoItemStore) Get(ctx context.Context, id primitive.ObjectID) (item, error) {
+	var doc item
+	err := coll(itemsCollection, mongoReads).FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetComment(mongoComment(ctx))).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return item{}, errNoDocument
+	}
+	return doc, err
+}
+
+func (ch itemChanges) set() bson.M {
+	return bson.M{
+		"name":        ch.Name,
+		"description": ch.Description,
+		"tags":        nonNilTags(ch.Tags),
+		"updatedAt":   ch.UpdatedAt,
+	}
+}
+
+func (mongoItemStore) Update(ctx context.Context, id primitive.ObjectID, ch itemChanges) (item, error) {
+	var doc item
+	err := coll(itemsCollection, mongoWrites).
+		FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": ch.set()},
+			options.FindOneAndUpdate().SetReturnDocument(options.After).SetComment(mongoComment(ctx))).
+		Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return item{}, errNoDocument
+	}
+	return doc, err
+}
+
+func (mongoItemStore) SetACL(ctx context.Context, id primitive.ObjectID, acl itemACL) (item, error) {
+	var doc item
+	err := coll(itemsCollection, mongoWrites).
+		FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"acl": acl, "updatedAt": time.Now().UTC()}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After).SetComment(mongoComment(ctx))).
+		Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return item{}, errNoDocument
+	}
+	return doc, err
+}
+
+func (s mongoItemStore) Delete(ctx context.Context, id primitive.ObjectID) (item, error) {
+	var doc item
+	err := coll(itemsCollection, mongoWrites).FindOneAndDelete(ctx, bson.M{"_id": id}, options.FindOneAndDelete().SetComment(mongoComment(ctx))).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return item{}, errNoDocument
+	}
+	if err != nil {
+		return item{}, err
+	}
+	keepDeleted(ctx, s.keep, doc)
+	return doc, nil
+}
+
+func (mongoItemStore) keep(ctx context.Context, kept []deletedItem) error {
+	docs := make([]interface{}, len(kept))
+	for i, k := range kept {
+		docs[i] = k
+	}
+	_, err := coll(deletedItemsCollection, mongoWrites).InsertMany(ctx, docs, options.InsertMany().SetComment(mongoComment(ctx)))
+	return err
+}
+
+func (mongoItemStore) GetMany(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]item, error) {
+	cur, err := coll(itemsCollection, mongoReads).Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetComment(mongoComment(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	var found []item
+	if err := cur.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	out := make(map[primitive.ObjectID]item, len(found))
+	for _, f := range found {
+		out[f.ID] = f
+	}
+	return out, nil
+}
+
+func (s mongoItemStore) Bulk(ctx context.Context, writes []itemWrite) ([]error, error) {
+	models := make([]mongo.WriteModel, len(writes))
+	var deleted []primitive.ObjectID
+	for i, w := range writes {
+		switch w.Op {
+		case batchCreate:
+			models[i] = mongo.NewInsertOneModel().SetDocument(w.Doc)
+		case batchUpdate:
+			models[i] = mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": w.ID}).SetUpdate(bson.M{"$set": w.Set.set()})
+		case batchDelete:
+			models[i] = mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": w.ID})
+			deleted = append(deleted, w.ID)
+		}
+	}
+	// Deleted items are kept, which needs their documents.
+	var before map[primitive.ObjectID]item
+	if len(deleted) > 0 {
+		var err error
+		if before, err = s.GetMany(ctx, deleted); err != nil {
+			return nil, err
+		}
+	}
+
+	errs := make([]error, len(writes))
+	_, err := coll(itemsCollection, mongoWrites).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false).SetComment(mongoComment(ctx)))
+	var bulkErr mongo.BulkWriteException
+	switch {
+	case errors.As(err, &bulkErr):
+		for _, we := range bulkErr.WriteErrors {
+			errs[we.Index] = we
+		}
+	case err != nil:
+		return nil, err
+	}
+	var kept []item
+	for i, w := range writes {
+		if w.Op == batchDelete && errs[i] == nil {
+			kept = append(kept, before[w.ID])
+		}
+	}
+	if len(kept) > 0 {
+		keepDeleted(ctx, s.keep, kept...)
+	}
+	return errs, nil
+}
+
+func (s mongoItemStore) Each(ctx context.Context, f itemFilter, fn func(item) error) error {
+	cur, err := coll(itemsCollection, mongoReports).Find(ctx, s.filter(f),
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetComment(mongoComment(ctx)))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var it item
+		if err := cur.Decode(&it); err != nil {
+			return err
+		}
+		if err := fn(it); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// Import needs MongoDB running as a replica set for its transactions.
+func (mongoItemStore) Import(ctx context.Context, docs []item, batchSize int, inTx importHook) (int, error) {
+	sess, err := db().Client().StartSession()
+	if err != nil {
+		return 0, err
+	}
+	defer sess.EndSession(ctx)
+
+	applied := 0
+	items := coll(itemsCollection, mongoWrites)
+	for start := 0; start < len(docs); start += batchSize {
+		end := min(start+batchSize, len(docs))
+		models := make([]mongo.WriteModel, 0, end-start)
+		for _, doc := range docs[start:end] {
+			if len(doc.ACL) == 0 {
+				// An export without shares keeps the stored ones.
+				models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": doc.ID}).
+					SetUpdate(bson.M{"$set": doc}).SetUpsert(true))
+				continue
+			}
+			models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": doc.ID}).SetReplacement(doc).SetUpsert(true))
+		}
+		_, err := sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			res, err := items.BulkWrite(sc, models, options.BulkWrite().SetOrdered(true))
+			if err != nil {
+				return nil, err
+			}
+			created := make([]bool, end-start)
+			for i := range res.UpsertedIDs {
+				created[i] = true
+			}
+			return nil, inTx(sc, docs[start:end], created)
+		})
+		if err != nil {
+			return applied, err
+		}
+		applied += end - start
+	}
+	return applied, nil
+}
+
+func (mongoItemStore) TagCounts(ctx context.Context) (map[string]int, error) {
+	cur, err := coll(itemsCollection, mongoReports).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$unwind", Value: "$tags"}},
+		{{Key: "$group", Value: bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}}},
+	}, options.Aggregate().SetComment(mongoComment(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Tag   string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]int, len(rows))
+	for _, r := range rows {
+		tags[r.Tag] = r.Count
+	}
+	return tags, nil
+}
+
+// mongoDenylistStore keeps denylist entries keyed by subject.
+type mongoDenylistStore struct{}
+
+func (mongoDenylistStore) List(ctx context.Context) ([]denylistEntry, error) {
+	cur, err := db().Collection(denylistCollection).Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	entries := []denylistEntry{}
+	if err := cur.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (mongoDenylistStore) Put(ctx context.Context, e denylistEntry) error {
+	_, err := db().Collection(denylistCollection).ReplaceOne(ctx, bson.M{"_id": e.Subject}, e, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (mongoDenylistStore) Delete(ctx context.Context, subject string) (bool, error) {
+	res, err := db().Collection(denylistCollection).DeleteOne(ctx, bson.M{"_id": subject})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+func (mongoDenylistStore) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	res, err := db().Collection(denylistCollection).DeleteMany(ctx, bson.M{"expiresAt": bson.M{"$lte": now}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// mongoAuditStore appends to the audit collection.
+type mongoAuditStore struct{}
+
+func (mongoAuditStore) Insert(ctx context.Context, e auditEntry) error {
+	_, err := db().Collection(auditCollection).InsertOne(ctx, e)
+	return err
+}
+
+func (mongoAuditStore) DeleteBefore(ctx context.Context, t time.Time) (int64, error) {
+	res, err := db().Collection(auditCollection).DeleteMany(ctx, bson.M{"time": bson.M{"$lt": t}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
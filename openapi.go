@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// routeDoc is the documentation attached to a named route. Routes are
+// named with documented() at registration and the OpenAPI document is
+// generated from the app's route table.
+type routeDoc struct {
+	Summary string
+	Tags    []string
+	// Auth marks routes that need a bearer token.
+	Auth bool
+	// Roles lists the realm roles of which the caller needs at least one.
+	Roles []string
+	// Caller is the caller kind the route requires (requireCaller).
+	Caller string
+}
+
+var routeDocs = map[string]routeDoc{}
+
+// documented records d under name and returns name for use with Route.Name.
+func documented(name string, d routeDoc) string {
+	routeDocs[name] = d
+	return name
+}
+
+var fiberParam = regexp.MustCompile(`\\?:([A-Za-z0-9_]+)\??`)
+
+// openAPIPath converts a Fiber path ("/items/:id") to OpenAPI form
+// ("/items/{id}"). An escaped colon (`/items\:batch`) stays literal.
+func openAPIPath(path string) (string, []string) {
+	var params []string
+	out := fiberParam.ReplaceAllStringFunc(path, func(m string) string {
+		if strings.HasPrefix(m, `\`) {
+			return m[1:]
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(m, ":"), "?")
+		params = append(params, name)
+		return "{" + name + "}"
+	})
+	return out, params
+}
+
+// buildOpenAPI walks the registered routes and renders an OpenAPI 3 document.
+func buildOpenAPI(app *fiber.App) fiber.Map {
+	paths := map[string]fiber.Map{}
+	for _, r := range app.GetRoutes(true) {
+		d, ok := routeDocs[r.Name]
+		if !ok || r.Method == fiber.MethodHead {
+			continue
+		}
+		path, params := openAPIPath(r.Path)
+
+		op := fiber.Map{
+			"operationId": r.Name,
+			"summary":     d.Summary,
+			"responses":   fiber.Map{"200": fiber.Map{"description": "OK"}},
+		}
+		tags := d.Tags
+		if m := versionedPath.FindStringSubmatch(r.Path); m != nil {
+			op["operationId"] = m[1] + "_" + r.Name
+			tags = append([]string{m[1]}, tags...)
+			if v, ok := lookupVersion(m[1]); ok && v.Deprecated {
+				op["deprecated"] = true
+			}
+		}
+		if len(tags) > 0 {
+			op["tags"] = tags
+		}
+		if len(params) > 0 {
+			ps := make([]fiber.Map, 0, len(params))
+			for _, p := range params {
+				ps = append(ps, fiber.Map{"name": p, "in": "path", "required": true, "schema": fiber.Map{"type": "string"}})
+			}
+			op["parameters"] = ps
+		}
+		if d.Auth || len(d.Roles) > 0 {
+			op["security"] = []fiber.Map{{"bearerAuth": []string{}}, {"keycloak": []string{}}}
+			responses := op["responses"].(fiber.Map)
+			responses["401"] = fiber.Map{"description": "Missing or invalid bearer token"}
+			if len(d.Roles) > 0 {
+				op["description"] = "Requires one of the realm roles: " + strings.Join(d.Roles, ", ")
+				responses["403"] = fiber.Map{"description": "Caller lacks the required role"}
+			}
+		}
+
+		if paths[path] == nil {
+			paths[path] = fiber.Map{}
+		}
+		paths[path][strings.ToLower(r.Method)] = op
+	}
+
+	versions := make([]string, 0, len(apiVersions))
+	for _, v := range apiVersions {
+		versions = append(versions, v.Name)
+	}
+	sort.Strings(versions)
+
+	return fiber.Map{
+		"openapi": "3.0.3",
+		"info": fiber.Map{
+			"title":       "Fiber demo API",
+			"version":     strings.Join(versions, ", "),
+			"description": "Backend API secured by Kong and Keycloak.",
+		},
+		"paths": paths,
+		"components": fiber.Map{
+			"securitySchemes": fiber.Map{
+				"bearerAuth": fiber.Map{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+					"description":  "Access token issued by " + keycloakIssuer(),
+				},
+				"keycloak": fiber.Map{
+					"type":             "openIdConnect",
+					"openIdConnectUrl": strings.TrimSuffix(keycloakIssuer(), "/") + "/.well-known/openid-configuration",
+				},
+			},
+		},
+	}
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Fiber demo API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>`
+
+// docsCSP lets Swagger UI load its bundle from unpkg.
+const docsCSP = "default-src 'self'; script-src 'self' 'unsafe-inline' https://unpkg.com; " +
+	"style-src 'self' 'unsafe-inline' https://unpkg.com; img-src 'self' data:; frame-ancestors 'none'"
+
+// mountDocs serves the generated spec at /openapi.json and Swagger UI at
+// /docs when API_DOCS_ENABLED is set. The spec is built on first request,
+// after every route has been registered.
+func mountDocs(app *fiber.App) {
+	if !getEnvBool("API_DOCS_ENABLED", false) {
+		return
+	}
+	useCORS(app, "/openapi.json", "DOCS")
+
+	var (
+		once sync.Once
+		spec fiber.Map
+	)
+	app.Get("/openapi.json", func(c *fiber.Ctx) error {
+		once.Do(func() { spec = buildOpenAPI(app) })
+		return c.JSON(spec)
+	})
+	app.Get("/docs", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentSecurityPolicy, docsCSP)
+		c.Type("html")
+		return c.SendString(swaggerUIPage)
+	})
+	log.Println("API docs enabled at /openapi.json and /docs")
+}
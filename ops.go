@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mountOps adds the operator endpoints under /ops. Like /admin they need
+// the admin role.
+func mountOps(app *fiber.App) {
+	ops := app.Group("/ops", requireRole("admin"))
+	ops.Get("/schedule", listSchedule)
+	ops.Post("/schedule/:name/run", runScheduledTask)
+	ops.Post("/jwks/refresh", refreshJWKS)
+	ops.Post("/caches/flush", flushCaches)
+	ops.Get("/log-level", getLogLevel)
+	ops.Put("/log-level", putLogLevel)
+	ops.Get("/config", effectiveConfig)
+	registerChaosRoutes(ops)
+}
+
+func listSchedule(c *fiber.Ctx) error {
+	out := make([]taskStatus, 0, len(scheduledTasks))
+	for _, t := range scheduledTasks {
+		out = append(out, t.status())
+	}
+	return c.JSON(fiber.Map{"tasks": out})
+}
+
+// runScheduledTask asks an enabled task to run now. A request while a run
+// is already queued is a no-op.
+func runScheduledTask(c *fiber.Ctx) error {
+	t := findTask(c.Params("name"))
+	if t == nil {
+		return newProblem(fiber.StatusNotFound, problemAboutBlank, "Unknown task")
+	}
+	if !t.status().Enabled {
+		return newProblem(fiber.StatusConflict, problemAboutBlank, "Task is disabled")
+	}
+	select {
+	case t.trigger <- struct{}{}:
+	default:
+	}
+	recordAudit(c, "schedule.run", t.name, nil)
+	return c.Status(fiber.StatusAccepted).JSON(t.status())
+}
+
+// refreshJWKS refetches the realm's signing keys now instead of waiting
+// for a token with an unknown key ID.
+func refreshJWKS(c *fiber.Ctx) error {
+	n, err := auth.RefreshKeys()
+	if errors.Is(err, keycloakauth.ErrNoJWKS) {
+		return newProblem(fiber.StatusConflict, problemAboutBlank, "Tokens are not verified against the JWKS in AUTH_MODE="+authMode)
+	}
+	if err != nil {
+		log.Println("JWKS refresh failed:", err)
+		return newProblem(fiber.StatusBadGateway, problemAboutBlank, "JWKS refresh failed")
+	}
+	recordAudit(c, "ops.jwks.refresh", jwksURL(), bson.M{"keys": n})
+	return c.JSON(fiber.Map{"url": jwksURL(), "keys": n})
+}
+
+// opsCache is a cache /ops/caches/flush can clear. flush reports what it
+// did, or why it was skipped.
+type opsCache struct {
+	name  string
+	flush func(ctx context.Context) (string, error)
+}
+
+var errCacheSkipped = errors.New("skipped")
+
+var opsCaches = []opsCache{
+	{"jwks", func(context.Context) (string, error) {
+		n, err := auth.RefreshKeys()
+		if errors.Is(err, keycloakauth.ErrNoJWKS) {
+			return "not used in AUTH_MODE=" + authMode, errCacheSkipped
+		}
+		return fmt.Sprintf("%d keys loaded", n), err
+	}},
+	{"roles", func(ctx context.Context) (string, error) {
+		if err := refreshRealmRoles(ctx); err != nil {
+			return "", err
+		}
+		n := 0
+		if r := realmRoles.Load(); r != nil {
+			n = len(*r)
+		}
+		return fmt.Sprintf("%d roles loaded", n), nil
+	}},
+	{"exchange", func(context.Context) (string, error) {
+		return fmt.Sprintf("%d tokens dropped", forgetExchanges()), nil
+	}},
+	{"service-token", func(context.Context) (string, error) {
+		forgetServiceToken()
+		return "dropped", nil
+	}},
+	{"secrets", func(context.Context) (string, error) {
+		secrets.refresh()
+		return "re-read", nil
+	}},
+}
+
+func init() {
+	for _, r := range cacheRoutes {
+		r := r
+		opsCaches = append(opsCaches, opsCache{r.Name, func(ctx context.Context) (string, error) {
+			if !cacheEnabled() {
+				return "Redis cache is off", errCacheSkipped
+			}
+			n, err := r.flush(ctx)
+			return fmt.Sprintf("%d entries dropped", n), err
+		}})
+	}
+}
+
+type cacheFlushResult struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// flushCaches clears the caches named in ?caches= (comma-separated), or
+// all of them. One failing cache does not stop the others.
+func flushCaches(c *fiber.Ctx) error {
+	names := splitList(c.Query("caches"))
+	selected := opsCaches
+	if len(names) > 0 {
+		selected = nil
+		for _, name := range names {
+			found := false
+			for _, oc := range opsCaches {
+				if oc.name == name {
+					selected, found = append(selected, oc), true
+					break
+				}
+			}
+			if !found {
+				return errValidation([]fieldError{{Field: "caches", Rule: "oneof", Message: "unknown cache " + name}})
+			}
+		}
+	}
+	results := make([]cacheFlushResult, 0, len(selected))
+	flushed := make([]string, 0, len(selected))
+	for _, oc := range selected {
+		detail, err := oc.flush(c.UserContext())
+		res := cacheFlushResult{Name: oc.name, OK: err == nil, Detail: detail}
+		switch {
+		case errors.Is(err, errCacheSkipped):
+			res.OK, res.Skipped = true, true
+		case err != nil:
+			log.Printf("Flushing cache %s failed: %v", oc.name, err)
+			res.Detail = err.Error()
+		default:
+			flushed = append(flushed, oc.name)
+		}
+		results = append(results, res)
+	}
+	recordAudit(c, "ops.caches.flush", strings.Join(flushed, ","), nil)
+	return c.JSON(fiber.Map{"caches": results})
+}
+
+type logLevelRequest struct {
+	Level string `json:"level" validate:"required,oneof=debug info warn error"`
+	// For reverts to the previous level after this long; 0 keeps it.
+	For duration `json:"for"`
+}
+
+func getLogLevel(c *fiber.Ctx) error {
+	out := fiber.Map{"level": strings.ToLower(logLevel.Level().String())}
+	if until := logLevelUntil(); !until.IsZero() {
+		out["until"] = until.UTC()
+	}
+	return c.JSON(out)
+}
+
+// putLogLevel changes the log level, optionally for a limited time. A
+// reload of the runtime config applies its own logLevel over it.
+func putLogLevel(c *fiber.Ctx) error {
+	var req logLevelRequest
+	if err := bindBody(c, &req); err != nil {
+		return err
+	}
+	if req.For < 0 {
+		return errValidation([]fieldError{{Field: "for", Rule: "min", Message: "must not be negative"}})
+	}
+	if err := overrideLogLevel(req.Level, time.Duration(req.For)); err != nil {
+		return newProblem(fiber.StatusBadRequest, problemValidation, err.Error())
+	}
+	log.Printf("Log level set to %s by %s", req.Level, subject(c))
+	recordAudit(c, "ops.log-level", req.Level, bson.M{"for": time.Duration(req.For).String()})
+	return getLogLevel(c)
+}
+
+// secretWords mark environment variables whose values /ops/config hides,
+// as a whole segment of the name: KEYCLOAK_CLIENT_SECRET and
+// FIELD_ENCRYPTION_KEY are hidden, KEYCLOAK_ISSUER is not.
+var secretWords = map[string]bool{
+	"SECRET": true, "SECRETS": true, "PASSWORD": true, "PASS": true, "TOKEN": true,
+	"KEY": true, "KEYS": true, "APIKEY": true, "CREDENTIALS": true, "PRIVATE": true,
+}
+
+// maskSetting hides secret values and the passwords in connection URIs.
+func maskSetting(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	for _, w := range strings.FieldsFunc(strings.ToUpper(name), func(r rune) bool { return r == '_' || r == '-' }) {
+		if secretWords[w] {
+			return "xxxxx"
+		}
+	}
+	if strings.Contains(value, "://") && strings.Contains(value, "@") {
+		if _, err := url.Parse(value); err != nil {
+			return "xxxxx"
+		}
+		return redactURI(value)
+	}
+	return value
+}
+
+// effectiveConfig shows what the process is running with: the settings
+// resolved at startup, the applied runtime config and the environment,
+// with secrets masked.
+func effectiveConfig(c *fiber.Ctx) error {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = maskSetting(k, v)
+	}
+	ttls := fiber.Map{}
+	for _, r := range cacheRoutes {
+		ttls[r.Name] = r.ttl.String()
+	}
+	rules := 0
+	if p := currentPolicy.Load(); p != nil {
+		rules = len(p.Rules)
+	}
+	store := "postgres"
+	if usesMongo() {
+		store = "mongodb"
+	}
+	return c.JSON(fiber.Map{
+		"version":  buildVersion,
+		"appEnv":   appEnv(),
+		"authMode": authMode,
+		"issuer":   keycloakIssuer(),
+		"logLevel": strings.ToLower(logLevel.Level().String()),
+		"storage":  store,
+		"policy": fiber.Map{
+			"file":              os.Getenv("POLICY_FILE"),
+			"rules":             rules,
+			"enforcedByGateway": policyAtGateway,
+		},
+		"cache":   fiber.Map{"enabled": cacheEnabled(), "ttls": ttls},
+		"runtime": currentRuntime.Load(),
+		"env":     env,
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// With EVENTS_OUTBOX, item events are not handed to the broker and the
+// webhooks directly, where a crash between the write and the publish
+// would lose them. They are written to the outbox collection in the
+// transaction that changes the item, and a relay on every instance
+// publishes them from there. An event is published at least once and
+// keeps its ID when it is retried, so consumers can drop repeats; NATS
+// JetStream does so itself, and webhook deliveries are queued exactly
+// once.
+const outboxCollection = "outbox"
+
+// outboxEntry is an event waiting for, or done with, the relay. The two
+// stages are tracked separately so a broker outage doesn't queue the
+// webhooks twice.
+type outboxEntry struct {
+	ID           string     `bson:"_id"`
+	Name         string     `bson:"name"`
+	Body         string     `bson:"body"`
+	CreatedAt    time.Time  `bson:"createdAt"`
+	NextAttempt  time.Time  `bson:"nextAttempt"`
+	LockedBy     string     `bson:"lockedBy,omitempty"`
+	Attempts     int        `bson:"attempts"`
+	LastError    string     `bson:"lastError,omitempty"`
+	WebhooksDone bool       `bson:"webhooksDone"`
+	BrokerDone   bool       `bson:"brokerDone"`
+	PublishedAt  *time.Time `bson:"publishedAt,omitempty"`
+}
+
+var outboxIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "publishedAt", Value: 1}, {Key: "nextAttempt", Value: 1}, {Key: "createdAt", Value: 1}}},
+}
+
+var (
+	outboxEnabled bool
+	outboxWake    = make(chan struct{}, 1)
+)
+
+// initOutbox enables the outbox when EVENTS_OUTBOX is set, MongoDB runs
+// as a replica set (for the transactions) and events or webhooks are on.
+// The relay polls every EVENTS_OUTBOX_POLL_INTERVAL (default 1s), leases
+// an entry for EVENTS_OUTBOX_LEASE (default 30s), and retries a failed one
+// with the job queue's backoff.
+func initOutbox() {
+	if !getEnvBool("EVENTS_OUTBOX", false) || !usesMongo() || !eventsWanted() {
+		return
+	}
+	outboxEnabled = true
+	host, _ := os.Hostname()
+	go outboxRelay(host+"/outbox",
+		getEnvDuration("EVENTS_OUTBOX_POLL_INTERVAL", time.Second),
+		getEnvDuration("EVENTS_OUTBOX_LEASE", 30*time.Second))
+	log.Println("Publishing events through the outbox")
+}
+
+// withOutbox runs write, which returns the events its changes cause. With
+// the outbox the changes and the events commit in one transaction: write
+// may run again if the transaction is retried, so it must not have other
+// side effects. Without it the events are published once write succeeds.
+func withOutbox(ctx context.Context, write func(ctx context.Context) ([]cloudEvent, error)) error {
+	if !outboxEnabled {
+		evs, err := write(ctx)
+		if err == nil {
+			for _, e := range evs {
+				publishEvent(e)
+			}
+		}
+		return err
+	}
+	// A causally consistent request session carries the transaction too.
+	sess := mongo.SessionFromContext(ctx)
+	if sess == nil {
+		s, err := db().Client().StartSession()
+		if err != nil {
+			return err
+		}
+		defer s.EndSession(ctx)
+		sess = s
+	}
+	_, err := sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		evs, err := write(sc)
+		if err != nil || len(evs) == 0 {
+			return nil, err
+		}
+		return nil, insertOutbox(sc, evs)
+	})
+	if err == nil {
+		wakeOutboxRelay()
+	}
+	return err
+}
+
+func insertOutbox(ctx context.Context, evs []cloudEvent) error {
+	docs := make([]interface{}, len(evs))
+	for i, e := range evs {
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		docs[i] = outboxEntry{ID: e.ID, Name: e.name, Body: string(body), CreatedAt: e.Time, NextAttempt: e.Time}
+	}
+	_, err := coll(outboxCollection, mongoWrites).InsertMany(ctx, docs)
+	return err
+}
+
+func wakeOutboxRelay() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+func outboxRelay(worker string, poll, lease time.Duration) {
+	for {
+		relayed, err := relayOutboxEntry(context.Background(), worker, lease)
+		if err != nil {
+			log.Println("Outbox relay:", err)
+		}
+		if !relayed {
+			select {
+			case <-outboxWake:
+			case <-time.After(poll):
+			}
+		}
+	}
+}
+
+// relayOutboxEntry publishes the oldest due entry, if any, and reports
+// whether there was one.
+func relayOutboxEntry(ctx context.Context, worker string, lease time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	var entry outboxEntry
+	err := db().Collection(outboxCollection).FindOneAndUpdate(ctx,
+		bson.M{"publishedAt": nil, "nextAttempt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"lockedBy": worker, "nextAttempt": now.Add(lease)}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "createdAt", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	runErr := relay(ctx, &entry, worker, lease)
+	set := bson.M{"webhooksDone": entry.WebhooksDone, "brokerDone": entry.BrokerDone}
+	if runErr == nil {
+		set["publishedAt"] = time.Now().UTC()
+	} else {
+		set["lastError"] = runErr.Error()
+		set["nextAttempt"] = time.Now().UTC().Add(retryDelay(entry.Attempts))
+		log.Printf("Outbox event %s attempt %d failed: %v", entry.ID, entry.Attempts, runErr)
+	}
+	_, err = db().Collection(outboxCollection).UpdateOne(ctx,
+		bson.M{"_id": entry.ID, "lockedBy": worker},
+		bson.M{"$set": set, "$unset": bson.M{"lockedBy": ""}})
+	return true, err
+}
+
+// relay runs the stages entry still needs, marking the ones done.
+func relay(ctx context.Context, entry *outboxEntry, worker string, lease time.Duration) error {
+	// The data is passed through as it was encoded.
+	var data json.RawMessage
+	e := cloudEvent{Data: &data}
+	if err := json.Unmarshal([]byte(entry.Body), &e); err != nil {
+		return fmt.Errorf("malformed entry: %w", err)
+	}
+	e.Data, e.name = data, entry.Name
+
+	ctx, cancel := context.WithTimeout(ctx, lease)
+	defer cancel()
+	if webhooksEnabled && !entry.WebhooksDone {
+		// The jobs and the mark commit together, and only while the lease
+		// holds, so a delivery is never queued twice.
+		sess, err := db().Client().StartSession()
+		if err != nil {
+			return err
+		}
+		_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			if err := enqueueWebhooks(sc, e); err != nil {
+				return nil, err
+			}
+			res, err := db().Collection(outboxCollection).UpdateOne(sc,
+				bson.M{"_id": entry.ID, "lockedBy": worker}, bson.M{"$set": bson.M{"webhooksDone": true}})
+			if err == nil && res.MatchedCount == 0 {
+				err = errors.New("lease lost")
+			}
+			return nil, err
+		})
+		sess.EndSession(ctx)
+		if err != nil {
+			return fmt.Errorf("webhooks: %w", err)
+		}
+	}
+	entry.WebhooksDone = true
+	if eventsPub != nil && !entry.BrokerDone {
+		if err := eventsPub.Publish(ctx, e); err != nil {
+			return fmt.Errorf("broker: %w", err)
+		}
+	}
+	entry.BrokerDone = true
+	return nil
+}
@@ -0,0 +1,329 @@
+// Package gateway decides requests in front of the application the way
+// the application does itself: by the POLICY_FILE rules of pkg/policy,
+// checked against claims that went through the same claims transformers
+// (the "claims" section of RUNTIME_CONFIG_FILE) and the same denylist. The
+// keycloak-authz Kong plugin is a thin adapter around it.
+//
+//	e, err := gateway.New(gateway.Options{PolicyFile: "/etc/kong/policy.json"})
+//	if err := e.Refresh(); err != nil {
+//		// log it; the last good version of each file stays in force
+//	}
+//	if status, reason := e.Decide(method, path, authHeader, accept); status != 0 {
+//		// refuse with status and reason
+//	}
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// reloadInterval is how often the files are checked for changes.
+const reloadInterval = time.Second
+
+var (
+	versionedPath = regexp.MustCompile(`^/api/(v[0-9]+)(/|$)`)
+	vendorAccept  = regexp.MustCompile(`application/vnd\.fiber-demo\.(v[0-9]+)\+json`)
+)
+
+// Options configures an Enforcer. Only PolicyFile is required.
+type Options struct {
+	// PolicyFile is the path to the policy, in the format of the app's
+	// POLICY_FILE.
+	PolicyFile string
+	// RuntimeConfigFile is the app's RUNTIME_CONFIG_FILE. Its "claims"
+	// section configures the claims transformers; the rest is ignored.
+	RuntimeConfigFile string
+	// RolesClaims mirrors the app's ROLES_CLAIM_PATHS.
+	RolesClaims []string
+	// Issuer, when set, makes the Enforcer verify tokens against the
+	// realm's JWKS (at JWKSURL, by default under Issuer) instead of
+	// trusting whatever verified them before.
+	Issuer  string
+	JWKSURL string
+	// HTTPClient fetches the JWKS and the denylist (10s timeout).
+	HTTPClient *http.Client
+	// APIVersion is the version unversioned /api paths and LegacyPaths are
+	// served under by the app (default "v1"). LegacyPaths defaults to the
+	// app's legacy routes.
+	APIVersion  string
+	LegacyPaths []string
+	// DenylistURL is the app's GET /hooks/denylist, polled every
+	// DenylistRefresh (10s) with DenylistToken. Without it no token is
+	// turned away for being denylisted.
+	DenylistURL     string
+	DenylistToken   string
+	DenylistRefresh time.Duration
+}
+
+// Enforcer applies the policy to requests. It is safe for concurrent use.
+type Enforcer struct {
+	opts   Options
+	auth   *keycloakauth.Auth
+	legacy map[string]bool
+
+	mu       sync.Mutex // guards the fields below and serializes Refresh
+	checked  time.Time
+	policyF  watched[*policy.Policy]
+	claimsF  watched[*keycloakauth.ClaimsConfig]
+	denyNext time.Time
+	denyErr  error
+
+	policy   atomic.Pointer[policy.Policy]
+	claims   atomic.Pointer[keycloakauth.ClaimsConfig]
+	denied   atomic.Pointer[map[string]keycloakauth.Denial]
+	fetching atomic.Bool
+}
+
+// New loads the files of opts and returns an Enforcer. The first denylist
+// fetch is made before New returns; if it fails, the next Refresh reports
+// it.
+func New(opts Options) (*Enforcer, error) {
+	if opts.PolicyFile == "" {
+		return nil, errors.New("gateway: PolicyFile is required")
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.APIVersion == "" {
+		opts.APIVersion = "v1"
+	}
+	if opts.LegacyPaths == nil {
+		opts.LegacyPaths = []string{"/public", "/profile", "/user", "/admin"}
+	}
+	if opts.DenylistRefresh <= 0 {
+		opts.DenylistRefresh = 10 * time.Second
+	}
+	e := &Enforcer{opts: opts, legacy: map[string]bool{}}
+	for _, p := range opts.LegacyPaths {
+		e.legacy[p] = true
+	}
+	e.policyF = watched[*policy.Policy]{path: opts.PolicyFile, load: policy.Load}
+	if err := e.policyF.refresh(); err != nil {
+		return nil, err
+	}
+	e.policy.Store(e.policyF.value)
+	if opts.RuntimeConfigFile != "" {
+		e.claimsF = watched[*keycloakauth.ClaimsConfig]{path: opts.RuntimeConfigFile, load: loadClaims}
+		if err := e.claimsF.refresh(); err != nil {
+			return nil, err
+		}
+		e.claims.Store(e.claimsF.value)
+	}
+
+	authOpts := keycloakauth.Options{
+		Mode:        keycloakauth.ModeGateway,
+		RolesClaims: opts.RolesClaims,
+		Claims:      e.claims.Load,
+		Transform:   e.acceptClaims,
+	}
+	if opts.Issuer != "" {
+		authOpts.Mode, authOpts.Issuer, authOpts.JWKSURL = keycloakauth.ModeJWKS, opts.Issuer, opts.JWKSURL
+		authOpts.HTTPClient = opts.HTTPClient
+	}
+	a, err := keycloakauth.New(authOpts)
+	if err != nil {
+		return nil, err
+	}
+	e.auth = a
+	if opts.DenylistURL != "" {
+		e.fetching.Store(true)
+		e.fetchDenylist()
+	}
+	return e, nil
+}
+
+// Refresh re-reads the files that changed, at most once a second, and
+// starts a denylist fetch when one is due. A file that stops loading keeps
+// its last good version in force, as does a failed fetch; the errors are
+// still returned so they can be logged.
+func (e *Enforcer) Refresh() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	var errs []error
+	if e.denyErr != nil {
+		errs = append(errs, e.denyErr)
+		e.denyErr = nil
+	}
+	if e.opts.DenylistURL != "" && !now.Before(e.denyNext) && e.fetching.CompareAndSwap(false, true) {
+		go e.fetchDenylist()
+	}
+	if now.Sub(e.checked) < reloadInterval {
+		return errors.Join(errs...)
+	}
+	e.checked = now
+	if err := e.policyF.refresh(); err != nil {
+		errs = append(errs, err)
+	}
+	e.policy.Store(e.policyF.value)
+	if e.opts.RuntimeConfigFile != "" {
+		if err := e.claimsF.refresh(); err != nil {
+			errs = append(errs, err)
+		}
+		e.claims.Store(e.claimsF.value)
+	}
+	return errors.Join(errs...)
+}
+
+// acceptClaims turns away denylisted subjects, after the claims
+// transformers have run, as the app does.
+func (e *Enforcer) acceptClaims(claims jwt.MapClaims) error {
+	m := e.denied.Load()
+	if m == nil {
+		return nil
+	}
+	if keycloakauth.Denied(claims, time.Now(), func(key string) (keycloakauth.Denial, bool) {
+		d, ok := (*m)[key]
+		return d, ok
+	}) {
+		return errors.New("subject is denylisted")
+	}
+	return nil
+}
+
+// fetchDenylist replaces the denylist with the app's. The caller has set
+// fetching.
+func (e *Enforcer) fetchDenylist() {
+	defer e.fetching.Store(false)
+	err := e.loadDenylist()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.denyNext = time.Now().Add(e.opts.DenylistRefresh)
+	if err != nil {
+		e.denyErr = fmt.Errorf("denylist: %w", err)
+	}
+}
+
+func (e *Enforcer) loadDenylist() error {
+	req, err := http.NewRequest(http.MethodGet, e.opts.DenylistURL, nil)
+	if err != nil {
+		return err
+	}
+	if e.opts.DenylistToken != "" {
+		req.Header.Set("Authorization", "Bearer "+e.opts.DenylistToken)
+	}
+	resp, err := e.opts.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	var body struct {
+		Entries []struct {
+			Subject string `json:"subject"`
+			keycloakauth.Denial
+		} `json:"entries"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	m := make(map[string]keycloakauth.Denial, len(body.Entries))
+	for _, entry := range body.Entries {
+		m[entry.Subject] = entry.Denial
+	}
+	e.denied.Store(&m)
+	return nil
+}
+
+// paths returns the paths rules are checked against: the request path
+// and, as the app's API versioning will rewrite it, the path the app
+// serves it under. The app enforces the policy on both.
+func (e *Enforcer) paths(path, accept string) []string {
+	switch {
+	case versionedPath.MatchString(path):
+		return []string{path}
+	case path == "/api" || strings.HasPrefix(path, "/api/"):
+		version := e.opts.APIVersion
+		if m := vendorAccept.FindStringSubmatch(accept); m != nil {
+			version = m[1]
+		}
+		return []string{path, "/api/" + version + strings.TrimPrefix(path, "/api")}
+	case e.legacy[path]:
+		return []string{path, "/api/" + e.opts.APIVersion + path}
+	}
+	return []string{path}
+}
+
+// Decide applies the policy to a request. It returns 0 to let the request
+// through, or the status and reason to refuse it with.
+func (e *Enforcer) Decide(method, path, authHeader, accept string) (int, string) {
+	p := e.policy.Load()
+	var tok *keycloakauth.Token
+	for _, path := range e.paths(path, accept) {
+		rule, ok := p.Match(method, path)
+		if !ok || rule.Open() {
+			continue
+		}
+		if tok == nil {
+			tok = e.auth.Decode(authHeader)
+		}
+		if tok.Err != nil {
+			return http.StatusUnauthorized, tok.Err.Error()
+		}
+		if reason := rule.Check(tok.Claims, tok.Roles); reason != "" {
+			return http.StatusForbidden, reason
+		}
+	}
+	return 0, ""
+}
+
+// watched is a file that is loaded again whenever its modification time
+// changes. A file that stops loading keeps the last good value.
+type watched[T any] struct {
+	path    string
+	load    func(path string) (T, error)
+	value   T
+	loaded  bool
+	modTime time.Time
+}
+
+func (w *watched[T]) refresh() error {
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		return err
+	}
+	if w.loaded && fi.ModTime().Equal(w.modTime) {
+		return nil
+	}
+	v, err := w.load(w.path)
+	if err != nil {
+		return err
+	}
+	w.value, w.loaded, w.modTime = v, true, fi.ModTime()
+	return nil
+}
+
+// loadClaims reads the "claims" section of a runtime config file.
+func loadClaims(path string) (*keycloakauth.ClaimsConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		Claims *keycloakauth.ClaimsConfig `json:"claims"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if cfg.Claims != nil {
+		if err := cfg.Claims.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: claims: %w", path, err)
+		}
+	}
+	return cfg.Claims, nil
+}
@@ -0,0 +1,46 @@
+package gateway_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/example/fiber-demo/pkg/gateway"
+)
+
+func TestDecideVersionedPaths(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.json")
+	rules := `{"rules": [{"path": "/api/v2/reports", "roles": ["admin"]}, {"path": "/api/v1/admin", "roles": ["admin"]}]}`
+	if err := os.WriteFile(file, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	e, err := gateway.New(gateway.Options{PolicyFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path, accept string
+		want         int
+	}{
+		{"/api/v2/reports", "", http.StatusUnauthorized},
+		{"/api/reports", "application/vnd.fiber-demo.v2+json", http.StatusUnauthorized},
+		{"/api/reports", "", 0},
+		{"/admin", "", http.StatusUnauthorized},
+		{"/public", "", 0},
+	}
+	for _, c := range cases {
+		if status, _ := e.Decide(http.MethodGet, c.path, "", c.accept); status != c.want {
+			t.Errorf("%s (%q): status %d, want %d", c.path, c.accept, status, c.want)
+		}
+	}
+}
+
+func TestNewRequiresLoadableFiles(t *testing.T) {
+	if _, err := gateway.New(gateway.Options{}); err == nil {
+		t.Error("New without PolicyFile succeeded")
+	}
+	if _, err := gateway.New(gateway.Options{PolicyFile: filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("New with a missing policy file succeeded")
+	}
+}
@@ -0,0 +1,197 @@
+// Package itemsrpc defines the items gRPC service for internal callers:
+// its messages, the service description the server registers, and a
+// client. Calls carry the caller's Keycloak access token in the
+// "authorization" metadata ("Bearer <token>") and are checked with the
+// same roles as the HTTP API.
+//
+//	conn, _ := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+//	items := itemsrpc.NewClient(conn)
+//	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+//	page, err := items.ListItems(ctx, &itemsrpc.ListRequest{Limit: 50})
+package itemsrpc
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// ServiceName is the fully qualified gRPC service name.
+const ServiceName = "fiberdemo.items.v1.Items"
+
+// Item mirrors the JSON representation of the HTTP API.
+type Item struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	CreatedBy   string    `json:"createdBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// ItemInput is the writable part of an item.
+type ItemInput struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+type ListRequest struct {
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+	Tag    string `json:"tag"`
+}
+
+type ListResponse struct {
+	Items  []Item `json:"items"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+type GetRequest struct {
+	ID string `json:"id"`
+}
+
+type ReplaceRequest struct {
+	ID   string    `json:"id"`
+	Item ItemInput `json:"item"`
+}
+
+type DeleteRequest struct {
+	ID string `json:"id"`
+}
+
+type Empty struct{}
+
+// ItemsServer is implemented by the service.
+type ItemsServer interface {
+	ListItems(context.Context, *ListRequest) (*ListResponse, error)
+	GetItem(context.Context, *GetRequest) (*Item, error)
+	CreateItem(context.Context, *ItemInput) (*Item, error)
+	ReplaceItem(context.Context, *ReplaceRequest) (*Item, error)
+	DeleteItem(context.Context, *DeleteRequest) (*Empty, error)
+	// StreamItems sends every item matching the filter, newest first,
+	// ignoring Limit and Offset.
+	StreamItems(*ListRequest, ItemStream) error
+}
+
+// ItemStream is the server side of StreamItems.
+type ItemStream interface {
+	Send(*Item) error
+	grpc.ServerStream
+}
+
+// RegisterItemsServer adds srv to s.
+func RegisterItemsServer(s grpc.ServiceRegistrar, srv ItemsServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+func unary[Req any, Resp any](name string, call func(ItemsServer, context.Context, *Req) (*Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(Req)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(ItemsServer), ctx, req.(*Req))
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/" + name}, handler)
+		},
+	}
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*ItemsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("ListItems", ItemsServer.ListItems),
+		unary("GetItem", ItemsServer.GetItem),
+		unary("CreateItem", ItemsServer.CreateItem),
+		unary("ReplaceItem", ItemsServer.ReplaceItem),
+		unary("DeleteItem", ItemsServer.DeleteItem),
+	},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "StreamItems",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			req := new(ListRequest)
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(ItemsServer).StreamItems(req, &itemStream{stream})
+		},
+	}},
+}
+
+type itemStream struct {
+	grpc.ServerStream
+}
+
+func (s *itemStream) Send(it *Item) error { return s.SendMsg(it) }
+
+// Client calls the items service over conn using the JSON codec.
+type Client struct {
+	conn grpc.ClientConnInterface
+}
+
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{conn: conn}
+}
+
+func (c *Client) invoke(ctx context.Context, method string, req, resp interface{}, opts []grpc.CallOption) error {
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype(CodecName)}, opts...)
+	return c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, req, resp, opts...)
+}
+
+func (c *Client) ListItems(ctx context.Context, req *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	resp := new(ListResponse)
+	return resp, c.invoke(ctx, "ListItems", req, resp, opts)
+}
+
+func (c *Client) GetItem(ctx context.Context, req *GetRequest, opts ...grpc.CallOption) (*Item, error) {
+	resp := new(Item)
+	return resp, c.invoke(ctx, "GetItem", req, resp, opts)
+}
+
+func (c *Client) CreateItem(ctx context.Context, req *ItemInput, opts ...grpc.CallOption) (*Item, error) {
+	resp := new(Item)
+	return resp, c.invoke(ctx, "CreateItem", req, resp, opts)
+}
+
+func (c *Client) ReplaceItem(ctx context.Context, req *ReplaceRequest, opts ...grpc.CallOption) (*Item, error) {
+	resp := new(Item)
+	return resp, c.invoke(ctx, "ReplaceItem", req, resp, opts)
+}
+
+func (c *Client) DeleteItem(ctx context.Context, req *DeleteRequest, opts ...grpc.CallOption) error {
+	return c.invoke(ctx, "DeleteItem", req, new(Empty), opts)
+}
+
+// StreamItems returns a function yielding items until it returns io.EOF.
+func (c *Client) StreamItems(ctx context.Context, req *ListRequest, opts ...grpc.CallOption) (func() (*Item, error), error) {
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype(CodecName)}, opts...)
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[0], "/"+ServiceName+"/StreamItems", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return func() (*Item, error) {
+		it := new(Item)
+		if err := stream.RecvMsg(it); err != nil {
+			return nil, err
+		}
+		return it, nil
+	}, nil
+}
@@ -0,0 +1,104 @@
+package keycloakauth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// ClaimPath addresses a nested claim, one key per level.
+type ClaimPath []string
+
+// ParseClaimPath parses a dotted path such as
+// "resource_access.my-client.roles". Keys that contain dots are quoted in
+// brackets: `resource_access["api.example.com"].roles`.
+func ParseClaimPath(s string) (ClaimPath, error) {
+	var p ClaimPath
+	rest := s
+	for rest != "" {
+		if rest[0] == '[' {
+			end := strings.Index(rest, `"]`)
+			if len(rest) < 2 || rest[1] != '"' || end < 0 {
+				return nil, fmt.Errorf("claim path %q: unterminated [\"...\"]", s)
+			}
+			p = append(p, rest[2:end])
+			rest = rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("claim path %q: empty key", s)
+			}
+			p = append(p, rest[:end])
+			rest = rest[end:]
+		}
+		if strings.HasPrefix(rest, ".") {
+			rest = rest[1:]
+			if rest == "" {
+				return nil, fmt.Errorf("claim path %q: trailing dot", s)
+			}
+		} else if rest != "" && rest[0] != '[' {
+			return nil, fmt.Errorf("claim path %q: expected . or [ after %q", s, p[len(p)-1])
+		}
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("claim path %q: empty", s)
+	}
+	return p, nil
+}
+
+// String formats p so that ParseClaimPath reads it back.
+func (p ClaimPath) String() string {
+	var sb strings.Builder
+	for i, k := range p {
+		if strings.ContainsAny(k, `."[]`) {
+			fmt.Fprintf(&sb, "[%q]", k)
+			continue
+		}
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(k)
+	}
+	return sb.String()
+}
+
+// parent returns the object holding the last key of p.
+func (p ClaimPath) parent(claims jwt.MapClaims) (map[string]interface{}, bool) {
+	cur := map[string]interface{}(claims)
+	for _, k := range p[:len(p)-1] {
+		next, ok := cur[k].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur = next
+	}
+	return cur, true
+}
+
+// Lookup returns the value at p, or false when some level is missing or
+// not an object.
+func (p ClaimPath) Lookup(claims jwt.MapClaims) (interface{}, bool) {
+	parent, ok := p.parent(claims)
+	if !ok {
+		return nil, false
+	}
+	v, ok := parent[p[len(p)-1]]
+	return v, ok
+}
+
+// Replace sets the value at p if it exists and reports whether it did.
+func (p ClaimPath) Replace(claims jwt.MapClaims, v interface{}) bool {
+	parent, ok := p.parent(claims)
+	if !ok {
+		return false
+	}
+	if _, ok := parent[p[len(p)-1]]; !ok {
+		return false
+	}
+	parent[p[len(p)-1]] = v
+	return true
+}
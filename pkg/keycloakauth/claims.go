@@ -0,0 +1,216 @@
+package keycloakauth
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// ClaimsConfig configures the built-in claims transformers. It is the
+// "claims" section of the app's RUNTIME_CONFIG_FILE, so the Kong plugin
+// can read the same file.
+type ClaimsConfig struct {
+	// RoleAliases renames roles, e.g. a legacy "app_admin" to "admin".
+	// Aliases are not chained.
+	RoleAliases map[string]string `json:"roleAliases,omitempty"`
+	// Permissions lists the permissions each role grants. They are added
+	// to the "permissions" claim.
+	Permissions map[string][]string `json:"permissions,omitempty"`
+	Tenant      *TenantConfig       `json:"tenant,omitempty"`
+}
+
+// TenantConfig sets the "tenant" claim from the first of From that the
+// token carries, else from the realm in the issuer when FromRealm is set,
+// else to Default.
+type TenantConfig struct {
+	From      []string `json:"from,omitempty"`
+	FromRealm bool     `json:"fromRealm,omitempty"`
+	Default   string   `json:"default,omitempty"`
+}
+
+// Validate checks that the configuration is usable.
+func (cc *ClaimsConfig) Validate() error {
+	for from, to := range cc.RoleAliases {
+		if from == "" || to == "" {
+			return errors.New("roleAliases: roles must not be empty")
+		}
+	}
+	for role, perms := range cc.Permissions {
+		if role == "" || slices.Contains(perms, "") {
+			return errors.New("permissions: roles and permissions must not be empty")
+		}
+	}
+	if t := cc.Tenant; t != nil {
+		if slices.Contains(t.From, "") {
+			return errors.New("tenant: from must not contain empty claim names")
+		}
+		if len(t.From) == 0 && !t.FromRealm && t.Default == "" {
+			return errors.New("tenant: set from, fromRealm or default")
+		}
+	}
+	return nil
+}
+
+type namedTransformer struct {
+	name string
+	fn   func(a *Auth, cc *ClaimsConfig, claims jwt.MapClaims) error
+}
+
+// builtinTransformers run in order: role aliases, then permissions derived
+// from the aliased roles, then the tenant.
+var builtinTransformers = []namedTransformer{
+	{"roleAliases", (*Auth).aliasRoles},
+	{"permissions", (*Auth).derivePermissions},
+	{"tenant", (*Auth).resolveTenant},
+}
+
+// A ClaimsTransformer normalizes or augments the claims of an accepted
+// token in place. Returning an error rejects the token.
+type ClaimsTransformer func(claims jwt.MapClaims) error
+
+var (
+	registeredMu sync.RWMutex
+	registered   []registeredTransformer
+)
+
+type registeredTransformer struct {
+	name string
+	fn   ClaimsTransformer
+}
+
+// RegisterClaimsTransformer adds fn to the transformers every Auth runs,
+// after the built-in ones and in the order of registration. Call it from
+// an init function. Register it in the keycloak-authz Kong plugin too, or
+// the gateway sees different claims than the app.
+func RegisterClaimsTransformer(name string, fn ClaimsTransformer) {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	registered = append(registered, registeredTransformer{name, fn})
+}
+
+// transform runs the built-in transformers configured by Options.Claims,
+// then the registered ones, then Options.Transform.
+func (a *Auth) transform(claims jwt.MapClaims) error {
+	if a.opts.Claims != nil {
+		if cc := a.opts.Claims(); cc != nil {
+			for _, t := range builtinTransformers {
+				if err := t.fn(a, cc, claims); err != nil {
+					return fmt.Errorf("claims %s: %w", t.name, err)
+				}
+			}
+		}
+	}
+	registeredMu.RLock()
+	custom := registered
+	registeredMu.RUnlock()
+	for _, t := range custom {
+		if err := t.fn(claims); err != nil {
+			return fmt.Errorf("claims %s: %w", t.name, err)
+		}
+	}
+	if a.opts.Transform != nil {
+		return a.opts.Transform(claims)
+	}
+	return nil
+}
+
+// aliasRoles renames roles in every roles claim the token carries.
+func (a *Auth) aliasRoles(cc *ClaimsConfig, claims jwt.MapClaims) error {
+	if len(cc.RoleAliases) == 0 {
+		return nil
+	}
+	rename := func(roles []interface{}) []interface{} {
+		out := make([]interface{}, 0, len(roles))
+		seen := map[string]bool{}
+		for _, v := range roles {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			if to, ok := cc.RoleAliases[s]; ok {
+				s = to
+			}
+			if !seen[s] {
+				seen[s] = true
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	for _, p := range a.rolesClaims {
+		if v, ok := p.Lookup(claims); ok {
+			if rl, ok := v.([]interface{}); ok {
+				p.Replace(claims, rename(rl))
+			}
+		}
+	}
+	return nil
+}
+
+// derivePermissions adds the permissions granted by the token's roles to
+// its "permissions" claim, keeping any the token already had.
+func (a *Auth) derivePermissions(cc *ClaimsConfig, claims jwt.MapClaims) error {
+	if len(cc.Permissions) == 0 {
+		return nil
+	}
+	roles, err := a.RolesOf(claims)
+	if err != nil {
+		return nil
+	}
+	set := map[string]bool{}
+	for _, p := range Permissions(claims) {
+		set[p] = true
+	}
+	for _, r := range roles {
+		for _, p := range cc.Permissions[r] {
+			set[p] = true
+		}
+	}
+	perms := make([]string, 0, len(set))
+	for p := range set {
+		perms = append(perms, p)
+	}
+	sort.Strings(perms)
+	out := make([]interface{}, len(perms))
+	for i, p := range perms {
+		out[i] = p
+	}
+	claims["permissions"] = out
+	return nil
+}
+
+// resolveTenant sets the "tenant" claim.
+func (a *Auth) resolveTenant(cc *ClaimsConfig, claims jwt.MapClaims) error {
+	t := cc.Tenant
+	if t == nil {
+		return nil
+	}
+	for _, name := range t.From {
+		if s, ok := claims[name].(string); ok && s != "" {
+			claims["tenant"] = s
+			return nil
+		}
+	}
+	if t.FromRealm {
+		iss, _ := claims["iss"].(string)
+		if i := strings.LastIndex(iss, "/realms/"); i >= 0 && i+len("/realms/") < len(iss) {
+			claims["tenant"] = iss[i+len("/realms/"):]
+			return nil
+		}
+	}
+	if t.Default != "" {
+		claims["tenant"] = t.Default
+	}
+	return nil
+}
+
+// Permissions returns the "permissions" claim.
+func Permissions(claims jwt.MapClaims) []string {
+	p, _ := claims["permissions"].([]interface{})
+	return Strings(p)
+}
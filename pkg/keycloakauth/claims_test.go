@@ -0,0 +1,41 @@
+package keycloakauth_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestRegisteredTransformerRunsAfterBuiltins(t *testing.T) {
+	var seen []interface{}
+	keycloakauth.RegisterClaimsTransformer("record", func(c jwt.MapClaims) error {
+		if c["sub"] == "registered" {
+			seen = c["roles"].([]interface{})
+			c["tenant"] = "custom-" + c["tenant"].(string)
+		}
+		return nil
+	})
+	cc := &keycloakauth.ClaimsConfig{
+		RoleAliases: map[string]string{"app_admin": "admin"},
+		Tenant:      &keycloakauth.TenantConfig{Default: "public"},
+	}
+	a := keycloakauth.MustNew(keycloakauth.Options{
+		Mode:   keycloakauth.ModeGateway,
+		Claims: func() *keycloakauth.ClaimsConfig { return cc },
+		Anonymous: func() jwt.MapClaims {
+			return jwt.MapClaims{"sub": "registered", "roles": []interface{}{"app_admin"}}
+		},
+	})
+	tok := a.Decode("")
+	if tok.Err != nil {
+		t.Fatal(tok.Err)
+	}
+	if !reflect.DeepEqual(seen, []interface{}{"admin"}) {
+		t.Errorf("registered transformer saw roles %v, want the aliased [admin]", seen)
+	}
+	if tok.Claims["tenant"] != "custom-public" {
+		t.Errorf("tenant = %v, want custom-public", tok.Claims["tenant"])
+	}
+}
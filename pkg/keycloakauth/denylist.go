@@ -0,0 +1,62 @@
+package keycloakauth
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// DenylistTokenPrefix starts the denylist keys that block a single token
+// by its jti rather than every token of a subject.
+const DenylistTokenPrefix = "jti:"
+
+// Denial is a denylist entry as it applies to tokens. It blocks every
+// token of its subject, whatever their expiry, until ExpiresAt passes.
+// With IssuedBefore it only blocks the tokens issued up to then, as after
+// a logout.
+type Denial struct {
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	IssuedBefore *time.Time `json:"issuedBefore,omitempty"`
+}
+
+// Active reports whether the denial is still in force at now.
+func (d Denial) Active(now time.Time) bool {
+	return d.ExpiresAt == nil || now.Before(*d.ExpiresAt)
+}
+
+// Blocks reports whether the denial rejects a token issued at iat. A
+// token without an iat claim is rejected by every denial.
+func (d Denial) Blocks(iat time.Time) bool {
+	return d.IssuedBefore == nil || iat.IsZero() || !iat.After(*d.IssuedBefore)
+}
+
+// Denied reports whether an active denial rejects the token of claims.
+// lookup finds the denial stored under a key: DenylistTokenPrefix and the
+// token's jti, then its subject.
+func Denied(claims jwt.MapClaims, now time.Time, lookup func(key string) (Denial, bool)) bool {
+	if jti, _ := claims["jti"].(string); jti != "" {
+		if d, ok := lookup(DenylistTokenPrefix + jti); ok && d.Active(now) {
+			return true
+		}
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return false
+	}
+	d, ok := lookup(sub)
+	return ok && d.Active(now) && d.Blocks(ClaimTime(claims, "iat"))
+}
+
+// ClaimTime reads a NumericDate claim, or the zero time without one.
+func ClaimTime(claims jwt.MapClaims, name string) time.Time {
+	switch v := claims[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return time.Unix(n, 0)
+		}
+	}
+	return time.Time{}
+}
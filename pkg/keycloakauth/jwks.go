@@ -0,0 +1,161 @@
+package keycloakauth
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// jwksCache holds the realm's RS256 signing keys by key ID. Keys are
+// fetched on first use and again when a token names a key ID that isn't
+// cached, which is how Keycloak key rotation is picked up. minRefetch
+// limits how often that happens so garbage tokens can't hammer Keycloak.
+type jwksCache struct {
+	url        string
+	minRefetch time.Duration
+	client     *http.Client
+
+	mu      sync.Mutex
+	fetched time.Time
+	keys    map[string]*rsa.PublicKey
+	// notAfter holds the certificate expiry of keys published with one.
+	notAfter map[string]time.Time
+}
+
+func (k *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	if !k.fetched.IsZero() && time.Since(k.fetched) < k.minRefetch {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	k.fetched = time.Now()
+	set, err := fetchKeySet(k.client, k.url)
+	if err != nil {
+		return nil, err
+	}
+	k.keys, k.notAfter = set.keys, set.notAfter
+	if key, ok := set.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// refresh refetches the keys regardless of minRefetch. On failure the
+// cached keys stay in use.
+func (k *jwksCache) refresh() (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	set, err := fetchKeySet(k.client, k.url)
+	if err != nil {
+		return len(k.keys), err
+	}
+	k.keys, k.notAfter, k.fetched = set.keys, set.notAfter, time.Now()
+	return len(set.keys), nil
+}
+
+// KeyInfo describes a signing key held from the JWKS.
+type KeyInfo struct {
+	Kid        string
+	Thumbprint string
+	// NotAfter is when the certificate the JWKS publishes with the key
+	// (x5c) expires, zero without one. Keycloak rotates keys before then.
+	NotAfter time.Time
+	// Pinned reports whether the key is among Options.PinnedKeys.
+	Pinned bool
+}
+
+// snapshot returns the held keys by key ID and when they were fetched.
+func (k *jwksCache) snapshot(pinned map[string]bool) ([]KeyInfo, time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	out := make([]KeyInfo, 0, len(k.keys))
+	for kid, key := range k.keys {
+		t := Thumbprint(key)
+		out = append(out, KeyInfo{Kid: kid, Thumbprint: t, NotAfter: k.notAfter[kid], Pinned: pinned[t]})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Kid < out[j].Kid })
+	return out, k.fetched
+}
+
+// Thumbprint returns the RFC 7638 JWK thumbprint of key: the unpadded
+// base64url SHA-256 of its canonical JWK members. It is the value to pin
+// in Options.PinnedKeys.
+func Thumbprint(key *rsa.PublicKey) string {
+	enc := base64.RawURLEncoding
+	jwk := `{"e":"` + enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()) +
+		`","kty":"RSA","n":"` + enc.EncodeToString(key.N.Bytes()) + `"}`
+	sum := sha256.Sum256([]byte(jwk))
+	return enc.EncodeToString(sum[:])
+}
+
+// FetchJWKS returns the RSA signing keys published at url, by key ID.
+func FetchJWKS(client *http.Client, url string) (map[string]*rsa.PublicKey, error) {
+	set, err := fetchKeySet(client, url)
+	return set.keys, err
+}
+
+// keySet is a fetched JWKS.
+type keySet struct {
+	keys     map[string]*rsa.PublicKey
+	notAfter map[string]time.Time
+}
+
+func fetchKeySet(client *http.Client, url string) (keySet, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return keySet{}, fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return keySet{}, fmt.Errorf("fetch JWKS: %s", resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kid string   `json:"kid"`
+			Kty string   `json:"kty"`
+			Use string   `json:"use"`
+			N   string   `json:"n"`
+			E   string   `json:"e"`
+			X5c []string `json:"x5c"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return keySet{}, fmt.Errorf("decode JWKS: %w", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	notAfter := map[string]time.Time{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return keySet{}, fmt.Errorf("JWKS key %s: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return keySet{}, fmt.Errorf("JWKS key %s: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		// The certificate is informational: the key is n and e either way.
+		if len(k.X5c) > 0 {
+			if der, err := base64.StdEncoding.DecodeString(k.X5c[0]); err == nil {
+				if cert, err := x509.ParseCertificate(der); err == nil {
+					notAfter[k.Kid] = cert.NotAfter
+				}
+			}
+		}
+	}
+	return keySet{keys: keys, notAfter: notAfter}, nil
+}
@@ -0,0 +1,392 @@
+// Package keycloakauth authenticates requests carrying Keycloak access
+// tokens and authorizes them by realm role, scope or group, as Fiber
+// middleware or, through HTTP, as net/http middleware.
+//
+// Tokens are either verified against the realm's JWKS (ModeJWKS) or, behind
+// a gateway such as Kong that has already verified them, only decoded
+// (ModeGateway). Each request's token is decoded once and kept in its
+// Locals, so several checks on one request cost a single parse.
+//
+//	auth, err := keycloakauth.New(keycloakauth.Options{
+//		Mode:   keycloakauth.ModeJWKS,
+//		Issuer: "http://keycloak:8080/realms/demo-realm",
+//	})
+//	app.Get("/reports", auth.RequireRole("admin"), reports)
+//	app.Get("/items", auth.RequireScope("items:read"), listItems)
+package keycloakauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Mode is how tokens are checked.
+type Mode string
+
+const (
+	// ModeGateway trusts a gateway in front of the service to have
+	// verified the token, and only decodes it.
+	ModeGateway Mode = "gateway"
+	// ModeJWKS verifies the RS256 signature against the realm's JWKS and
+	// checks expiry and issuer.
+	ModeJWKS Mode = "jwks"
+)
+
+// Locals keys the middleware stores its results under.
+const (
+	// LocalsToken holds the request's *Token.
+	LocalsToken = "token"
+	// LocalsClaims holds the jwt.MapClaims of a request that passed a
+	// Require middleware.
+	LocalsClaims = "claims"
+)
+
+// Options configures an Auth. Only Mode, and Issuer with ModeJWKS, are
+// required.
+type Options struct {
+	Mode Mode
+	// Issuer is the realm URL tokens must be issued by, e.g.
+	// "http://keycloak:8080/realms/demo-realm".
+	Issuer string
+	// JWKSURL defaults to the realm's certs endpoint under Issuer.
+	JWKSURL string
+	// JWKSMinRefresh limits how often an unknown key ID triggers a JWKS
+	// fetch (30s). A negative value refetches every time.
+	JWKSMinRefresh time.Duration
+	// HTTPClient fetches the JWKS (http.DefaultClient).
+	HTTPClient *http.Client
+	// Audience, when set, must be among the token's "aud" in ModeJWKS.
+	Audience string
+	// Issuers, when set, lists the "iss" values accepted in ModeJWKS
+	// instead of Issuer alone, such as the realm's internal and public
+	// URLs. The JWKS is still Issuer's.
+	Issuers []string
+	// PinnedKeys, when set, are the RFC 7638 thumbprints (see Thumbprint)
+	// of the only keys tokens may be signed with in ModeJWKS, however the
+	// JWKS changes. A token signed by another key is rejected with
+	// ErrUnpinnedKey after calling OnUnpinnedKey.
+	PinnedKeys []string
+	// OnUnpinnedKey, when set, is told the key ID and thumbprint of each
+	// unpinned key a token was signed with.
+	OnUnpinnedKey func(kid, thumbprint string)
+
+	// RolesClaims are the claims roles are read from, in order of
+	// preference, as ParseClaimPath paths. The first the token carries as
+	// an array wins (default "roles", then "realm_access.roles").
+	RolesClaims []string
+	// GroupsClaim holds the groups (default "groups").
+	GroupsClaim string
+	// ScopeClaim holds the space-separated scopes (default "scope").
+	ScopeClaim string
+
+	// Claims, when set, returns the configuration of the built-in claims
+	// transformers, which run on every accepted token before those added
+	// with RegisterClaimsTransformer and Transform. It is called for each
+	// token, so the configuration can be reloaded; nil skips them.
+	Claims func() *ClaimsConfig
+	// Transform, when set, runs on the claims of every accepted token
+	// before roles are read. It may change them in place; an error rejects
+	// the token.
+	Transform func(jwt.MapClaims) error
+	// Anonymous, when set, supplies the claims of requests that send no
+	// Authorization header. It is meant for local development without
+	// Keycloak and must return a fresh map on each call.
+	Anonymous func() jwt.MapClaims
+
+	// Deny renders a refused request, with status 401 or 403. The default
+	// returns a *fiber.Error.
+	Deny func(c *fiber.Ctx, status int, message string) error
+	// DenyHTTP does the same for the net/http middleware. The default
+	// writes message as plain text.
+	DenyHTTP func(w http.ResponseWriter, r *http.Request, status int, message string)
+}
+
+// Auth checks tokens according to its Options. It is safe for concurrent
+// use.
+type Auth struct {
+	opts        Options
+	jwks        *jwksCache
+	rolesClaims []ClaimPath
+	issuers     []string
+	pinned      map[string]bool
+}
+
+// New validates opts and returns an Auth.
+func New(opts Options) (*Auth, error) {
+	a := &Auth{opts: opts}
+	switch opts.Mode {
+	case ModeGateway:
+	case ModeJWKS:
+		if opts.Issuer == "" {
+			return nil, errors.New("keycloakauth: Issuer is required in jwks mode")
+		}
+		url := opts.JWKSURL
+		if url == "" {
+			url = strings.TrimSuffix(opts.Issuer, "/") + "/protocol/openid-connect/certs"
+		}
+		minRefetch := opts.JWKSMinRefresh
+		switch {
+		case minRefetch == 0:
+			minRefetch = 30 * time.Second
+		case minRefetch < 0:
+			minRefetch = 0
+		}
+		client := opts.HTTPClient
+		if client == nil {
+			client = http.DefaultClient
+		}
+		a.jwks = &jwksCache{url: url, minRefetch: minRefetch, client: client}
+		a.issuers = opts.Issuers
+		if len(a.issuers) == 0 {
+			a.issuers = []string{opts.Issuer}
+		}
+		if len(opts.PinnedKeys) > 0 {
+			a.pinned = map[string]bool{}
+			for _, tp := range opts.PinnedKeys {
+				a.pinned[tp] = true
+			}
+		}
+	default:
+		return nil, fmt.Errorf("keycloakauth: unknown mode %q", opts.Mode)
+	}
+	if len(opts.RolesClaims) == 0 {
+		opts.RolesClaims = []string{"roles", "realm_access.roles"}
+	}
+	for _, s := range opts.RolesClaims {
+		p, err := ParseClaimPath(s)
+		if err != nil {
+			return nil, fmt.Errorf("keycloakauth: roles claim: %w", err)
+		}
+		a.rolesClaims = append(a.rolesClaims, p)
+	}
+	if a.opts.GroupsClaim == "" {
+		a.opts.GroupsClaim = "groups"
+	}
+	if a.opts.ScopeClaim == "" {
+		a.opts.ScopeClaim = "scope"
+	}
+	if a.opts.Deny == nil {
+		a.opts.Deny = func(_ *fiber.Ctx, status int, message string) error {
+			return fiber.NewError(status, message)
+		}
+	}
+	return a, nil
+}
+
+// MustNew is like New but panics on invalid options.
+func MustNew(opts Options) *Auth {
+	a, err := New(opts)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// Mode returns the mode a was created with.
+func (a *Auth) Mode() Mode {
+	return a.opts.Mode
+}
+
+// ErrNoJWKS is returned by RefreshKeys outside ModeJWKS.
+var ErrNoJWKS = errors.New("keycloakauth: tokens are not verified against a JWKS")
+
+// ErrUnpinnedKey rejects tokens signed by a key outside PinnedKeys.
+var ErrUnpinnedKey = errors.New("keycloakauth: signing key is not pinned")
+
+// RefreshKeys refetches the JWKS now, regardless of JWKSMinRefresh, and
+// returns the number of keys held. If the fetch fails, the previous keys
+// stay in use.
+func (a *Auth) RefreshKeys() (int, error) {
+	if a.jwks == nil {
+		return 0, ErrNoJWKS
+	}
+	return a.jwks.refresh()
+}
+
+// Keys returns the signing keys held from the JWKS, by key ID, and when
+// the JWKS was last fetched, which is zero until the first token is
+// verified.
+func (a *Auth) Keys() ([]KeyInfo, time.Time, error) {
+	if a.jwks == nil {
+		return nil, time.Time{}, ErrNoJWKS
+	}
+	keys, fetched := a.jwks.snapshot(a.pinned)
+	return keys, fetched, nil
+}
+
+// Token is the outcome of reading a bearer token.
+type Token struct {
+	// Raw is the encoded token, empty for Anonymous claims.
+	Raw    string
+	Claims jwt.MapClaims
+	// Err is why the token was rejected; Claims is nil then.
+	Err      error
+	Roles    []string
+	RolesErr error
+}
+
+// Decode checks an Authorization header value. Use it for transports
+// other than Fiber, such as gRPC metadata or a WebSocket query parameter.
+func (a *Auth) Decode(authHeader string) *Token {
+	t := &Token{}
+	switch {
+	case authHeader == "" && a.opts.Anonymous != nil:
+		t.Claims = a.opts.Anonymous()
+	default:
+		t.Raw, t.Err = BearerToken(authHeader)
+		if t.Err == nil {
+			if a.opts.Mode == ModeJWKS {
+				t.Claims, t.Err = a.verify(t.Raw)
+			} else {
+				t.Claims, t.Err = parseUnverified(t.Raw)
+			}
+		}
+	}
+	if t.Err == nil {
+		t.Err = a.transform(t.Claims)
+	}
+	if t.Err != nil {
+		t.Claims = nil
+		return t
+	}
+	t.Roles, t.RolesErr = a.RolesOf(t.Claims)
+	return t
+}
+
+// Token returns the request's decoded token, decoding it on first use.
+func (a *Auth) Token(c *fiber.Ctx) *Token {
+	if t, ok := Cached(c); ok {
+		return t
+	}
+	t := a.Decode(c.Get(fiber.HeaderAuthorization))
+	c.Locals(LocalsToken, t)
+	return t
+}
+
+// Cached returns the request's token if something already decoded it,
+// without decoding it otherwise. Loggers use it to name the caller.
+func Cached(c *fiber.Ctx) (*Token, bool) {
+	t, ok := c.Locals(LocalsToken).(*Token)
+	return t, ok
+}
+
+// Claims returns the claims of the request's token.
+func (a *Auth) Claims(c *fiber.Ctx) (jwt.MapClaims, error) {
+	t := a.Token(c)
+	return t.Claims, t.Err
+}
+
+// Roles returns the roles of the request's token.
+func (a *Auth) Roles(c *fiber.Ctx) ([]string, error) {
+	t := a.Token(c)
+	if t.Err != nil {
+		return nil, t.Err
+	}
+	return t.Roles, t.RolesErr
+}
+
+// RolesOf reads roles from claims using the configured roles claims.
+func (a *Auth) RolesOf(claims jwt.MapClaims) ([]string, error) {
+	for _, p := range a.rolesClaims {
+		if v, ok := p.Lookup(claims); ok {
+			if rl, ok := v.([]interface{}); ok {
+				return Strings(rl), nil
+			}
+		}
+	}
+	return nil, errors.New("no roles in token")
+}
+
+// RolesClaims returns the parsed roles claim paths, most preferred first.
+func (a *Auth) RolesClaims() []ClaimPath {
+	return a.rolesClaims
+}
+
+// GroupsOf returns the token's groups.
+func (a *Auth) GroupsOf(claims jwt.MapClaims) []string {
+	g, _ := claims[a.opts.GroupsClaim].([]interface{})
+	return Strings(g)
+}
+
+// ScopesOf returns the token's scopes.
+func (a *Auth) ScopesOf(claims jwt.MapClaims) []string {
+	s, _ := claims[a.opts.ScopeClaim].(string)
+	return strings.Fields(s)
+}
+
+// BearerToken extracts the token from an "Authorization: Bearer <token>"
+// header value.
+func BearerToken(authHeader string) (string, error) {
+	if authHeader == "" {
+		return "", fmt.Errorf("missing Authorization header")
+	}
+	scheme, token, ok := strings.Cut(authHeader, " ")
+	if !ok || scheme != "Bearer" || token == "" || strings.IndexByte(token, ' ') >= 0 {
+		return "", fmt.Errorf("invalid Authorization header format")
+	}
+	return token, nil
+}
+
+var unverifiedParser = jwt.NewParser()
+
+func parseUnverified(raw string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := unverifiedParser.ParseUnverified(raw, claims); err != nil {
+		return nil, fmt.Errorf("failed to parse token: %v", err)
+	}
+	return claims, nil
+}
+
+var jwtParser = jwt.NewParser(jwt.WithValidMethods([]string{"RS256"}))
+
+// verify checks the token's signature against the realm JWKS, its expiry,
+// its issuer and, when configured, its audience.
+func (a *Auth) verify(raw string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwtParser.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := a.jwks.key(kid)
+		if err != nil || a.pinned == nil {
+			return key, err
+		}
+		if tp := Thumbprint(key); !a.pinned[tp] {
+			if a.opts.OnUnpinnedKey != nil {
+				a.opts.OnUnpinnedKey(kid, tp)
+			}
+			return nil, ErrUnpinnedKey
+		}
+		return key, nil
+	})
+	if errors.Is(err, ErrUnpinnedKey) {
+		return nil, fmt.Errorf("invalid token: %w", ErrUnpinnedKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+	iss, _ := claims["iss"].(string)
+	if !slices.Contains(a.issuers, iss) {
+		return nil, errors.New("invalid token: unexpected issuer")
+	}
+	if a.opts.Audience != "" && !claims.VerifyAudience(a.opts.Audience, true) {
+		return nil, errors.New("invalid token: unexpected audience")
+	}
+	return claims, nil
+}
+
+// Strings keeps the string elements of a decoded JSON array.
+func Strings(ifaces []interface{}) []string {
+	out := make([]string, 0, len(ifaces))
+	for _, v := range ifaces {
+		if s, ok := v.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
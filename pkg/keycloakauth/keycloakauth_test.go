@@ -0,0 +1,400 @@
+package keycloakauth_test
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/fiber-demo/internal/oidctest"
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func jwksAuth(t *testing.T, iss *oidctest.Issuer, mutate func(*keycloakauth.Options)) *keycloakauth.Auth {
+	t.Helper()
+	opts := keycloakauth.Options{
+		Mode:           keycloakauth.ModeJWKS,
+		Issuer:         iss.URL,
+		JWKSURL:        iss.JWKSURL,
+		JWKSMinRefresh: -1,
+	}
+	if mutate != nil {
+		mutate(&opts)
+	}
+	a, err := keycloakauth.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestNewRejectsBadOptions(t *testing.T) {
+	for name, opts := range map[string]keycloakauth.Options{
+		"unknown mode":    {Mode: "basic"},
+		"jwks no issuer":  {Mode: keycloakauth.ModeJWKS},
+		"bad roles claim": {Mode: keycloakauth.ModeGateway, RolesClaims: []string{"a..b"}},
+	} {
+		if _, err := keycloakauth.New(opts); err == nil {
+			t.Errorf("%s: New succeeded", name)
+		}
+	}
+}
+
+func TestJWKSVerification(t *testing.T) {
+	iss := oidctest.New(t)
+	a := jwksAuth(t, iss, nil)
+
+	tok := a.Decode("Bearer " + iss.TokenFor(t, "alice", "user"))
+	if tok.Err != nil {
+		t.Fatalf("valid token rejected: %v", tok.Err)
+	}
+	if tok.Claims["sub"] != "alice" || !reflect.DeepEqual(tok.Roles, []string{"user"}) {
+		t.Errorf("got sub %v roles %v", tok.Claims["sub"], tok.Roles)
+	}
+
+	rejected := map[string]string{
+		"forged":       "Bearer " + iss.ForgedToken(t, jwt.MapClaims{"sub": "mallory"}),
+		"expired":      "Bearer " + iss.Token(t, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(-time.Minute).Unix()}),
+		"other issuer": "Bearer " + iss.Token(t, jwt.MapClaims{"sub": "alice", "iss": "http://evil/realms/x"}),
+		"no header":    "",
+		"not bearer":   "Basic YWxpY2U6cHc=",
+		"garbage":      "Bearer not-a-jwt",
+	}
+	for name, header := range rejected {
+		if tok := a.Decode(header); tok.Err == nil || tok.Claims != nil {
+			t.Errorf("%s: accepted (claims %v)", name, tok.Claims)
+		}
+	}
+}
+
+func TestJWKSKeyRotation(t *testing.T) {
+	iss := oidctest.New(t)
+	a := jwksAuth(t, iss, nil)
+	if tok := a.Decode("Bearer " + iss.TokenFor(t, "alice")); tok.Err != nil {
+		t.Fatal(tok.Err)
+	}
+	iss.RotateKey(t)
+	if tok := a.Decode("Bearer " + iss.TokenFor(t, "alice")); tok.Err != nil {
+		t.Fatalf("token from rotated key rejected: %v", tok.Err)
+	}
+}
+
+func TestAudience(t *testing.T) {
+	iss := oidctest.New(t)
+	a := jwksAuth(t, iss, func(o *keycloakauth.Options) { o.Audience = "billing-api" })
+	if tok := a.Decode("Bearer " + iss.Token(t, jwt.MapClaims{"sub": "a", "aud": []interface{}{"account", "billing-api"}})); tok.Err != nil {
+		t.Errorf("matching audience rejected: %v", tok.Err)
+	}
+	if tok := a.Decode("Bearer " + iss.Token(t, jwt.MapClaims{"sub": "a", "aud": "account"})); tok.Err == nil {
+		t.Error("other audience accepted")
+	}
+}
+
+func TestIssuerAllowlist(t *testing.T) {
+	iss := oidctest.New(t)
+	public := "https://sso.example.com/realms/" + oidctest.Realm
+	a := jwksAuth(t, iss, func(o *keycloakauth.Options) { o.Issuers = []string{iss.URL, public} })
+	for _, issuer := range []string{iss.URL, public} {
+		if tok := a.Decode("Bearer " + iss.Token(t, jwt.MapClaims{"sub": "a", "iss": issuer})); tok.Err != nil {
+			t.Errorf("%s rejected: %v", issuer, tok.Err)
+		}
+	}
+	if tok := a.Decode("Bearer " + iss.Token(t, jwt.MapClaims{"sub": "a", "iss": "http://evil/realms/x"})); tok.Err == nil {
+		t.Error("unlisted issuer accepted")
+	}
+}
+
+func TestThumbprint(t *testing.T) {
+	// The example key of RFC 7638, section 3.1.
+	raw, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(raw), E: 65537}
+	if got, want := keycloakauth.Thumbprint(key), "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != want {
+		t.Errorf("Thumbprint = %s, want %s", got, want)
+	}
+}
+
+func TestPinnedKeys(t *testing.T) {
+	iss := oidctest.New(t)
+	keys, err := keycloakauth.FetchJWKS(http.DefaultClient, iss.JWKSURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unpinned []string
+	a := jwksAuth(t, iss, func(o *keycloakauth.Options) {
+		o.PinnedKeys = []string{keycloakauth.Thumbprint(keys["key-1"])}
+		o.OnUnpinnedKey = func(kid, _ string) { unpinned = append(unpinned, kid) }
+	})
+	if tok := a.Decode("Bearer " + iss.TokenFor(t, "alice")); tok.Err != nil {
+		t.Fatalf("token from pinned key rejected: %v", tok.Err)
+	}
+	iss.RotateKey(t)
+	tok := a.Decode("Bearer " + iss.TokenFor(t, "alice"))
+	if !errors.Is(tok.Err, keycloakauth.ErrUnpinnedKey) {
+		t.Fatalf("token from unpinned key: got %v, want ErrUnpinnedKey", tok.Err)
+	}
+	if !reflect.DeepEqual(unpinned, []string{"key-2"}) {
+		t.Errorf("OnUnpinnedKey got %v", unpinned)
+	}
+}
+
+func TestGatewayDecodesWithoutVerifying(t *testing.T) {
+	iss := oidctest.New(t)
+	a := keycloakauth.MustNew(keycloakauth.Options{Mode: keycloakauth.ModeGateway})
+	// Gateway mode trusts whatever sits in front; even a forged signature
+	// decodes.
+	tok := a.Decode("Bearer " + iss.ForgedToken(t, jwt.MapClaims{"sub": "bob", "roles": []interface{}{"admin"}}))
+	if tok.Err != nil || tok.Claims["sub"] != "bob" || !reflect.DeepEqual(tok.Roles, []string{"admin"}) {
+		t.Fatalf("got %+v", tok)
+	}
+	if tok.Raw == "" {
+		t.Error("Raw not set")
+	}
+}
+
+func TestRolesClaims(t *testing.T) {
+	claims := jwt.MapClaims{
+		"roles":        []interface{}{"top"},
+		"realm_access": map[string]interface{}{"roles": []interface{}{"realm"}},
+		"resource_access": map[string]interface{}{
+			"api.example.com": map[string]interface{}{"roles": []interface{}{"client", 7}},
+		},
+	}
+	cases := []struct {
+		paths []string
+		want  []string
+	}{
+		{nil, []string{"top"}},
+		{[]string{"realm_access.roles"}, []string{"realm"}},
+		{[]string{`resource_access["api.example.com"].roles`, "roles"}, []string{"client"}},
+		{[]string{"missing.roles", "realm_access.roles"}, []string{"realm"}},
+	}
+	for _, c := range cases {
+		a := keycloakauth.MustNew(keycloakauth.Options{Mode: keycloakauth.ModeGateway, RolesClaims: c.paths})
+		got, err := a.RolesOf(claims)
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got %v, %v; want %v", c.paths, got, err, c.want)
+		}
+	}
+	a := keycloakauth.MustNew(keycloakauth.Options{Mode: keycloakauth.ModeGateway, RolesClaims: []string{"realm_access"}})
+	if _, err := a.RolesOf(claims); err == nil {
+		t.Error("object claim read as roles")
+	}
+}
+
+func TestParseClaimPath(t *testing.T) {
+	valid := map[string]keycloakauth.ClaimPath{
+		"roles":                              {"roles"},
+		"resource_access.my-client.roles":    {"resource_access", "my-client", "roles"},
+		`resource_access["api.x.com"].roles`: {"resource_access", "api.x.com", "roles"},
+		`["https://example.com/roles"]`:      {"https://example.com/roles"},
+	}
+	for in, want := range valid {
+		got, err := keycloakauth.ParseClaimPath(in)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, %v", in, got, err)
+			continue
+		}
+		if back, err := keycloakauth.ParseClaimPath(got.String()); err != nil || !reflect.DeepEqual(back, want) {
+			t.Errorf("%s: String() %q does not round-trip", in, got.String())
+		}
+	}
+	for _, in := range []string{"", "a..b", "a.", ".a", `a["b`, `a["b"]c`, `a[b]`} {
+		if p, err := keycloakauth.ParseClaimPath(in); err == nil {
+			t.Errorf("%q: parsed as %q", in, p)
+		}
+	}
+}
+
+func TestTransformAndAnonymous(t *testing.T) {
+	a := keycloakauth.MustNew(keycloakauth.Options{
+		Mode: keycloakauth.ModeGateway,
+		Anonymous: func() jwt.MapClaims {
+			return jwt.MapClaims{"sub": "dev", "roles": []interface{}{"legacy_admin"}}
+		},
+		Transform: func(c jwt.MapClaims) error {
+			if c["sub"] == "blocked" {
+				return errors.New("subject is denylisted")
+			}
+			c["roles"] = []interface{}{strings.TrimPrefix(c["roles"].([]interface{})[0].(string), "legacy_")}
+			return nil
+		},
+	})
+	tok := a.Decode("")
+	if tok.Err != nil || tok.Claims["sub"] != "dev" || !reflect.DeepEqual(tok.Roles, []string{"admin"}) {
+		t.Fatalf("anonymous: got %+v", tok)
+	}
+	iss := oidctest.New(t)
+	tok = a.Decode("Bearer " + iss.Token(t, jwt.MapClaims{"sub": "blocked", "roles": []interface{}{"user"}}))
+	if tok.Err == nil || tok.Claims != nil {
+		t.Fatalf("transform error did not reject: %+v", tok)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	iss := oidctest.New(t)
+	a := jwksAuth(t, iss, nil)
+	app := fiber.New()
+	ok := func(c *fiber.Ctx) error {
+		claims, _ := c.Locals(keycloakauth.LocalsClaims).(jwt.MapClaims)
+		return c.SendString(claims["sub"].(string))
+	}
+	app.Get("/any", a.RequireAuth(), ok)
+	app.Get("/admin", a.RequireRole("admin", "ops"), ok)
+	app.Get("/scoped", a.RequireScope("items:read", "items:write"), ok)
+	app.Get("/staff", a.RequireGroup("/staff"), ok)
+	app.Get("/people", a.RequireCaller(policy.CallerHuman), ok)
+	app.Get("/robots", a.RequireCaller(policy.CallerService), ok)
+
+	alice := iss.Token(t, jwt.MapClaims{
+		"sub":          "alice",
+		"realm_access": map[string]interface{}{"roles": []interface{}{"ops"}},
+		"scope":        "openid items:read items:write",
+		"groups":       []interface{}{"/staff", "/beta"},
+	})
+	bob := iss.Token(t, jwt.MapClaims{"sub": "bob", "scope": "openid items:read"})
+	robot := iss.Token(t, jwt.MapClaims{"sub": "robot", "client_id": "reporting-batch"})
+
+	cases := []struct {
+		path, token string
+		want        int
+	}{
+		{"/any", "", fiber.StatusUnauthorized},
+		{"/any", bob, fiber.StatusOK},
+		{"/admin", alice, fiber.StatusOK},
+		{"/admin", bob, fiber.StatusForbidden},
+		{"/scoped", alice, fiber.StatusOK},
+		{"/scoped", bob, fiber.StatusForbidden},
+		{"/staff", alice, fiber.StatusOK},
+		{"/staff", bob, fiber.StatusForbidden},
+		{"/people", bob, fiber.StatusOK},
+		{"/people", robot, fiber.StatusForbidden},
+		{"/robots", robot, fiber.StatusOK},
+		{"/robots", bob, fiber.StatusForbidden},
+		{"/robots", "", fiber.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.path, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.want {
+			t.Errorf("%s with %.10q: status %d, want %d", c.path, c.token, resp.StatusCode, c.want)
+		}
+	}
+}
+
+func TestDecodeOncePerRequest(t *testing.T) {
+	calls := 0
+	a := keycloakauth.MustNew(keycloakauth.Options{
+		Mode:      keycloakauth.ModeGateway,
+		Transform: func(jwt.MapClaims) error { calls++; return nil },
+	})
+	iss := oidctest.New(t)
+	app := fiber.New()
+	app.Get("/", a.RequireAuth(), a.RequireRole("user"), func(c *fiber.Ctx) error {
+		if _, ok := keycloakauth.Cached(c); !ok {
+			t.Error("token not cached")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+iss.TokenFor(t, "alice", "user"))
+	if resp, err := app.Test(req); err != nil || resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("status %v, %v", resp, err)
+	}
+	if calls != 1 {
+		t.Errorf("token decoded %d times", calls)
+	}
+}
+
+func TestDeny(t *testing.T) {
+	a := keycloakauth.MustNew(keycloakauth.Options{
+		Mode: keycloakauth.ModeGateway,
+		Deny: func(c *fiber.Ctx, status int, message string) error {
+			return c.Status(status).JSON(fiber.Map{"detail": message})
+		},
+	})
+	app := fiber.New()
+	app.Get("/", a.RequireRole("admin"), func(c *fiber.Ctx) error { return nil })
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusUnauthorized || resp.Header.Get("Content-Type") != fiber.MIMEApplicationJSON {
+		t.Errorf("got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestRefreshKeys(t *testing.T) {
+	iss := oidctest.New(t)
+	// With throttling on, a rotated key is only picked up once forced.
+	a := jwksAuth(t, iss, func(o *keycloakauth.Options) { o.JWKSMinRefresh = time.Hour })
+	if tok := a.Decode("Bearer " + iss.TokenFor(t, "alice")); tok.Err != nil {
+		t.Fatal(tok.Err)
+	}
+	iss.RotateKey(t)
+	if tok := a.Decode("Bearer " + iss.TokenFor(t, "alice")); tok.Err == nil {
+		t.Fatal("rotated key accepted before the throttle expired")
+	}
+	if n, err := a.RefreshKeys(); err != nil || n == 0 {
+		t.Fatalf("RefreshKeys: %d, %v", n, err)
+	}
+	if tok := a.Decode("Bearer " + iss.TokenFor(t, "alice")); tok.Err != nil {
+		t.Fatalf("rotated key rejected after refresh: %v", tok.Err)
+	}
+	gw := keycloakauth.MustNew(keycloakauth.Options{Mode: keycloakauth.ModeGateway})
+	if _, err := gw.RefreshKeys(); !errors.Is(err, keycloakauth.ErrNoJWKS) {
+		t.Errorf("gateway mode: %v", err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	iss := oidctest.New(t)
+	a := jwksAuth(t, iss, nil)
+	if keys, fetched, err := a.Keys(); err != nil || len(keys) != 0 || !fetched.IsZero() {
+		t.Fatalf("before the first token: %v, %v, %v", keys, fetched, err)
+	}
+	if tok := a.Decode("Bearer " + iss.TokenFor(t, "alice")); tok.Err != nil {
+		t.Fatal(tok.Err)
+	}
+	iss.RotateKey(t)
+	if _, err := a.RefreshKeys(); err != nil {
+		t.Fatal(err)
+	}
+	keys, fetched, err := a.Keys()
+	if err != nil || len(keys) != 2 || fetched.IsZero() {
+		t.Fatalf("Keys: %v, %v, %v", keys, fetched, err)
+	}
+	for i, k := range keys {
+		if want := fmt.Sprintf("key-%d", i+1); k.Kid != want {
+			t.Errorf("key %d: kid %s, want %s", i, k.Kid, want)
+		}
+		if k.Thumbprint == "" || k.Pinned {
+			t.Errorf("%s: thumbprint %q, pinned %v", k.Kid, k.Thumbprint, k.Pinned)
+		}
+		if left := time.Until(k.NotAfter); left < oidctest.CertValidity-time.Hour || left > oidctest.CertValidity {
+			t.Errorf("%s: certificate expires %v", k.Kid, k.NotAfter)
+		}
+	}
+	gw := keycloakauth.MustNew(keycloakauth.Options{Mode: keycloakauth.ModeGateway})
+	if _, _, err := gw.Keys(); !errors.Is(err, keycloakauth.ErrNoJWKS) {
+		t.Errorf("gateway mode: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package keycloakauth
+
+import (
+	"strings"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// A rule decides whether an accepted token may proceed. It returns 0 to
+// allow, or 403 with the reason for refusing.
+type rule func(t *Token) (status int, reason string)
+
+// authorize applies r after the authentication every rule implies.
+func authorize(t *Token, r rule) (int, string) {
+	if t.Err != nil {
+		return fiber.StatusUnauthorized, t.Err.Error()
+	}
+	if r == nil {
+		return 0, ""
+	}
+	return r(t)
+}
+
+func roleRule(roles []string) rule {
+	return func(t *Token) (int, string) {
+		if t.RolesErr != nil {
+			return fiber.StatusForbidden, "Cannot extract roles"
+		}
+		if !HasAny(t.Roles, roles...) {
+			return fiber.StatusForbidden, "Missing role: " + strings.Join(roles, " or ")
+		}
+		return 0, ""
+	}
+}
+
+func (a *Auth) scopeRule(scopes []string) rule {
+	return func(t *Token) (int, string) {
+		have := a.ScopesOf(t.Claims)
+		for _, s := range scopes {
+			if !HasAny(have, s) {
+				return fiber.StatusForbidden, "Missing scope: " + s
+			}
+		}
+		return 0, ""
+	}
+}
+
+func (a *Auth) groupRule(groups []string) rule {
+	return func(t *Token) (int, string) {
+		if !HasAny(a.GroupsOf(t.Claims), groups...) {
+			return fiber.StatusForbidden, "Missing group: " + strings.Join(groups, " or ")
+		}
+		return 0, ""
+	}
+}
+
+func callerRule(kind string) rule {
+	return func(t *Token) (int, string) {
+		if reason := policy.CheckCaller(t.Claims, kind); reason != "" {
+			return fiber.StatusForbidden, reason
+		}
+		return 0, ""
+	}
+}
+
+// RequireAuth allows any request with an accepted token.
+func (a *Auth) RequireAuth() fiber.Handler {
+	return a.require(nil)
+}
+
+// RequireRole allows callers holding at least one of roles.
+func (a *Auth) RequireRole(roles ...string) fiber.Handler {
+	return a.require(roleRule(roles))
+}
+
+// RequireScope allows callers whose token was granted every one of
+// scopes.
+func (a *Auth) RequireScope(scopes ...string) fiber.Handler {
+	return a.require(a.scopeRule(scopes))
+}
+
+// RequireGroup allows callers in at least one of groups, as named in the
+// groups claim (Keycloak's group membership mapper writes full paths such
+// as "/staff/ops" unless told otherwise).
+func (a *Auth) RequireGroup(groups ...string) fiber.Handler {
+	return a.require(a.groupRule(groups))
+}
+
+// RequireCaller allows tokens of kind: policy.CallerHuman for people
+// signed in as themselves, policy.CallerService for service accounts
+// (client credentials grant).
+func (a *Auth) RequireCaller(kind string) fiber.Handler {
+	return a.require(callerRule(kind))
+}
+
+func (a *Auth) require(r rule) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		t := a.Token(c)
+		if status, reason := authorize(t, r); status != 0 {
+			return a.opts.Deny(c, status, reason)
+		}
+		c.Locals(LocalsClaims, t.Claims)
+		return c.Next()
+	}
+}
+
+// HasAny reports whether have contains one of want.
+func HasAny(have []string, want ...string) bool {
+	for _, h := range have {
+		for _, w := range want {
+			if h == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimsOf is a nil-safe accessor for handlers.
+func claimsOf(t *Token) jwt.MapClaims {
+	if t == nil {
+		return nil
+	}
+	return t.Claims
+}
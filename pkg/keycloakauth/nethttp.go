@@ -0,0 +1,118 @@
+package keycloakauth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// HTTP adapts an Auth to net/http. Its middleware has the
+// func(http.Handler) http.Handler shape that chi, gorilla/mux and plain
+// net/http chains use, and applies the same Options as the Fiber
+// middleware:
+//
+//	h := auth.HTTP()
+//	r := chi.NewRouter()
+//	r.Use(h.Authenticate)
+//	r.With(h.RequireRole("admin")).Delete("/items/{id}", deleteItem)
+//
+//	mux.Handle("/reports", h.RequireScope("reports:read")(reports))
+type HTTP struct {
+	a    *Auth
+	deny func(w http.ResponseWriter, r *http.Request, status int, message string)
+}
+
+// HTTP returns the net/http adapter of a. Refusals are written with
+// Options.DenyHTTP, or as plain text.
+func (a *Auth) HTTP() HTTP {
+	deny := a.opts.DenyHTTP
+	if deny == nil {
+		deny = func(w http.ResponseWriter, _ *http.Request, status int, message string) {
+			http.Error(w, message, status)
+		}
+	}
+	return HTTP{a: a, deny: deny}
+}
+
+type tokenKey struct{}
+
+// TokenFromContext returns the token that the HTTP middleware decoded for
+// the request.
+func TokenFromContext(ctx context.Context) (*Token, bool) {
+	t, ok := ctx.Value(tokenKey{}).(*Token)
+	return t, ok
+}
+
+// ClaimsFromContext returns the claims of an accepted token, or nil.
+func ClaimsFromContext(ctx context.Context) jwt.MapClaims {
+	t, _ := TokenFromContext(ctx)
+	return claimsOf(t)
+}
+
+// token returns the request's token, decoding it unless a middleware
+// earlier in the chain already has, and the request carrying it.
+func (h HTTP) token(r *http.Request) (*Token, *http.Request) {
+	if t, ok := TokenFromContext(r.Context()); ok {
+		return t, r
+	}
+	t := h.a.Decode(r.Header.Get("Authorization"))
+	return t, r.WithContext(context.WithValue(r.Context(), tokenKey{}, t))
+}
+
+// Authenticate decodes the token into the request context without
+// refusing anything, for handlers that treat anonymous callers
+// differently. Read it with TokenFromContext.
+func (h HTTP) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, r = h.token(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAuth allows any request with an accepted token.
+func (h HTTP) RequireAuth() func(http.Handler) http.Handler {
+	return h.require(nil)
+}
+
+// RequireRole allows callers holding at least one of roles.
+func (h HTTP) RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return h.require(roleRule(roles))
+}
+
+// RequireScope allows callers whose token was granted every one of
+// scopes.
+func (h HTTP) RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return h.require(h.a.scopeRule(scopes))
+}
+
+// RequireGroup allows callers in at least one of groups.
+func (h HTTP) RequireGroup(groups ...string) func(http.Handler) http.Handler {
+	return h.require(h.a.groupRule(groups))
+}
+
+// RequireCaller allows tokens of kind, policy.CallerHuman or
+// policy.CallerService.
+func (h HTTP) RequireCaller(kind string) func(http.Handler) http.Handler {
+	return h.require(callerRule(kind))
+}
+
+func (h HTTP) require(rl rule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, r := h.token(r)
+			if status, reason := authorize(t, rl); status != 0 {
+				if status == http.StatusUnauthorized {
+					challenge := "Bearer"
+					if r.Header.Get("Authorization") != "" {
+						challenge += ` error="invalid_token"`
+					}
+					w.Header().Set("WWW-Authenticate", challenge)
+				}
+				h.deny(w, r, status, reason)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package keycloakauth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/example/fiber-demo/internal/oidctest"
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestHTTPMiddleware(t *testing.T) {
+	iss := oidctest.New(t)
+	a := jwksAuth(t, iss, nil)
+	h := a.HTTP()
+
+	sub := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := keycloakauth.ClaimsFromContext(r.Context())
+		if claims == nil {
+			w.Write([]byte("anonymous"))
+			return
+		}
+		w.Write([]byte(claims["sub"].(string)))
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/open", h.Authenticate(sub))
+	mux.Handle("/any", h.RequireAuth()(sub))
+	mux.Handle("/admin", h.RequireRole("admin")(sub))
+	mux.Handle("/scoped", h.RequireScope("items:write")(sub))
+	mux.Handle("/staff", h.RequireGroup("/staff")(sub))
+	// Stacked middleware share one decode through the context.
+	mux.Handle("/both", h.Authenticate(h.RequireAuth()(h.RequireRole("user", "admin")(sub))))
+
+	alice := iss.Token(t, jwt.MapClaims{
+		"sub":          "alice",
+		"realm_access": map[string]interface{}{"roles": []interface{}{"admin"}},
+		"scope":        "openid items:write",
+		"groups":       []interface{}{"/staff"},
+	})
+	bob := iss.TokenFor(t, "bob", "user")
+
+	cases := []struct {
+		path, token string
+		want        int
+		body        string
+	}{
+		{"/open", "", http.StatusOK, "anonymous"},
+		{"/open", bob, http.StatusOK, "bob"},
+		{"/any", "", http.StatusUnauthorized, "missing Authorization header"},
+		{"/any", "garbage", http.StatusUnauthorized, ""},
+		{"/any", bob, http.StatusOK, "bob"},
+		{"/admin", alice, http.StatusOK, "alice"},
+		{"/admin", bob, http.StatusForbidden, "Missing role: admin"},
+		{"/scoped", alice, http.StatusOK, "alice"},
+		{"/scoped", bob, http.StatusForbidden, "Missing scope: items:write"},
+		{"/staff", alice, http.StatusOK, "alice"},
+		{"/staff", bob, http.StatusForbidden, "Missing group: /staff"},
+		{"/both", bob, http.StatusOK, "bob"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.path, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != c.want || !strings.Contains(rec.Body.String(), c.body) {
+			t.Errorf("%s with %.10q: %d %q, want %d %q", c.path, c.token, rec.Code, rec.Body.String(), c.want, c.body)
+		}
+		if rec.Code == http.StatusUnauthorized && !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("%s: no bearer challenge", c.path)
+		}
+	}
+}
+
+func TestHTTPDenyAndDecodeOnce(t *testing.T) {
+	calls := 0
+	a := keycloakauth.MustNew(keycloakauth.Options{
+		Mode:      keycloakauth.ModeGateway,
+		Transform: func(jwt.MapClaims) error { calls++; return nil },
+		DenyHTTP: func(w http.ResponseWriter, _ *http.Request, status int, message string) {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(status)
+			w.Write([]byte(`{"detail":"` + message + `"}`))
+		},
+	})
+	h := a.HTTP()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	chain := h.RequireAuth()(h.RequireRole("admin")(ok))
+
+	iss := oidctest.New(t)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+iss.TokenFor(t, "bob", "user"))
+	rec := httptest.NewRecorder()
+	chain.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if calls != 1 {
+		t.Errorf("token decoded %d times", calls)
+	}
+}
@@ -0,0 +1,208 @@
+// Package policy reads and evaluates the authorization rules of a
+// POLICY_FILE. The application and, through pkg/gateway, the keycloak-authz
+// Kong plugin both use it, so a file enforced at the gateway means exactly
+// what it means in the application.
+//
+//	p, err := policy.Load("config/policy.json")
+//	if rule, ok := p.Match(method, path); ok && !rule.Open() {
+//		if reason := rule.Check(claims, roles); reason != "" {
+//			// refuse with 403 and reason
+//		}
+//	}
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Pattern selects requests by method and path.
+//
+// Path is matched segment by segment: "*" matches one segment and "**"
+// matches any remainder, so "/api/*/admin/**" covers every admin route of
+// every API version. Segments are compared case-insensitively, as Fiber
+// routes them. An empty Methods list matches all methods.
+type Pattern struct {
+	Methods []string `json:"methods,omitempty"`
+	Path    string   `json:"path"`
+}
+
+// Matches reports whether the pattern covers method and path.
+func (p Pattern) Matches(method, path string) bool {
+	if len(p.Methods) > 0 {
+		found := false
+		for _, m := range p.Methods {
+			if strings.EqualFold(m, method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return globMatch(strings.Split(strings.Trim(p.Path, "/"), "/"), strings.Split(strings.Trim(path, "/"), "/"))
+}
+
+// Validate checks that the pattern is usable.
+func (p Pattern) Validate() error {
+	if !strings.HasPrefix(p.Path, "/") {
+		return fmt.Errorf("path %q must start with /", p.Path)
+	}
+	return nil
+}
+
+func globMatch(pattern, segments []string) bool {
+	for i, p := range pattern {
+		if p == "**" {
+			return true
+		}
+		if i >= len(segments) || (p != "*" && !strings.EqualFold(p, segments[i])) {
+			return false
+		}
+	}
+	return len(pattern) == len(segments)
+}
+
+// Callers are either people signed in through Keycloak or clients using
+// their service account (client credentials grant).
+const (
+	CallerHuman   = "human"
+	CallerService = "service"
+)
+
+// ServiceClientID returns the client of a service-account token, or ""
+// for a user token. Keycloak marks these tokens with a client_id claim
+// (clientId before Keycloak 24) and a service-account-<client> username.
+func ServiceClientID(claims jwt.MapClaims) string {
+	for _, k := range []string{"client_id", "clientId"} {
+		if id, _ := claims[k].(string); id != "" {
+			return id
+		}
+	}
+	if name, _ := claims["preferred_username"].(string); strings.HasPrefix(name, "service-account-") {
+		if azp, _ := claims["azp"].(string); azp != "" {
+			return azp
+		}
+		return strings.TrimPrefix(name, "service-account-")
+	}
+	return ""
+}
+
+// CallerKind returns CallerService or CallerHuman.
+func CallerKind(claims jwt.MapClaims) string {
+	if ServiceClientID(claims) != "" {
+		return CallerService
+	}
+	return CallerHuman
+}
+
+// CheckCaller returns why claims of the wrong kind are refused, or "" when
+// they are of kind want. An empty want accepts both.
+func CheckCaller(claims jwt.MapClaims, want string) string {
+	if want == "" || CallerKind(claims) == want {
+		return ""
+	}
+	if want == CallerHuman {
+		return "Service account tokens are not accepted here; sign in as a user"
+	}
+	return "Only service account tokens are accepted here"
+}
+
+// Rule grants access to requests matching its pattern.
+type Rule struct {
+	Pattern
+	// Roles lists realm roles of which the caller needs at least one.
+	Roles []string `json:"roles,omitempty"`
+	// Authenticated requires a token without requiring any role.
+	Authenticated bool `json:"authenticated,omitempty"`
+	// Caller restricts the rule to CallerHuman or CallerService tokens.
+	Caller string `json:"caller,omitempty"`
+}
+
+// Validate checks that the rule is usable.
+func (r Rule) Validate() error {
+	if r.Caller != "" && r.Caller != CallerHuman && r.Caller != CallerService {
+		return fmt.Errorf("caller must be %q or %q", CallerHuman, CallerService)
+	}
+	return r.Pattern.Validate()
+}
+
+// Open reports whether the rule lets anonymous requests through.
+func (r Rule) Open() bool {
+	return len(r.Roles) == 0 && !r.Authenticated && r.Caller == ""
+}
+
+// Allows reports whether a caller holding roles satisfies the rule's
+// roles.
+func (r Rule) Allows(roles []string) bool {
+	if len(r.Roles) == 0 {
+		return true
+	}
+	for _, have := range roles {
+		for _, want := range r.Roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check decides an authenticated caller with claims and roles. It returns
+// "" to allow, or why the caller is forbidden.
+func (r Rule) Check(claims jwt.MapClaims, roles []string) string {
+	if reason := CheckCaller(claims, r.Caller); reason != "" {
+		return reason
+	}
+	if !r.Allows(roles) {
+		return "Missing role: " + strings.Join(r.Roles, " or ")
+	}
+	return ""
+}
+
+// Policy is an ordered list of rules. The first rule matching a request
+// decides; requests no rule matches are left to the caller's own checks.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Load reads and validates a policy file. Unknown fields are errors, so a
+// misspelt key cannot silently open a route.
+func Load(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, r := range p.Rules {
+		if err := r.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i, err)
+		}
+	}
+	return &p, nil
+}
+
+// Match returns the first rule covering method and path. A nil policy
+// matches nothing.
+func (p *Policy) Match(method, path string) (Rule, bool) {
+	if p == nil {
+		return Rule{}, false
+	}
+	for _, r := range p.Rules {
+		if r.Matches(method, path) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
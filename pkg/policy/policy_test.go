@@ -0,0 +1,79 @@
+package policy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestPatternMatches(t *testing.T) {
+	cases := []struct {
+		pattern      policy.Pattern
+		method, path string
+		want         bool
+	}{
+		{policy.Pattern{Path: "/api/*/admin"}, "GET", "/api/v1/admin", true},
+		{policy.Pattern{Path: "/api/*/admin"}, "GET", "/api/v1/admin/x", false},
+		{policy.Pattern{Path: "/api/*/items/**"}, "GET", "/api/v2/items", true},
+		{policy.Pattern{Path: "/api/*/items/**"}, "GET", "/api/v2/items/a/b", true},
+		{policy.Pattern{Path: "/api/*/items/**"}, "GET", "/api/items", false},
+		{policy.Pattern{Path: "/api/*/admin"}, "GET", "/API/V1/Admin", true},
+		{policy.Pattern{Path: "/api/*/items/**"}, "GET", "/Api/v2/ITEMS/a", true},
+		{policy.Pattern{Methods: []string{"DELETE"}, Path: "/**"}, "delete", "/x", true},
+		{policy.Pattern{Methods: []string{"DELETE"}, Path: "/**"}, "GET", "/x", false},
+	}
+	for _, c := range cases {
+		if got := c.pattern.Matches(c.method, c.path); got != c.want {
+			t.Errorf("%+v %s %s: got %v", c.pattern, c.method, c.path, got)
+		}
+	}
+}
+
+func TestLoadAndCheck(t *testing.T) {
+	p, err := policy.Load(filepath.Join("..", "..", "config", "policy.example.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	human := jwt.MapClaims{"sub": "alice", "preferred_username": "alice"}
+	robot := jwt.MapClaims{"sub": "svc", "client_id": "reporting"}
+
+	rule, ok := p.Match("DELETE", "/api/v1/items/42")
+	if !ok || rule.Open() {
+		t.Fatalf("delete rule not matched: %+v %v", rule, ok)
+	}
+	if reason := rule.Check(human, []string{"admin"}); reason != "" {
+		t.Errorf("admin refused: %s", reason)
+	}
+	if reason := rule.Check(human, []string{"user"}); reason != "Missing role: admin" {
+		t.Errorf("user: got %q", reason)
+	}
+	if reason := rule.Check(robot, []string{"admin"}); reason == "" {
+		t.Error("service account allowed to delete")
+	}
+	if _, ok := p.Match("GET", "/health"); ok {
+		t.Error("unlisted path matched")
+	}
+	if rule, _ := p.Match("GET", "/api/v1/profile"); rule.Open() || !rule.Authenticated {
+		t.Errorf("profile rule: %+v", rule)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"unknown field": `{"rules": [{"path": "/x", "role": ["admin"]}]}`,
+		"relative path": `{"rules": [{"path": "x"}]}`,
+		"bad caller":    `{"rules": [{"path": "/x", "caller": "robot"}]}`,
+	} {
+		path := filepath.Join(dir, "policy.json")
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := policy.Load(path); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
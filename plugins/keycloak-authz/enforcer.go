@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/gateway"
+)
+
+// enforcers maps a configuration, as its JSON, to its enforcer. Kong
+// creates a new configuration instance whenever the plugin is changed
+// through the Admin API.
+var enforcers sync.Map
+
+func enforcerFor(conf Config) (*gateway.Enforcer, error) {
+	key := conf.key()
+	if e, ok := enforcers.Load(key); ok {
+		return e.(*gateway.Enforcer), nil
+	}
+	e, err := gateway.New(conf.options())
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := enforcers.LoadOrStore(key, e)
+	return actual.(*gateway.Enforcer), nil
+}
+
+// options maps the plugin configuration to the shared enforcer's, so the
+// gateway decides requests the way the app does.
+func (conf Config) options() gateway.Options {
+	return gateway.Options{
+		PolicyFile:        conf.PolicyFile,
+		RuntimeConfigFile: conf.RuntimeConfigFile,
+		RolesClaims:       conf.RolesClaims,
+		Issuer:            conf.Issuer,
+		JWKSURL:           conf.JWKSURL,
+		HTTPClient:        &http.Client{Timeout: 10 * time.Second},
+		APIVersion:        conf.APIVersion,
+		LegacyPaths:       conf.LegacyPaths,
+		DenylistURL:       conf.DenylistURL,
+		DenylistToken:     conf.DenylistToken,
+	}
+}
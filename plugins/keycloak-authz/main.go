@@ -0,0 +1,115 @@
+// Command keycloak-authz is a Kong plugin that enforces the application's
+// POLICY_FILE at the gateway. Kong runs it through its Go plugin server.
+//
+// Requests that a rule refuses get the same 401 or 403 problem response
+// the app would send, and never reach the app. Start the app with
+// POLICY_ENFORCED_BY_GATEWAY=true to skip its own evaluation; it then only
+// trusts the Authorization header Kong forwards, as in AUTH_MODE=gateway.
+//
+// By default the plugin trusts the token that Kong's jwt plugin has already
+// verified. It runs after that plugin. If issuer is set, it verifies the
+// token against the realm JWKS itself. Either way the claims go through the
+// app's claims transformers and denylist (pkg/gateway) before the rules
+// see them.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Kong/go-pdk"
+	"github.com/Kong/go-pdk/server"
+)
+
+const (
+	// Version is reported to Kong.
+	Version = "1.0.0"
+	// Priority runs the plugin after jwt (1450) and before acl (950).
+	Priority = 1000
+)
+
+// Config is the plugin configuration set through the Admin API, e.g.
+//
+//	{"name": "keycloak-authz", "config": {"policy_file": "/etc/kong/policy.json"}}
+type Config struct {
+	// PolicyFile is the path to the policy, in the format of the app's
+	// POLICY_FILE. Changes are picked up within a second.
+	PolicyFile string `json:"policy_file"`
+	// RuntimeConfigFile is the app's RUNTIME_CONFIG_FILE, whose claims
+	// section sets role aliases, permissions and the tenant as in the app.
+	RuntimeConfigFile string `json:"runtime_config_file"`
+	// RolesClaims mirrors the app's ROLES_CLAIM_PATHS.
+	RolesClaims []string `json:"roles_claims"`
+	// Issuer, when set, makes the plugin verify tokens against the realm's
+	// JWKS (at JWKSURL, by default under Issuer) instead of trusting the
+	// jwt plugin.
+	Issuer  string `json:"issuer"`
+	JWKSURL string `json:"jwks_url"`
+	// APIVersion is the version unversioned /api paths and LegacyPaths are
+	// served under by the app (default "v1").
+	APIVersion  string   `json:"api_version"`
+	LegacyPaths []string `json:"legacy_paths"`
+	// DenylistURL is the app's GET /hooks/denylist, polled with
+	// DenylistToken (the app's DENYLIST_FEED_TOKEN).
+	DenylistURL   string `json:"denylist_url"`
+	DenylistToken string `json:"denylist_token"`
+}
+
+// New returns an empty configuration for Kong to fill in.
+func New() interface{} {
+	return &Config{}
+}
+
+func (conf Config) key() string {
+	b, _ := json.Marshal(conf)
+	return string(b)
+}
+
+// Access runs before Kong proxies the request.
+func (conf Config) Access(kong *pdk.PDK) {
+	e, err := enforcerFor(conf)
+	if err != nil {
+		kong.Log.Err("keycloak-authz: ", err.Error())
+		deny(kong, http.StatusInternalServerError, "Authorization policy unavailable")
+		return
+	}
+	if err := e.Refresh(); err != nil {
+		kong.Log.Warn("keycloak-authz: keeping the previous version: ", err.Error())
+	}
+	method, _ := kong.Request.GetMethod()
+	path, _ := kong.Request.GetPath()
+	authHeader, _ := kong.Request.GetHeader("Authorization")
+	accept, _ := kong.Request.GetHeader("Accept")
+	if status, reason := e.Decide(method, path, authHeader, accept); status != 0 {
+		deny(kong, status, reason)
+	}
+}
+
+// Problem types shared with the app's responses.
+var problemTypes = map[int]string{
+	http.StatusUnauthorized: "urn:fiber-demo:problem:unauthorized",
+	http.StatusForbidden:    "urn:fiber-demo:problem:forbidden",
+}
+
+// deny ends the request with an RFC 7807 body like the app's.
+func deny(kong *pdk.PDK, status int, detail string) {
+	typ, ok := problemTypes[status]
+	if !ok {
+		typ = "about:blank"
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"type":   typ,
+		"title":  http.StatusText(status),
+		"status": status,
+		"detail": detail,
+	})
+	headers := map[string][]string{"Content-Type": {"application/problem+json"}}
+	if status == http.StatusUnauthorized {
+		headers["WWW-Authenticate"] = []string{"Bearer"}
+	}
+	kong.Response.Exit(status, body, headers)
+}
+
+func main() {
+	server.StartServer(New, Version, Priority)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+)
+
+// currentPolicy is the authorization policy loaded from POLICY_FILE.
+// Rules are evaluated in order and the first match decides; requests no
+// rule matches fall through to the route's own checks.
+var currentPolicy atomic.Pointer[policy.Policy]
+
+// policyAtGateway is set when the keycloak-authz Kong plugin enforces
+// POLICY_FILE in front of the app, which then skips its own evaluation.
+// It is only accepted in gateway auth mode.
+var policyAtGateway = getEnvBool("POLICY_ENFORCED_BY_GATEWAY", false)
+
+// enforcePolicy applies the loaded policy in front of the routes. It runs
+// again after a route is rewritten by versioning, so rules should target
+// the versioned /api paths.
+func enforcePolicy(c *fiber.Ctx) error {
+	if policyAtGateway {
+		return c.Next()
+	}
+	rule, ok := currentPolicy.Load().Match(c.Method(), c.Path())
+	if !ok || rule.Open() {
+		return c.Next()
+	}
+	claims, err := parseToken(c)
+	if err != nil {
+		return errUnauthorized(err.Error())
+	}
+	roles, _ := requestRoles(c)
+	if reason := rule.Check(claims, roles); reason != "" {
+		// Refusals by the rule's caller kind keep their own label.
+		if policy.CheckCaller(claims, rule.Caller) != "" {
+			markDenied(c, "caller")
+		} else {
+			markDenied(c, "policy")
+		}
+		return errForbidden(reason)
+	}
+	c.Locals("claims", claims)
+	return c.Next()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/gateway"
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func bearer(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	raw, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("unverified"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + raw
+}
+
+// TestGatewayDecidesLikeApp runs the same tokens through the app's
+// policy middleware and the Kong plugin's enforcer, with the example
+// policy and runtime config, and expects the same answer from both.
+func TestGatewayDecidesLikeApp(t *testing.T) {
+	const policyFile, runtimeFile = "config/policy.example.json", "config/runtime.example.json"
+	p, err := policy.Load(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadRuntimeConfig(runtimeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentPolicy.Store(p)
+	currentRuntime.Store(cfg)
+	t.Cleanup(func() { currentPolicy.Store(nil); currentRuntime.Store(nil) })
+	denied.Store(&map[string]denylistEntry{
+		"u-mallory": {Subject: "u-mallory", CreatedAt: time.Now()},
+	})
+	t.Cleanup(func() { denied.Store(&map[string]denylistEntry{}) })
+
+	app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
+	app.Use(enforcePolicy)
+	app.Use(func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusNoContent) })
+
+	feed := fiber.New()
+	feed.Get("/hooks/denylist", denylistFeed)
+	e, err := gateway.New(gateway.Options{
+		PolicyFile:        policyFile,
+		RuntimeConfigFile: runtimeFile,
+		DenylistURL:       "http://app/hooks/denylist",
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return feed.Test(req)
+		})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	iat := float64(time.Now().Unix())
+	alice := bearer(t, jwt.MapClaims{"sub": "u-alice", "iat": iat, "roles": []interface{}{"app_admin"}})
+	bob := bearer(t, jwt.MapClaims{"sub": "u-bob", "iat": iat, "roles": []interface{}{"app_user"}})
+	robot := bearer(t, jwt.MapClaims{"sub": "u-robot", "iat": iat, "client_id": "reporting", "roles": []interface{}{"app_admin"}})
+	mallory := bearer(t, jwt.MapClaims{"sub": "u-mallory", "iat": iat, "roles": []interface{}{"admin"}})
+	cases := []struct {
+		name, method, path, auth string
+		want                     int
+	}{
+		{"aliased admin role", "GET", "/api/v1/admin", alice, fiber.StatusNoContent},
+		{"aliased user role", "GET", "/api/v1/admin", bob, fiber.StatusForbidden},
+		{"aliased user on items", "GET", "/api/v1/items", bob, fiber.StatusNoContent},
+		{"human deletes", "DELETE", "/api/v1/items/abc", alice, fiber.StatusNoContent},
+		{"service account deletes", "DELETE", "/api/v1/items/abc", robot, fiber.StatusForbidden},
+		{"denylisted subject", "GET", "/api/v1/admin", mallory, fiber.StatusUnauthorized},
+		{"anonymous", "GET", "/api/v1/profile", "", fiber.StatusUnauthorized},
+		{"open path", "GET", "/api/v1/public", "", fiber.StatusNoContent},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.path, nil)
+			if c.auth != "" {
+				req.Header.Set(fiber.HeaderAuthorization, c.auth)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body problem
+			_ = json.NewDecoder(resp.Body).Decode(&body)
+			if resp.StatusCode != c.want {
+				t.Fatalf("app: status %d (%s), want %d", resp.StatusCode, body.Detail, c.want)
+			}
+
+			status, reason := e.Decide(c.method, c.path, c.auth, "")
+			if status == 0 {
+				status = fiber.StatusNoContent
+			}
+			if status != resp.StatusCode || reason != body.Detail {
+				t.Errorf("gateway: %d %q, app: %d %q", status, reason, resp.StatusCode, body.Detail)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/example/fiber-demo/internal/httpclient"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem types used across the API. Generic HTTP failures use about:blank.
+const (
+	problemAboutBlank    = "about:blank"
+	problemUnauthorized  = "urn:fiber-demo:problem:unauthorized"
+	problemForbidden     = "urn:fiber-demo:problem:forbidden"
+	problemValidation    = "urn:fiber-demo:problem:validation"
+	problemDatabase      = "urn:fiber-demo:problem:database"
+	problemRateLimited   = "urn:fiber-demo:problem:rate-limited"
+	problemQuotaExceeded = "urn:fiber-demo:problem:quota-exceeded"
+	problemOverloaded    = "urn:fiber-demo:problem:overloaded"
+	problemTimeout       = "urn:fiber-demo:problem:timeout"
+)
+
+// problem is an RFC 7807 error body. Handlers return it as an error and
+// problemErrorHandler renders it.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	TraceID  string `json:"traceId,omitempty"`
+	// Errors lists per-field failures of validation problems.
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+func (p *problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
+}
+
+func newProblem(status int, typ, detail string) *problem {
+	return &problem{Type: typ, Title: http.StatusText(status), Status: status, Detail: detail}
+}
+
+func errUnauthorized(detail string) *problem {
+	return newProblem(fiber.StatusUnauthorized, problemUnauthorized, detail)
+}
+
+func errForbidden(detail string) *problem {
+	return newProblem(fiber.StatusForbidden, problemForbidden, detail)
+}
+
+// errDatabase logs the driver error and hides it from the client. An
+// operation cut short by the request's deadline is reported as a timeout.
+func errDatabase(err error) *problem {
+	if errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err) {
+		log.Println("Database timeout:", err)
+		return errTimeout("Database did not answer in time")
+	}
+	log.Println("Database error:", err)
+	return newProblem(fiber.StatusInternalServerError, problemDatabase, "Database error")
+}
+
+// errUpstream maps the error of an upstreamHTTP call. A refused token
+// exchange is the caller's 403 and a caller without a token a 401;
+// Keycloak's token endpoint or the target failing to answer, or an open
+// circuit, is a 502.
+func errUpstream(err error) *problem {
+	var refused *exchangeError
+	switch {
+	case errors.As(err, &refused):
+		return newProblem(fiber.StatusForbidden, problemAboutBlank, "Token exchange refused: "+refused.Description)
+	case errors.Is(err, httpclient.ErrNoUser):
+		return errUnauthorized("Missing Authorization header")
+	}
+	log.Println("Upstream call failed:", err)
+	return newProblem(fiber.StatusBadGateway, problemAboutBlank, err.Error())
+}
+
+// asProblem returns a copy of err as a problem. Problems are kept as-is,
+// fiber errors become about:blank problems and anything else is hidden
+// behind a generic 500.
+func asProblem(err error) *problem {
+	var p *problem
+	var fe *fiber.Error
+	var refused *exchangeError
+	switch {
+	case errors.As(err, &p):
+		cp := *p
+		p = &cp
+	case errors.As(err, &fe):
+		p = newProblem(fe.Code, problemAboutBlank, fe.Message)
+	case errors.As(err, &refused):
+		// Keycloak won't issue the caller a token for a sibling service.
+		p = newProblem(fiber.StatusForbidden, problemAboutBlank, "Token exchange refused: "+refused.Description)
+	default:
+		log.Println("Unhandled error:", err)
+		p = newProblem(fiber.StatusInternalServerError, problemAboutBlank, "")
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	return p
+}
+
+// problemErrorHandler is the app-wide fiber.ErrorHandler rendering every
+// error as a problem document.
+func problemErrorHandler(c *fiber.Ctx, err error) error {
+	p := asProblem(err)
+	p.Instance = c.OriginalURL()
+	if id, ok := c.Locals("requestid").(string); ok {
+		p.TraceID = id
+	}
+	if p.Status == fiber.StatusUnauthorized || p.Status == fiber.StatusForbidden {
+		emitAuthDenied(c, p.Status, p.Detail)
+		noteAuthFailure(c)
+	}
+
+	return c.Status(p.Status).JSON(p, problemContentType)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const quotaUsageCollection = "quota_usage"
+
+const (
+	quotaDay   = "day"
+	quotaMonth = "month"
+)
+
+// quotaRule allows Limit requests per calendar Period (UTC) to callers
+// with realm role Role, counted per caller, or to tokens issued to Client,
+// counted per client. Path defaults to every API route. Unlike rate
+// limits, quotas survive restarts and are shared by all instances.
+type quotaRule struct {
+	policy.Pattern
+	Role   string `json:"role,omitempty"`
+	Client string `json:"client,omitempty"`
+	Limit  int64  `json:"limit"`
+	Period string `json:"period"`
+}
+
+func (q *quotaRule) validate() error {
+	if q.Path == "" {
+		q.Path = "/api/**"
+	}
+	if err := q.Pattern.Validate(); err != nil {
+		return err
+	}
+	if (q.Role == "") == (q.Client == "") {
+		return errors.New("set exactly one of role and client")
+	}
+	if q.Limit <= 0 {
+		return errors.New("limit must be positive")
+	}
+	if q.Period != quotaDay && q.Period != quotaMonth {
+		return fmt.Errorf("period must be %q or %q", quotaDay, quotaMonth)
+	}
+	return nil
+}
+
+// name identifies the rule in counters and reports.
+func (q quotaRule) name() string {
+	if q.Role != "" {
+		return "role:" + q.Role
+	}
+	return "client:" + q.Client
+}
+
+// quotaPeriod names the period containing now and returns when it ends.
+func quotaPeriod(period string, now time.Time) (string, time.Time) {
+	now = now.UTC()
+	if period == quotaDay {
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+	}
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start.Format("2006-01"), start.AddDate(0, 1, 0)
+}
+
+// quotaUsage is one caller's count for one rule and period.
+type quotaUsage struct {
+	ID      string    `bson:"_id" json:"-"`
+	Rule    string    `bson:"rule" json:"rule"`
+	Caller  string    `bson:"caller" json:"caller"`
+	Period  string    `bson:"period" json:"period"`
+	Count   int64     `bson:"count" json:"count"`
+	Limit   int64     `bson:"limit" json:"limit"`
+	ResetAt time.Time `bson:"resetAt" json:"resetAt"`
+}
+
+// quotaCounter stores usage counts.
+type quotaCounter interface {
+	// Incr adds one to u's count, creating it from u, and returns the new
+	// count.
+	Incr(ctx context.Context, u quotaUsage) (int64, error)
+	Usage(ctx context.Context) ([]quotaUsage, error)
+}
+
+var quotaCounts quotaCounter
+
+// initQuotas picks where usage is counted: Redis when the cache is
+// enabled, MongoDB otherwise. Quotas are off with PostgreSQL and no Redis.
+func initQuotas() {
+	switch {
+	case cacheEnabled():
+		quotaCounts = redisQuotaCounter{}
+	case usesMongo():
+		quotaCounts = mongoQuotaCounter{}
+	default:
+		log.Println("Quotas need Redis (REDIS_URL) or MongoDB; configured quotas are not enforced")
+	}
+}
+
+// callerFor returns who the request counts against under q.
+func (q quotaRule) callerFor(c *fiber.Ctx) (string, bool) {
+	if !q.Matches(c.Method(), c.Path()) {
+		return "", false
+	}
+	claims, err := parseToken(c)
+	if err != nil {
+		return "", false
+	}
+	if q.Client != "" {
+		azp, _ := claims["azp"].(string)
+		return "client:" + azp, azp == q.Client
+	}
+	roles, err := requestRoles(c)
+	if err != nil || !slices.Contains(roles, q.Role) {
+		return "", false
+	}
+	sub, _ := claims["sub"].(string)
+	return "sub:" + sub, sub != ""
+}
+
+// enforceQuota counts the request against the first matching quota and
+// rejects it with 429 once the quota is used up. Counting errors let the
+// request through.
+func enforceQuota(c *fiber.Ctx) error {
+	cfg := currentRuntime.Load()
+	if quotaCounts == nil || cfg == nil {
+		return c.Next()
+	}
+	for _, q := range cfg.Quotas {
+		caller, ok := q.callerFor(c)
+		if !ok {
+			continue
+		}
+		now := time.Now()
+		period, reset := quotaPeriod(q.Period, now)
+		u := quotaUsage{
+			ID:      q.name() + "|" + period + "|" + caller,
+			Rule:    q.name(),
+			Caller:  caller,
+			Period:  period,
+			Limit:   q.Limit,
+			ResetAt: reset,
+		}
+		count, err := quotaCounts.Incr(c.UserContext(), u)
+		if err != nil {
+			log.Println("Quota count failed:", err)
+			return c.Next()
+		}
+		untilReset := strconv.Itoa(int(reset.Sub(now).Seconds()))
+		c.Set("X-Quota-Limit", strconv.FormatInt(q.Limit, 10))
+		c.Set("X-Quota-Remaining", strconv.FormatInt(max(q.Limit-count, 0), 10))
+		c.Set("X-Quota-Reset", untilReset)
+		if count > q.Limit {
+			c.Set(fiber.HeaderRetryAfter, untilReset)
+			return newProblem(fiber.StatusTooManyRequests, problemQuotaExceeded,
+				fmt.Sprintf("Quota of %d requests per %s exceeded", q.Limit, q.Period))
+		}
+		return c.Next()
+	}
+	return c.Next()
+}
+
+// mongoQuotaCounter keeps counts in quota_usage. Old periods expire with
+// the collection's retention policy.
+type mongoQuotaCounter struct{}
+
+func (mongoQuotaCounter) Incr(ctx context.Context, u quotaUsage) (int64, error) {
+	var out quotaUsage
+	err := db().Collection(quotaUsageCollection).FindOneAndUpdate(ctx,
+		bson.M{"_id": u.ID},
+		bson.M{
+			"$inc": bson.M{"count": 1},
+			"$set": bson.M{"rule": u.Rule, "caller": u.Caller, "period": u.Period, "limit": u.Limit, "resetAt": u.ResetAt},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&out)
+	return out.Count, err
+}
+
+func (mongoQuotaCounter) Usage(ctx context.Context) ([]quotaUsage, error) {
+	cur, err := db().Collection(quotaUsageCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	out := []quotaUsage{}
+	if err := cur.All(ctx, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// redisQuotaCounter keeps each count in a hash that expires a month after
+// its period ends, so the previous period can still be reported.
+type redisQuotaCounter struct{}
+
+func (redisQuotaCounter) key(id string) string {
+	return cachePrefix + "quota:" + id
+}
+
+func (r redisQuotaCounter) Incr(ctx context.Context, u quotaUsage) (int64, error) {
+	client := cacheClient.Load()
+	key := r.key(u.ID)
+	var count *redis.IntCmd
+	_, err := client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		count = p.HIncrBy(ctx, key, "count", 1)
+		p.HSet(ctx, key, "rule", u.Rule, "caller", u.Caller, "period", u.Period, "limit", u.Limit, "resetAt", u.ResetAt.Format(time.RFC3339))
+		p.ExpireAt(ctx, key, u.ResetAt.AddDate(0, 1, 0))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+func (r redisQuotaCounter) Usage(ctx context.Context) ([]quotaUsage, error) {
+	client := cacheClient.Load()
+	out := []quotaUsage{}
+	iter := client.Scan(ctx, 0, r.key("*"), 500).Iterator()
+	for iter.Next(ctx) {
+		h, err := client.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		u := quotaUsage{Rule: h["rule"], Caller: h["caller"], Period: h["period"]}
+		u.Count, _ = strconv.ParseInt(h["count"], 10, 64)
+		u.Limit, _ = strconv.ParseInt(h["limit"], 10, 64)
+		u.ResetAt, _ = time.Parse(time.RFC3339, h["resetAt"])
+		out = append(out, u)
+	}
+	return out, iter.Err()
+}
+
+func registerQuotaRoutes(r fiber.Router) {
+	r.Get("/quotas", quotaReport)
+}
+
+// quotaReport lists the configured quotas and the usage of the current
+// periods, heaviest callers first. all=true includes past periods.
+func quotaReport(c *fiber.Ctx) error {
+	var rules []quotaRule
+	if cfg := currentRuntime.Load(); cfg != nil {
+		rules = cfg.Quotas
+	}
+	if rules == nil {
+		rules = []quotaRule{}
+	}
+	if quotaCounts == nil {
+		return c.JSON(fiber.Map{"quotas": rules, "usage": []quotaUsage{}, "enforced": false})
+	}
+	usage, err := quotaCounts.Usage(c.UserContext())
+	if err != nil {
+		return errDatabase(err)
+	}
+	if !c.QueryBool("all") {
+		now := time.Now()
+		usage = slices.DeleteFunc(usage, func(u quotaUsage) bool { return !u.ResetAt.After(now) })
+	}
+	if rule := c.Query("rule"); rule != "" {
+		usage = slices.DeleteFunc(usage, func(u quotaUsage) bool { return u.Rule != rule })
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Count > usage[j].Count })
+	return c.JSON(fiber.Map{"quotas": rules, "usage": usage, "enforced": true})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+)
+
+// duration is a time.Duration that reads "1m"-style strings from JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// rateLimitRule allows Max requests per Window for each caller on the
+// routes its pattern matches. Callers are keyed by token subject, or by
+// client IP for anonymous requests.
+type rateLimitRule struct {
+	policy.Pattern
+	Max    int      `json:"max"`
+	Window duration `json:"window"`
+}
+
+func (r rateLimitRule) validate() error {
+	if err := r.Pattern.Validate(); err != nil {
+		return err
+	}
+	if r.Max <= 0 || r.Window <= 0 {
+		return errors.New("max and window must be positive")
+	}
+	return nil
+}
+
+type compiledRateLimit struct {
+	rule    rateLimitRule
+	handler fiber.Handler
+}
+
+// currentRateLimits is rebuilt on every runtime config reload; counters
+// start over when the limits change.
+var currentRateLimits atomic.Pointer[[]compiledRateLimit]
+
+func compileRateLimits(rules []rateLimitRule) []compiledRateLimit {
+	out := make([]compiledRateLimit, 0, len(rules))
+	for i, r := range rules {
+		prefix := strconv.Itoa(i) + ":"
+		window := time.Duration(r.Window)
+		out = append(out, compiledRateLimit{
+			rule: r,
+			handler: limiter.New(limiter.Config{
+				Max:        r.Max,
+				Expiration: window,
+				KeyGenerator: func(c *fiber.Ctx) string {
+					return prefix + rateLimitKey(c)
+				},
+				LimitReached: func(c *fiber.Ctx) error {
+					c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(window.Seconds())))
+					return newProblem(fiber.StatusTooManyRequests, problemRateLimited,
+						fmt.Sprintf("Rate limit of %d requests per %s exceeded", r.Max, window))
+				},
+			}),
+		})
+	}
+	return out
+}
+
+func rateLimitKey(c *fiber.Ctx) string {
+	if claims, err := parseToken(c); err == nil {
+		if sub, ok := claims["sub"].(string); ok && sub != "" {
+			return "sub:" + sub
+		}
+	}
+	return "ip:" + c.IP()
+}
+
+// rateLimit applies the first configured limit matching the request.
+func rateLimit(c *fiber.Ctx) error {
+	limits := currentRateLimits.Load()
+	if limits == nil {
+		return c.Next()
+	}
+	for _, l := range *limits {
+		if l.rule.Matches(c.Method(), c.Path()) {
+			return l.handler(c)
+		}
+	}
+	return c.Next()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maskedSecret is what Keycloak exports in place of client secrets.
+const maskedSecret = "**********"
+
+// adminCall calls the Admin API of the app's realm at path, like
+// keycloakAdmin.
+type adminCall func(ctx context.Context, method, path string, body, out interface{}) error
+
+// realmImportResult is Keycloak's partial import summary.
+type realmImportResult struct {
+	Created     bool `json:"created"`
+	Added       int  `json:"added"`
+	Overwritten int  `json:"overwritten"`
+	Skipped     int  `json:"skipped"`
+	Results     []struct {
+		Action       string `json:"action"`
+		ResourceType string `json:"resourceType"`
+		ResourceName string `json:"resourceName"`
+	} `json:"results"`
+}
+
+// partialImportKeys are the parts of a realm representation that
+// partialImport brings in. The rest is realm settings, applied with PUT.
+var partialImportKeys = []string{"users", "clients", "groups", "roles", "identityProviders"}
+
+// exportRealm returns the realm with its clients, groups and roles, but
+// not its users, as Keycloak's partial export writes it. Client secrets
+// come back masked.
+func exportRealm(ctx context.Context, call adminCall) (map[string]interface{}, error) {
+	var rep map[string]interface{}
+	err := call(ctx, http.MethodPost, "/partial-export?exportClients=true&exportGroupsAndRoles=true", nil, &rep)
+	return rep, err
+}
+
+// importRealm applies rep to the app's realm, so a definition exported
+// from one environment can be promoted to the next: the realm name and id
+// in rep are replaced by the app's. A missing realm is created whole, which
+// needs a master realm administrator. Otherwise the realm settings are
+// updated and users, clients, groups, roles and identity providers are
+// partially imported, with ifExists ("fail", "skip" or "overwrite")
+// deciding what happens to the ones already there. Masked client secrets
+// are dropped, so an overwritten confidential client gets a new secret
+// unless rep carries the real one.
+func importRealm(ctx context.Context, call adminCall, create adminCall, rep map[string]interface{}, ifExists string) (realmImportResult, error) {
+	var result realmImportResult
+	_, realm := keycloakRealmURL()
+	delete(rep, "id")
+	rep["realm"] = realm
+	if clients, ok := rep["clients"].([]interface{}); ok {
+		for _, c := range clients {
+			if client, ok := c.(map[string]interface{}); ok && client["secret"] == maskedSecret {
+				delete(client, "secret")
+			}
+		}
+	}
+
+	err := call(ctx, http.MethodGet, "", nil, nil)
+	if keycloakAdminStatus(err) == http.StatusNotFound {
+		if err := create(ctx, http.MethodPost, "", rep, nil); err != nil {
+			return result, err
+		}
+		result.Created = true
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	settings := make(map[string]interface{}, len(rep))
+	for k, v := range rep {
+		settings[k] = v
+	}
+	partial := map[string]interface{}{"ifResourceExists": map[string]string{
+		"fail": "FAIL", "skip": "SKIP", "overwrite": "OVERWRITE",
+	}[ifExists]}
+	for _, k := range partialImportKeys {
+		if v, ok := rep[k]; ok {
+			partial[k] = v
+			delete(settings, k)
+		}
+	}
+	if err := call(ctx, http.MethodPut, "", settings, nil); err != nil {
+		return result, fmt.Errorf("realm settings: %w", err)
+	}
+	if err := call(ctx, http.MethodPost, "/partialImport", partial, &result); err != nil {
+		return result, fmt.Errorf("partial import: %w", err)
+	}
+	return result, nil
+}
+
+// masterAdmin returns an adminCall for the app's realm as the master realm
+// administrator, and one for creating it, when KEYCLOAK_ADMIN_PASSWORD is
+// set.
+func masterAdmin(ctx context.Context) (call, create adminCall, err error) {
+	token, err := keycloakMasterToken(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, realm := keycloakRealmURL()
+	call = func(ctx context.Context, method, path string, body, out interface{}) error {
+		return keycloakAdminAs(ctx, token, method, "/admin/realms/"+realm+path, body, out)
+	}
+	create = func(ctx context.Context, method, _ string, body, out interface{}) error {
+		return keycloakAdminAs(ctx, token, method, "/admin/realms", body, out)
+	}
+	return call, create, nil
+}
+
+// serviceAccountCreate refuses to create a realm, which the service
+// account of a realm cannot do.
+func serviceAccountCreate(context.Context, string, string, interface{}, interface{}) error {
+	_, realm := keycloakRealmURL()
+	return fmt.Errorf("realm %q does not exist; creating it needs KEYCLOAK_ADMIN_PASSWORD", realm)
+}
+
+// registerRealmRoutes adds the realm export and import endpoints. They go
+// through the app's service account, which needs the realm-management
+// roles view-realm and manage-realm (plus manage-clients and manage-users
+// to import those).
+func registerRealmRoutes(r fiber.Router) {
+	r.Get("/realm", getRealm)
+	r.Put("/realm", putRealm)
+}
+
+func getRealm(c *fiber.Ctx) error {
+	rep, err := exportRealm(c.UserContext(), keycloakAdmin)
+	if err != nil {
+		return newProblem(fiber.StatusBadGateway, problemAboutBlank, "Realm export failed: "+err.Error())
+	}
+	_, realm := keycloakRealmURL()
+	recordAudit(c, "realm.export", realm, nil)
+	c.Attachment("realm-" + realm + ".json")
+	return c.JSON(rep)
+}
+
+type realmImportQuery struct {
+	IfExists string `query:"ifExists" validate:"omitempty,oneof=fail skip overwrite"`
+}
+
+func putRealm(c *fiber.Ctx) error {
+	var q realmImportQuery
+	if err := bindQuery(c, &q); err != nil {
+		return err
+	}
+	if q.IfExists == "" {
+		q.IfExists = "skip"
+	}
+	var rep map[string]interface{}
+	if err := json.Unmarshal(c.Body(), &rep); err != nil || rep == nil {
+		return errValidation([]fieldError{{Field: "body", Rule: "json", Message: "must be a realm representation (JSON object)"}})
+	}
+	result, err := importRealm(c.UserContext(), keycloakAdmin, serviceAccountCreate, rep, q.IfExists)
+	if err != nil {
+		return newProblem(fiber.StatusBadGateway, problemAboutBlank, "Realm import failed: "+err.Error())
+	}
+	_, realm := keycloakRealmURL()
+	recordAudit(c, "realm.import", realm, bson.M{
+		"ifExists": q.IfExists, "created": result.Created,
+		"added": result.Added, "overwritten": result.Overwritten, "skipped": result.Skipped,
+	})
+	return c.JSON(result)
+}
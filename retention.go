@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const settingsCollection = "settings"
+
+// retentionPolicy expires the documents of a collection once their Field
+// timestamp is older than the retention, using a TTL index.
+type retentionPolicy struct {
+	Collection string
+	Field      string
+	// Env sets the retention when it hasn't been changed at runtime.
+	Env     string
+	Default time.Duration
+}
+
+var retentionPolicies = []retentionPolicy{
+	{Collection: auditCollection, Field: "time", Env: "AUDIT_RETENTION", Default: 90 * 24 * time.Hour},
+	{Collection: idempotencyCollection, Field: "createdAt", Env: "IDEMPOTENCY_TTL", Default: 24 * time.Hour},
+	{Collection: deletedItemsCollection, Field: "deletedAt", Env: "DELETED_ITEMS_RETENTION", Default: 30 * 24 * time.Hour},
+	// Counted from the end of the quota period.
+	{Collection: quotaUsageCollection, Field: "resetAt", Env: "QUOTA_USAGE_RETENTION", Default: 90 * 24 * time.Hour},
+	// Only published entries have the timestamp, so pending ones stay.
+	{Collection: outboxCollection, Field: "publishedAt", Env: "EVENTS_OUTBOX_RETENTION", Default: 24 * time.Hour},
+	{Collection: webhookDeliveriesCollection, Field: "at", Env: "WEBHOOK_DELIVERY_RETENTION", Default: 7 * 24 * time.Hour},
+}
+
+// retentionSettings is the settings document holding retentions changed
+// through /admin/retention, which take precedence over the environment.
+type retentionSettings struct {
+	ID       string              `bson:"_id"`
+	Policies map[string]duration `bson:"policies"`
+}
+
+var retention struct {
+	sync.Mutex
+	current map[string]time.Duration
+}
+
+func findRetentionPolicy(coll string) (retentionPolicy, bool) {
+	for _, p := range retentionPolicies {
+		if p.Collection == coll {
+			return p, true
+		}
+	}
+	return retentionPolicy{}, false
+}
+
+// retentionFor returns the retention in force for coll.
+func retentionFor(coll string) time.Duration {
+	retention.Lock()
+	d, ok := retention.current[coll]
+	retention.Unlock()
+	if ok {
+		return d
+	}
+	p, _ := findRetentionPolicy(coll)
+	return p.envRetention()
+}
+
+func (p retentionPolicy) envRetention() time.Duration {
+	d, err := time.ParseDuration(getEnv(p.Env, ""))
+	if err != nil || d <= 0 {
+		return p.Default
+	}
+	return d
+}
+
+// ensureRetention creates or adjusts the TTL index of every policy. It runs
+// at startup with the other indexes.
+func ensureRetention(ctx context.Context) error {
+	var stored retentionSettings
+	err := db().Collection(settingsCollection).FindOne(ctx, bson.M{"_id": "retention"}).Decode(&stored)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("retention settings: %w", err)
+	}
+	current := map[string]time.Duration{}
+	for _, p := range retentionPolicies {
+		d := p.envRetention()
+		if v, ok := stored.Policies[p.Collection]; ok {
+			d = time.Duration(v)
+		}
+		if err := applyRetention(ctx, p, d); err != nil {
+			return err
+		}
+		current[p.Collection] = d
+	}
+	retention.Lock()
+	retention.current = current
+	retention.Unlock()
+	return nil
+}
+
+// applyRetention makes the TTL index of p expire documents after d. A TTL
+// index that already exists with another expiry is changed in place with
+// collMod.
+func applyRetention(ctx context.Context, p retentionPolicy, d time.Duration) error {
+	secs := int32(d / time.Second)
+	name := p.Field + "_ttl"
+	model := mongo.IndexModel{
+		Keys:    bson.D{{Key: p.Field, Value: 1}},
+		Options: options.Index().SetName(name).SetExpireAfterSeconds(secs),
+	}
+	_, err := db().Collection(p.Collection).Indexes().CreateOne(ctx, model)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Name == "IndexOptionsConflict" || cmdErr.Code == 85) {
+		err = db().RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: p.Collection},
+			{Key: "index", Value: bson.D{{Key: "name", Value: name}, {Key: "expireAfterSeconds", Value: secs}}},
+		}).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("retention on %s: %w", p.Collection, err)
+	}
+	return nil
+}
+
+func registerRetentionRoutes(r fiber.Router) {
+	r.Get("/retention", listRetention)
+	r.Put("/retention/:collection", putRetention)
+}
+
+func listRetention(c *fiber.Ctx) error {
+	out := make([]fiber.Map, 0, len(retentionPolicies))
+	for _, p := range retentionPolicies {
+		out = append(out, fiber.Map{
+			"collection": p.Collection,
+			"field":      p.Field,
+			"retention":  retentionFor(p.Collection).String(),
+		})
+	}
+	return c.JSON(fiber.Map{"policies": out})
+}
+
+// retentionRequest is the body of PUT /admin/retention/:collection.
+type retentionRequest struct {
+	Retention duration `json:"retention" validate:"required"`
+}
+
+// putRetention changes a collection's retention. The TTL index is
+// updated right away and the value is stored so it survives restarts.
+func putRetention(c *fiber.Ctx) error {
+	p, ok := findRetentionPolicy(c.Params("collection"))
+	if !ok {
+		return newProblem(fiber.StatusNotFound, problemAboutBlank, "No retention policy for this collection")
+	}
+	var req retentionRequest
+	if err := bindBody(c, &req); err != nil {
+		return err
+	}
+	d := time.Duration(req.Retention)
+	if d < time.Minute {
+		return errValidation([]fieldError{{Field: "retention", Rule: "min", Message: "must be at least 1m"}})
+	}
+	ctx := context.Background()
+	if err := applyRetention(ctx, p, d); err != nil {
+		return errDatabase(err)
+	}
+	_, err := db().Collection(settingsCollection).UpdateByID(ctx, "retention",
+		bson.M{"$set": bson.M{"policies." + p.Collection: req.Retention}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return errDatabase(err)
+	}
+	retention.Lock()
+	if retention.current == nil {
+		retention.current = map[string]time.Duration{}
+	}
+	retention.current[p.Collection] = d
+	retention.Unlock()
+	log.Printf("Retention of %s set to %s by %s", p.Collection, d, subject(c))
+	recordAudit(c, "retention.set", p.Collection, bson.M{"retention": d.String()})
+	return c.JSON(fiber.Map{"collection": p.Collection, "field": p.Field, "retention": d.String()})
+}
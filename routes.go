@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+)
+
+// registerRoutes adds the API endpoints to a version group. Handlers that
+// changed shape between versions switch on currentVersion.
+func registerRoutes(r fiber.Router) {
+	// Public route (no auth)
+	r.Get("/public", publicHandler).
+		Name(documented("public", routeDoc{Summary: "Public endpoint"}))
+
+	// Feature flags as they apply to the caller
+	r.Get("/flags", myFlags).
+		Name(documented("flags", routeDoc{Summary: "Feature flags evaluated for the calling user", Auth: true}))
+
+	// Protected route: any authenticated user
+	r.Get("/profile", profileHandler).
+		Name(documented("profile", routeDoc{Summary: "Claims of the calling user", Auth: true}))
+
+	// Token claims, Keycloak userinfo and the app's profile in one response
+	r.Get("/me", meHandler).
+		Name(documented("me", routeDoc{Summary: "Complete context of the calling user", Auth: true}))
+	r.Put("/me/profile", putMyProfile).
+		Name(documented("putMyProfile", routeDoc{Summary: "Replace the calling user's profile", Auth: true}))
+
+	// Sibling services called on the caller's behalf (UPSTREAM_ROUTES)
+	r.Get("/upstream/:service/*", relayUpstream).
+		Name(documented("upstream", routeDoc{Summary: "Relay a request to a sibling service", Auth: true}))
+
+	// Protected route: only users with realm role "user"
+	r.Get("/user", requireRole("user"), userHandler).
+		Name(documented("user", routeDoc{Summary: "User-level endpoint", Roles: []string{"user"}}))
+
+	// Protected route: only users with realm role "admin"
+	r.Get("/admin", requireRole("admin"), adminHandler).
+		Name(documented("admin", routeDoc{Summary: "Admin-level endpoint with item count", Roles: []string{"admin"}}))
+
+	// Item CRUD
+	registerItemRoutes(r)
+}
+
+func publicHandler(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"message": "This is a public endpoint."})
+}
+
+func profileHandler(c *fiber.Ctx) error {
+	claims, err := parseToken(c)
+	if err != nil {
+		return errUnauthorized(err.Error())
+	}
+	username, _ := claims["preferred_username"].(string)
+	// Service accounts are named by their client rather than a username.
+	clientID := policy.ServiceClientID(claims)
+
+	if currentVersion(c) == "v1" {
+		out := fiber.Map{
+			"message":  fmt.Sprintf("Hello, %v", username),
+			"roles":    claims["roles"],
+			"subject":  claims["sub"],
+			"issuedAt": claims["iat"],
+		}
+		if clientID != "" {
+			out["message"] = "Hello, " + clientID
+			out["clientId"] = clientID
+		}
+		if imp := impersonatorOf(claims); imp != nil {
+			out["actingAs"] = username
+			out["impersonator"] = imp
+		}
+		return c.JSON(out)
+	}
+
+	// v2 resolves roles from either claim layout and names the user explicitly.
+	roles, _ := requestRoles(c)
+	if roles == nil {
+		roles = []string{}
+	}
+	out := fiber.Map{
+		"caller":   policy.CallerKind(claims),
+		"subject":  claims["sub"],
+		"roles":    roles,
+		"issuedAt": claims["iat"],
+	}
+	if clientID != "" {
+		out["clientId"] = clientID
+	} else {
+		out["username"] = username
+	}
+	// An admin impersonating this user sees whose session they are in.
+	if imp := impersonatorOf(claims); imp != nil {
+		out["actingAs"] = username
+		out["impersonator"] = imp
+	}
+	return c.JSON(out)
+}
+
+func userHandler(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"message": "Hello, user-level endpoint!"})
+}
+
+func adminHandler(c *fiber.Ctx) error {
+	count, err := itemDB.Count(c.UserContext())
+	if err != nil {
+		return errDatabase(err)
+	}
+	return c.JSON(fiber.Map{
+		"message":     "Hello, admin-level endpoint!",
+		"itemCountDB": count,
+	})
+}
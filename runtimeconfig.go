@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/example/fiber-demo/pkg/policy"
+)
+
+// runtimeConfig holds the settings that can change without a restart. It
+// is read from RUNTIME_CONFIG_FILE; anything not set there keeps its
+// environment-variable value. Listener settings and the token issuer are
+// deliberately absent: they are fixed for the life of the process.
+type runtimeConfig struct {
+	LogLevel string `json:"logLevel,omitempty"`
+	// CORSOrigins overrides the allowed origins per route group ("api",
+	// "docs").
+	CORSOrigins map[string][]string `json:"corsOrigins,omitempty"`
+	RateLimits  []rateLimitRule     `json:"rateLimits,omitempty"`
+	// Concurrency limits are checked in order; the first that matches
+	// applies.
+	Concurrency []concurrencyRule `json:"concurrency,omitempty"`
+	// Timeouts override REQUEST_TIMEOUT; the first that matches applies.
+	Timeouts []timeoutRule `json:"timeouts,omitempty"`
+	// CacheControl sets the caching headers of anonymous responses; the
+	// first that matches applies.
+	CacheControl []cacheControlRule `json:"cacheControl,omitempty"`
+	// Quotas are checked in order; the first that applies counts.
+	Quotas []quotaRule `json:"quotas,omitempty"`
+	// Claims configures the built-in claims transformers.
+	Claims *keycloakauth.ClaimsConfig `json:"claims,omitempty"`
+}
+
+// immutableSettings are rejected in the runtime config with a hint to
+// restart instead.
+var immutableSettings = []string{"port", "issuer", "keycloakIssuer", "tls"}
+
+var currentRuntime atomic.Pointer[runtimeConfig]
+
+func loadRuntimeConfig(path string) (*runtimeConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, k := range immutableSettings {
+		if _, ok := raw[k]; ok {
+			return nil, fmt.Errorf("%s: %q is fixed at startup; restart the service to change it", path, k)
+		}
+	}
+
+	var cfg runtimeConfig
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if cfg.LogLevel != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+			return nil, fmt.Errorf("%s: logLevel: %w", path, err)
+		}
+	}
+	for group, origins := range cfg.CORSOrigins {
+		if err := validateCORSOrigins(group, origins); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for i, r := range cfg.RateLimits {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%s: rate limit %d: %w", path, i, err)
+		}
+	}
+	for i, r := range cfg.Concurrency {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%s: concurrency limit %d: %w", path, i, err)
+		}
+	}
+	for i, r := range cfg.Timeouts {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%s: timeout %d: %w", path, i, err)
+		}
+	}
+	for i, r := range cfg.CacheControl {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%s: cacheControl %d: %w", path, i, err)
+		}
+	}
+	for i := range cfg.Quotas {
+		if err := cfg.Quotas[i].validate(); err != nil {
+			return nil, fmt.Errorf("%s: quota %d: %w", path, i, err)
+		}
+	}
+	if cfg.Claims != nil {
+		if err := cfg.Claims.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: claims: %w", path, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// applyRuntimeConfig swaps in cfg. In-flight requests finish with the
+// values they started with.
+func applyRuntimeConfig(cfg *runtimeConfig) {
+	level := getEnv("LOG_LEVEL", "info")
+	if cfg.LogLevel != "" {
+		level = cfg.LogLevel
+	}
+	if err := setLogLevel(level); err != nil {
+		log.Println("Ignoring log level:", err)
+	}
+	limits := compileRateLimits(cfg.RateLimits)
+	currentRateLimits.Store(&limits)
+	concurrency := compileConcurrency(cfg.Concurrency)
+	currentConcurrency.Store(&concurrency)
+	timeouts := cfg.Timeouts
+	currentTimeouts.Store(&timeouts)
+	cacheControl := cfg.CacheControl
+	currentCacheControl.Store(&cacheControl)
+	currentRuntime.Store(cfg)
+}
+
+var reloadMu sync.Mutex
+
+// reloadRuntime re-reads POLICY_FILE and RUNTIME_CONFIG_FILE. A file that
+// fails to load leaves the previously applied version in place.
+func reloadRuntime() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	var errs []error
+	if path := os.Getenv("POLICY_FILE"); path != "" {
+		if p, err := policy.Load(path); err != nil {
+			errs = append(errs, err)
+		} else {
+			currentPolicy.Store(p)
+			log.Printf("Loaded %d policy rules from %s", len(p.Rules), path)
+		}
+	}
+
+	if path := os.Getenv("RUNTIME_CONFIG_FILE"); path != "" {
+		if cfg, err := loadRuntimeConfig(path); err != nil {
+			errs = append(errs, err)
+		} else {
+			applyRuntimeConfig(cfg)
+			log.Println("Loaded runtime config from", path)
+		}
+	} else {
+		applyRuntimeConfig(&runtimeConfig{})
+	}
+	return errors.Join(errs...)
+}
+
+// initRuntimeConfig loads the reloadable settings, failing hard if they
+// are invalid at startup, and reloads them on SIGHUP and whenever either
+// file changes on disk, checked every CONFIG_WATCH_INTERVAL (default 10s,
+// "0" disables watching).
+func initRuntimeConfig() {
+	if err := reloadRuntime(); err != nil {
+		log.Fatal("Runtime config error: ", err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("SIGHUP received, reloading runtime configuration")
+			logReload(reloadRuntime())
+		}
+	}()
+
+	interval := 10 * time.Second
+	if v := os.Getenv("CONFIG_WATCH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Println("Ignoring CONFIG_WATCH_INTERVAL:", err)
+		} else {
+			interval = d
+		}
+	}
+	if interval > 0 {
+		go watchRuntimeFiles(interval)
+	}
+}
+
+func logReload(err error) {
+	if err != nil {
+		log.Println("Reload failed, keeping previous settings:", err)
+	}
+}
+
+func watchRuntimeFiles(interval time.Duration) {
+	var files []string
+	for _, k := range []string{"POLICY_FILE", "RUNTIME_CONFIG_FILE"} {
+		if v := os.Getenv(k); v != "" {
+			files = append(files, v)
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+	stamp := func() string {
+		var sb strings.Builder
+		for _, f := range files {
+			if fi, err := os.Stat(f); err == nil {
+				fmt.Fprintf(&sb, "%s:%d:%d;", f, fi.ModTime().UnixNano(), fi.Size())
+			}
+		}
+		return sb.String()
+	}
+	last := stamp()
+	for range time.Tick(interval) {
+		if s := stamp(); s != last {
+			last = s
+			log.Println("Runtime configuration changed on disk, reloading")
+			logReload(reloadRuntime())
+		}
+	}
+}
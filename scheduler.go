@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scheduledTask is a recurring maintenance task run in-process. Runs of
+// the same task never overlap; a run still going when the next one is due
+// simply delays it.
+type scheduledTask struct {
+	name    string
+	run     func(ctx context.Context) error
+	trigger chan struct{}
+
+	mu           sync.Mutex
+	enabled      bool
+	interval     time.Duration
+	running      bool
+	runs         int
+	failures     int
+	lastStart    time.Time
+	lastDuration time.Duration
+	lastError    string
+	nextRun      time.Time
+}
+
+// taskStatus is the view of a task served at /ops/schedule.
+type taskStatus struct {
+	Name         string     `json:"name"`
+	Enabled      bool       `json:"enabled"`
+	Interval     string     `json:"interval"`
+	Running      bool       `json:"running"`
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"`
+	LastRun      *time.Time `json:"lastRun,omitempty"`
+	LastDuration string     `json:"lastDuration,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+	NextRun      *time.Time `json:"nextRun,omitempty"`
+}
+
+func (t *scheduledTask) status() taskStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := taskStatus{
+		Name:      t.name,
+		Enabled:   t.enabled,
+		Interval:  t.interval.String(),
+		Running:   t.running,
+		Runs:      t.runs,
+		Failures:  t.failures,
+		LastError: t.lastError,
+	}
+	if !t.lastStart.IsZero() {
+		last := t.lastStart
+		s.LastRun, s.LastDuration = &last, t.lastDuration.String()
+	}
+	if t.enabled && !t.nextRun.IsZero() {
+		next := t.nextRun
+		s.NextRun = &next
+	}
+	return s
+}
+
+func (t *scheduledTask) execute() {
+	t.mu.Lock()
+	t.running, t.lastStart = true, time.Now()
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.interval)
+	err := t.run(ctx)
+	cancel()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running = false
+	t.runs++
+	t.lastDuration = time.Since(t.lastStart)
+	t.lastError = ""
+	if err != nil {
+		t.failures++
+		t.lastError = err.Error()
+		log.Printf("Scheduled task %s failed: %v", t.name, err)
+	}
+}
+
+// loop runs the task right away and then every interval, or sooner when
+// triggered from /ops.
+func (t *scheduledTask) loop() {
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+		case <-t.trigger:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		t.execute()
+		t.mu.Lock()
+		t.nextRun = time.Now().Add(t.interval)
+		t.mu.Unlock()
+		timer.Reset(t.interval)
+	}
+}
+
+// scheduledTasks lists every maintenance task, in status order.
+var scheduledTasks = []*scheduledTask{
+	{name: "denylist-purge", interval: time.Hour, run: purgeDenylist},
+	{name: "audit-compact", interval: 24 * time.Hour, run: compactAudit},
+	{name: "keycloak-roles", interval: 15 * time.Minute, run: refreshRealmRoles},
+	{name: "kong-sync", interval: 5 * time.Minute, run: syncKongConsumer},
+}
+
+func findTask(name string) *scheduledTask {
+	for _, t := range scheduledTasks {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// taskEnv turns "kong-sync" into "SCHEDULE_KONG_SYNC".
+func taskEnv(name string) string {
+	return "SCHEDULE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// initScheduler starts the maintenance tasks unless SCHEDULER_ENABLED is
+// false. Each task is switched with SCHEDULE_<NAME>_ENABLED and paced with
+// SCHEDULE_<NAME>_INTERVAL. The Keycloak and Kong tasks default to
+// enabled only when their credentials or Admin URL are configured.
+func initScheduler() {
+	if !getEnvBool("SCHEDULER_ENABLED", true) {
+		log.Println("Scheduler disabled")
+		return
+	}
+	defaults := map[string]bool{
+		"keycloak-roles": keycloakClientSecret() != "",
+		"kong-sync":      os.Getenv("KONG_ADMIN_URL") != "",
+	}
+	if err := initKongClient(); err != nil {
+		log.Fatal("Kong client: ", err)
+	}
+	for _, t := range scheduledTasks {
+		env := taskEnv(t.name)
+		if v := os.Getenv(env + "_INTERVAL"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				log.Fatalf("%s_INTERVAL: invalid duration %q", env, v)
+			}
+			t.interval = d
+		}
+		enabled, ok := defaults[t.name]
+		if !ok {
+			enabled = true
+		}
+		t.enabled = getEnvBool(env+"_ENABLED", enabled)
+		t.trigger = make(chan struct{}, 1)
+		if t.enabled {
+			go t.loop()
+		}
+	}
+}
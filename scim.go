@@ -0,0 +1,771 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// SCIM 2.0 (RFC 7643, RFC 7644) lets a corporate identity provider such
+// as Okta or Azure AD provision users and groups into the app's realm.
+// Each operation is translated into Admin API calls, so Keycloak stays the
+// source of truth; the users collection mirrors the result.
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimContentType = "application/scim+json"
+
+	// Keycloak attributes holding SCIM fields it has no place for.
+	scimExternalIDAttr  = "scimExternalId"
+	scimDisplayNameAttr = "scimDisplayName"
+
+	scimMaxResults = 200
+)
+
+// scimError is an error response in the SCIM format (RFC 7644 3.12).
+type scimError struct {
+	status           int
+	scimType, detail string
+}
+
+func newSCIMError(status int, scimType, detail string) *scimError {
+	return &scimError{status: status, scimType: scimType, detail: detail}
+}
+
+func (e *scimError) Error() string {
+	return e.detail
+}
+
+// scimErrors turns the errors of the SCIM handlers into SCIM error
+// responses, which provisioning clients expect instead of problem
+// documents.
+func scimErrors(c *fiber.Ctx) error {
+	err := c.Next()
+	if err == nil {
+		return nil
+	}
+	e := toSCIMError(err)
+	body := fiber.Map{"schemas": []string{scimErrorSchema}, "status": strconv.Itoa(e.status), "detail": e.detail}
+	if e.scimType != "" {
+		body["scimType"] = e.scimType
+	}
+	return c.Status(e.status).JSON(body, scimContentType)
+}
+
+func toSCIMError(err error) *scimError {
+	var se *scimError
+	var p *problem
+	var fe *fiber.Error
+	switch {
+	case errors.As(err, &se):
+		return se
+	case errors.As(err, &p):
+		if p.Status != fiber.StatusBadRequest && p.Status != fiber.StatusUnprocessableEntity {
+			return newSCIMError(p.Status, "", p.Error())
+		}
+		// SCIM reports invalid input as 400 invalidValue.
+		detail := p.Error()
+		for _, fe := range p.Errors {
+			detail += "; " + fe.Field + " " + fe.Message
+		}
+		return newSCIMError(fiber.StatusBadRequest, "invalidValue", detail)
+	case errors.As(err, &fe):
+		return newSCIMError(fe.Code, "", fe.Message)
+	}
+	switch keycloakAdminStatus(err) {
+	case http.StatusNotFound:
+		return newSCIMError(http.StatusNotFound, "", "Resource not found")
+	case http.StatusConflict:
+		return newSCIMError(http.StatusConflict, "uniqueness", "A resource with that name already exists")
+	case http.StatusBadRequest:
+		return newSCIMError(http.StatusBadRequest, "invalidValue", err.Error())
+	}
+	return newSCIMError(http.StatusBadGateway, "", "Keycloak request failed: "+err.Error())
+}
+
+// scimAuth accepts the bearer token in SCIM_TOKEN, which is what the
+// identity providers' provisioning connectors are configured with.
+func scimAuth(c *fiber.Ctx) error {
+	want := secrets.Get("SCIM_TOKEN", "")
+	got, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if want == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="scim"`)
+		return newSCIMError(fiber.StatusUnauthorized, "", "Invalid SCIM token")
+	}
+	// The audit log attributes provisioning changes to "scim".
+	c.Locals("claims", jwt.MapClaims{"sub": "scim"})
+	return c.Next()
+}
+
+// mountSCIM adds the SCIM endpoints under /scim/v2 when SCIM_TOKEN is
+// set. The app's service account needs the realm-management roles
+// manage-users, view-users and query-groups.
+func mountSCIM(app *fiber.App) {
+	if secrets.Get("SCIM_TOKEN", "") == "" {
+		return
+	}
+	scim := app.Group("/scim/v2", scimErrors, scimAuth)
+	scim.Get("/ServiceProviderConfig", scimServiceProviderConfig)
+	scim.Get("/Users", listSCIMUsers)
+	scim.Post("/Users", createSCIMUser)
+	scim.Get("/Users/:id", getSCIMUser)
+	scim.Put("/Users/:id", replaceSCIMUser)
+	scim.Patch("/Users/:id", patchSCIMUserHandler)
+	scim.Delete("/Users/:id", deleteSCIMUser)
+	scim.Get("/Groups", listSCIMGroups)
+	scim.Post("/Groups", createSCIMGroup)
+	scim.Get("/Groups/:id", getSCIMGroup)
+	scim.Put("/Groups/:id", replaceSCIMGroup)
+	scim.Patch("/Groups/:id", patchSCIMGroupHandler)
+	scim.Delete("/Groups/:id", deleteSCIMGroup)
+}
+
+func scimServiceProviderConfig(c *fiber.Ctx) error {
+	unsupported := fiber.Map{"supported": false}
+	return c.JSON(fiber.Map{
+		"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"patch":          fiber.Map{"supported": true},
+		"filter":         fiber.Map{"supported": true, "maxResults": scimMaxResults},
+		"bulk":           fiber.Map{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"changePassword": unsupported,
+		"sort":           unsupported,
+		"etag":           unsupported,
+		"authenticationSchemes": []fiber.Map{{
+			"type": "oauthbearertoken", "name": "Bearer token", "description": "The token in SCIM_TOKEN",
+		}},
+	}, scimContentType)
+}
+
+// scimName, scimMultiValue and scimMeta are the complex attributes of the
+// User and Group resources.
+type scimName struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	Formatted  string `json:"formatted,omitempty"`
+}
+
+type scimMultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	Location     string     `json:"location,omitempty"`
+}
+
+// scimUser is the SCIM User resource. Groups are read-only.
+type scimUser struct {
+	Schemas     []string         `json:"schemas"`
+	ID          string           `json:"id,omitempty"`
+	ExternalID  string           `json:"externalId,omitempty"`
+	UserName    string           `json:"userName" validate:"required,max=255"`
+	Name        *scimName        `json:"name,omitempty"`
+	DisplayName string           `json:"displayName,omitempty"`
+	Emails      []scimMultiValue `json:"emails,omitempty"`
+	Active      *scimBool        `json:"active,omitempty"`
+	Groups      []scimMultiValue `json:"groups,omitempty"`
+	Meta        *scimMeta        `json:"meta,omitempty"`
+}
+
+// scimGroup is the SCIM Group resource.
+type scimGroup struct {
+	Schemas     []string         `json:"schemas"`
+	ID          string           `json:"id,omitempty"`
+	ExternalID  string           `json:"externalId,omitempty"`
+	DisplayName string           `json:"displayName" validate:"required,max=255"`
+	Members     []scimMultiValue `json:"members,omitempty"`
+	Meta        *scimMeta        `json:"meta,omitempty"`
+}
+
+// kcUser and kcGroup are the Admin API representations.
+type kcUser struct {
+	ID               string              `json:"id,omitempty"`
+	Username         string              `json:"username"`
+	Enabled          bool                `json:"enabled"`
+	Email            string              `json:"email,omitempty"`
+	FirstName        string              `json:"firstName,omitempty"`
+	LastName         string              `json:"lastName,omitempty"`
+	Attributes       map[string][]string `json:"attributes,omitempty"`
+	CreatedTimestamp int64               `json:"createdTimestamp,omitempty"`
+}
+
+type kcGroup struct {
+	ID         string              `json:"id,omitempty"`
+	Name       string              `json:"name"`
+	Attributes map[string][]string `json:"attributes,omitempty"`
+}
+
+func firstAttr(attrs map[string][]string, name string) string {
+	if v := attrs[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// setAttr sets or, when value is empty, removes one attribute, keeping
+// the others Keycloak holds.
+func setAttr(attrs *map[string][]string, name, value string) {
+	if *attrs == nil {
+		*attrs = map[string][]string{}
+	}
+	if value == "" {
+		delete(*attrs, name)
+		return
+	}
+	(*attrs)[name] = []string{value}
+}
+
+// scimBase is the URL the resource locations are relative to.
+func scimBase(c *fiber.Ctx) string {
+	return c.BaseURL() + "/scim/v2"
+}
+
+func (u kcUser) scim(base string, groups []kcGroup) scimUser {
+	active := scimBool(u.Enabled)
+	out := scimUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          u.ID,
+		ExternalID:  firstAttr(u.Attributes, scimExternalIDAttr),
+		UserName:    u.Username,
+		DisplayName: firstAttr(u.Attributes, scimDisplayNameAttr),
+		Active:      &active,
+		Meta:        &scimMeta{ResourceType: "User", Location: base + "/Users/" + u.ID},
+	}
+	if u.FirstName != "" || u.LastName != "" {
+		out.Name = &scimName{GivenName: u.FirstName, FamilyName: u.LastName, Formatted: strings.TrimSpace(u.FirstName + " " + u.LastName)}
+	}
+	if u.Email != "" {
+		out.Emails = []scimMultiValue{{Value: u.Email, Type: "work", Primary: true}}
+	}
+	if u.CreatedTimestamp > 0 {
+		t := time.UnixMilli(u.CreatedTimestamp).UTC()
+		out.Meta.Created = &t
+	}
+	for _, g := range groups {
+		out.Groups = append(out.Groups, scimMultiValue{Value: g.ID, Display: g.Name, Ref: base + "/Groups/" + g.ID})
+	}
+	return out
+}
+
+// applyTo copies s onto u, as a replacement: attributes s leaves out are
+// cleared, and an omitted active means enabled.
+func (s scimUser) applyTo(u *kcUser) {
+	u.Username = s.UserName
+	u.Enabled = s.Active == nil || bool(*s.Active)
+	u.FirstName, u.LastName = "", ""
+	if s.Name != nil {
+		u.FirstName, u.LastName = s.Name.GivenName, s.Name.FamilyName
+	}
+	u.Email = ""
+	for i, e := range s.Emails {
+		if e.Primary || i == 0 {
+			u.Email = e.Value
+		}
+		if e.Primary {
+			break
+		}
+	}
+	setAttr(&u.Attributes, scimExternalIDAttr, s.ExternalID)
+	setAttr(&u.Attributes, scimDisplayNameAttr, s.DisplayName)
+}
+
+// scimPage reads startIndex (1-based) and count.
+func scimPage(c *fiber.Ctx) (start, count int) {
+	start, count = c.QueryInt("startIndex", 1), c.QueryInt("count", 100)
+	if start < 1 {
+		start = 1
+	}
+	return start, max(0, min(count, scimMaxResults))
+}
+
+func scimList(c *fiber.Ctx, total, start int, resources interface{}, n int) error {
+	return c.JSON(fiber.Map{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   start,
+		"itemsPerPage": n,
+		"Resources":    resources,
+	}, scimContentType)
+}
+
+// fetchUser returns the user, with its groups when withGroups is set.
+func fetchUser(ctx context.Context, id string, withGroups bool) (kcUser, []kcGroup, error) {
+	var u kcUser
+	if err := keycloakAdmin(ctx, http.MethodGet, "/users/"+url.PathEscape(id), nil, &u); err != nil {
+		return u, nil, err
+	}
+	var groups []kcGroup
+	if withGroups {
+		if err := keycloakAdmin(ctx, http.MethodGet, "/users/"+url.PathEscape(id)+"/groups", nil, &groups); err != nil {
+			return u, nil, err
+		}
+	}
+	return u, groups, nil
+}
+
+func listSCIMUsers(c *fiber.Ctx) error {
+	start, count := scimPage(c)
+	attr, value, err := parseSCIMFilter(c.Query("filter"))
+	if err != nil {
+		return err
+	}
+	q := url.Values{"first": {strconv.Itoa(start - 1)}, "max": {strconv.Itoa(count)}, "briefRepresentation": {"false"}}
+	switch attr {
+	case "":
+	case "username":
+		q.Set("username", value)
+		q.Set("exact", "true")
+	case "emails", "emails.value":
+		q.Set("email", value)
+		q.Set("exact", "true")
+	case "externalid":
+		q.Set("q", scimExternalIDAttr+":"+value)
+	default:
+		return newSCIMError(400, "invalidFilter", "Users can be filtered by userName, externalId or emails.value")
+	}
+	ctx := c.UserContext()
+	var users []kcUser
+	if err := keycloakAdmin(ctx, http.MethodGet, "/users?"+q.Encode(), nil, &users); err != nil {
+		return err
+	}
+	total := start - 1 + len(users)
+	if attr == "" {
+		if err := keycloakAdmin(ctx, http.MethodGet, "/users/count", nil, &total); err != nil {
+			return err
+		}
+	}
+	base := scimBase(c)
+	out := make([]scimUser, 0, len(users))
+	for _, u := range users {
+		// Keycloak's username and email matches ignore case; SCIM's
+		// externalId match doesn't.
+		if attr == "externalid" && firstAttr(u.Attributes, scimExternalIDAttr) != value {
+			continue
+		}
+		out = append(out, u.scim(base, nil))
+	}
+	if attr == "externalid" {
+		total = start - 1 + len(out)
+	}
+	return scimList(c, total, start, out, len(out))
+}
+
+func createSCIMUser(c *fiber.Ctx) error {
+	var in scimUser
+	if err := bindBody(c, &in); err != nil {
+		return err
+	}
+	var u kcUser
+	in.applyTo(&u)
+	ctx := c.UserContext()
+	if err := keycloakAdmin(ctx, http.MethodPost, "/users", u, nil); err != nil {
+		return err
+	}
+	var found []kcUser
+	q := url.Values{"username": {in.UserName}, "exact": {"true"}, "briefRepresentation": {"false"}}
+	if err := keycloakAdmin(ctx, http.MethodGet, "/users?"+q.Encode(), nil, &found); err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("user %q not found after creating it", in.UserName)
+	}
+	cacheUser(ctx, found[0], nil)
+	recordAudit(c, "scim.user.create", found[0].ID, nil)
+	out := found[0].scim(scimBase(c), nil)
+	c.Location(out.Meta.Location)
+	return c.Status(fiber.StatusCreated).JSON(out, scimContentType)
+}
+
+func getSCIMUser(c *fiber.Ctx) error {
+	u, groups, err := fetchUser(c.UserContext(), c.Params("id"), true)
+	if err != nil {
+		return err
+	}
+	return c.JSON(u.scim(scimBase(c), groups), scimContentType)
+}
+
+// updateSCIMUser writes u back and returns the stored user, mirrored in
+// the cache.
+func updateSCIMUser(c *fiber.Ctx, u kcUser, action string) error {
+	ctx := c.UserContext()
+	if err := keycloakAdmin(ctx, http.MethodPut, "/users/"+url.PathEscape(u.ID), u, nil); err != nil {
+		return err
+	}
+	stored, groups, err := fetchUser(ctx, u.ID, true)
+	if err != nil {
+		return err
+	}
+	cacheUser(ctx, stored, groups)
+	recordAudit(c, action, u.ID, nil)
+	return c.JSON(stored.scim(scimBase(c), groups), scimContentType)
+}
+
+func replaceSCIMUser(c *fiber.Ctx) error {
+	var in scimUser
+	if err := bindBody(c, &in); err != nil {
+		return err
+	}
+	u, _, err := fetchUser(c.UserContext(), c.Params("id"), false)
+	if err != nil {
+		return err
+	}
+	in.applyTo(&u)
+	return updateSCIMUser(c, u, "scim.user.replace")
+}
+
+func patchSCIMUserHandler(c *fiber.Ctx) error {
+	var patch scimPatch
+	if err := bindBody(c, &patch); err != nil {
+		return err
+	}
+	u, _, err := fetchUser(c.UserContext(), c.Params("id"), false)
+	if err != nil {
+		return err
+	}
+	s := u.scim("", nil)
+	if err := patchSCIMUser(&s, patch.Operations); err != nil {
+		return err
+	}
+	if s.UserName == "" {
+		return newSCIMError(400, "invalidValue", "userName is required")
+	}
+	s.applyTo(&u)
+	return updateSCIMUser(c, u, "scim.user.patch")
+}
+
+func deleteSCIMUser(c *fiber.Ctx) error {
+	id := c.Params("id")
+	ctx := c.UserContext()
+	if err := keycloakAdmin(ctx, http.MethodDelete, "/users/"+url.PathEscape(id), nil, nil); err != nil {
+		return err
+	}
+	uncacheUser(ctx, id)
+	recordAudit(c, "scim.user.delete", id, nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (g kcGroup) scim(base string, members []kcUser) scimGroup {
+	out := scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          g.ID,
+		ExternalID:  firstAttr(g.Attributes, scimExternalIDAttr),
+		DisplayName: g.Name,
+		Meta:        &scimMeta{ResourceType: "Group", Location: base + "/Groups/" + g.ID},
+	}
+	for _, m := range members {
+		out.Members = append(out.Members, scimMultiValue{Value: m.ID, Display: m.Username, Ref: base + "/Users/" + m.ID})
+	}
+	return out
+}
+
+// groupMembers returns every member of the group, a page at a time.
+func groupMembers(ctx context.Context, id string) ([]kcUser, error) {
+	var all []kcUser
+	for first := 0; ; first += 100 {
+		var page []kcUser
+		path := fmt.Sprintf("/groups/%s/members?briefRepresentation=true&first=%d&max=100", url.PathEscape(id), first)
+		if err := keycloakAdmin(ctx, http.MethodGet, path, nil, &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(page) < 100 {
+			return all, nil
+		}
+	}
+}
+
+// setMembership adds or removes the users' membership of group.
+func setMembership(ctx context.Context, groupID string, userIDs []string, add bool) error {
+	method := http.MethodPut
+	if !add {
+		method = http.MethodDelete
+	}
+	for _, uid := range userIDs {
+		path := "/users/" + url.PathEscape(uid) + "/groups/" + url.PathEscape(groupID)
+		if err := keycloakAdmin(ctx, method, path, nil, nil); err != nil {
+			return err
+		}
+	}
+	cacheMembership(ctx, groupID, userIDs, add)
+	return nil
+}
+
+// syncMembers makes the group's members exactly want.
+func syncMembers(ctx context.Context, groupID string, want []string) error {
+	current, err := groupMembers(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool, len(want))
+	for _, id := range want {
+		keep[id] = true
+	}
+	var remove []string
+	for _, m := range current {
+		if keep[m.ID] {
+			delete(keep, m.ID)
+		} else {
+			remove = append(remove, m.ID)
+		}
+	}
+	var add []string
+	for _, id := range want {
+		if keep[id] {
+			add = append(add, id)
+			delete(keep, id)
+		}
+	}
+	if err := setMembership(ctx, groupID, remove, false); err != nil {
+		return err
+	}
+	return setMembership(ctx, groupID, add, true)
+}
+
+func listSCIMGroups(c *fiber.Ctx) error {
+	start, count := scimPage(c)
+	attr, value, err := parseSCIMFilter(c.Query("filter"))
+	if err != nil {
+		return err
+	}
+	q := url.Values{"first": {strconv.Itoa(start - 1)}, "max": {strconv.Itoa(count)}, "briefRepresentation": {"false"}}
+	switch attr {
+	case "":
+	case "displayname":
+		q.Set("search", value)
+		q.Set("exact", "true")
+	default:
+		return newSCIMError(400, "invalidFilter", "Groups can be filtered by displayName")
+	}
+	ctx := c.UserContext()
+	var groups []kcGroup
+	if err := keycloakAdmin(ctx, http.MethodGet, "/groups?"+q.Encode(), nil, &groups); err != nil {
+		return err
+	}
+	base := scimBase(c)
+	out := make([]scimGroup, 0, len(groups))
+	for _, g := range groups {
+		// Older Keycloak versions ignore exact and match substrings.
+		if attr == "" || g.Name == value {
+			out = append(out, g.scim(base, nil))
+		}
+	}
+	total := start - 1 + len(out)
+	if attr == "" {
+		var n struct{ Count int }
+		if err := keycloakAdmin(ctx, http.MethodGet, "/groups/count?top=true", nil, &n); err != nil {
+			return err
+		}
+		total = n.Count
+	}
+	return scimList(c, total, start, out, len(out))
+}
+
+func getSCIMGroup(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	id := c.Params("id")
+	var g kcGroup
+	if err := keycloakAdmin(ctx, http.MethodGet, "/groups/"+url.PathEscape(id), nil, &g); err != nil {
+		return err
+	}
+	members, err := groupMembers(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(g.scim(scimBase(c), members), scimContentType)
+}
+
+// respondGroup returns the stored group with its members.
+func respondGroup(c *fiber.Ctx, id string, status int) error {
+	ctx := c.UserContext()
+	var g kcGroup
+	if err := keycloakAdmin(ctx, http.MethodGet, "/groups/"+url.PathEscape(id), nil, &g); err != nil {
+		return err
+	}
+	members, err := groupMembers(ctx, id)
+	if err != nil {
+		return err
+	}
+	out := g.scim(scimBase(c), members)
+	if status == fiber.StatusCreated {
+		c.Location(out.Meta.Location)
+	}
+	return c.Status(status).JSON(out, scimContentType)
+}
+
+func scimMemberIDs(members []scimMultiValue) []string {
+	ids := make([]string, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.Value)
+	}
+	return ids
+}
+
+func createSCIMGroup(c *fiber.Ctx) error {
+	var in scimGroup
+	if err := bindBody(c, &in); err != nil {
+		return err
+	}
+	ctx := c.UserContext()
+	g := kcGroup{Name: in.DisplayName}
+	setAttr(&g.Attributes, scimExternalIDAttr, in.ExternalID)
+	if err := keycloakAdmin(ctx, http.MethodPost, "/groups", g, nil); err != nil {
+		return err
+	}
+	var found []kcGroup
+	q := url.Values{"search": {in.DisplayName}, "exact": {"true"}}
+	if err := keycloakAdmin(ctx, http.MethodGet, "/groups?"+q.Encode(), nil, &found); err != nil {
+		return err
+	}
+	for _, f := range found {
+		if f.Name == in.DisplayName {
+			g.ID = f.ID
+		}
+	}
+	if g.ID == "" {
+		return fmt.Errorf("group %q not found after creating it", in.DisplayName)
+	}
+	if err := setMembership(ctx, g.ID, scimMemberIDs(in.Members), true); err != nil {
+		return err
+	}
+	recordAudit(c, "scim.group.create", g.ID, nil)
+	return respondGroup(c, g.ID, fiber.StatusCreated)
+}
+
+// renameGroup updates the group's name and external ID, keeping its other
+// attributes.
+func renameGroup(ctx context.Context, id string, name, externalID *string) error {
+	var g kcGroup
+	if err := keycloakAdmin(ctx, http.MethodGet, "/groups/"+url.PathEscape(id), nil, &g); err != nil {
+		return err
+	}
+	if name != nil {
+		g.Name = *name
+	}
+	if externalID != nil {
+		setAttr(&g.Attributes, scimExternalIDAttr, *externalID)
+	}
+	return keycloakAdmin(ctx, http.MethodPut, "/groups/"+url.PathEscape(id), g, nil)
+}
+
+func replaceSCIMGroup(c *fiber.Ctx) error {
+	var in scimGroup
+	if err := bindBody(c, &in); err != nil {
+		return err
+	}
+	ctx := c.UserContext()
+	id := c.Params("id")
+	if err := renameGroup(ctx, id, &in.DisplayName, &in.ExternalID); err != nil {
+		return err
+	}
+	if err := syncMembers(ctx, id, scimMemberIDs(in.Members)); err != nil {
+		return err
+	}
+	recordAudit(c, "scim.group.replace", id, nil)
+	return respondGroup(c, id, fiber.StatusOK)
+}
+
+// patchSCIMGroupHandler supports what provisioning clients send for
+// groups: renames, and adding, removing or replacing members.
+func patchSCIMGroupHandler(c *fiber.Ctx) error {
+	var patch scimPatch
+	if err := bindBody(c, &patch); err != nil {
+		return err
+	}
+	ctx := c.UserContext()
+	id := c.Params("id")
+	for _, op := range patch.Operations {
+		kind, err := op.kind()
+		if err != nil {
+			return err
+		}
+		path := strings.ToLower(stripSCIMSchema(op.Path))
+		if m := scimMemberPathRe.FindStringSubmatch(op.Path); m != nil {
+			if kind != "remove" {
+				return newSCIMError(400, "invalidPath", "Only remove can address a single member")
+			}
+			if err := setMembership(ctx, id, []string{m[1]}, false); err != nil {
+				return err
+			}
+			continue
+		}
+		switch path {
+		case "members":
+			ids, err := memberIDs(op.Value)
+			if err != nil {
+				return err
+			}
+			switch {
+			case kind == "add":
+				err = setMembership(ctx, id, ids, true)
+			case kind == "replace":
+				err = syncMembers(ctx, id, ids)
+			case len(ids) > 0:
+				err = setMembership(ctx, id, ids, false)
+			default:
+				err = syncMembers(ctx, id, nil)
+			}
+			if err != nil {
+				return err
+			}
+		case "displayname", "externalid", "":
+			var attrs struct {
+				DisplayName *string `json:"displayName"`
+				ExternalID  *string `json:"externalId"`
+			}
+			if path == "" {
+				if err := decodeSCIMValue(op.Value, &attrs); err != nil {
+					return err
+				}
+			} else {
+				var s string
+				if kind != "remove" {
+					if err := decodeSCIMValue(op.Value, &s); err != nil {
+						return err
+					}
+				}
+				if path == "displayname" {
+					if s == "" {
+						return newSCIMError(400, "mutability", "displayName is required")
+					}
+					attrs.DisplayName = &s
+				} else {
+					attrs.ExternalID = &s
+				}
+			}
+			if err := renameGroup(ctx, id, attrs.DisplayName, attrs.ExternalID); err != nil {
+				return err
+			}
+		default:
+			return newSCIMError(400, "invalidPath", "Groups can be patched at displayName, externalId or members")
+		}
+	}
+	recordAudit(c, "scim.group.patch", id, nil)
+	return respondGroup(c, id, fiber.StatusOK)
+}
+
+func deleteSCIMGroup(c *fiber.Ctx) error {
+	id := c.Params("id")
+	ctx := c.UserContext()
+	if err := keycloakAdmin(ctx, http.MethodDelete, "/groups/"+url.PathEscape(id), nil, nil); err != nil {
+		return err
+	}
+	uncacheGroup(ctx, id)
+	recordAudit(c, "scim.group.delete", id, nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// scimFilterRe matches the one filter form provisioning clients send:
+// an attribute compared for equality with a string (RFC 7644 3.4.2.2).
+var scimFilterRe = regexp.MustCompile(`^\s*([A-Za-z][\w.:]*)\s+(?i:eq)\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+// parseSCIMFilter returns the lowercased attribute and value of an
+// equality filter. An empty filter returns empty strings.
+func parseSCIMFilter(filter string) (attr, value string, err error) {
+	if strings.TrimSpace(filter) == "" {
+		return "", "", nil
+	}
+	m := scimFilterRe.FindStringSubmatch(filter)
+	if m == nil {
+		return "", "", newSCIMError(400, "invalidFilter", `Only filters of the form attribute eq "value" are supported`)
+	}
+	value, err = strconv.Unquote(`"` + m[2] + `"`)
+	if err != nil {
+		return "", "", newSCIMError(400, "invalidFilter", "Malformed filter value")
+	}
+	return strings.ToLower(stripSCIMSchema(m[1])), value, nil
+}
+
+// stripSCIMSchema drops a core schema URN prefix from an attribute path,
+// as in "urn:ietf:params:scim:schemas:core:2.0:User:userName".
+func stripSCIMSchema(path string) string {
+	for _, schema := range []string{scimUserSchema, scimGroupSchema} {
+		if len(path) > len(schema) && strings.EqualFold(path[:len(schema)+1], schema+":") {
+			return path[len(schema)+1:]
+		}
+	}
+	return path
+}
+
+// scimPatch is a PATCH request body (RFC 7644 3.5.2).
+type scimPatch struct {
+	Schemas    []string      `json:"schemas"`
+	Operations []scimPatchOp `json:"Operations" validate:"required,min=1,dive"`
+}
+
+type scimPatchOp struct {
+	Op    string          `json:"op" validate:"required"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// kind returns the lowercased operation, as clients differ in case.
+func (op scimPatchOp) kind() (string, error) {
+	switch k := strings.ToLower(op.Op); k {
+	case "add", "replace", "remove":
+		return k, nil
+	default:
+		return "", newSCIMError(400, "invalidSyntax", "Unknown patch op "+strconv.Quote(op.Op))
+	}
+}
+
+// scimUserAttrs maps the lowercased User attributes the app stores to
+// their JSON names. Patches to other attributes are ignored, since
+// clients routinely send ones a service provider doesn't keep.
+var scimUserAttrs = map[string]string{
+	"username":        "userName",
+	"externalid":      "externalId",
+	"displayname":     "displayName",
+	"active":          "active",
+	"name":            "name",
+	"name.givenname":  "name.givenName",
+	"name.familyname": "name.familyName",
+	"name.formatted":  "name.formatted",
+	"emails":          "emails",
+}
+
+// scimEmailPathRe matches value paths into the emails, such as
+// `emails[type eq "work"].value`, which set the user's one email.
+var scimEmailPathRe = regexp.MustCompile(`(?i)^emails\[.*\](\.value)?$`)
+
+// patchSCIMUser applies ops to u.
+func patchSCIMUser(u *scimUser, ops []scimPatchOp) error {
+	doc, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		kind, err := op.kind()
+		if err != nil {
+			return err
+		}
+		var value interface{}
+		if len(op.Value) > 0 {
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				return newSCIMError(400, "invalidValue", "Malformed patch value")
+			}
+		}
+		path := stripSCIMSchema(op.Path)
+		if path == "" {
+			// The value is an object of attributes to set.
+			attrs, ok := value.(map[string]interface{})
+			if !ok || kind == "remove" {
+				return newSCIMError(400, "noTarget", "A patch without a path needs an object value")
+			}
+			for k, v := range attrs {
+				setSCIMAttr(m, stripSCIMSchema(k), v)
+			}
+			continue
+		}
+		if scimEmailPathRe.MatchString(path) {
+			path = "emails"
+			if s, ok := value.(string); ok {
+				value = []interface{}{map[string]interface{}{"value": s, "primary": true, "type": "work"}}
+			}
+		}
+		if kind == "remove" {
+			setSCIMAttr(m, path, nil)
+			continue
+		}
+		setSCIMAttr(m, path, value)
+	}
+	doc, err = json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var patched scimUser
+	if err := json.Unmarshal(doc, &patched); err != nil {
+		return newSCIMError(400, "invalidValue", "Patched user is invalid: "+err.Error())
+	}
+	*u = patched
+	return nil
+}
+
+// setSCIMAttr sets, or with a nil value removes, a known attribute of the
+// user document m. A dotted path addresses a sub-attribute of "name".
+func setSCIMAttr(m map[string]interface{}, path string, value interface{}) {
+	name, ok := scimUserAttrs[strings.ToLower(path)]
+	if !ok {
+		return
+	}
+	if name == "userName" && value == nil {
+		// userName is required and cannot be removed.
+		return
+	}
+	parent, key := m, name
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		sub, _ := m[name[:i]].(map[string]interface{})
+		if sub == nil {
+			sub = map[string]interface{}{}
+			m[name[:i]] = sub
+		}
+		parent, key = sub, name[i+1:]
+	}
+	if value == nil {
+		delete(parent, key)
+		return
+	}
+	if key == "emails" {
+		if s, ok := value.(map[string]interface{}); ok {
+			value = []interface{}{s}
+		}
+	}
+	parent[key] = value
+}
+
+// scimBool is a boolean that also accepts "True" and "False" strings,
+// which some clients send for active.
+type scimBool bool
+
+func (b *scimBool) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bool:
+		*b = scimBool(v)
+	case string:
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*b = scimBool(parsed)
+	default:
+		return fmt.Errorf("want a boolean, not %s", data)
+	}
+	return nil
+}
+
+// memberIDs returns the user IDs in a members value: an array of
+// {"value": id} objects.
+func memberIDs(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var members []scimMultiValue
+	if err := json.Unmarshal(raw, &members); err != nil {
+		var one scimMultiValue
+		if json.Unmarshal(raw, &one) != nil {
+			return nil, newSCIMError(400, "invalidValue", "members must be a list of {\"value\": id}")
+		}
+		members = []scimMultiValue{one}
+	}
+	ids := make([]string, 0, len(members))
+	for _, mv := range members {
+		if mv.Value != "" {
+			ids = append(ids, mv.Value)
+		}
+	}
+	return ids, nil
+}
+
+// scimMemberPathRe matches `members[value eq "id"]`.
+var scimMemberPathRe = regexp.MustCompile(`(?i)^members\[\s*value\s+eq\s+"([^"]+)"\s*\]$`)
+
+// decodeSCIMValue decodes a patch value into v.
+func decodeSCIMValue(raw json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(raw, v); err != nil {
+		return newSCIMError(400, "invalidValue", "Malformed patch value")
+	}
+	return nil
+}
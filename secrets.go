@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretProvider resolves named secrets such as "MONGO_URI". Lookup
+// reports ok=false when the provider simply doesn't hold the secret.
+type secretProvider interface {
+	Name() string
+	Lookup(ctx context.Context, name string) (value string, ok bool, err error)
+}
+
+// envProvider reads secrets from environment variables.
+type envProvider struct{}
+
+func (envProvider) Name() string { return "env" }
+
+func (envProvider) Lookup(_ context.Context, name string) (string, bool, error) {
+	v, ok := os.LookupEnv(name)
+	return v, ok && v != "", nil
+}
+
+// fileProvider reads secrets from mounted files: the path in <NAME>_FILE
+// if set, otherwise <dir>/<NAME> or <dir>/<name> as Docker and Kubernetes
+// secret mounts lay them out.
+type fileProvider struct {
+	dir string
+}
+
+func (fileProvider) Name() string { return "file" }
+
+func (p fileProvider) Lookup(_ context.Context, name string) (string, bool, error) {
+	candidates := []string{filepath.Join(p.dir, name), filepath.Join(p.dir, strings.ToLower(name))}
+	if f := os.Getenv(name + "_FILE"); f != "" {
+		candidates = []string{f}
+	}
+	for _, path := range candidates {
+		b, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return strings.TrimRight(string(b), "\r\n"), true, nil
+	}
+	return "", false, nil
+}
+
+// vaultProvider reads secrets from one HashiCorp Vault KV v2 path. The key
+// is the secret name as given or lower-cased ("MONGO_URI" or "mongo_uri").
+type vaultProvider struct {
+	addr      string
+	path      string
+	namespace string
+	token     func() string
+	client    *http.Client
+
+	mu      sync.Mutex
+	fetched time.Time
+	data    map[string]interface{}
+}
+
+func (*vaultProvider) Name() string { return "vault" }
+
+func (p *vaultProvider) Lookup(ctx context.Context, name string) (string, bool, error) {
+	data, err := p.read(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	for _, key := range []string{name, strings.ToLower(name)} {
+		if v, ok := data[key].(string); ok {
+			return v, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// read fetches the KV document, reusing it for a few seconds so a refresh
+// of several secrets costs a single request.
+func (p *vaultProvider) read(ctx context.Context) (map[string]interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.data != nil && time.Since(p.fetched) < 5*time.Second {
+		return p.data, nil
+	}
+
+	url := strings.TrimSuffix(p.addr, "/") + "/v1/" + strings.TrimPrefix(p.path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", p.token())
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault %s: %s", p.path, resp.Status)
+	}
+	var body struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("vault %s: %w", p.path, err)
+	}
+	p.data, p.fetched = body.Data.Data, time.Now()
+	return p.data, nil
+}
+
+// secretStore resolves secrets through an ordered provider chain, caches
+// them and re-reads them periodically so rotated values reach Watch
+// callbacks without a restart.
+type secretStore struct {
+	providers []secretProvider
+
+	mu       sync.Mutex
+	values   map[string]string
+	watchers map[string][]func(string)
+}
+
+var secrets = &secretStore{providers: []secretProvider{envProvider{}}}
+
+// initSecrets builds the provider chain from SECRETS_PROVIDERS (default
+// "vault,file,env", with vault skipped unless VAULT_ADDR is set) and starts
+// the rotation check every SECRETS_REFRESH_INTERVAL (default 5m).
+func initSecrets() error {
+	var providers []secretProvider
+	for _, name := range getEnvList("SECRETS_PROVIDERS", []string{"vault", "file", "env"}) {
+		switch name {
+		case "env":
+			providers = append(providers, envProvider{})
+		case "file":
+			providers = append(providers, fileProvider{dir: getEnv("SECRETS_DIR", "/run/secrets")})
+		case "vault":
+			p, err := newVaultProvider()
+			if err != nil {
+				return err
+			}
+			if p != nil {
+				providers = append(providers, p)
+			}
+		default:
+			return fmt.Errorf("unknown secrets provider %q", name)
+		}
+	}
+	secrets = &secretStore{providers: providers}
+
+	interval := 5 * time.Minute
+	if d, err := time.ParseDuration(os.Getenv("SECRETS_REFRESH_INTERVAL")); err == nil && d > 0 {
+		interval = d
+	}
+	go secrets.refreshLoop(interval)
+	return nil
+}
+
+func newVaultProvider() (*vaultProvider, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+	tlsCfg, err := upstreamTLSConfig("VAULT")
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsCfg != nil {
+		transport.TLSClientConfig = tlsCfg
+	}
+	// The token is read on every request so a renewed VAULT_TOKEN_FILE applies.
+	token := func() string {
+		if f := os.Getenv("VAULT_TOKEN_FILE"); f != "" {
+			if b, err := os.ReadFile(f); err == nil {
+				return strings.TrimSpace(string(b))
+			}
+		}
+		return os.Getenv("VAULT_TOKEN")
+	}
+	return &vaultProvider{
+		addr:      addr,
+		path:      getEnv("VAULT_SECRET_PATH", "secret/data/fiber-demo"),
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		token:     token,
+		client:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+// resolve asks each provider in turn and returns the first hit.
+func (s *secretStore) resolve(ctx context.Context, name string) (string, error) {
+	for _, p := range s.providers {
+		v, ok, err := p.Lookup(ctx, name)
+		if err != nil {
+			return "", fmt.Errorf("secret %s from %s: %w", name, p.Name(), err)
+		}
+		if ok {
+			return v, nil
+		}
+	}
+	return "", nil
+}
+
+// Get returns the secret, or fallback when no provider holds it.
+func (s *secretStore) Get(name, fallback string) string {
+	s.mu.Lock()
+	v, cached := s.values[name]
+	s.mu.Unlock()
+	if !cached {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var err error
+		if v, err = s.resolve(ctx, name); err != nil {
+			log.Println(err)
+		}
+		s.mu.Lock()
+		if s.values == nil {
+			s.values = map[string]string{}
+		}
+		s.values[name] = v
+		s.mu.Unlock()
+	}
+	if v == "" {
+		return fallback
+	}
+	return v
+}
+
+// Watch registers fn to run with the new value whenever name rotates.
+func (s *secretStore) Watch(name string, fn func(string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watchers == nil {
+		s.watchers = map[string][]func(string){}
+	}
+	s.watchers[name] = append(s.watchers[name], fn)
+}
+
+func (s *secretStore) refreshLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.refresh()
+	}
+}
+
+// refresh re-reads every cached secret and notifies watchers of changes.
+// A provider error keeps the previous value.
+func (s *secretStore) refresh() {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.values))
+	for name := range s.values {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+
+	for _, name := range names {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		v, err := s.resolve(ctx, name)
+		cancel()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		s.mu.Lock()
+		changed := s.values[name] != v
+		s.values[name] = v
+		watchers := append([]func(string){}, s.watchers[name]...)
+		s.mu.Unlock()
+
+		if changed {
+			log.Printf("Secret %s rotated", name)
+			for _, fn := range watchers {
+				fn(v)
+			}
+		}
+	}
+}
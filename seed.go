@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// seedCreator is recorded as the creator of the demo items.
+const seedCreator = "seed"
+
+// demoItems are seeded when no SEED_ITEMS_FILE is given.
+var demoItems = []itemRequest{
+	{Name: "Desk lamp", Description: "Adjustable LED lamp", Tags: []string{"office", "lighting"}},
+	{Name: "Standing desk", Description: "Electric, 120x80 cm", Tags: []string{"office", "furniture"}},
+	{Name: "Mechanical keyboard", Description: "Tenkeyless, brown switches", Tags: []string{"office", "peripherals"}},
+	{Name: "Noise-cancelling headphones", Tags: []string{"audio"}},
+	{Name: "Coffee grinder", Description: "Burr grinder, 40 settings", Tags: []string{"kitchen"}},
+}
+
+// loadSeedItems reads a JSON array of items in the POST /items format
+// from path, or returns demoItems when path is empty.
+func loadSeedItems(path string) ([]itemRequest, error) {
+	if path == "" {
+		return demoItems, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var reqs []itemRequest
+	if err := json.Unmarshal(b, &reqs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range reqs {
+		if err := validate.Struct(&reqs[i]); err != nil {
+			return nil, fmt.Errorf("%s: item %d: %w", path, i, err)
+		}
+	}
+	return reqs, nil
+}
+
+// seedID derives a stable ID from the item name, so that seeding again
+// skips the items already there instead of duplicating them.
+func seedID(name string) primitive.ObjectID {
+	var id primitive.ObjectID
+	sum := sha256.Sum256([]byte("seed:" + name))
+	copy(id[:], sum[:])
+	return id
+}
+
+// seedItems inserts the items that aren't stored yet and reports each to
+// out. It writes through itemDB directly, without events or jobs.
+func seedItems(ctx context.Context, out io.Writer, reqs []itemRequest) error {
+	added := 0
+	for _, req := range reqs {
+		id := seedID(req.Name)
+		_, err := itemDB.Get(ctx, id)
+		if err == nil {
+			fmt.Fprintf(out, "item %q exists\n", req.Name)
+			continue
+		}
+		if !errors.Is(err, errNoDocument) {
+			return err
+		}
+		now := time.Now().UTC()
+		doc := item{
+			ID:          id,
+			Name:        req.Name,
+			Description: encryptedString(req.Description),
+			Tags:        nonNilTags(req.Tags),
+			CreatedBy:   searchableString(seedCreator),
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if err := itemDB.Insert(ctx, doc); err != nil {
+			return fmt.Errorf("item %q: %w", req.Name, err)
+		}
+		fmt.Fprintf(out, "item %q added (%s)\n", req.Name, id.Hex())
+		added++
+	}
+	fmt.Fprintf(out, "%d of %d items added\n", added, len(reqs))
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serve runs the app on PORT (default 3000), over TLS when serverTLSConfig
+// finds a certificate source. With TLS enabled, HTTP_REDIRECT_PORT starts
+// a plain HTTP listener that redirects to HTTPS and answers ACME HTTP-01
+// challenges for autocert.
+func serve(app *fiber.App) error {
+	port := getEnv("PORT", "3000")
+	tlsCfg, manager, err := serverTLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsCfg == nil {
+		log.Println("Starting server on port", port)
+		return app.Listen(":" + port)
+	}
+
+	if redirectPort := os.Getenv("HTTP_REDIRECT_PORT"); redirectPort != "" {
+		go serveRedirect(redirectPort, port, manager)
+	}
+
+	ln, err := tls.Listen("tcp", ":"+port, tlsCfg)
+	if err != nil {
+		return err
+	}
+	if manager != nil {
+		log.Println("Starting TLS server with ACME autocert on port", port)
+	} else {
+		log.Println("Starting TLS server on port", port)
+	}
+	return app.Listener(ln)
+}
+
+// serveRedirect answers plain HTTP on redirectPort with a permanent
+// redirect to the HTTPS listener on tlsPort.
+func serveRedirect(redirectPort, tlsPort string, manager *autocert.Manager) {
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+	if manager != nil {
+		h = manager.HTTPHandler(h)
+	}
+	srv := &http.Server{
+		Addr:              ":" + redirectPort,
+		Handler:           h,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	log.Println("Redirecting HTTP on port", redirectPort, "to HTTPS")
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatal("HTTP redirect listener: ", err)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+)
+
+// requireCaller rejects tokens that are not of kind want, one of
+// policy.CallerHuman and policy.CallerService, whether or not a policy
+// file is loaded.
+func requireCaller(want string) fiber.Handler {
+	check := auth.RequireCaller(want)
+	return func(c *fiber.Ctx) error {
+		if t := tokenFor(c); t.Err == nil && policy.CheckCaller(t.Claims, want) != "" {
+			markDenied(c, "caller")
+		}
+		return check(c)
+	}
+}
+
+// requireHuman allows only users signed in as themselves.
+func requireHuman() fiber.Handler {
+	return requireCaller(policy.CallerHuman)
+}
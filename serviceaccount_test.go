@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Without a policy file, deleting an item still needs a person.
+func TestDeleteItemRefusesServiceAccounts(t *testing.T) {
+	currentPolicy.Store(nil)
+	app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
+	registerItemRoutes(app.Group("/api/v1"))
+
+	robot := bearer(t, jwt.MapClaims{"sub": "u-robot", "client_id": "reporting-batch", "roles": []interface{}{"admin"}})
+	req := httptest.NewRequest(fiber.MethodDelete, "/api/v1/items/64b7f0c2a1b2c3d4e5f60718", nil)
+	req.Header.Set(fiber.HeaderAuthorization, robot)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body problem
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != fiber.StatusForbidden {
+		t.Fatalf("status %d (%s), want 403", resp.StatusCode, body.Detail)
+	}
+
+	// /auth/can gives the same answer.
+	mountAuthCan(app)
+	req = httptest.NewRequest(fiber.MethodPost, "/auth/can", strings.NewReader(`{"checks":[{"method":"DELETE","path":"/api/v1/items/64b7f0c2a1b2c3d4e5f60718"}]}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(fiber.HeaderAuthorization, robot)
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var can struct {
+		Results []canResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&can); err != nil {
+		t.Fatal(err)
+	}
+	if len(can.Results) != 1 || can.Results[0].Allowed || can.Results[0].Reason != body.Detail {
+		t.Errorf("/auth/can: %+v, want refused with %q", can.Results, body.Detail)
+	}
+}
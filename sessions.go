@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The session registry records in Redis the tokens seen recently, one
+// entry per jti, so admins can see who is active and cut a session short.
+// Entries expire with their token. Each instance writes an entry at most
+// once every SESSIONS_TOUCH_INTERVAL, which bounds lastSeen's precision.
+// The index by last-seen time drops the sessions idle for longer than
+// SESSIONS_MAX_IDLE, whose tokens have expired.
+
+// session is a token seen by the app.
+type session struct {
+	JTI     string `json:"jti"`
+	Subject string `json:"subject"`
+	// SessionID is the Keycloak session ("sid"), which terminating the
+	// session logs out.
+	SessionID string    `json:"sessionId,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	IP        string    `json:"ip"`
+	IssuedAt  time.Time `json:"issuedAt,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+var (
+	sessionsEnabled bool
+	sessionsTouch   time.Duration
+	sessionsMaxIdle time.Duration
+
+	// sessionsTouched holds when this instance last wrote each entry.
+	sessionsTouchedMu sync.Mutex
+	sessionsTouched   = map[string]time.Time{}
+)
+
+// initSessions enables the registry when SESSIONS_ENABLED is set and Redis
+// is configured:
+//
+//	SESSIONS_ENABLED         record the tokens seen (default false)
+//	SESSIONS_TOUCH_INTERVAL  how often an instance refreshes an entry's lastSeen (default 30s)
+//	SESSIONS_MAX_IDLE        idle time after which a session leaves the index (default 24h); keep it above the token lifespan
+func initSessions() {
+	if !getEnvBool("SESSIONS_ENABLED", false) {
+		return
+	}
+	if !cacheEnabled() {
+		log.Println("Session registry disabled: it needs REDIS_URL")
+		return
+	}
+	sessionsEnabled = true
+	sessionsTouch = getEnvDuration("SESSIONS_TOUCH_INTERVAL", 30*time.Second)
+	sessionsMaxIdle = getEnvDuration("SESSIONS_MAX_IDLE", 24*time.Hour)
+	log.Println("Session registry enabled")
+}
+
+func sessionKey(jti string) string {
+	return cachePrefix + "session:" + jti
+}
+
+// sessionsIndex is the sorted set of jtis by last-seen time.
+func sessionsIndex() string {
+	return cachePrefix + "sessions"
+}
+
+// recordSession registers the token of the request, once the handler has
+// read it. Tokens without a jti or an expiry can't be tracked.
+func recordSession(c *fiber.Ctx) error {
+	err := c.Next()
+	if !sessionsEnabled {
+		return err
+	}
+	t, ok := keycloakauth.Cached(c)
+	if !ok || t.Err != nil || t.Raw == "" {
+		return err
+	}
+	jti, _ := t.Claims["jti"].(string)
+	exp := claimTime(t.Claims, "exp")
+	if jti == "" || exp.IsZero() {
+		return err
+	}
+	now := time.Now()
+	sessionsTouchedMu.Lock()
+	last, seen := sessionsTouched[jti]
+	if seen && now.Sub(last) < sessionsTouch {
+		sessionsTouchedMu.Unlock()
+		return err
+	}
+	sessionsTouched[jti] = now
+	if len(sessionsTouched) > 10000 {
+		for k, v := range sessionsTouched {
+			if now.Sub(v) >= sessionsTouch {
+				delete(sessionsTouched, k)
+			}
+		}
+	}
+	sessionsTouchedMu.Unlock()
+
+	s := session{
+		JTI:       jti,
+		IP:        c.IP(),
+		IssuedAt:  issuedAt(t.Claims).UTC(),
+		ExpiresAt: exp.UTC(),
+		FirstSeen: now.UTC(),
+		LastSeen:  now.UTC(),
+	}
+	s.Subject, _ = t.Claims["sub"].(string)
+	s.Client, _ = t.Claims["azp"].(string)
+	// Older Keycloak versions name the session session_state.
+	if s.SessionID, _ = t.Claims["sid"].(string); s.SessionID == "" {
+		s.SessionID, _ = t.Claims["session_state"].(string)
+	}
+	if werr := touchSession(context.WithoutCancel(c.UserContext()), s); werr != nil {
+		log.Println("Session not recorded:", werr)
+	}
+	return err
+}
+
+// touchSession stores s, keeping the firstSeen of an existing entry.
+func touchSession(ctx context.Context, s session) error {
+	client := cacheClient.Load()
+	if client == nil {
+		return nil
+	}
+	ttl := time.Until(s.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, cacheOpTimeout)
+	defer cancel()
+	if prev, err := getSession(ctx, s.JTI); err == nil {
+		s.FirstSeen = prev.FirstSeen
+	}
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	pipe := client.TxPipeline()
+	pipe.Set(ctx, sessionKey(s.JTI), body, ttl)
+	pipe.ZAdd(ctx, sessionsIndex(), redis.Z{Score: float64(s.LastSeen.Unix()), Member: s.JTI})
+	// The entries expire by themselves, the index members don't.
+	pipe.ZRemRangeByScore(ctx, sessionsIndex(), "-inf", strconv.FormatInt(s.LastSeen.Add(-sessionsMaxIdle).Unix(), 10))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+var errNoSession = errors.New("no such session")
+
+func getSession(ctx context.Context, jti string) (session, error) {
+	client := cacheClient.Load()
+	if client == nil {
+		return session{}, errNoSession
+	}
+	raw, err := client.Get(ctx, sessionKey(jti)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return session{}, errNoSession
+	}
+	if err != nil {
+		return session{}, err
+	}
+	var s session
+	err = json.Unmarshal(raw, &s)
+	return s, err
+}
+
+// sessionsScanMax bounds the sessions a listing reads.
+const sessionsScanMax = 10000
+
+// listSessions returns the live sessions, most recently seen first, and
+// drops the index entries of those that expired.
+func listSessions(ctx context.Context) ([]session, error) {
+	client := cacheClient.Load()
+	if client == nil {
+		return nil, nil
+	}
+	jtis, err := client.ZRevRange(ctx, sessionsIndex(), 0, sessionsScanMax-1).Result()
+	if err != nil || len(jtis) == 0 {
+		return nil, err
+	}
+	keys := make([]string, len(jtis))
+	for i, jti := range jtis {
+		keys[i] = sessionKey(jti)
+	}
+	vals, err := client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]session, 0, len(vals))
+	var gone []interface{}
+	for i, v := range vals {
+		raw, ok := v.(string)
+		var s session
+		if !ok || json.Unmarshal([]byte(raw), &s) != nil {
+			gone = append(gone, jtis[i])
+			continue
+		}
+		out = append(out, s)
+	}
+	if len(gone) > 0 {
+		if err := client.ZRem(ctx, sessionsIndex(), gone...).Err(); err != nil {
+			log.Println("Expired sessions not pruned:", err)
+		}
+	}
+	return out, nil
+}
+
+// forgetSession removes the entry of jti from the registry.
+func forgetSession(ctx context.Context, jti string) error {
+	client := cacheClient.Load()
+	if client == nil {
+		return nil
+	}
+	pipe := client.TxPipeline()
+	pipe.Del(ctx, sessionKey(jti))
+	pipe.ZRem(ctx, sessionsIndex(), jti)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func registerSessionRoutes(r fiber.Router) {
+	r.Get("/sessions", listSessionsHandler)
+	r.Delete("/sessions/:jti", terminateSession)
+}
+
+// listSessionsHandler lists the live sessions, optionally of one subject,
+// up to limit (default 100).
+func listSessionsHandler(c *fiber.Ctx) error {
+	if !sessionsEnabled {
+		return errSessionsDisabled()
+	}
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		return errValidation([]fieldError{{Field: "limit", Rule: "range", Message: "must be between 1 and 1000"}})
+	}
+	all, err := listSessions(c.UserContext())
+	if err != nil {
+		return errDatabase(err)
+	}
+	sub := c.Query("subject")
+	out := make([]session, 0, min(len(all), limit))
+	for _, s := range all {
+		if sub != "" && s.Subject != sub {
+			continue
+		}
+		if len(out) == limit {
+			break
+		}
+		out = append(out, s)
+	}
+	return c.JSON(fiber.Map{"sessions": out})
+}
+
+// terminateSession denylists the session's token until it expires, on
+// every instance, and logs the Keycloak session out so it can't be
+// refreshed. The response says whether the logout succeeded; the token is
+// rejected either way.
+func terminateSession(c *fiber.Ctx) error {
+	if !sessionsEnabled {
+		return errSessionsDisabled()
+	}
+	jti := c.Params("jti")
+	s, err := getSession(c.UserContext(), jti)
+	if errors.Is(err, errNoSession) {
+		return newProblem(fiber.StatusNotFound, problemAboutBlank, "No such session")
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+	exp := s.ExpiresAt
+	e := denylistEntry{
+		Subject:   denylistTokenPrefix + s.JTI,
+		Reason:    "Session terminated",
+		CreatedBy: subject(c),
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: &exp,
+	}
+	if err := denylistDB.Put(c.UserContext(), e); err != nil {
+		return errDatabase(err)
+	}
+	changeDenylist(c.UserContext(), denylistChange{Entry: &e})
+
+	logout := "done"
+	switch {
+	case s.SessionID == "":
+		logout = "skipped: the token names no Keycloak session"
+	default:
+		err := keycloakAdmin(c.UserContext(), fiber.MethodDelete, "/sessions/"+s.SessionID, nil, nil)
+		if keycloakAdminStatus(err) == fiber.StatusNotFound {
+			logout = "skipped: the Keycloak session already ended"
+		} else if err != nil {
+			log.Printf("Keycloak logout of session %s failed: %v", s.SessionID, err)
+			logout = "failed: " + err.Error()
+		}
+	}
+	if err := forgetSession(context.WithoutCancel(c.UserContext()), jti); err != nil {
+		log.Printf("Terminated session %s still listed: %v", jti, err)
+	}
+	log.Printf("Session %s of %s terminated by %s", jti, s.Subject, e.CreatedBy)
+	recordAudit(c, "sessions.terminate", s.Subject, bson.M{"jti": jti, "sessionId": s.SessionID, "keycloakLogout": logout})
+	return c.JSON(fiber.Map{"session": s, "keycloakLogout": logout})
+}
+
+func errSessionsDisabled() *problem {
+	return newProblem(fiber.StatusConflict, problemAboutBlank, "The session registry is off; set SESSIONS_ENABLED and REDIS_URL")
+}
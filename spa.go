@@ -0,0 +1,109 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// spaFiles is the frontend built into the binary. Replace web/ with the
+// build output of yours; the placeholder only shows its configuration.
+//
+//go:embed all:web
+var spaFiles embed.FS
+
+// spaConfig is served at /app/config.json, so one frontend build works
+// against any deployment.
+type spaConfig struct {
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"clientId"`
+	APIBase  string `json:"apiBase"`
+	// CanURL is the batch authorization check (POST /auth/can).
+	CanURL string `json:"canUrl"`
+}
+
+// mountSPA serves the frontend under /app when SPA_ENABLED is set. Paths
+// that name no file get index.html, so client-side routes survive a
+// reload; missing files with an extension are 404s. The files need no
+// token: the frontend signs in against Keycloak itself and sends the
+// token to the API.
+//
+//	SPA_DIR        serve this directory instead of the embedded files, for development
+//	SPA_ISSUER     issuer the browser signs in with (default KEYCLOAK_ISSUER)
+//	SPA_CLIENT_ID  public Keycloak client of the frontend (default KEYCLOAK_CLIENT_ID)
+//	SPA_API_BASE   API prefix the frontend calls (default /api/<default version>)
+//	SPA_CSP        Content-Security-Policy of the frontend's responses
+func mountSPA(app *fiber.App) {
+	if !getEnvBool("SPA_ENABLED", false) {
+		return
+	}
+	files, err := fs.Sub(spaFiles, "web")
+	if err != nil {
+		log.Fatal("SPA files error: ", err)
+	}
+	if dir := os.Getenv("SPA_DIR"); dir != "" {
+		files = os.DirFS(dir)
+	}
+	cfg := spaConfig{
+		Issuer:   getEnv("SPA_ISSUER", keycloakIssuer()),
+		ClientID: getEnv("SPA_CLIENT_ID", keycloakClientID()),
+		APIBase:  getEnv("SPA_API_BASE", "/api/"+defaultAPIVersion),
+		CanURL:   "/auth/can",
+	}
+	csp := getEnv("SPA_CSP", spaCSP(cfg.Issuer))
+
+	app.Get("/app/config.json", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		return c.JSON(cfg)
+	})
+	app.Get("/app/*", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentSecurityPolicy, csp)
+		return serveSPAFile(c, files, c.Params("*"))
+	})
+	log.Println("Serving the frontend at /app")
+}
+
+// serveSPAFile sends name from files, or index.html for client-side
+// routes. Files under assets/, which bundlers name by content hash, are
+// cached for a year; the rest are revalidated.
+func serveSPAFile(c *fiber.Ctx, files fs.FS, name string) error {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	if info, err := fs.Stat(files, name); err != nil || info.IsDir() {
+		if path.Ext(name) != "" {
+			return fiber.ErrNotFound
+		}
+		name = "index.html"
+	}
+	body, err := fs.ReadFile(files, name)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(name, "assets/") {
+		c.Set(fiber.HeaderCacheControl, "public, max-age=31536000, immutable")
+	} else {
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+	}
+	c.Type(strings.TrimPrefix(path.Ext(name), "."))
+	return c.Send(body)
+}
+
+// spaCSP allows the frontend's own scripts and styles, and the Keycloak
+// origin it signs in with, including the hidden iframe keycloak-js uses
+// for silent sign-in.
+func spaCSP(issuer string) string {
+	kc := ""
+	if u, err := url.Parse(issuer); err == nil && u.Host != "" {
+		kc = " " + u.Scheme + "://" + u.Host
+	}
+	return "default-src 'self'; connect-src 'self'" + kc + "; frame-src" + kc + " 'self'; img-src 'self' data:; " +
+		"style-src 'self' 'unsafe-inline'; frame-ancestors 'none'; base-uri 'self'; form-action 'self'" + kc
+}
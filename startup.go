@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// startupCheck probes one dependency during the boot wait.
+type startupCheck struct {
+	name  string
+	probe func(ctx context.Context) error
+	// done releases what the probe held on to.
+	done func()
+}
+
+// waitForDependencies blocks until the dependencies in STARTUP_WAIT_FOR
+// answer, so that a slow docker-compose start doesn't leave the app
+// failing its first requests. Keycloak counts as up once its discovery
+// document is served and MongoDB once the primary answers a ping. Failed
+// probes are retried with exponential backoff, from
+// STARTUP_WAIT_BACKOFF (500ms) up to STARTUP_WAIT_MAX_BACKOFF (10s), until
+// STARTUP_WAIT_TIMEOUT (60s) has passed. The app then starts anyway: an
+// unreachable MongoDB leaves it unready and the JWKS is fetched on the
+// first token. STARTUP_WAIT_TIMEOUT=0 skips the wait. Commands that need
+// fewer dependencies pass their names in only.
+func waitForDependencies(only ...string) error {
+	if d, err := time.ParseDuration(os.Getenv("STARTUP_WAIT_TIMEOUT")); err == nil && d == 0 {
+		return nil
+	}
+	timeout := getEnvDuration("STARTUP_WAIT_TIMEOUT", time.Minute)
+	checks, err := startupChecks(only)
+	if err != nil || len(checks) == 0 {
+		return err
+	}
+	for _, check := range checks {
+		if check.done != nil {
+			defer check.done()
+		}
+	}
+
+	delay := getEnvDuration("STARTUP_WAIT_BACKOFF", 500*time.Millisecond)
+	maxBackoff := getEnvDuration("STARTUP_WAIT_MAX_BACKOFF", 10*time.Second)
+	start := time.Now()
+	deadline := start.Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		pending := checks[:0]
+		for _, check := range checks {
+			if err := check.probe(ctx); err != nil {
+				log.Printf("Waiting for %s (attempt %d): %v", check.name, attempt, err)
+				pending = append(pending, check)
+				continue
+			}
+			if attempt > 1 {
+				log.Printf("%s is up after %s", check.name, time.Since(start).Round(time.Millisecond))
+			}
+		}
+		checks = pending
+		if len(checks) == 0 {
+			return nil
+		}
+
+		sleep := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		delay = min(2*delay, maxBackoff)
+		if time.Until(deadline) < sleep {
+			names := make([]string, len(checks))
+			for i, check := range checks {
+				names[i] = check.name
+			}
+			log.Printf("Gave up waiting for %s after %s, starting anyway", strings.Join(names, ", "), timeout)
+			return nil
+		}
+		time.Sleep(sleep)
+	}
+}
+
+// startupChecks returns the probes named by only, or else by
+// STARTUP_WAIT_FOR. The default is keycloak, unless AUTH_MODE=dev, and
+// mongodb with the mongo storage backend.
+func startupChecks(only []string) ([]startupCheck, error) {
+	var defaults []string
+	if getEnv("AUTH_MODE", authModeGateway) != authModeDev {
+		defaults = append(defaults, "keycloak")
+	}
+	if getEnv("STORAGE_BACKEND", storageMongo) == storageMongo {
+		defaults = append(defaults, "mongodb")
+	}
+	names := only
+	if len(names) == 0 {
+		names = getEnvList("STARTUP_WAIT_FOR", defaults)
+	}
+	var checks []startupCheck
+	for _, name := range names {
+		switch name {
+		case "keycloak":
+			checks = append(checks, keycloakStartupCheck(name, keycloakIssuer()))
+		case "keycloak-server":
+			// The master realm, for the seed command that creates the app's.
+			base, _ := keycloakRealmURL()
+			checks = append(checks, keycloakStartupCheck(name, base+"/realms/master"))
+		case "mongodb":
+			uri := secrets.Get("MONGO_URI", "mongodb://localhost:27017")
+			if _, err := mongoClientOptions(uri); err != nil {
+				return nil, err
+			}
+			checks = append(checks, mongoStartupCheck(uri))
+		default:
+			return nil, fmt.Errorf("STARTUP_WAIT_FOR: unknown dependency %q (want keycloak, keycloak-server or mongodb)", name)
+		}
+	}
+	return checks, nil
+}
+
+// keycloakStartupCheck fetches the OpenID discovery document of issuer.
+func keycloakStartupCheck(name, issuer string) startupCheck {
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	return startupCheck{name: name, probe: func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := keycloakHTTP.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("discovery document: %s", resp.Status)
+		}
+		return nil
+	}}
+}
+
+// mongoStartupCheck pings the primary through one client, created on the
+// first attempt, which is disconnected once the wait is over.
+func mongoStartupCheck(uri string) startupCheck {
+	var client *mongo.Client
+	return startupCheck{
+		name: "mongodb",
+		probe: func(context.Context) error {
+			if client == nil {
+				c, err := connectMongo(uri)
+				if c == nil {
+					return err
+				}
+				client = c
+				return err
+			}
+			return pingMongo(client)
+		},
+		done: func() {
+			if client != nil {
+				_ = client.Disconnect(context.Background())
+			}
+		},
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/keycloakauth"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// GET /admin/stats is a JSON snapshot of what an ops dashboard shows:
+// request rates by route, the JWKS keys held, the database pool, cache hit
+// rates, the denylist and the job backlog. Unlike /metrics it is always
+// on, and needs no Prometheus to read.
+
+// statsWindow is how far back the per-route request rates look.
+const statsWindow = 60
+
+// routeRate counts the requests of a route, with a ring of per-second
+// counts over the last statsWindow seconds.
+type routeRate struct {
+	total, errors uint64
+	// seconds[i] counts the requests of the Unix second at[i].
+	seconds [statsWindow]uint64
+	at      [statsWindow]int64
+}
+
+var (
+	routeRatesMu sync.Mutex
+	routeRates   = map[string]*routeRate{}
+)
+
+// countRouteRate records the request's route once its response is final.
+func countRouteRate(c *fiber.Ctx) error {
+	err := c.Next()
+	if err != nil {
+		if herr := c.App().Config().ErrorHandler(c, err); herr != nil {
+			_ = c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+	route := "unmatched"
+	if r := c.Route(); r != nil && r.Path != "/" {
+		route = c.Method() + " " + r.Path
+	}
+	now := time.Now().Unix()
+	routeRatesMu.Lock()
+	r, ok := routeRates[route]
+	if !ok {
+		r = &routeRate{}
+		routeRates[route] = r
+	}
+	r.total++
+	if c.Response().StatusCode() >= fiber.StatusInternalServerError {
+		r.errors++
+	}
+	i := now % statsWindow
+	if r.at[i] != now {
+		r.at[i], r.seconds[i] = now, 0
+	}
+	r.seconds[i]++
+	routeRatesMu.Unlock()
+	return nil
+}
+
+// routeStats is the entry of a route in /admin/stats.
+type routeStats struct {
+	Route      string  `json:"route"`
+	Total      uint64  `json:"total"`
+	Errors     uint64  `json:"errors"`
+	LastMinute uint64  `json:"lastMinute"`
+	PerSecond  float64 `json:"perSecond"`
+}
+
+// routeRateStats returns the routes by requests in the last minute, then
+// by name.
+func routeRateStats(now time.Time) []routeStats {
+	since := now.Unix() - statsWindow
+	routeRatesMu.Lock()
+	out := make([]routeStats, 0, len(routeRates))
+	for route, r := range routeRates {
+		s := routeStats{Route: route, Total: r.total, Errors: r.errors}
+		for i, at := range r.at {
+			if at > since {
+				s.LastMinute += r.seconds[i]
+			}
+		}
+		s.PerSecond = float64(s.LastMinute) / statsWindow
+		out = append(out, s)
+	}
+	routeRatesMu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].LastMinute != out[j].LastMinute {
+			return out[i].LastMinute > out[j].LastMinute
+		}
+		return out[i].Route < out[j].Route
+	})
+	return out
+}
+
+// mongoPool follows the connection pools of the MongoDB clients, summed
+// over the servers of the deployment.
+var mongoPool struct {
+	open, inUse, waiting, checkoutFailed, cleared atomic.Int64
+}
+
+// mongoPoolMonitor is set on every MongoDB client, including those made
+// when the URI rotates.
+var mongoPoolMonitor = &event.PoolMonitor{Event: func(e *event.PoolEvent) {
+	switch e.Type {
+	case event.ConnectionCreated:
+		mongoPool.open.Add(1)
+	case event.ConnectionClosed:
+		mongoPool.open.Add(-1)
+	case event.GetStarted:
+		mongoPool.waiting.Add(1)
+	case event.GetSucceeded:
+		mongoPool.waiting.Add(-1)
+		mongoPool.inUse.Add(1)
+	case event.GetFailed:
+		mongoPool.waiting.Add(-1)
+		mongoPool.checkoutFailed.Add(1)
+	case event.ConnectionReturned:
+		mongoPool.inUse.Add(-1)
+	case event.PoolCleared:
+		mongoPool.cleared.Add(1)
+	}
+}}
+
+func registerStatsRoutes(r fiber.Router) {
+	r.Get("/stats", statsHandler)
+}
+
+func statsHandler(c *fiber.Ctx) error {
+	now := time.Now().UTC()
+	out := fiber.Map{
+		"time":     now,
+		"uptime":   time.Since(startedAt).Round(time.Second).String(),
+		"requests": routeRateStats(now),
+		"jwks":     jwksStats(),
+		"database": databaseStats(),
+		"cache":    cacheStats(),
+		"denylist": fiber.Map{"entries": denylistSize()},
+	}
+	if usesMongo() {
+		jobs, err := jobStats(c)
+		if err != nil {
+			return errDatabase(err)
+		}
+		out["jobs"] = jobs
+	}
+	return c.JSON(out)
+}
+
+func jwksStats() fiber.Map {
+	keys, fetched, err := auth.Keys()
+	if errors.Is(err, keycloakauth.ErrNoJWKS) {
+		return fiber.Map{"used": false, "authMode": authMode}
+	}
+	out := make([]fiber.Map, 0, len(keys))
+	for _, k := range keys {
+		key := fiber.Map{"kid": k.Kid, "thumbprint": k.Thumbprint, "pinned": k.Pinned}
+		if !k.NotAfter.IsZero() {
+			key["notAfter"] = k.NotAfter.UTC()
+			key["expiresIn"] = time.Until(k.NotAfter).Round(time.Second).String()
+		}
+		out = append(out, key)
+	}
+	stats := fiber.Map{"used": true, "url": jwksURL(), "keys": out}
+	if !fetched.IsZero() {
+		stats["fetchedAt"] = fetched.UTC()
+	}
+	return stats
+}
+
+func databaseStats() fiber.Map {
+	if !usesMongo() {
+		if pool := pg(); pool != nil {
+			s := pool.Stat()
+			return fiber.Map{
+				"storage":       "postgres",
+				"open":          s.TotalConns(),
+				"inUse":         s.AcquiredConns(),
+				"idle":          s.IdleConns(),
+				"max":           s.MaxConns(),
+				"acquires":      s.AcquireCount(),
+				"emptyAcquires": s.EmptyAcquireCount(),
+			}
+		}
+		return fiber.Map{"storage": "postgres"}
+	}
+	return fiber.Map{
+		"storage":        "mongodb",
+		"open":           mongoPool.open.Load(),
+		"inUse":          mongoPool.inUse.Load(),
+		"waiting":        mongoPool.waiting.Load(),
+		"checkoutFailed": mongoPool.checkoutFailed.Load(),
+		"cleared":        mongoPool.cleared.Load(),
+	}
+}
+
+func cacheStats() fiber.Map {
+	routes := fiber.Map{}
+	for _, r := range cacheRoutes {
+		hits, misses := r.hits.Load(), r.misses.Load()
+		s := fiber.Map{"ttl": r.ttl.String(), "hits": hits, "misses": misses}
+		if hits+misses > 0 {
+			s["hitRate"] = float64(hits) / float64(hits+misses)
+		}
+		routes[r.Name] = s
+	}
+	return fiber.Map{"enabled": cacheEnabled(), "routes": routes}
+}
+
+func denylistSize() int {
+	if m := denied.Load(); m != nil {
+		return len(*m)
+	}
+	return 0
+}
+
+// jobStats counts the jobs by status, and the pending ones already due,
+// which are the backlog the workers have yet to claim.
+func jobStats(c *fiber.Ctx) (fiber.Map, error) {
+	ctx := c.UserContext()
+	jobs := db().Collection(jobsCollection)
+	cur, err := jobs.Aggregate(ctx, bson.A{
+		bson.M{"$group": bson.M{"_id": "$status", "n": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		Status string `bson:"_id"`
+		N      int64  `bson:"n"`
+	}
+	if err := cur.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	byStatus := map[string]int64{jobPending: 0, jobRunning: 0, jobDone: 0, jobDead: 0}
+	for _, g := range groups {
+		byStatus[g.Status] = g.N
+	}
+	due, err := jobs.CountDocuments(ctx, bson.M{"status": jobPending, "runAt": bson.M{"$lte": time.Now().UTC()}})
+	if err != nil {
+		return nil, err
+	}
+	return fiber.Map{"enabled": jobsEnabled, "byStatus": byStatus, "due": due}, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// STORAGE_BACKEND selects where the app keeps its data.
+const (
+	storageMongo    = "mongo"
+	storagePostgres = "postgres"
+)
+
+var storageBackend = storageMongo
+
+// errNoDocument is returned by the stores when the addressed document
+// doesn't exist.
+var errNoDocument = errors.New("no such document")
+
+// itemFilter narrows the items listed or exported.
+type itemFilter struct {
+	Tag          string
+	CreatedBy    string
+	CreatedSince time.Time
+	CreatedUntil time.Time
+	// VisibleTo keeps the items created by or shared with the caller.
+	VisibleTo *itemCaller
+}
+
+// itemWrite is one operation of a bulk write. Create uses Doc; Update
+// uses ID and Set; Delete uses ID.
+type itemWrite struct {
+	Op  string
+	ID  primitive.ObjectID
+	Doc item
+	Set itemChanges
+}
+
+// itemChanges are the fields a replace or bulk update sets.
+type itemChanges struct {
+	Name        string
+	Description encryptedString
+	Tags        []string
+	UpdatedAt   time.Time
+}
+
+// itemStore persists items. Event emission and job enqueueing stay in
+// the item functions of items.go, which sit on top of it.
+type itemStore interface {
+	List(ctx context.Context, f itemFilter, offset, limit int) ([]item, error)
+	Count(ctx context.Context) (int64, error)
+	Insert(ctx context.Context, doc item) error
+	Get(ctx context.Context, id primitive.ObjectID) (item, error)
+	Update(ctx context.Context, id primitive.ObjectID, ch itemChanges) (item, error)
+	// Delete removes the item and keeps a copy for the deleted-items
+	// retention period.
+	Delete(ctx context.Context, id primitive.ObjectID) (item, error)
+	GetMany(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]item, error)
+	// SetACL replaces the item's shares.
+	SetACL(ctx context.Context, id primitive.ObjectID, acl itemACL) (item, error)
+	// Bulk runs writes unordered and returns one error slot per write.
+	Bulk(ctx context.Context, writes []itemWrite) ([]error, error)
+	// Each streams matching items in ID order without loading them all.
+	Each(ctx context.Context, f itemFilter, fn func(item) error) error
+	// Import inserts or replaces docs in transactions of batchSize and
+	// returns how many were committed. inTx runs in each transaction after
+	// its writes, with the docs written and which of them were created; an
+	// error rolls the batch back.
+	Import(ctx context.Context, docs []item, batchSize int, inTx importHook) (int, error)
+	TagCounts(ctx context.Context) (map[string]int, error)
+}
+
+// importHook is run by itemStore.Import in each batch's transaction.
+type importHook func(ctx context.Context, batch []item, created []bool) error
+
+// denylistStore persists denylist entries.
+type denylistStore interface {
+	List(ctx context.Context) ([]denylistEntry, error)
+	Put(ctx context.Context, e denylistEntry) error
+	// Delete reports whether an entry existed.
+	Delete(ctx context.Context, subject string) (bool, error)
+	DeleteExpired(ctx context.Context, now time.Time) (int64, error)
+}
+
+// auditStore persists audit entries.
+type auditStore interface {
+	Insert(ctx context.Context, e auditEntry) error
+	DeleteBefore(ctx context.Context, t time.Time) (int64, error)
+}
+
+var (
+	itemDB     itemStore
+	denylistDB denylistStore
+	auditDB    auditStore
+)
+
+// usesMongo reports whether MongoDB is the storage backend. The job
+// queue, reports, idempotency records and TTL retention are MongoDB-only.
+func usesMongo() bool {
+	return storageBackend == storageMongo
+}
+
+// initStorage connects the backend named by STORAGE_BACKEND (default
+// mongo) and prepares its collections or tables. Item reads go through
+// the Redis cache when it is enabled.
+func initStorage() error {
+	if err := openStorage(); err != nil {
+		return err
+	}
+	// Injected errors hit the backend, not the cache in front of it.
+	if chaosEnabled {
+		itemDB = chaosItemStore{itemDB}
+	}
+	if cacheEnabled() {
+		itemDB = cachedItemStore{itemDB}
+	}
+	return nil
+}
+
+func openStorage() error {
+	storageBackend = getEnv("STORAGE_BACKEND", storageMongo)
+	switch storageBackend {
+	case storageMongo:
+		if err := initMongo(); err != nil {
+			return err
+		}
+		itemDB, denylistDB, auditDB = mongoItemStore{}, mongoDenylistStore{}, mongoAuditStore{}
+		if ready("mongodb") {
+			return ensureIndexes()
+		}
+		whenMongoUp(func() {
+			if err := ensureIndexes(); err != nil {
+				log.Println("MongoDB indexes:", err)
+			}
+		})
+		return nil
+	case storagePostgres:
+		if getEnvBool("JOBS_ENABLED", false) {
+			return errors.New("the job queue needs MongoDB; unset JOBS_ENABLED with STORAGE_BACKEND=postgres")
+		}
+		if err := initPostgres(); err != nil {
+			return err
+		}
+		itemDB, denylistDB, auditDB = pgItemStore{}, pgDenylistStore{}, pgAuditStore{}
+		log.Println("Idempotency keys, reports and /admin/retention are unavailable with PostgreSQL")
+		return nil
+	default:
+		return fmt.Errorf("unknown STORAGE_BACKEND %q (want mongo or postgres)", storageBackend)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/example/fiber-demo/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+)
+
+// timeoutRule overrides REQUEST_TIMEOUT on the routes its pattern matches.
+// A zero Timeout runs them without a deadline, for routes that legitimately
+// take long.
+type timeoutRule struct {
+	policy.Pattern
+	Timeout duration `json:"timeout"`
+}
+
+func (r timeoutRule) validate() error {
+	if err := r.Pattern.Validate(); err != nil {
+		return err
+	}
+	if r.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	return nil
+}
+
+var (
+	requestTimeoutDefault time.Duration
+	// currentTimeouts is replaced on every runtime config reload.
+	currentTimeouts atomic.Pointer[[]timeoutRule]
+)
+
+// initRequestTimeouts reads REQUEST_TIMEOUT (default 30s), the deadline of
+// requests no timeout rule matches. Keep it below Kong's read_timeout for
+// the service, so work stops by the time Kong has given up on it.
+func initRequestTimeouts() {
+	requestTimeoutDefault = getEnvDuration("REQUEST_TIMEOUT", 30*time.Second)
+}
+
+func timeoutFor(method, path string) time.Duration {
+	if rules := currentTimeouts.Load(); rules != nil {
+		for _, r := range *rules {
+			if r.Matches(method, path) {
+				return time.Duration(r.Timeout)
+			}
+		}
+	}
+	return requestTimeoutDefault
+}
+
+// requestTimeout gives the request's user context a deadline, which the
+// Mongo, Postgres, Redis and Keycloak calls made for it all use, so a slow
+// query is abandoned instead of piling up behind the next ones. A request
+// that fails once the deadline has passed is answered with 504.
+//
+// fasthttp doesn't report a client hanging up mid-request, so the deadline
+// is also what bounds the work done for a disconnected client. Streamed
+// responses, such as exports, stop when writing to the client fails.
+func requestTimeout(c *fiber.Ctx) error {
+	d := timeoutFor(c.Method(), c.Path())
+	if d <= 0 {
+		return c.Next()
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), d)
+	defer cancel()
+	c.SetUserContext(ctx)
+	c.Locals("requestTimeout", d)
+	return timedOut(c, c.Next())
+}
+
+// timedOut returns the 504 of a request that failed with err once its
+// deadline had passed, or err. Middleware rendering errors itself, such
+// as idempotency, calls it first.
+func timedOut(c *fiber.Ctx, err error) error {
+	d, ok := c.Locals("requestTimeout").(time.Duration)
+	if err == nil || !ok || !errors.Is(c.UserContext().Err(), context.DeadlineExceeded) {
+		return err
+	}
+	var p *problem
+	if errors.As(err, &p) && p.Type == problemTimeout {
+		return err
+	}
+	log.Printf("%s %s timed out after %s: %v", c.Method(), c.Path(), d, err)
+	return errTimeout(fmt.Sprintf("Request did not complete within %s", d))
+}
+
+func errTimeout(detail string) *problem {
+	return newProblem(fiber.StatusGatewayTimeout, problemTimeout, detail)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsFiles are the certificate paths configured for one TLS endpoint.
+type tlsFiles struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// tlsFilesFromEnv reads <PREFIX>_CERT_FILE, <PREFIX>_KEY_FILE and
+// <PREFIX>_CA_FILE (or <PREFIX>_CLIENT_CA_FILE for the listener).
+func tlsFilesFromEnv(prefix, caName string) tlsFiles {
+	return tlsFiles{
+		CertFile: os.Getenv(prefix + "_CERT_FILE"),
+		KeyFile:  os.Getenv(prefix + "_KEY_FILE"),
+		CAFile:   os.Getenv(prefix + "_" + caName),
+	}
+}
+
+// tlsReloadInterval bounds how often certificate files are re-checked.
+func tlsReloadInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("TLS_RELOAD_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return time.Minute
+}
+
+// certReloader serves a key pair and CA pool from disk and reloads them
+// when the files' modification times change, so rotated certificates are
+// picked up without a restart. A failed reload keeps the previous
+// material and is logged.
+type certReloader struct {
+	files    tlsFiles
+	interval time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	stamps  map[string]time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func newCertReloader(files tlsFiles) (*certReloader, error) {
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, errors.New("certificate and key files must be set together")
+	}
+	r := &certReloader{files: files, interval: tlsReloadInterval()}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) paths() []string {
+	var out []string
+	for _, p := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (r *certReloader) load() error {
+	stamps := map[string]time.Time{}
+	for _, p := range r.paths() {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		stamps[p] = fi.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if r.files.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load key pair: %w", err)
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if r.files.CAFile != "" {
+		pem, err := os.ReadFile(r.files.CAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.files.CAFile)
+		}
+	}
+
+	r.cert, r.pool, r.stamps = cert, pool, stamps
+	r.checked = time.Now()
+	return nil
+}
+
+// refresh reloads the files if the check interval has elapsed and any of
+// them changed on disk.
+func (r *certReloader) refresh() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < r.interval {
+		return
+	}
+	r.checked = time.Now()
+	for _, p := range r.paths() {
+		fi, err := os.Stat(p)
+		if err == nil && fi.ModTime().Equal(r.stamps[p]) {
+			continue
+		}
+		if err := r.load(); err != nil {
+			log.Printf("TLS reload of %s failed, keeping previous certificates: %v", strings.Join(r.paths(), ", "), err)
+		} else {
+			log.Printf("TLS certificates reloaded from %s", strings.Join(r.paths(), ", "))
+		}
+		return
+	}
+}
+
+func (r *certReloader) certificate() *tls.Certificate {
+	r.refresh()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert
+}
+
+func (r *certReloader) caPool() *x509.CertPool {
+	r.refresh()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pool
+}
+
+// serverTLSConfig builds the listener TLS config. The certificate comes
+// either from TLS_CERT_FILE and TLS_KEY_FILE or, when TLS_AUTOCERT_DOMAINS
+// is set, from Let's Encrypt via ACME; the returned manager is non-nil in
+// that case so the HTTP-01 challenge handler can be mounted.
+// Setting TLS_CLIENT_CA_FILE enables mutual TLS so only callers holding a
+// certificate from that CA (Kong) can connect; TLS_CLIENT_AUTH selects
+// "require" (default), "verify-if-given" or "none".
+// It returns a nil config when TLS is not configured.
+func serverTLSConfig() (*tls.Config, *autocert.Manager, error) {
+	files := tlsFilesFromEnv("TLS", "CLIENT_CA_FILE")
+	domains := getEnvList("TLS_AUTOCERT_DOMAINS", nil)
+	switch {
+	case files.CertFile == "" && len(domains) == 0:
+		if files.CAFile != "" {
+			return nil, nil, errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE/TLS_KEY_FILE or TLS_AUTOCERT_DOMAINS")
+		}
+		return nil, nil, nil
+	case files.CertFile != "" && len(domains) > 0:
+		return nil, nil, errors.New("TLS_CERT_FILE and TLS_AUTOCERT_DOMAINS are mutually exclusive")
+	}
+
+	var r *certReloader
+	if files != (tlsFiles{}) {
+		var err error
+		if r, err = newCertReloader(files); err != nil {
+			return nil, nil, fmt.Errorf("server TLS: %w", err)
+		}
+	}
+
+	clientAuth := tls.NoClientCert
+	if files.CAFile != "" {
+		switch getEnv("TLS_CLIENT_AUTH", "require") {
+		case "require":
+			clientAuth = tls.RequireAndVerifyClientCert
+		case "verify-if-given":
+			clientAuth = tls.VerifyClientCertIfGiven
+		case "none":
+		default:
+			return nil, nil, fmt.Errorf("server TLS: unknown TLS_CLIENT_AUTH %q", os.Getenv("TLS_CLIENT_AUTH"))
+		}
+	}
+
+	var manager *autocert.Manager
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return r.certificate(), nil
+	}
+	nextProtos := []string{"http/1.1"}
+	if len(domains) > 0 {
+		manager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(getEnv("TLS_AUTOCERT_CACHE_DIR", "autocert-cache")),
+			Email:      os.Getenv("TLS_AUTOCERT_EMAIL"),
+		}
+		getCertificate = manager.GetCertificate
+		nextProtos = append(nextProtos, acme.ALPNProto)
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: getCertificate,
+				NextProtos:     nextProtos,
+				ClientAuth:     clientAuth,
+			}
+			if files.CAFile != "" {
+				cfg.ClientCAs = r.caPool()
+			}
+			return cfg, nil
+		},
+	}, manager, nil
+}
+
+// upstreamTLSConfig builds the client TLS config for an upstream such as
+// "KEYCLOAK" or "MONGO" from <PREFIX>_TLS_CERT_FILE / _KEY_FILE (client
+// certificate) and <PREFIX>_TLS_CA_FILE (custom CA bundle). It returns nil
+// when none of them are set, leaving the system defaults in place.
+func upstreamTLSConfig(prefix string) (*tls.Config, error) {
+	files := tlsFilesFromEnv(prefix+"_TLS", "CA_FILE")
+	if files == (tlsFiles{}) {
+		return nil, nil
+	}
+	r, err := newCertReloader(files)
+	if err != nil {
+		return nil, fmt.Errorf("%s TLS: %w", strings.ToLower(prefix), err)
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if files.CertFile != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.certificate(), nil
+		}
+	}
+	if files.CAFile != "" {
+		// Verification is done by hand so a rotated CA bundle applies to new
+		// connections; the standard check is skipped only to allow that.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			if cs.ServerName == "" {
+				return errors.New("no server name to verify the certificate against")
+			}
+			opts := x509.VerifyOptions{
+				Roots:         r.caPool(),
+				DNSName:       cs.ServerName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	return cfg, nil
+}
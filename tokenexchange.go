@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Token exchange (RFC 8693) trades the caller's access token for one
+// issued to another audience, so a handler can call a downstream API on
+// the user's behalf with a token that API accepts and nothing more. The
+// app's client needs Keycloak's token-exchange permission for each target
+// client.
+const (
+	grantTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccess    = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// exchangeError is Keycloak refusing an exchange, as opposed to failing
+// to reach it.
+type exchangeError struct {
+	Status      int
+	Code        string
+	Description string
+}
+
+func (e *exchangeError) Error() string {
+	return fmt.Sprintf("token exchange refused (%d %s): %s", e.Status, e.Code, e.Description)
+}
+
+type exchangedToken struct {
+	token   string
+	expires time.Time
+}
+
+// exchanged caches tokens per (subject, audience). An entry never outlives
+// the inbound token it came from.
+var exchanged struct {
+	sync.Mutex
+	tokens map[string]exchangedToken
+}
+
+var exchangeGroup singleflight.Group
+
+const exchangeCacheMax = 10000
+
+// forgetExchanges drops every cached exchanged token and returns how many
+// there were.
+func forgetExchanges() int {
+	exchanged.Lock()
+	defer exchanged.Unlock()
+	n := len(exchanged.tokens)
+	exchanged.tokens = nil
+	return n
+}
+
+func cachedExchange(key string) (string, bool) {
+	exchanged.Lock()
+	defer exchanged.Unlock()
+	t, ok := exchanged.tokens[key]
+	if !ok || time.Until(t.expires) < 30*time.Second {
+		return "", false
+	}
+	return t.token, true
+}
+
+func storeExchange(key string, t exchangedToken) {
+	exchanged.Lock()
+	defer exchanged.Unlock()
+	if exchanged.tokens == nil {
+		exchanged.tokens = map[string]exchangedToken{}
+	}
+	if len(exchanged.tokens) >= exchangeCacheMax {
+		now := time.Now()
+		for k, v := range exchanged.tokens {
+			if v.expires.Before(now) {
+				delete(exchanged.tokens, k)
+			}
+		}
+	}
+	if len(exchanged.tokens) >= exchangeCacheMax {
+		// Still full of live tokens: start over rather than grow.
+		exchanged.tokens = map[string]exchangedToken{}
+	}
+	exchanged.tokens[key] = t
+}
+
+// exchangeAudienceAllowed applies TOKEN_EXCHANGE_AUDIENCES, the clients
+// handlers may request tokens for. Unset allows any.
+func exchangeAudienceAllowed(audience string) bool {
+	allowed := getEnvList("TOKEN_EXCHANGE_AUDIENCES", nil)
+	return len(allowed) == 0 || slices.Contains(allowed, audience)
+}
+
+// exchangeToken returns a token for audience on behalf of subject, whose
+// inbound token is subjectToken and expires at subjectExpiry.
+func exchangeToken(ctx context.Context, subject, subjectToken string, subjectExpiry time.Time, audience string) (string, error) {
+	if !exchangeAudienceAllowed(audience) {
+		return "", fmt.Errorf("token exchange: audience %q is not in TOKEN_EXCHANGE_AUDIENCES", audience)
+	}
+	key := subject + "\x00" + audience
+	if token, ok := cachedExchange(key); ok {
+		return token, nil
+	}
+	v, err, _ := exchangeGroup.Do(key, func() (interface{}, error) {
+		t, err := requestExchange(ctx, subjectToken, audience)
+		if err != nil {
+			return "", err
+		}
+		if !subjectExpiry.IsZero() && subjectExpiry.Before(t.expires) {
+			t.expires = subjectExpiry
+		}
+		storeExchange(key, t)
+		return t.token, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+func requestExchange(ctx context.Context, subjectToken, audience string) (exchangedToken, error) {
+	secret := keycloakClientSecret()
+	if secret == "" {
+		return exchangedToken{}, errors.New("token exchange: KEYCLOAK_CLIENT_SECRET is not set")
+	}
+	form := url.Values{
+		"grant_type":           {grantTokenExchange},
+		"client_id":            {keycloakClientID()},
+		"client_secret":        {secret},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {tokenTypeAccess},
+		"requested_token_type": {tokenTypeAccess},
+		"audience":             {audience},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, keycloakIssuer()+"/protocol/openid-connect/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return exchangedToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := keycloakHTTP.Do(req)
+	if err != nil {
+		return exchangedToken{}, fmt.Errorf("token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return exchangedToken{}, fmt.Errorf("token exchange: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return exchangedToken{}, &exchangeError{Status: resp.StatusCode, Code: body.Error, Description: body.ErrorDescription}
+	}
+	return exchangedToken{
+		token:   body.AccessToken,
+		expires: time.Now().Add(time.Duration(body.ExpiresIn) * time.Second),
+	}, nil
+}
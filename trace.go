@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// traceContext ties the work done for one request together: its request
+// ID and its W3C trace context (https://www.w3.org/TR/trace-context/).
+// The trace ID comes from the caller's traceparent, as set by Kong's
+// OpenTelemetry plugin, or is generated; SpanID identifies this service's
+// part of the trace and is what outbound calls name as their parent.
+type traceContext struct {
+	RequestID string
+	TraceID   string
+	SpanID    string
+	Flags     string
+	// State is the caller's tracestate, passed through untouched.
+	State string
+}
+
+func (t traceContext) traceparent() string {
+	return "00-" + t.TraceID + "-" + t.SpanID + "-" + t.Flags
+}
+
+var traceparentRe = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// parseTraceparent returns the trace ID and flags of a traceparent header.
+// Version ff and all-zero IDs are invalid.
+func parseTraceparent(h string) (traceID, flags string, ok bool) {
+	m := traceparentRe.FindStringSubmatch(strings.TrimSpace(h))
+	if m == nil || m[1] == "ff" || strings.Trim(m[2], "0") == "" || strings.Trim(m[3], "0") == "" {
+		return "", "", false
+	}
+	return m[2], m[4], true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type traceKey struct{}
+
+func withTrace(ctx context.Context, t traceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// traceFrom returns the trace context of the request ctx belongs to.
+func traceFrom(ctx context.Context) (traceContext, bool) {
+	t, ok := ctx.Value(traceKey{}).(traceContext)
+	return t, ok
+}
+
+// tracing starts the request's trace context, keeps it in the locals for
+// the access log and in the user context for the Mongo and HTTP clients.
+// It must run after the request ID middleware.
+func tracing(c *fiber.Ctx) error {
+	t := traceContext{SpanID: randomHex(8), Flags: "00"}
+	t.RequestID, _ = c.Locals("requestid").(string)
+	if id, flags, ok := parseTraceparent(c.Get("traceparent")); ok {
+		t.TraceID, t.Flags, t.State = id, flags, c.Get("tracestate")
+	} else {
+		t.TraceID = randomHex(16)
+	}
+	c.Locals("trace", t)
+	c.SetUserContext(withTrace(c.UserContext(), t))
+	return c.Next()
+}
+
+// tracingTransport adds the trace context and request ID of the request's
+// context to outbound calls, so Keycloak's and Kong's logs show which
+// request caused them.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (tr tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t, ok := traceFrom(req.Context())
+	if !ok {
+		return tr.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("traceparent", t.traceparent())
+	if t.State != "" {
+		req.Header.Set("tracestate", t.State)
+	}
+	if t.RequestID != "" && req.Header.Get(fiber.HeaderXRequestID) == "" {
+		req.Header.Set(fiber.HeaderXRequestID, t.RequestID)
+	}
+	return tr.base.RoundTrip(req)
+}
+
+// mongoComment is the $comment of the MongoDB operations done for the
+// request of ctx, which the slow query log and currentOp show, as in
+// "fiber-demo requestId=... traceparent=...". Outside a request it only
+// names the app.
+func mongoComment(ctx context.Context) string {
+	t, ok := traceFrom(ctx)
+	if !ok {
+		return "fiber-demo"
+	}
+	return "fiber-demo requestId=" + t.RequestID + " traceparent=" + t.traceparent()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/internal/httpclient"
+	"github.com/gofiber/fiber/v2"
+)
+
+// upstreamHTTP calls sibling services, attaching the token each target
+// expects (UPSTREAM_TARGETS). Requests built with the handler's
+// c.UserContext() send the caller's token to user-token targets.
+var (
+	upstreamHTTP      *http.Client
+	upstreamTransport *httpclient.Transport
+	// upstreamUsers is set when a target is sent the caller's token.
+	upstreamUsers bool
+	// upstreamRoutes maps the services of UPSTREAM_ROUTES to their URLs.
+	upstreamRoutes map[string]string
+)
+
+// upstreamBodyMax bounds the relayed response body.
+const upstreamBodyMax = 4 << 20
+
+// initUpstream builds upstreamHTTP. UPSTREAM_TARGETS lists
+// "<url prefix>=<auth>" pairs, auth being "user", "user:<audience>" (the
+// user's token exchanged for that client), "service" (the app's
+// client-credentials token) or "none". URLs outside every prefix get no
+// token. TLS comes from UPSTREAM_TLS_*. UPSTREAM_ROUTES lists
+// "<service>=<url>" pairs relayed under /upstream/<service>.
+func initUpstream() error {
+	targets, err := parseUpstreamTargets(getEnvList("UPSTREAM_TARGETS", nil))
+	if err != nil {
+		return err
+	}
+	if upstreamRoutes, err = parseUpstreamRoutes(getEnvList("UPSTREAM_ROUTES", nil)); err != nil {
+		return err
+	}
+	tlsCfg, err := upstreamTLSConfig("UPSTREAM")
+	if err != nil {
+		return err
+	}
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsCfg != nil {
+		base.TLSClientConfig = tlsCfg
+	}
+	upstreamTransport = httpclient.NewTransport(httpclient.Config{
+		Targets:          targets,
+		ServiceToken:     keycloakServiceToken,
+		Exchange:         exchangeForUser,
+		Timeout:          getEnvDuration("UPSTREAM_TIMEOUT", 10*time.Second),
+		Retries:          getEnvInt("UPSTREAM_RETRIES", 2),
+		Backoff:          getEnvDuration("UPSTREAM_RETRY_BACKOFF", 100*time.Millisecond),
+		BreakerThreshold: getEnvInt("UPSTREAM_BREAKER_THRESHOLD", 5),
+		BreakerCooldown:  getEnvDuration("UPSTREAM_BREAKER_COOLDOWN", 30*time.Second),
+		Base:             tracingTransport{base},
+	})
+	upstreamHTTP = &http.Client{Transport: upstreamTransport}
+	for _, t := range targets {
+		upstreamUsers = upstreamUsers || t.Auth == httpclient.AuthUser
+	}
+	return nil
+}
+
+func parseUpstreamTargets(entries []string) ([]httpclient.Target, error) {
+	var targets []httpclient.Target
+	for _, e := range entries {
+		i := strings.LastIndex(e, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("UPSTREAM_TARGETS: %q is not <url prefix>=<auth>", e)
+		}
+		t := httpclient.Target{Prefix: e[:i]}
+		auth, audience, _ := strings.Cut(e[i+1:], ":")
+		var err error
+		if t.Auth, err = httpclient.ParseAuth(auth); err != nil {
+			return nil, fmt.Errorf("UPSTREAM_TARGETS: %w", err)
+		}
+		if audience != "" && t.Auth != httpclient.AuthUser {
+			return nil, fmt.Errorf("UPSTREAM_TARGETS: %q: only user targets take an audience", e)
+		}
+		t.Audience = audience
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+func parseUpstreamRoutes(entries []string) (map[string]string, error) {
+	routes := map[string]string{}
+	for _, e := range entries {
+		name, u, ok := strings.Cut(e, "=")
+		if !ok || name == "" || strings.Contains(name, "/") || u == "" {
+			return nil, fmt.Errorf("UPSTREAM_ROUTES: %q is not <service>=<url>", e)
+		}
+		routes[name] = strings.TrimSuffix(u, "/")
+	}
+	return routes, nil
+}
+
+func exchangeForUser(ctx context.Context, u httpclient.User, audience string) (string, error) {
+	return exchangeToken(ctx, u.Subject, u.Token, u.Expires, audience)
+}
+
+// inboundUser is the caller as seen by downstream calls: their raw bearer
+// token, subject and token expiry.
+func inboundUser(c *fiber.Ctx) (httpclient.User, error) {
+	t := tokenFor(c)
+	if t.Err != nil {
+		return httpclient.User{}, t.Err
+	}
+	if t.Raw == "" {
+		return httpclient.User{}, errors.New("missing Authorization header")
+	}
+	u := httpclient.User{Token: t.Raw}
+	u.Subject, _ = t.Claims["sub"].(string)
+	if exp, ok := t.Claims["exp"].(float64); ok {
+		u.Expires = time.Unix(int64(exp), 0)
+	}
+	return u, nil
+}
+
+// carryUpstreamUser adds the caller to the request's context, for the
+// requests handlers send with upstreamHTTP. An anonymous caller is left
+// out, and user-token targets then fail with httpclient.ErrNoUser.
+func carryUpstreamUser(c *fiber.Ctx) error {
+	if upstreamUsers && c.Get(fiber.HeaderAuthorization) != "" {
+		if u, err := inboundUser(c); err == nil {
+			c.SetUserContext(httpclient.WithUser(c.UserContext(), u))
+		}
+	}
+	return c.Next()
+}
+
+// relayUpstream answers GET /upstream/:service/* with the service's answer
+// to the rest of the path, asked on the caller's behalf with upstreamHTTP:
+// the service's UPSTREAM_TARGETS entry decides whether it gets the
+// caller's token, one exchanged for its audience, or the app's own.
+func relayUpstream(c *fiber.Ctx) error {
+	if _, err := parseToken(c); err != nil {
+		return errUnauthorized(err.Error())
+	}
+	base, ok := upstreamRoutes[c.Params("service")]
+	if !ok {
+		return fiber.NewError(fiber.StatusNotFound, "Unknown upstream service")
+	}
+	target := base + "/" + c.Params("*")
+	if q := c.Request().URI().QueryString(); len(q) > 0 {
+		target += "?" + string(q)
+	}
+	req, err := http.NewRequestWithContext(c.UserContext(), http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if accept := c.Get(fiber.HeaderAccept); accept != "" {
+		req.Header.Set(fiber.HeaderAccept, accept)
+	}
+	resp, err := upstreamHTTP.Do(req)
+	if err != nil {
+		return errUpstream(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, upstreamBodyMax))
+	if err != nil {
+		return errUpstream(err)
+	}
+	if ct := resp.Header.Get(fiber.HeaderContentType); ct != "" {
+		c.Set(fiber.HeaderContentType, ct)
+	}
+	return c.Status(resp.StatusCode).Send(body)
+}
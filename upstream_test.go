@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// A relayed call exchanges the caller's token for the service's audience;
+// a refused exchange is a 403 and an unreachable token endpoint a 502.
+func TestRelayUpstreamExchangesToken(t *testing.T) {
+	var exchanges atomic.Int32
+	kc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchanges.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostFormValue("audience") != "billing-api" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error":"access_denied","error_description":"client not allowed to exchange"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"billing-token","expires_in":300}`))
+	}))
+	defer kc.Close()
+	svc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"path": r.URL.Path, "authorization": r.Header.Get("Authorization")})
+	}))
+	defer svc.Close()
+
+	t.Setenv("KEYCLOAK_ISSUER", kc.URL+"/realms/demo")
+	t.Setenv("KEYCLOAK_CLIENT_SECRET", "secret")
+	t.Setenv("UPSTREAM_TARGETS", svc.URL+"/billing=user:billing-api,"+svc.URL+"/ledger=user:ledger-api")
+	t.Setenv("UPSTREAM_ROUTES", "billing="+svc.URL+"/billing,ledger="+svc.URL+"/ledger")
+	t.Setenv("UPSTREAM_RETRIES", "-1")
+	if err := initUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { upstreamHTTP, upstreamTransport, upstreamUsers, upstreamRoutes = nil, nil, false, nil })
+	forgetExchanges()
+	t.Cleanup(func() { forgetExchanges() })
+
+	app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
+	app.Use(carryUpstreamUser)
+	app.Get("/api/v1/upstream/:service/*", relayUpstream)
+	alice := bearer(t, jwt.MapClaims{"sub": "u-alice", "roles": []interface{}{"user"}})
+	get := func(path, auth string) (*http.Response, map[string]interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(fiber.MethodGet, path, nil)
+		if auth != "" {
+			req.Header.Set(fiber.HeaderAuthorization, auth)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]interface{}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp, body
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, body := get("/api/v1/upstream/billing/invoices", alice)
+		if resp.StatusCode != fiber.StatusOK || body["authorization"] != "Bearer billing-token" || body["path"] != "/billing/invoices" {
+			t.Fatalf("billing: %d %v", resp.StatusCode, body)
+		}
+	}
+	if n := exchanges.Load(); n != 1 {
+		t.Errorf("%d exchanges for two calls, want 1 (cached)", n)
+	}
+
+	cases := []struct {
+		name, path, auth string
+		want             int
+	}{
+		{"exchange refused", "/api/v1/upstream/ledger/balance", alice, fiber.StatusForbidden},
+		{"anonymous", "/api/v1/upstream/billing/invoices", "", fiber.StatusUnauthorized},
+		{"unknown service", "/api/v1/upstream/payroll/runs", alice, fiber.StatusNotFound},
+	}
+	for _, c := range cases {
+		if resp, body := get(c.path, c.auth); resp.StatusCode != c.want {
+			t.Errorf("%s: status %d (%v), want %d", c.name, resp.StatusCode, body["detail"], c.want)
+		}
+	}
+
+	// Keycloak's token endpoint is down.
+	kc.Close()
+	forgetExchanges()
+	if resp, body := get("/api/v1/upstream/billing/invoices", alice); resp.StatusCode != fiber.StatusBadGateway {
+		t.Errorf("token endpoint down: status %d (%v), want 502", resp.StatusCode, body["detail"])
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// usersCollection mirrors the Keycloak users provisioned through SCIM, so
+// the app can look them up without calling the Admin API.
+const usersCollection = "users"
+
+// cachedUser is the local copy of a Keycloak user, keyed by its ID, which
+// is the subject of the user's tokens.
+type cachedUser struct {
+	ID          string    `bson:"_id"`
+	UserName    string    `bson:"userName"`
+	ExternalID  string    `bson:"externalId,omitempty"`
+	DisplayName string    `bson:"displayName,omitempty"`
+	Email       string    `bson:"email,omitempty"`
+	Active      bool      `bson:"active"`
+	Groups      []string  `bson:"groups"`
+	SyncedAt    time.Time `bson:"syncedAt"`
+}
+
+var userIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "userName", Value: 1}}},
+	{Keys: bson.D{{Key: "externalId", Value: 1}}, Options: options.Index().SetSparse(true)},
+	{Keys: bson.D{{Key: "groups", Value: 1}}},
+}
+
+// The cache is best effort: Keycloak stays the source of truth, so a
+// failed update is logged rather than failing the provisioning call, and
+// the next write to the user repairs it. With PostgreSQL there is no
+// cache.
+
+// cacheUser stores u with the IDs of its groups.
+func cacheUser(ctx context.Context, u kcUser, groups []kcGroup) {
+	if !usesMongo() {
+		return
+	}
+	doc := cachedUser{
+		ID:          u.ID,
+		UserName:    u.Username,
+		ExternalID:  firstAttr(u.Attributes, scimExternalIDAttr),
+		DisplayName: firstAttr(u.Attributes, scimDisplayNameAttr),
+		Email:       u.Email,
+		Active:      u.Enabled,
+		Groups:      make([]string, 0, len(groups)),
+		SyncedAt:    time.Now().UTC(),
+	}
+	for _, g := range groups {
+		doc.Groups = append(doc.Groups, g.ID)
+	}
+	_, err := db().Collection(usersCollection).ReplaceOne(ctx, bson.M{"_id": u.ID}, doc, options.Replace().SetUpsert(true))
+	logCacheError("user "+u.ID, err)
+	meCache.invalidate(ctx, u.ID)
+}
+
+// uncacheUser removes a deleted user.
+func uncacheUser(ctx context.Context, id string) {
+	if !usesMongo() {
+		return
+	}
+	_, err := db().Collection(usersCollection).DeleteOne(ctx, bson.M{"_id": id})
+	logCacheError("user "+id, err)
+	meCache.invalidate(ctx, id)
+}
+
+// cacheMembership adds the users to group, or removes them from it.
+func cacheMembership(ctx context.Context, groupID string, userIDs []string, add bool) {
+	if !usesMongo() || len(userIDs) == 0 {
+		return
+	}
+	update := bson.M{"$pull": bson.M{"groups": groupID}}
+	if add {
+		update = bson.M{"$addToSet": bson.M{"groups": groupID}}
+	}
+	_, err := db().Collection(usersCollection).UpdateMany(ctx, bson.M{"_id": bson.M{"$in": userIDs}}, update)
+	logCacheError("group "+groupID, err)
+}
+
+// uncacheGroup removes a deleted group from its members.
+func uncacheGroup(ctx context.Context, groupID string) {
+	if !usesMongo() {
+		return
+	}
+	_, err := db().Collection(usersCollection).UpdateMany(ctx, bson.M{"groups": groupID}, bson.M{"$pull": bson.M{"groups": groupID}})
+	logCacheError("group "+groupID, err)
+}
+
+func logCacheError(what string, err error) {
+	if err != nil {
+		log.Printf("User cache update for %s failed: %v", what, err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+// fieldError describes one failed constraint in a request DTO.
+type fieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+var validate = newValidator()
+
+// newValidator reports fields by their json/query names rather than the Go
+// struct field names.
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		for _, tag := range []string{"json", "query"} {
+			name := strings.SplitN(f.Tag.Get(tag), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			if name != "" {
+				return name
+			}
+		}
+		return f.Name
+	})
+	return v
+}
+
+func errValidation(fields []fieldError) *problem {
+	p := newProblem(fiber.StatusUnprocessableEntity, problemValidation, "Request failed validation")
+	p.Errors = fields
+	return p
+}
+
+// validateStruct runs the struct-tag rules on dto and converts failures
+// into a 422 problem listing every invalid field.
+func validateStruct(dto interface{}) error {
+	err := validate.Struct(dto)
+	if err == nil {
+		return nil
+	}
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return err
+	}
+	fields := make([]fieldError, 0, len(verrs))
+	for _, fe := range verrs {
+		fields = append(fields, fieldError{
+			Field:   fieldPath(fe),
+			Rule:    fe.Tag(),
+			Message: fieldMessage(fe),
+		})
+	}
+	return errValidation(fields)
+}
+
+// fieldPath drops the DTO type name from the validator namespace
+// ("createItemRequest.tags[0]" -> "tags[0]").
+func fieldPath(fe validator.FieldError) string {
+	ns := fe.Namespace()
+	if i := strings.IndexByte(ns, '.'); i >= 0 {
+		return ns[i+1:]
+	}
+	return fe.Field()
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required", "required_unless":
+		return "is required"
+	case "min":
+		return fmt.Sprintf("must be at least %s%s", fe.Param(), lengthUnit(fe.Kind()))
+	case "max":
+		return fmt.Sprintf("must be at most %s%s", fe.Param(), lengthUnit(fe.Kind()))
+	case "oneof":
+		return fmt.Sprintf("must be one of: %s", fe.Param())
+	case "bcp47_language_tag":
+		return "must be a language tag such as en-US"
+	default:
+		return fmt.Sprintf("failed rule %q", fe.Tag())
+	}
+}
+
+func lengthUnit(k reflect.Kind) string {
+	switch k {
+	case reflect.String:
+		return " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return " entries"
+	}
+	return ""
+}
+
+// bindBody decodes the request body into dto and validates it. A body that
+// cannot be decoded is a 400; one that decodes but breaks a rule is a 422.
+func bindBody(c *fiber.Ctx, dto interface{}) error {
+	if err := c.BodyParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, problemValidation, "Malformed request body: "+err.Error())
+	}
+	return validateStruct(dto)
+}
+
+// bindQuery decodes and validates the query string into dto.
+func bindQuery(c *fiber.Ctx, dto interface{}) error {
+	if err := c.QueryParser(dto); err != nil {
+		return newProblem(fiber.StatusBadRequest, problemValidation, "Malformed query string: "+err.Error())
+	}
+	return validateStruct(dto)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// apiVersion describes one mounted version of the API.
+type apiVersion struct {
+	Name       string
+	Deprecated bool
+	// Sunset is the announced removal date; zero when none has been set.
+	Sunset time.Time
+	// Successor is the version clients should migrate to once deprecated.
+	Successor string
+}
+
+// apiVersions lists every version mounted under /api, oldest first.
+var apiVersions = []apiVersion{
+	{Name: "v1"},
+	{Name: "v2"},
+}
+
+const defaultAPIVersion = "v1"
+
+// legacyRoutes are the unversioned paths the existing Kong routes point
+// at. They stay available as deprecated aliases of the default version.
+var legacyRoutes = map[string]bool{
+	"/public":  true,
+	"/profile": true,
+	"/user":    true,
+	"/admin":   true,
+}
+
+var (
+	versionedPath = regexp.MustCompile(`^/api/(v[0-9]+)(/|$)`)
+	vendorAccept  = regexp.MustCompile(`application/vnd\.fiber-demo\.(v[0-9]+)\+json`)
+)
+
+func lookupVersion(name string) (apiVersion, bool) {
+	for _, v := range apiVersions {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return apiVersion{}, false
+}
+
+// versionFromAccept picks the API version requested through the Accept
+// header, e.g. "application/vnd.fiber-demo.v2+json".
+func versionFromAccept(accept string) string {
+	if m := vendorAccept.FindStringSubmatch(accept); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// negotiateVersion rewrites /api/<path> to /api/<version>/<path> when the
+// path carries no explicit version, using the Accept header or falling
+// back to the default version.
+func negotiateVersion(c *fiber.Ctx) error {
+	path := c.Path()
+	if versionedPath.MatchString(path) {
+		return c.Next()
+	}
+	// The version, and so the response, depends on Accept.
+	c.Vary(fiber.HeaderAccept)
+	name := versionFromAccept(c.Get(fiber.HeaderAccept))
+	if name == "" {
+		name = defaultAPIVersion
+	}
+	if _, ok := lookupVersion(name); !ok {
+		return fiber.NewError(fiber.StatusNotAcceptable, fmt.Sprintf("Unsupported API version: %s", name))
+	}
+	c.Path("/api/" + name + strings.TrimPrefix(path, "/api"))
+	return c.RestartRouting()
+}
+
+// legacyAlias serves the unversioned legacy paths from the default version
+// and marks the responses as deprecated.
+func legacyAlias(c *fiber.Ctx) error {
+	path := c.Path()
+	if !legacyRoutes[path] {
+		return c.Next()
+	}
+	setDeprecationHeaders(c, apiVersion{Deprecated: true, Successor: defaultAPIVersion})
+	c.Path("/api/" + defaultAPIVersion + path)
+	return c.RestartRouting()
+}
+
+// versionHeaders is the shared middleware of a version group. It records
+// the version for handlers and advertises deprecation when applicable.
+func versionHeaders(v apiVersion) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals("apiVersion", v.Name)
+		c.Set("API-Version", v.Name)
+		setDeprecationHeaders(c, v)
+		return c.Next()
+	}
+}
+
+// setDeprecationHeaders sets the Deprecation, Sunset and Link headers
+// (RFC 8594) for a deprecated version.
+func setDeprecationHeaders(c *fiber.Ctx, v apiVersion) {
+	if !v.Deprecated {
+		return
+	}
+	c.Set("Deprecation", "true")
+	if !v.Sunset.IsZero() {
+		c.Set("Sunset", v.Sunset.UTC().Format(time.RFC1123))
+	}
+	if v.Successor != "" {
+		c.Append(fiber.HeaderLink, fmt.Sprintf(`</api/%s>; rel="successor-version"`, v.Successor))
+	}
+}
+
+// currentVersion returns the API version the request was routed to.
+func currentVersion(c *fiber.Ctx) string {
+	if v, ok := c.Locals("apiVersion").(string); ok {
+		return v
+	}
+	return defaultAPIVersion
+}
+
+// useVersionRouting installs the legacy aliases and version negotiation.
+// Both rewrite the path and restart routing, so they go ahead of any
+// middleware that must not run twice for one request.
+func useVersionRouting(app *fiber.App) {
+	app.Use(legacyAlias)
+	app.Use("/api", negotiateVersion)
+}
+
+// mountAPI registers every API version under /api.
+func mountAPI(app *fiber.App) {
+	api := app.Group("/api")
+	if usesMongo() {
+		if getEnvBool("MONGO_CAUSAL_CONSISTENCY", false) {
+			api.Use(causalConsistency())
+		}
+		api.Use(idempotency)
+	}
+	api.Use(flagCaller)
+	for _, v := range apiVersions {
+		registerRoutes(api.Group("/"+v.Name, versionHeaders(v)))
+	}
+}
@@ -0,0 +1,6 @@
+// Placeholder frontend: shows the runtime configuration the app serves.
+fetch("/app/config.json")
+  .then((res) => res.json())
+  .then((cfg) => {
+    document.getElementById("config").textContent = JSON.stringify(cfg, null, 2);
+  });
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	webhooksCollection          = "webhooks"
+	webhookDeliveriesCollection = "webhook_deliveries"
+)
+
+// webhookEvents are the event types a webhook can subscribe to.
+var webhookEvents = map[string]bool{
+	eventItemCreated:     true,
+	eventItemUpdated:     true,
+	eventItemDeleted:     true,
+	eventAuthAnomaly:     true,
+	eventAuthUnpinnedKey: true,
+}
+
+// webhook is a target registered through /admin/webhooks. The secret signs
+// deliveries and is only shown when it is set.
+type webhook struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	URL         string             `bson:"url" json:"url"`
+	Events      []string           `bson:"events" json:"events"`
+	Active      bool               `bson:"active" json:"active"`
+	Description string             `bson:"description,omitempty" json:"description,omitempty"`
+	Secret      encryptedString    `bson:"secret" json:"-"`
+	CreatedBy   string             `bson:"createdBy" json:"createdBy"`
+	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt   time.Time          `bson:"updatedAt" json:"updatedAt"`
+}
+
+// webhookDelivery records one delivery attempt, for debugging receivers.
+type webhookDelivery struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	WebhookID primitive.ObjectID `bson:"webhookId" json:"webhookId"`
+	EventID   string             `bson:"eventId" json:"eventId"`
+	EventType string             `bson:"eventType" json:"eventType"`
+	Attempt   int                `bson:"attempt" json:"attempt"`
+	Status    int                `bson:"status,omitempty" json:"status,omitempty"`
+	Error     string             `bson:"error,omitempty" json:"error,omitempty"`
+	Response  string             `bson:"response,omitempty" json:"response,omitempty"`
+	Duration  float64            `bson:"durationMs" json:"durationMs"`
+	At        time.Time          `bson:"at" json:"at"`
+}
+
+var (
+	webhookIndexes = []mongo.IndexModel{
+		{Keys: bson.D{{Key: "events", Value: 1}, {Key: "active", Value: 1}}},
+	}
+	webhookDeliveryIndexes = []mongo.IndexModel{
+		{Keys: bson.D{{Key: "webhookId", Value: 1}, {Key: "at", Value: -1}}},
+	}
+)
+
+var (
+	webhooksEnabled bool
+	webhookHTTP     *http.Client
+)
+
+// initWebhooks enables webhooks, which are delivered as jobs and so need
+// MongoDB and JOBS_ENABLED. Each attempt has WEBHOOK_TIMEOUT (default
+// 10s); failed attempts are retried with the job queue's backoff, up to
+// JOBS_MAX_ATTEMPTS. Redirects are not followed.
+func initWebhooks() {
+	if !usesMongo() || !jobsEnabled {
+		return
+	}
+	webhookHTTP = &http.Client{
+		Timeout: getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	webhooksEnabled = true
+}
+
+// queueWebhooks enqueues a delivery of e to every active webhook
+// subscribed to it. It runs in the background so the request that caused
+// the event doesn't wait for the lookup.
+func queueWebhooks(e cloudEvent) {
+	if !webhooksEnabled || !webhookEvents[e.name] {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := enqueueWebhooks(ctx, e); err != nil {
+			log.Printf("Webhooks for %s not queued: %v", e.ID, err)
+		}
+	}()
+}
+
+// enqueueWebhooks adds the delivery jobs of e. The outbox relay calls it
+// in the transaction that marks the entry, so each is queued exactly once.
+func enqueueWebhooks(ctx context.Context, e cloudEvent) error {
+	if !webhookEvents[e.name] {
+		return nil
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	cur, err := db().Collection(webhooksCollection).Find(ctx,
+		bson.M{"active": true, "events": e.name}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var hooks []webhook
+	if err := cur.All(ctx, &hooks); err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		// The key keeps a retried enqueue from delivering twice.
+		err := enqueueJob(ctx, "webhook.deliver", "webhook:"+h.ID.Hex()+":"+e.ID, bson.M{
+			"webhook": h.ID.Hex(), "eventId": e.ID, "eventType": e.name, "body": string(body),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signWebhook returns the signature header of a delivery: the HMAC-SHA256
+// of "<timestamp>.<body>" under the webhook's secret, hex encoded.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts one event to one webhook and logs the attempt. A
+// webhook deleted or deactivated since the event is skipped.
+func deliverWebhook(ctx context.Context, payload bson.M) error {
+	id, err := primitive.ObjectIDFromHex(fmt.Sprint(payload["webhook"]))
+	if err != nil {
+		return nil
+	}
+	var h webhook
+	err = db().Collection(webhooksCollection).FindOne(ctx, bson.M{"_id": id}).Decode(&h)
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && !h.Active) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	body, _ := payload["body"].(string)
+	d := webhookDelivery{
+		WebhookID: id,
+		EventID:   fmt.Sprint(payload["eventId"]),
+		EventType: fmt.Sprint(payload["eventType"]),
+		Attempt:   jobAttempt(ctx),
+		At:        time.Now().UTC(),
+	}
+	d.Status, d.Response, err = postWebhook(ctx, h, d, []byte(body))
+	d.Duration = float64(time.Since(d.At).Microseconds()) / 1000
+	if err != nil {
+		d.Error = err.Error()
+	}
+	if _, logErr := db().Collection(webhookDeliveriesCollection).InsertOne(ctx, d); logErr != nil {
+		log.Printf("Webhook delivery %s to %s not logged: %v", d.EventID, h.ID.Hex(), logErr)
+	}
+	return err
+}
+
+// postWebhook sends the delivery and returns the status and the start of
+// the response body. Any status outside 2xx is an error.
+func postWebhook(ctx context.Context, h webhook, d webhookDelivery, body []byte) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	req.Header.Set("User-Agent", "fiber-demo-webhooks")
+	req.Header.Set("X-Webhook-Id", d.EventID)
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set("X-Webhook-Attempt", strconv.Itoa(d.Attempt))
+	ts := d.At.Unix()
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Webhook-Signature", signWebhook(string(h.Secret), ts, body))
+	resp, err := webhookHTTP.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, string(snippet), fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, string(snippet), nil
+}
+
+func registerWebhookRoutes(r fiber.Router) {
+	r.Get("/webhooks", listWebhooks)
+	r.Post("/webhooks", createWebhook)
+	r.Get("/webhooks/:id", getWebhook)
+	r.Put("/webhooks/:id", replaceWebhook)
+	r.Delete("/webhooks/:id", deleteWebhook)
+	r.Get("/webhooks/:id/deliveries", listWebhookDeliveries)
+}
+
+// webhookRequest is the body of webhook create and replace calls. Without
+// a secret, create generates one and replace keeps the current one.
+type webhookRequest struct {
+	URL         string   `json:"url" validate:"required,url,max=2048"`
+	Events      []string `json:"events" validate:"required,min=1,max=20"`
+	Active      *bool    `json:"active"`
+	Description string   `json:"description" validate:"max=200"`
+	Secret      string   `json:"secret" validate:"omitempty,min=16,max=256"`
+}
+
+// webhookWithSecret is the reply to a call that set the secret, the only
+// time it is returned.
+type webhookWithSecret struct {
+	webhook
+	Secret string `json:"secret"`
+}
+
+func errWebhookNotFound() *problem {
+	return newProblem(fiber.StatusNotFound, problemAboutBlank, "Webhook not found")
+}
+
+func webhookID(c *fiber.Ctx) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return id, errWebhookNotFound()
+	}
+	return id, nil
+}
+
+// bindWebhook reads and checks a webhookRequest. Plain http targets are
+// refused in production.
+func bindWebhook(c *fiber.Ctx) (webhookRequest, error) {
+	var req webhookRequest
+	if err := bindBody(c, &req); err != nil {
+		return req, err
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "https" && (u.Scheme != "http" || appEnv() == "production")) {
+		msg := "must be an http or https URL"
+		if appEnv() == "production" {
+			msg = "must be an https URL"
+		}
+		return req, errValidation([]fieldError{{Field: "url", Rule: "scheme", Message: msg}})
+	}
+	var fields []fieldError
+	for i, name := range req.Events {
+		if !webhookEvents[name] {
+			fields = append(fields, fieldError{Field: fmt.Sprintf("events[%d]", i), Rule: "oneof", Message: "must be one of " + strings.Join(webhookEventNames(), " ")})
+		}
+	}
+	if len(fields) > 0 {
+		return req, errValidation(fields)
+	}
+	return req, nil
+}
+
+// webhookEventNames lists webhookEvents in order.
+func webhookEventNames() []string {
+	names := make([]string, 0, len(webhookEvents))
+	for name := range webhookEvents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func listWebhooks(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	cur, err := db().Collection(webhooksCollection).Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return errDatabase(err)
+	}
+	hooks := []webhook{}
+	if err := cur.All(ctx, &hooks); err != nil {
+		return errDatabase(err)
+	}
+	return c.JSON(fiber.Map{"webhooks": hooks})
+}
+
+func createWebhook(c *fiber.Ctx) error {
+	req, err := bindWebhook(c)
+	if err != nil {
+		return err
+	}
+	if req.Secret == "" {
+		if req.Secret, err = newWebhookSecret(); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UTC()
+	h := webhook{
+		ID:          primitive.NewObjectID(),
+		URL:         req.URL,
+		Events:      req.Events,
+		Active:      req.Active == nil || *req.Active,
+		Description: req.Description,
+		Secret:      encryptedString(req.Secret),
+		CreatedBy:   subject(c),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if _, err := db().Collection(webhooksCollection).InsertOne(c.UserContext(), h); err != nil {
+		return errDatabase(err)
+	}
+	recordAudit(c, "webhook.create", h.ID.Hex(), bson.M{"url": h.URL, "events": h.Events})
+	return c.Status(fiber.StatusCreated).JSON(webhookWithSecret{webhook: h, Secret: req.Secret})
+}
+
+func findWebhook(ctx context.Context, id primitive.ObjectID) (webhook, error) {
+	var h webhook
+	err := db().Collection(webhooksCollection).FindOne(ctx, bson.M{"_id": id}).Decode(&h)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return h, errWebhookNotFound()
+	}
+	if err != nil {
+		return h, errDatabase(err)
+	}
+	return h, nil
+}
+
+func getWebhook(c *fiber.Ctx) error {
+	id, err := webhookID(c)
+	if err != nil {
+		return err
+	}
+	h, err := findWebhook(c.UserContext(), id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(h)
+}
+
+func replaceWebhook(c *fiber.Ctx) error {
+	id, err := webhookID(c)
+	if err != nil {
+		return err
+	}
+	req, err := bindWebhook(c)
+	if err != nil {
+		return err
+	}
+	set := bson.M{
+		"url":         req.URL,
+		"events":      req.Events,
+		"active":      req.Active == nil || *req.Active,
+		"description": req.Description,
+		"updatedAt":   time.Now().UTC(),
+	}
+	if req.Secret != "" {
+		set["secret"] = encryptedString(req.Secret)
+	}
+	var h webhook
+	err = db().Collection(webhooksCollection).FindOneAndUpdate(c.UserContext(), bson.M{"_id": id},
+		bson.M{"$set": set}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&h)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errWebhookNotFound()
+	}
+	if err != nil {
+		return errDatabase(err)
+	}
+	recordAudit(c, "webhook.update", id.Hex(), bson.M{"url": h.URL, "events": h.Events, "active": h.Active, "secretChanged": req.Secret != ""})
+	if req.Secret != "" {
+		return c.JSON(webhookWithSecret{webhook: h, Secret: req.Secret})
+	}
+	return c.JSON(h)
+}
+
+// deleteWebhook removes the webhook. Its queued deliveries are skipped and
+// its delivery log expires with the retention.
+func deleteWebhook(c *fiber.Ctx) error {
+	id, err := webhookID(c)
+	if err != nil {
+		return err
+	}
+	res, err := db().Collection(webhooksCollection).DeleteOne(c.UserContext(), bson.M{"_id": id})
+	if err != nil {
+		return errDatabase(err)
+	}
+	if res.DeletedCount == 0 {
+		return errWebhookNotFound()
+	}
+	recordAudit(c, "webhook.delete", id.Hex(), nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+type listDeliveriesQuery struct {
+	Failed bool   `query:"failed"`
+	Event  string `query:"event" validate:"max=100"`
+	Limit  int    `query:"limit" validate:"omitempty,min=1,max=100"`
+}
+
+// listWebhookDeliveries returns the latest delivery attempts, newest
+// first. failed=true keeps the failed ones, event those of one event ID.
+func listWebhookDeliveries(c *fiber.Ctx) error {
+	id, err := webhookID(c)
+	if err != nil {
+		return err
+	}
+	var q listDeliveriesQuery
+	if err := bindQuery(c, &q); err != nil {
+		return err
+	}
+	if q.Limit == 0 {
+		q.Limit = 50
+	}
+	ctx := c.UserContext()
+	if _, err := findWebhook(ctx, id); err != nil {
+		return err
+	}
+	filter := bson.M{"webhookId": id}
+	if q.Failed {
+		filter["error"] = bson.M{"$exists": true}
+	}
+	if q.Event != "" {
+		filter["eventId"] = q.Event
+	}
+	cur, err := db().Collection(webhookDeliveriesCollection).Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "at", Value: -1}}).SetLimit(int64(q.Limit)))
+	if err != nil {
+		return errDatabase(err)
+	}
+	deliveries := []webhookDelivery{}
+	if err := cur.All(ctx, &deliveries); err != nil {
+		return errDatabase(err)
+	}
+	return c.JSON(fiber.Map{"deliveries": deliveries})
+}
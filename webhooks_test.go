@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestBindWebhookEvents(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
+	app.Post("/webhooks", func(c *fiber.Ctx) error {
+		if _, err := bindWebhook(c); err != nil {
+			return err
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+	cases := []struct {
+		events string
+		want   int
+	}{
+		{`["item.created","item.deleted"]`, fiber.StatusNoContent},
+		{`["auth.anomaly"]`, fiber.StatusNoContent},
+		{`["auth.unpinned_key"]`, fiber.StatusNoContent},
+		{`["auth.denied"]`, fiber.StatusUnprocessableEntity},
+		{`[]`, fiber.StatusUnprocessableEntity},
+	}
+	for _, c := range cases {
+		body := `{"url":"https://hooks.example.com/in","events":` + c.events + `}`
+		req := httptest.NewRequest(fiber.MethodPost, "/webhooks", strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.want {
+			t.Errorf("events %s: status %d, want %d", c.events, resp.StatusCode, c.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Close codes sent when the server ends a connection because of auth.
+const (
+	wsCloseTokenExpired = 4001
+	wsCloseDenylisted   = 4003
+)
+
+// wsConns holds the open connections by subject so that denylisting a
+// subject closes its sockets immediately.
+var wsConns = struct {
+	sync.Mutex
+	bySub map[string]map[*websocket.Conn]struct{}
+}{bySub: map[string]map[*websocket.Conn]struct{}{}}
+
+// mountWebSocket adds /ws. The token is checked once at upgrade, from the
+// Authorization header or, for browsers which cannot set headers on a
+// WebSocket, the access_token query parameter. Browser origins are
+// checked against CORS_WS_ALLOWED_ORIGINS (falling back to the CORS
+// defaults, and overridable as corsOrigins.ws at runtime).
+func mountWebSocket(app *fiber.App) {
+	allowed := originChecker("WS")
+	app.Get("/ws", wsUpgrade(allowed), websocket.New(wsHandler))
+	onDenylisted(func(sub string) {
+		wsConns.Lock()
+		conns := make([]*websocket.Conn, 0, len(wsConns.bySub[sub]))
+		for conn := range wsConns.bySub[sub] {
+			// After a logout only connections opened with older tokens close.
+			if claims, _ := conn.Locals("claims").(jwt.MapClaims); isDenylisted(claims) {
+				conns = append(conns, conn)
+			}
+		}
+		wsConns.Unlock()
+		for _, conn := range conns {
+			wsClose(conn, wsCloseDenylisted, "subject denylisted")
+		}
+	})
+}
+
+func wsUpgrade(originAllowed func(string) bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !websocket.IsWebSocketUpgrade(c) {
+			return newProblem(fiber.StatusUpgradeRequired, problemAboutBlank, "WebSocket upgrade required")
+		}
+		if origin := c.Get(fiber.HeaderOrigin); origin != "" && !originAllowed(origin) {
+			return errForbidden("Origin not allowed")
+		}
+		header := c.Get(fiber.HeaderAuthorization)
+		if header == "" && c.Query("access_token") != "" {
+			header = "Bearer " + c.Query("access_token")
+		}
+		t := decodeToken(header)
+		if t.Err != nil {
+			return errUnauthorized(t.Err.Error())
+		}
+		c.Locals("claims", t.Claims)
+		return c.Next()
+	}
+}
+
+// wsClose sends a close frame and drops the connection, which ends the
+// handler's read loop. It is safe to call from any goroutine.
+func wsClose(conn *websocket.Conn, code int, reason string) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	_ = conn.Close()
+}
+
+// wsHandler greets the client and echoes its messages until it leaves or
+// its token expires.
+func wsHandler(conn *websocket.Conn) {
+	claims, _ := conn.Locals("claims").(jwt.MapClaims)
+	sub, _ := claims["sub"].(string)
+
+	wsConns.Lock()
+	if wsConns.bySub[sub] == nil {
+		wsConns.bySub[sub] = map[*websocket.Conn]struct{}{}
+	}
+	wsConns.bySub[sub][conn] = struct{}{}
+	wsConns.Unlock()
+	defer func() {
+		wsConns.Lock()
+		delete(wsConns.bySub[sub], conn)
+		if len(wsConns.bySub[sub]) == 0 {
+			delete(wsConns.bySub, sub)
+		}
+		wsConns.Unlock()
+	}()
+
+	// The subject may have been denylisted since the upgrade.
+	if isDenylisted(claims) {
+		wsClose(conn, wsCloseDenylisted, "subject denylisted")
+		return
+	}
+	welcome := fiber.Map{"type": "welcome", "subject": sub}
+	if exp, ok := claims["exp"].(float64); ok {
+		expiresAt := time.Unix(int64(exp), 0)
+		timer := time.AfterFunc(time.Until(expiresAt), func() {
+			wsClose(conn, wsCloseTokenExpired, "token expired")
+		})
+		defer timer.Stop()
+		welcome["expiresAt"] = expiresAt.UTC()
+	}
+	if err := conn.WriteJSON(welcome); err != nil {
+		return
+	}
+
+	for {
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if mt != websocket.TextMessage {
+			continue
+		}
+		if err := conn.WriteJSON(fiber.Map{"type": "echo", "data": string(msg)}); err != nil {
+			return
+		}
+	}
+}